@@ -0,0 +1,352 @@
+// gRPC interface for producing to Kafka.
+//
+// Author: Kirk Morales
+// Copyright 2022. All Rights Reserved.
+
+// Code generated by protoc-gen-go. DO NOT EDIT.
+// versions:
+// 	protoc-gen-go v1.36.8
+// 	protoc        (unknown)
+// source: beget.proto
+
+package begetpb
+
+import (
+	protoreflect "google.golang.org/protobuf/reflect/protoreflect"
+	protoimpl "google.golang.org/protobuf/runtime/protoimpl"
+	reflect "reflect"
+	sync "sync"
+	unsafe "unsafe"
+)
+
+const (
+	// Verify that this generated code is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(20 - protoimpl.MinVersion)
+	// Verify that runtime/protoimpl is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(protoimpl.MaxVersion - 20)
+)
+
+// A message to produce
+type ProduceRequest struct {
+	state protoimpl.MessageState `protogen:"open.v1"`
+	// The topic to write the message to (required)
+	Topic string `protobuf:"bytes,1,opt,name=topic,proto3" json:"topic,omitempty"`
+	// The key of the message (optional)
+	Key string `protobuf:"bytes,2,opt,name=key,proto3" json:"key,omitempty"`
+	// The message value (required)
+	Value         []byte `protobuf:"bytes,3,opt,name=value,proto3" json:"value,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *ProduceRequest) Reset() {
+	*x = ProduceRequest{}
+	mi := &file_beget_proto_msgTypes[0]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *ProduceRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ProduceRequest) ProtoMessage() {}
+
+func (x *ProduceRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_beget_proto_msgTypes[0]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ProduceRequest.ProtoReflect.Descriptor instead.
+func (*ProduceRequest) Descriptor() ([]byte, []int) {
+	return file_beget_proto_rawDescGZIP(), []int{0}
+}
+
+func (x *ProduceRequest) GetTopic() string {
+	if x != nil {
+		return x.Topic
+	}
+	return ""
+}
+
+func (x *ProduceRequest) GetKey() string {
+	if x != nil {
+		return x.Key
+	}
+	return ""
+}
+
+func (x *ProduceRequest) GetValue() []byte {
+	if x != nil {
+		return x.Value
+	}
+	return nil
+}
+
+type ProduceResponse struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *ProduceResponse) Reset() {
+	*x = ProduceResponse{}
+	mi := &file_beget_proto_msgTypes[1]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *ProduceResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ProduceResponse) ProtoMessage() {}
+
+func (x *ProduceResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_beget_proto_msgTypes[1]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ProduceResponse.ProtoReflect.Descriptor instead.
+func (*ProduceResponse) Descriptor() ([]byte, []int) {
+	return file_beget_proto_rawDescGZIP(), []int{1}
+}
+
+type ProduceBatchRequest struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Messages      []*ProduceRequest      `protobuf:"bytes,1,rep,name=messages,proto3" json:"messages,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *ProduceBatchRequest) Reset() {
+	*x = ProduceBatchRequest{}
+	mi := &file_beget_proto_msgTypes[2]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *ProduceBatchRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ProduceBatchRequest) ProtoMessage() {}
+
+func (x *ProduceBatchRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_beget_proto_msgTypes[2]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ProduceBatchRequest.ProtoReflect.Descriptor instead.
+func (*ProduceBatchRequest) Descriptor() ([]byte, []int) {
+	return file_beget_proto_rawDescGZIP(), []int{2}
+}
+
+func (x *ProduceBatchRequest) GetMessages() []*ProduceRequest {
+	if x != nil {
+		return x.Messages
+	}
+	return nil
+}
+
+type ProduceBatchResponse struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Results       []*ProduceResult       `protobuf:"bytes,1,rep,name=results,proto3" json:"results,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *ProduceBatchResponse) Reset() {
+	*x = ProduceBatchResponse{}
+	mi := &file_beget_proto_msgTypes[3]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *ProduceBatchResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ProduceBatchResponse) ProtoMessage() {}
+
+func (x *ProduceBatchResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_beget_proto_msgTypes[3]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ProduceBatchResponse.ProtoReflect.Descriptor instead.
+func (*ProduceBatchResponse) Descriptor() ([]byte, []int) {
+	return file_beget_proto_rawDescGZIP(), []int{3}
+}
+
+func (x *ProduceBatchResponse) GetResults() []*ProduceResult {
+	if x != nil {
+		return x.Results
+	}
+	return nil
+}
+
+// The outcome of producing a single message in a batch or stream
+type ProduceResult struct {
+	state protoimpl.MessageState `protogen:"open.v1"`
+	// The gRPC status code. `0` (OK) means the message was produced.
+	Code uint32 `protobuf:"varint,1,opt,name=code,proto3" json:"code,omitempty"`
+	// The error message, if the message wasn't produced
+	Error         string `protobuf:"bytes,2,opt,name=error,proto3" json:"error,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *ProduceResult) Reset() {
+	*x = ProduceResult{}
+	mi := &file_beget_proto_msgTypes[4]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *ProduceResult) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ProduceResult) ProtoMessage() {}
+
+func (x *ProduceResult) ProtoReflect() protoreflect.Message {
+	mi := &file_beget_proto_msgTypes[4]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ProduceResult.ProtoReflect.Descriptor instead.
+func (*ProduceResult) Descriptor() ([]byte, []int) {
+	return file_beget_proto_rawDescGZIP(), []int{4}
+}
+
+func (x *ProduceResult) GetCode() uint32 {
+	if x != nil {
+		return x.Code
+	}
+	return 0
+}
+
+func (x *ProduceResult) GetError() string {
+	if x != nil {
+		return x.Error
+	}
+	return ""
+}
+
+var File_beget_proto protoreflect.FileDescriptor
+
+const file_beget_proto_rawDesc = "" +
+	"\n" +
+	"\vbeget.proto\x12\bbeget.v1\"N\n" +
+	"\x0eProduceRequest\x12\x14\n" +
+	"\x05topic\x18\x01 \x01(\tR\x05topic\x12\x10\n" +
+	"\x03key\x18\x02 \x01(\tR\x03key\x12\x14\n" +
+	"\x05value\x18\x03 \x01(\fR\x05value\"\x11\n" +
+	"\x0fProduceResponse\"K\n" +
+	"\x13ProduceBatchRequest\x124\n" +
+	"\bmessages\x18\x01 \x03(\v2\x18.beget.v1.ProduceRequestR\bmessages\"I\n" +
+	"\x14ProduceBatchResponse\x121\n" +
+	"\aresults\x18\x01 \x03(\v2\x17.beget.v1.ProduceResultR\aresults\"9\n" +
+	"\rProduceResult\x12\x12\n" +
+	"\x04code\x18\x01 \x01(\rR\x04code\x12\x14\n" +
+	"\x05error\x18\x02 \x01(\tR\x05error2\xe6\x01\n" +
+	"\bProducer\x12>\n" +
+	"\aProduce\x12\x18.beget.v1.ProduceRequest\x1a\x19.beget.v1.ProduceResponse\x12M\n" +
+	"\fProduceBatch\x12\x1d.beget.v1.ProduceBatchRequest\x1a\x1e.beget.v1.ProduceBatchResponse\x12K\n" +
+	"\rProduceStream\x12\x18.beget.v1.ProduceRequest\x1a\x1e.beget.v1.ProduceBatchResponse(\x01B\x0fZ\rbeget/begetpbb\x06proto3"
+
+var (
+	file_beget_proto_rawDescOnce sync.Once
+	file_beget_proto_rawDescData []byte
+)
+
+func file_beget_proto_rawDescGZIP() []byte {
+	file_beget_proto_rawDescOnce.Do(func() {
+		file_beget_proto_rawDescData = protoimpl.X.CompressGZIP(unsafe.Slice(unsafe.StringData(file_beget_proto_rawDesc), len(file_beget_proto_rawDesc)))
+	})
+	return file_beget_proto_rawDescData
+}
+
+var file_beget_proto_msgTypes = make([]protoimpl.MessageInfo, 5)
+var file_beget_proto_goTypes = []any{
+	(*ProduceRequest)(nil),       // 0: beget.v1.ProduceRequest
+	(*ProduceResponse)(nil),      // 1: beget.v1.ProduceResponse
+	(*ProduceBatchRequest)(nil),  // 2: beget.v1.ProduceBatchRequest
+	(*ProduceBatchResponse)(nil), // 3: beget.v1.ProduceBatchResponse
+	(*ProduceResult)(nil),        // 4: beget.v1.ProduceResult
+}
+var file_beget_proto_depIdxs = []int32{
+	0, // 0: beget.v1.ProduceBatchRequest.messages:type_name -> beget.v1.ProduceRequest
+	4, // 1: beget.v1.ProduceBatchResponse.results:type_name -> beget.v1.ProduceResult
+	0, // 2: beget.v1.Producer.Produce:input_type -> beget.v1.ProduceRequest
+	2, // 3: beget.v1.Producer.ProduceBatch:input_type -> beget.v1.ProduceBatchRequest
+	0, // 4: beget.v1.Producer.ProduceStream:input_type -> beget.v1.ProduceRequest
+	1, // 5: beget.v1.Producer.Produce:output_type -> beget.v1.ProduceResponse
+	3, // 6: beget.v1.Producer.ProduceBatch:output_type -> beget.v1.ProduceBatchResponse
+	3, // 7: beget.v1.Producer.ProduceStream:output_type -> beget.v1.ProduceBatchResponse
+	5, // [5:8] is the sub-list for method output_type
+	2, // [2:5] is the sub-list for method input_type
+	2, // [2:2] is the sub-list for extension type_name
+	2, // [2:2] is the sub-list for extension extendee
+	0, // [0:2] is the sub-list for field type_name
+}
+
+func init() { file_beget_proto_init() }
+func file_beget_proto_init() {
+	if File_beget_proto != nil {
+		return
+	}
+	type x struct{}
+	out := protoimpl.TypeBuilder{
+		File: protoimpl.DescBuilder{
+			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
+			RawDescriptor: unsafe.Slice(unsafe.StringData(file_beget_proto_rawDesc), len(file_beget_proto_rawDesc)),
+			NumEnums:      0,
+			NumMessages:   5,
+			NumExtensions: 0,
+			NumServices:   1,
+		},
+		GoTypes:           file_beget_proto_goTypes,
+		DependencyIndexes: file_beget_proto_depIdxs,
+		MessageInfos:      file_beget_proto_msgTypes,
+	}.Build()
+	File_beget_proto = out.File
+	file_beget_proto_goTypes = nil
+	file_beget_proto_depIdxs = nil
+}
@@ -0,0 +1,210 @@
+// gRPC interface for producing to Kafka.
+//
+// Author: Kirk Morales
+// Copyright 2022. All Rights Reserved.
+
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.5.1
+// - protoc             (unknown)
+// source: beget.proto
+
+package begetpb
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.64.0 or later.
+const _ = grpc.SupportPackageIsVersion9
+
+const (
+	Producer_Produce_FullMethodName       = "/beget.v1.Producer/Produce"
+	Producer_ProduceBatch_FullMethodName  = "/beget.v1.Producer/ProduceBatch"
+	Producer_ProduceStream_FullMethodName = "/beget.v1.Producer/ProduceStream"
+)
+
+// ProducerClient is the client API for Producer service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+//
+// Produces messages to Kafka topics
+type ProducerClient interface {
+	// Produces a single message
+	Produce(ctx context.Context, in *ProduceRequest, opts ...grpc.CallOption) (*ProduceResponse, error)
+	// Produces a batch of messages. Each message succeeds or fails independently and
+	// the results are returned in the same order as the messages in the request.
+	ProduceBatch(ctx context.Context, in *ProduceBatchRequest, opts ...grpc.CallOption) (*ProduceBatchResponse, error)
+	// Produces a stream of messages, returning a result for every message once the
+	// client closes the stream. Results are in the order the messages were sent.
+	ProduceStream(ctx context.Context, opts ...grpc.CallOption) (grpc.ClientStreamingClient[ProduceRequest, ProduceBatchResponse], error)
+}
+
+type producerClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewProducerClient(cc grpc.ClientConnInterface) ProducerClient {
+	return &producerClient{cc}
+}
+
+func (c *producerClient) Produce(ctx context.Context, in *ProduceRequest, opts ...grpc.CallOption) (*ProduceResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(ProduceResponse)
+	err := c.cc.Invoke(ctx, Producer_Produce_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *producerClient) ProduceBatch(ctx context.Context, in *ProduceBatchRequest, opts ...grpc.CallOption) (*ProduceBatchResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(ProduceBatchResponse)
+	err := c.cc.Invoke(ctx, Producer_ProduceBatch_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *producerClient) ProduceStream(ctx context.Context, opts ...grpc.CallOption) (grpc.ClientStreamingClient[ProduceRequest, ProduceBatchResponse], error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	stream, err := c.cc.NewStream(ctx, &Producer_ServiceDesc.Streams[0], Producer_ProduceStream_FullMethodName, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &grpc.GenericClientStream[ProduceRequest, ProduceBatchResponse]{ClientStream: stream}
+	return x, nil
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type Producer_ProduceStreamClient = grpc.ClientStreamingClient[ProduceRequest, ProduceBatchResponse]
+
+// ProducerServer is the server API for Producer service.
+// All implementations must embed UnimplementedProducerServer
+// for forward compatibility.
+//
+// Produces messages to Kafka topics
+type ProducerServer interface {
+	// Produces a single message
+	Produce(context.Context, *ProduceRequest) (*ProduceResponse, error)
+	// Produces a batch of messages. Each message succeeds or fails independently and
+	// the results are returned in the same order as the messages in the request.
+	ProduceBatch(context.Context, *ProduceBatchRequest) (*ProduceBatchResponse, error)
+	// Produces a stream of messages, returning a result for every message once the
+	// client closes the stream. Results are in the order the messages were sent.
+	ProduceStream(grpc.ClientStreamingServer[ProduceRequest, ProduceBatchResponse]) error
+	mustEmbedUnimplementedProducerServer()
+}
+
+// UnimplementedProducerServer must be embedded to have
+// forward compatible implementations.
+//
+// NOTE: this should be embedded by value instead of pointer to avoid a nil
+// pointer dereference when methods are called.
+type UnimplementedProducerServer struct{}
+
+func (UnimplementedProducerServer) Produce(context.Context, *ProduceRequest) (*ProduceResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Produce not implemented")
+}
+func (UnimplementedProducerServer) ProduceBatch(context.Context, *ProduceBatchRequest) (*ProduceBatchResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ProduceBatch not implemented")
+}
+func (UnimplementedProducerServer) ProduceStream(grpc.ClientStreamingServer[ProduceRequest, ProduceBatchResponse]) error {
+	return status.Errorf(codes.Unimplemented, "method ProduceStream not implemented")
+}
+func (UnimplementedProducerServer) mustEmbedUnimplementedProducerServer() {}
+func (UnimplementedProducerServer) testEmbeddedByValue()                  {}
+
+// UnsafeProducerServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to ProducerServer will
+// result in compilation errors.
+type UnsafeProducerServer interface {
+	mustEmbedUnimplementedProducerServer()
+}
+
+func RegisterProducerServer(s grpc.ServiceRegistrar, srv ProducerServer) {
+	// If the following call pancis, it indicates UnimplementedProducerServer was
+	// embedded by pointer and is nil.  This will cause panics if an
+	// unimplemented method is ever invoked, so we test this at initialization
+	// time to prevent it from happening at runtime later due to I/O.
+	if t, ok := srv.(interface{ testEmbeddedByValue() }); ok {
+		t.testEmbeddedByValue()
+	}
+	s.RegisterService(&Producer_ServiceDesc, srv)
+}
+
+func _Producer_Produce_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ProduceRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ProducerServer).Produce(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Producer_Produce_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ProducerServer).Produce(ctx, req.(*ProduceRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Producer_ProduceBatch_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ProduceBatchRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ProducerServer).ProduceBatch(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Producer_ProduceBatch_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ProducerServer).ProduceBatch(ctx, req.(*ProduceBatchRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Producer_ProduceStream_Handler(srv interface{}, stream grpc.ServerStream) error {
+	return srv.(ProducerServer).ProduceStream(&grpc.GenericServerStream[ProduceRequest, ProduceBatchResponse]{ServerStream: stream})
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type Producer_ProduceStreamServer = grpc.ClientStreamingServer[ProduceRequest, ProduceBatchResponse]
+
+// Producer_ServiceDesc is the grpc.ServiceDesc for Producer service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var Producer_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "beget.v1.Producer",
+	HandlerType: (*ProducerServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "Produce",
+			Handler:    _Producer_Produce_Handler,
+		},
+		{
+			MethodName: "ProduceBatch",
+			Handler:    _Producer_ProduceBatch_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "ProduceStream",
+			Handler:       _Producer_ProduceStream_Handler,
+			ClientStreams: true,
+		},
+	},
+	Metadata: "beget.proto",
+}
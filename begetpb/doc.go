@@ -0,0 +1,7 @@
+// Package begetpb contains the generated protobuf and gRPC code for beget's gRPC
+// interface. Regenerate it with `make proto` after editing `beget.proto`.
+//
+// Author: Kirk Morales
+// Copyright 2022. All Rights Reserved.
+
+package begetpb
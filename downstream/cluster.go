@@ -0,0 +1,276 @@
+// Functions associated with the Kafka clusters topics are written to
+//
+// Author: Kirk Morales
+// Copyright 2022. All Rights Reserved.
+
+package downstream
+
+import (
+	"beget/util"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+	"github.com/segmentio/kafka-go/protocol"
+	"github.com/segmentio/kafka-go/protocol/saslauthenticate"
+	"github.com/segmentio/kafka-go/protocol/saslhandshake"
+	"github.com/segmentio/kafka-go/sasl"
+	"github.com/segmentio/kafka-go/sasl/plain"
+	"github.com/segmentio/kafka-go/sasl/scram"
+)
+
+// The name that refers to the cluster of the top-level `kafka` brokers
+const defaultCluster = "default"
+
+// A Kafka cluster, with its options resolved
+type cluster struct {
+	name    string
+	brokers []string
+	options util.ClusterOptions
+	tls     *tls.Config    // nil unless TLS is enabled
+	sasl    sasl.Mechanism // nil unless SASL is enabled
+}
+
+// Clusters by name, including the default cluster
+var kafkaClusters map[string]*cluster
+
+// Writers for the clusters in `Config.Kafka.Clusters`, by name. The default
+// cluster's writer is `KafkaWriter`.
+var KafkaClusterWriters map[string]*kafka.Writer
+
+// Parses the default cluster and the configured clusters, loading their credentials
+func initClusters() error {
+	kafkaClusters = make(map[string]*cluster)
+
+	c, err := newCluster(defaultCluster, util.Config.Kafka.Brokers, util.Config.Kafka.ClusterOptions)
+	if err != nil {
+		return err
+	}
+	kafkaClusters[defaultCluster] = c
+
+	for name, config := range util.Config.Kafka.Clusters {
+		if name == defaultCluster {
+			return fmt.Errorf("cluster name %q is reserved for the top-level brokers", name)
+		} else if len(config.Brokers) == 0 {
+			return fmt.Errorf("cluster %s: no brokers provided", name)
+		}
+
+		c, err := newCluster(name, config.Brokers, config.ClusterOptions.WithDefaults(util.Config.Kafka.ClusterOptions))
+		if err != nil {
+			return fmt.Errorf("cluster %s: %w", name, err)
+		}
+		kafkaClusters[name] = c
+	}
+
+	return nil
+}
+
+// Creates a cluster, loading its TLS configuration and SASL credentials
+func newCluster(name string, brokers []string, options util.ClusterOptions) (*cluster, error) {
+	c := &cluster{name: name, brokers: brokers, options: options}
+
+	if options.TLS.IsEnabled() {
+		config, err := loadTLSConfig(options.TLS)
+		if err != nil {
+			return nil, err
+		}
+		c.tls = config
+	}
+
+	if options.SASL != nil {
+		mechanism, err := parseSASLMechanism(options.SASL)
+		if err != nil {
+			return nil, err
+		}
+		c.sasl = mechanism
+	}
+
+	return c, nil
+}
+
+// Returns the TLS configuration described by the config
+func loadTLSConfig(config *util.TLSConfig) (*tls.Config, error) {
+	tlsConfig := &tls.Config{InsecureSkipVerify: config.InsecureSkipVerify}
+
+	if config.CAFile != "" {
+		pem, err := os.ReadFile(config.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read CA file: %w", err)
+		}
+
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in CA file %s", config.CAFile)
+		}
+	}
+
+	if config.CertFile != "" || config.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(config.CertFile, config.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load client certificate: %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	return tlsConfig, nil
+}
+
+// Returns the SASL mechanism described by the config
+func parseSASLMechanism(config *util.SASLConfig) (sasl.Mechanism, error) {
+	switch strings.ToLower(config.Mechanism) {
+	case "plain":
+		return plain.Mechanism{Username: config.Username, Password: config.Password}, nil
+	case "scram-sha-256":
+		return scram.Mechanism(scram.SHA256, config.Username, config.Password)
+	case "scram-sha-512":
+		return scram.Mechanism(scram.SHA512, config.Username, config.Password)
+	default:
+		return nil, fmt.Errorf("invalid SASL mechanism %q", config.Mechanism)
+	}
+}
+
+// Returns the default cluster, which is only parsed with its credentials in release mode
+func getDefaultCluster() *cluster {
+	if c, ok := kafkaClusters[defaultCluster]; ok {
+		return c
+	}
+	return &cluster{name: defaultCluster, brokers: util.Config.Kafka.Brokers}
+}
+
+// Returns the name of the cluster `name` refers to in a topic's settings
+func clusterName(name string) string {
+	if name == "" {
+		return defaultCluster
+	}
+	return name
+}
+
+// Checks that a topic's settings refer to configured clusters
+func checkTopicClusters(config util.TopicConfig) error {
+	for _, name := range []string{config.Cluster, config.Mirror} {
+		if _, ok := util.Config.Kafka.Clusters[name]; !ok && name != "" && name != defaultCluster {
+			return fmt.Errorf("unknown cluster %q", name)
+		}
+	}
+
+	if config.Mirror != "" && clusterName(config.Mirror) == clusterName(config.Cluster) {
+		return fmt.Errorf("mirror cluster must differ from the topic's cluster")
+	}
+
+	return nil
+}
+
+// Returns the writer for the cluster with the given name
+func clusterWriter(name string) *kafka.Writer {
+	if w, ok := KafkaClusterWriters[name]; ok {
+		return w
+	}
+	return KafkaWriter
+}
+
+// Returns the transport used to connect to the cluster, or nil for the default transport
+func (c *cluster) transport() kafka.RoundTripper {
+	if c.tls == nil && c.sasl == nil {
+		return nil
+	}
+	return &kafka.Transport{TLS: c.tls, SASL: c.sasl}
+}
+
+// Returns a client for the cluster
+func (c *cluster) client(timeout time.Duration) *kafka.Client {
+	return &kafka.Client{Addr: kafka.TCP(c.brokers...), Timeout: timeout, Transport: c.transport()}
+}
+
+// Returns the dialer readers use to connect to the cluster, or nil for the default dialer
+func (c *cluster) dialer() *kafka.Dialer {
+	if c.tls == nil && c.sasl == nil {
+		return nil
+	}
+	return &kafka.Dialer{
+		Timeout:       10 * time.Second,
+		DualStack:     true,
+		TLS:           c.tls,
+		SASLMechanism: c.sasl,
+	}
+}
+
+// Opens a connection to the broker at `addr`, using TLS and authenticating if the
+// cluster is configured to
+func (c *cluster) dial(ctx context.Context, addr string) (net.Conn, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	host, port, _ := net.SplitHostPort(addr)
+
+	if c.tls != nil {
+		config := c.tls.Clone()
+		if config.ServerName == "" {
+			config.ServerName = host
+		}
+
+		tlsConn := tls.Client(conn, config)
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		conn = tlsConn
+	}
+
+	if c.sasl != nil {
+		portNum, _ := strconv.Atoi(port)
+		ctx = sasl.WithMetadata(ctx, &sasl.Metadata{Host: host, Port: portNum})
+		if err := authenticate(ctx, conn, c.sasl); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("SASL authentication failed: %w", err)
+		}
+	}
+
+	return conn, nil
+}
+
+// Authenticates the connection using the SASL mechanism
+func authenticate(ctx context.Context, conn net.Conn, mechanism sasl.Mechanism) error {
+	msg, err := protocol.RoundTrip(conn, 1, 0, clientID, &saslhandshake.Request{Mechanism: mechanism.Name()})
+	if err != nil {
+		return err
+	} else if code := msg.(*saslhandshake.Response).ErrorCode; code != 0 {
+		return kafka.Error(code)
+	}
+
+	session, state, err := mechanism.Start(ctx)
+	if err != nil {
+		return err
+	}
+
+	for done := false; !done; {
+		msg, err := protocol.RoundTrip(conn, 0, 0, clientID, &saslauthenticate.Request{AuthBytes: state})
+		if err != nil {
+			return err
+		}
+
+		res := msg.(*saslauthenticate.Response)
+		if res.ErrorCode != 0 {
+			return fmt.Errorf("%w: %s", kafka.Error(res.ErrorCode), res.ErrorMessage)
+		}
+
+		if done, state, err = session.Next(ctx, res.AuthBytes); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
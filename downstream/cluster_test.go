@@ -0,0 +1,138 @@
+package downstream_test
+
+import (
+	"beget/downstream"
+	"beget/util"
+	"testing"
+
+	"github.com/segmentio/kafka-go"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClusters(t *testing.T) {
+	t.Run("writers per cluster", func(t *testing.T) {
+		config := `
+app:
+  mode: release
+
+kafka:
+  brokers:
+    - regional.foo.com
+  max_attempts: 3
+  batch_size: 10
+  topics:
+    events: {}
+    audit:
+      cluster: global
+    orders:
+      mirror: global
+      compression: gzip
+  clusters:
+    global:
+      brokers:
+        - global.foo.com
+      batch_size: 100
+      sasl:
+        mechanism: scram-sha-512
+        username: beget
+        password: secret
+`
+
+		err := util.InitConfigFromYaml(config)
+		assert.Nil(t, err)
+
+		err = downstream.Init()
+		assert.Nil(t, err)
+
+		assert.EqualValues(t, kafka.TCP("regional.foo.com"), downstream.KafkaWriter.Addr)
+		assert.Nil(t, downstream.KafkaWriter.Transport)
+
+		global := downstream.KafkaClusterWriters["global"]
+		assert.EqualValues(t, kafka.TCP("global.foo.com"), global.Addr)
+		assert.Equal(t, 100, global.BatchSize)
+		assert.Equal(t, 3, global.MaxAttempts)
+		assert.NotNil(t, global.Transport)
+
+		// Topics overriding writer options get a writer on each of their clusters
+		assert.EqualValues(t, kafka.TCP("regional.foo.com"), downstream.KafkaTopicWriters["orders"].Addr)
+		assert.EqualValues(t, kafka.TCP("global.foo.com"), downstream.KafkaMirrorWriters["orders"].Addr)
+		assert.Equal(t, kafka.Gzip, downstream.KafkaMirrorWriters["orders"].Compression)
+
+		assert.True(t, downstream.Transactional("events"))
+		assert.False(t, downstream.Transactional("audit"))
+		assert.False(t, downstream.Transactional("orders"))
+
+		assert.Nil(t, downstream.Close())
+	})
+
+	t.Run("invalid clusters", func(t *testing.T) {
+		util.Config.Kafka.Brokers = []string{"regional.foo.com"}
+
+		tests := []struct {
+			name     string
+			clusters map[string]util.ClusterConfig
+			topic    util.TopicConfig
+			err      string
+		}{
+			{"unknown cluster", nil, util.TopicConfig{Cluster: "global"}, `topic foo: unknown cluster "global"`},
+			{"unknown mirror", nil, util.TopicConfig{Mirror: "global"}, `topic foo: unknown cluster "global"`},
+			{"mirror to own cluster", nil, util.TopicConfig{Mirror: "default"}, "topic foo: mirror cluster must differ from the topic's cluster"},
+			{"no brokers", map[string]util.ClusterConfig{"global": {}}, util.TopicConfig{}, "cluster global: no brokers provided"},
+			{"reserved name", map[string]util.ClusterConfig{"default": {Brokers: []string{"global.foo.com"}}}, util.TopicConfig{}, `cluster name "default" is reserved for the top-level brokers`},
+			{
+				"invalid SASL mechanism",
+				map[string]util.ClusterConfig{"global": {
+					Brokers:        []string{"global.foo.com"},
+					ClusterOptions: util.ClusterOptions{SASL: &util.SASLConfig{Mechanism: "kerberos"}},
+				}},
+				util.TopicConfig{},
+				`cluster global: invalid SASL mechanism "kerberos"`,
+			},
+			{
+				"missing CA file",
+				map[string]util.ClusterConfig{"global": {
+					Brokers:        []string{"global.foo.com"},
+					ClusterOptions: util.ClusterOptions{TLS: &util.TLSConfig{CAFile: "testdata/missing.pem"}},
+				}},
+				util.TopicConfig{},
+				"cluster global: failed to read CA file: open testdata/missing.pem: no such file or directory",
+			},
+		}
+
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				util.Config.Kafka.Clusters = tt.clusters
+				util.Config.Kafka.Topics = map[string]util.TopicConfig{"foo": tt.topic}
+
+				err := downstream.Init()
+
+				assert.EqualError(t, err, tt.err)
+			})
+		}
+	})
+
+	t.Run("disabled TLS", func(t *testing.T) {
+		disabled := false
+		util.Config.Kafka.Brokers = []string{"regional.foo.com"}
+		util.Config.Kafka.Topics = map[string]util.TopicConfig{"foo": {}}
+		util.Config.Kafka.Clusters = map[string]util.ClusterConfig{"global": {
+			Brokers:        []string{"global.foo.com"},
+			ClusterOptions: util.ClusterOptions{TLS: &util.TLSConfig{Enabled: &disabled, CAFile: "testdata/missing.pem"}},
+		}}
+
+		// The CA file isn't loaded, since TLS is off
+		err := downstream.Init()
+
+		assert.Nil(t, err)
+		assert.Nil(t, downstream.KafkaClusterWriters["global"].Transport)
+		assert.Nil(t, downstream.Close())
+	})
+
+	// Reset config
+	util.Config.App.Mode = util.DebugMode
+	util.Config.Kafka.Topics = nil
+	util.Config.Kafka.Clusters = nil
+	util.Config.Kafka.Brokers = []string{}
+	util.Config.Kafka.MaxAttempts = 0
+	util.Config.Kafka.BatchSize = 0
+}
@@ -0,0 +1,357 @@
+// Functions associated with Kafka consumption
+//
+// Author: Kirk Morales
+// Copyright 2022. All Rights Reserved.
+
+package downstream
+
+import (
+	"beget/util"
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+)
+
+// Returned when consuming is attempted while not connected to Kafka
+var ErrConsumeUnavailable = errors.New("consuming is not available in debug mode")
+
+// Readers are closed after going unused for this long, leaving their consumer group
+const defaultReaderIdleTimeout = 5 * time.Minute
+
+// How long to keep collecting messages that are already available once the
+// first message of a fetch has arrived
+const fetchLinger = 100 * time.Millisecond
+
+var KafkaReadableTopics map[string]struct{} = make(map[string]struct{})
+
+// A reader for a single topic and consumer group, shared between requests
+type groupReader struct {
+	mu       sync.Mutex // Serializes fetches and commits by concurrent requests
+	reader   *kafka.Reader
+	lastUsed time.Time
+	closed   bool // Set, with `mu` held, once the reader is closed and removed from `readers`
+}
+
+type readerKey struct {
+	topic string
+	group string
+}
+
+var readers = make(map[readerKey]*groupReader)
+var readersMu sync.Mutex
+var stopReaper chan struct{}
+
+// Parses the readable topics and starts closing idle readers
+func initConsumer() {
+	KafkaReadableTopics = make(map[string]struct{})
+	for _, topic := range util.Config.Kafka.ReadableTopics {
+		KafkaReadableTopics[topic] = struct{}{}
+	}
+
+	if util.Config.App.Mode == util.ReleaseMode && len(KafkaReadableTopics) > 0 && stopReaper == nil {
+		stopReaper = make(chan struct{})
+		go reapReaders(stopReaper)
+	}
+}
+
+// Returns the reader for the given topic and group, creating it if needed
+func getReader(topic, group string) *groupReader {
+	readersMu.Lock()
+	defer readersMu.Unlock()
+
+	key := readerKey{topic, group}
+	if gr, ok := readers[key]; ok {
+		return gr
+	}
+
+	gr := &groupReader{
+		reader: kafka.NewReader(kafka.ReaderConfig{
+			Brokers: util.Config.Kafka.Brokers,
+			Dialer:  getDefaultCluster().dialer(),
+			GroupID: group,
+			Topic:   topic,
+		}),
+		lastUsed: time.Now(),
+	}
+	readers[key] = gr
+
+	return gr
+}
+
+// Returns the reader for the given topic and group, locked. The reaper may close a
+// reader between it being looked up and locked, in which case it's looked up again.
+func acquireReader(topic, group string) *groupReader {
+	for {
+		gr := getReader(topic, group)
+		gr.mu.Lock()
+		if !gr.closed {
+			return gr
+		}
+		gr.mu.Unlock()
+	}
+}
+
+// Periodically closes readers that haven't been used recently
+func reapReaders(stop chan struct{}) {
+	idleTimeout := util.Config.Kafka.ReaderIdleTimeout
+	if idleTimeout <= 0 {
+		idleTimeout = defaultReaderIdleTimeout
+	}
+
+	ticker := time.NewTicker(idleTimeout / 2)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+
+		readersMu.Lock()
+		for key, gr := range readers {
+			// Skip readers that are busy, they're clearly not idle
+			if !gr.mu.TryLock() {
+				continue
+			}
+			if time.Since(gr.lastUsed) > idleTimeout {
+				delete(readers, key)
+				gr.closed = true
+				if err := gr.reader.Close(); err != nil {
+					util.Sugar.Error("failed to close reader:", err)
+				}
+			}
+			gr.mu.Unlock()
+		}
+		readersMu.Unlock()
+	}
+}
+
+// Closes all readers
+func closeReaders() error {
+	if stopReaper != nil {
+		close(stopReaper)
+		stopReaper = nil
+	}
+
+	readersMu.Lock()
+	defer readersMu.Unlock()
+
+	var errs []error
+	for key, gr := range readers {
+		delete(readers, key)
+		gr.mu.Lock()
+		gr.closed = true
+		errs = append(errs, gr.reader.Close())
+		gr.mu.Unlock()
+	}
+
+	return errors.Join(errs...)
+}
+
+// Fetches up to `max` messages from the topic for the consumer group. Waits up to
+// `wait` for the first message, then returns as soon as no more are immediately
+// available. Messages are not committed. This syntax allows us to stub the function
+// for testing.
+var KafkaFetch = func(ctx context.Context, topic, group string, max int, wait time.Duration) ([]kafka.Message, error) {
+	if util.Config.App.Mode == util.DebugMode {
+		return nil, ErrConsumeUnavailable
+	}
+
+	gr := acquireReader(topic, group)
+	defer gr.mu.Unlock()
+	defer func() { gr.lastUsed = time.Now() }()
+
+	ctx, cancel := context.WithTimeout(ctx, wait)
+	defer cancel()
+
+	messages := make([]kafka.Message, 0, max)
+	for len(messages) < max {
+		fetchCtx, fetchCancel := ctx, context.CancelFunc(func() {})
+		if len(messages) > 0 {
+			fetchCtx, fetchCancel = context.WithTimeout(ctx, fetchLinger)
+		}
+
+		m, err := gr.reader.FetchMessage(fetchCtx)
+		fetchCancel()
+		if errors.Is(err, context.DeadlineExceeded) {
+			break
+		} else if err != nil {
+			return messages, err
+		}
+
+		messages = append(messages, m)
+	}
+
+	return messages, nil
+}
+
+// Commits the given offsets for the consumer group. Only the topic, partition
+// and offset of each message are used. This syntax allows us to stub the function
+// for testing.
+var KafkaCommit = func(ctx context.Context, topic, group string, ms []kafka.Message) error {
+	if util.Config.App.Mode == util.DebugMode {
+		return ErrConsumeUnavailable
+	}
+
+	gr := acquireReader(topic, group)
+	defer gr.mu.Unlock()
+	defer func() { gr.lastUsed = time.Now() }()
+
+	return gr.reader.CommitMessages(ctx, ms...)
+}
+
+// Describes where a stream of messages starts
+type StreamPosition struct {
+	Partition int           // The partition to read, or -1 to read every partition
+	Offsets   map[int]int64 // The offset to start reading each partition at
+	Start     int64         // Where partitions not in `Offsets` start, either kafka.FirstOffset or kafka.LastOffset
+}
+
+// Streams messages from a topic without a consumer group, starting at the given
+// position. Also returns the offset each partition starts at, with `Start`
+// resolved to an actual offset, so a client that disconnects before receiving
+// anything can resume without missing messages. The returned channel is closed
+// once ctx is done or reading from any partition fails. This syntax allows us to
+// stub the function for testing.
+var KafkaStream = func(ctx context.Context, topic string, pos StreamPosition) (<-chan kafka.Message, map[int]int64, error) {
+	if util.Config.App.Mode == util.DebugMode {
+		return nil, nil, ErrConsumeUnavailable
+	}
+
+	partitions := []int{pos.Partition}
+	if pos.Partition < 0 {
+		var err error
+		if partitions, err = topicPartitions(ctx, topic); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	starts, err := startOffsets(ctx, topic, partitions, pos)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	readers := make([]*kafka.Reader, 0, len(partitions))
+	for _, partition := range partitions {
+		reader := kafka.NewReader(kafka.ReaderConfig{
+			Brokers:   util.Config.Kafka.Brokers,
+			Dialer:    getDefaultCluster().dialer(),
+			Topic:     topic,
+			Partition: partition,
+		})
+		readers = append(readers, reader)
+
+		if err := reader.SetOffset(starts[partition]); err != nil {
+			for _, r := range readers {
+				r.Close()
+			}
+			return nil, nil, err
+		}
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	messages := make(chan kafka.Message)
+
+	var wg sync.WaitGroup
+	for _, reader := range readers {
+		wg.Add(1)
+		go func(reader *kafka.Reader) {
+			defer wg.Done()
+			defer reader.Close()
+
+			// Stop every partition if one fails so the client can resume from a known position
+			defer cancel()
+
+			for {
+				m, err := reader.ReadMessage(ctx)
+				if err != nil {
+					if ctx.Err() == nil {
+						util.Sugar.Error("failed to stream kafka messages:", err)
+					}
+					return
+				}
+
+				select {
+				case messages <- m:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}(reader)
+	}
+
+	go func() {
+		wg.Wait()
+		cancel()
+		close(messages)
+	}()
+
+	return messages, starts, nil
+}
+
+// Returns the offset each partition starts at: its offset in `pos.Offsets` or,
+// for partitions without one, its first or next offset as `pos.Start` asks
+func startOffsets(ctx context.Context, topic string, partitions []int, pos StreamPosition) (map[int]int64, error) {
+	starts := make(map[int]int64, len(partitions))
+	var requests []kafka.OffsetRequest
+	for _, partition := range partitions {
+		if offset, ok := pos.Offsets[partition]; ok {
+			starts[partition] = offset
+		} else {
+			requests = append(requests, kafka.OffsetRequest{Partition: partition, Timestamp: pos.Start})
+		}
+	}
+
+	if len(requests) == 0 {
+		return starts, nil
+	}
+
+	client := getDefaultCluster().client(0)
+	res, err := client.ListOffsets(ctx, &kafka.ListOffsetsRequest{Topics: map[string][]kafka.OffsetRequest{topic: requests}})
+	if err != nil {
+		return nil, err
+	}
+
+	for _, p := range res.Topics[topic] {
+		if p.Error != nil {
+			return nil, fmt.Errorf("partition %d: %w", p.Partition, p.Error)
+		} else if pos.Start == kafka.FirstOffset {
+			starts[p.Partition] = p.FirstOffset
+		} else {
+			starts[p.Partition] = p.LastOffset
+		}
+	}
+
+	for _, r := range requests {
+		if _, ok := starts[r.Partition]; !ok {
+			return nil, fmt.Errorf("partition %d: %w", r.Partition, kafka.UnknownTopicOrPartition)
+		}
+	}
+	return starts, nil
+}
+
+// Returns the IDs of the topic's partitions
+func topicPartitions(ctx context.Context, topic string) ([]int, error) {
+	client := getDefaultCluster().client(0)
+
+	res, err := client.Metadata(ctx, &kafka.MetadataRequest{Topics: []string{topic}})
+	if err != nil {
+		return nil, err
+	} else if len(res.Topics) == 0 {
+		return nil, kafka.UnknownTopicOrPartition
+	} else if res.Topics[0].Error != nil {
+		return nil, res.Topics[0].Error
+	}
+
+	partitions := make([]int, 0, len(res.Topics[0].Partitions))
+	for _, p := range res.Topics[0].Partitions {
+		partitions = append(partitions, p.ID)
+	}
+
+	return partitions, nil
+}
@@ -0,0 +1,89 @@
+package downstream_test
+
+import (
+	"beget/downstream"
+	"beget/downstream/kafkatest"
+	"beget/util"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestInitReadableTopics(t *testing.T) {
+	util.Config.App.Mode = util.DebugMode
+	util.Config.Kafka.Topics = map[string]util.TopicConfig{"foo": {}}
+	util.Config.Kafka.ReadableTopics = []string{"foo", "bar"}
+
+	err := downstream.Init()
+
+	assert.Nil(t, err)
+	assert.EqualValues(t, map[string]struct{}{"foo": {}, "bar": {}}, downstream.KafkaReadableTopics)
+
+	// Reset config
+	util.Config.Kafka.Topics = nil
+	util.Config.Kafka.ReadableTopics = []string{}
+}
+
+func TestConsumeDebug(t *testing.T) {
+	util.Config.App.Mode = util.DebugMode
+
+	messages, err := downstream.KafkaFetch(context.Background(), "foo", "group", 10, time.Second)
+	assert.Nil(t, messages)
+	assert.ErrorIs(t, err, downstream.ErrConsumeUnavailable)
+
+	err = downstream.KafkaCommit(context.Background(), "foo", "group", nil)
+	assert.ErrorIs(t, err, downstream.ErrConsumeUnavailable)
+
+	stream, starts, err := downstream.KafkaStream(context.Background(), "foo", downstream.StreamPosition{Partition: -1})
+	assert.Nil(t, stream)
+	assert.Nil(t, starts)
+	assert.ErrorIs(t, err, downstream.ErrConsumeUnavailable)
+}
+
+func TestStreamStarts(t *testing.T) {
+	util.InitLogging()
+
+	broker, err := kafkatest.NewBroker("foo")
+	assert.Nil(t, err)
+	defer broker.Close()
+
+	util.Config.App.Mode = util.ReleaseMode
+	util.Config.Kafka.Brokers = []string{broker.Addr()}
+	util.Config.Kafka.Topics = map[string]util.TopicConfig{"foo": {}}
+	util.Config.Kafka.BatchTimeout = time.Millisecond
+	assert.Nil(t, downstream.Init())
+	defer downstream.Close()
+
+	err = downstream.ProduceBatch(context.Background(), []kafka.Message{{Topic: "foo", Value: []byte("a")}, {Topic: "foo", Value: []byte("b")}})
+	assert.Nil(t, err)
+
+	tests := map[string]struct {
+		pos  downstream.StreamPosition
+		want map[int]int64
+	}{
+		"latest":   {downstream.StreamPosition{Partition: -1, Start: kafka.LastOffset}, map[int]int64{0: 2}},
+		"earliest": {downstream.StreamPosition{Partition: -1, Start: kafka.FirstOffset}, map[int]int64{0: 0}},
+		"offset":   {downstream.StreamPosition{Partition: 0, Offsets: map[int]int64{0: 1}, Start: kafka.LastOffset}, map[int]int64{0: 1}},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			_, starts, err := downstream.KafkaStream(ctx, "foo", tt.pos)
+
+			assert.Nil(t, err)
+			assert.Equal(t, tt.want, starts)
+		})
+	}
+
+	// Reset config
+	util.Config.App.Mode = util.DebugMode
+	util.Config.Kafka.Brokers = []string{}
+	util.Config.Kafka.Topics = nil
+	util.Config.Kafka.BatchTimeout = 0
+}
@@ -0,0 +1,152 @@
+// Functions associated with discovering the topics that exist on the brokers
+//
+// Author: Kirk Morales
+// Copyright 2022. All Rights Reserved.
+
+package downstream
+
+import (
+	"beget/util"
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+)
+
+// How long a single fetch of the topic list may take
+const discoveryTimeout = 10 * time.Second
+
+// Topics that existed on each cluster's brokers when they were last listed
+var discoveredTopics map[string]map[string]struct{}
+var discoveredMu sync.RWMutex
+var stopDiscoverer chan struct{}
+var discoverer sync.WaitGroup
+
+// Starts listing the brokers' topics periodically when any topics are allowed by a
+// pattern. The first listing happens before returning, so matching topics are
+// producible right away.
+func initDiscovery() error {
+	stopDiscovery()
+
+	discoveredMu.Lock()
+	discoveredTopics = make(map[string]map[string]struct{})
+	discoveredMu.Unlock()
+
+	if len(kafkaTopicPatterns) == 0 {
+		return nil
+	}
+
+	interval := util.Config.Kafka.DiscoveryInterval
+	if interval <= 0 {
+		for _, p := range kafkaTopicPatterns {
+			if !autoCreates(KafkaTopicSettings[p.pattern].Cluster) {
+				return fmt.Errorf("topic patterns require discovery_interval or allow_auto_topic_creation")
+			}
+		}
+		return nil
+	}
+
+	refreshTopics()
+
+	stopDiscoverer = make(chan struct{})
+	discoverer.Add(1)
+	go discoverTopics(stopDiscoverer, interval)
+
+	return nil
+}
+
+// Lists the brokers' topics every interval until stopped
+func discoverTopics(stop chan struct{}, interval time.Duration) {
+	defer discoverer.Done()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			refreshTopics()
+		}
+	}
+}
+
+// Replaces the discovered topics with the current topics of each cluster that
+// patterns are written to. On failure, a cluster's previous topics are kept.
+func refreshTopics() {
+	clusters := make(map[string]struct{})
+	for _, p := range kafkaTopicPatterns {
+		clusters[clusterName(KafkaTopicSettings[p.pattern].Cluster)] = struct{}{}
+	}
+
+	for cluster := range clusters {
+		ctx, cancel := context.WithTimeout(context.Background(), discoveryTimeout)
+		names, err := KafkaListTopics(ctx, cluster)
+		cancel()
+
+		if err != nil {
+			util.Sugar.Errorf("failed to list topics of cluster %s: %v", cluster, err)
+			continue
+		}
+
+		topics := make(map[string]struct{}, len(names))
+		for _, name := range names {
+			topics[name] = struct{}{}
+		}
+
+		discoveredMu.Lock()
+		discoveredTopics[cluster] = topics
+		discoveredMu.Unlock()
+	}
+}
+
+// Stops listing the brokers' topics, waiting for a listing in progress to finish
+func stopDiscovery() {
+	if stopDiscoverer != nil {
+		close(stopDiscoverer)
+		stopDiscoverer = nil
+		discoverer.Wait()
+	}
+}
+
+// Returns whether the named cluster creates missing topics automatically
+func autoCreates(cluster string) bool {
+	if c, ok := kafkaClusters[clusterName(cluster)]; ok {
+		return c.options.AllowAutoTopicCreation
+	}
+	return util.Config.Kafka.AllowAutoTopicCreation
+}
+
+// Returns whether the topic existed on its cluster when its topics were last listed
+func topicDiscovered(topic string) bool {
+	cluster := clusterName(SettingsFor(topic).Cluster)
+
+	discoveredMu.RLock()
+	defer discoveredMu.RUnlock()
+
+	_, ok := discoveredTopics[cluster][topic]
+	return ok
+}
+
+// Returns the names of the topics that exist on the named cluster. This syntax
+// allows us to stub the function for testing.
+var KafkaListTopics = func(ctx context.Context, cluster string) ([]string, error) {
+	client := kafkaClusters[cluster].client(0)
+
+	// Requesting no topics in particular returns all of them
+	res, err := client.Metadata(ctx, &kafka.MetadataRequest{})
+	if err != nil {
+		return nil, err
+	}
+
+	names := make([]string, 0, len(res.Topics))
+	for _, t := range res.Topics {
+		if t.Error == nil && !t.Internal {
+			names = append(names, t.Name)
+		}
+	}
+	return names, nil
+}
@@ -0,0 +1,142 @@
+package downstream_test
+
+import (
+	"beget/downstream"
+	"beget/util"
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTopicPatterns(t *testing.T) {
+	util.Config.Kafka.Topics = map[string]util.TopicConfig{
+		"orders": {},
+		"team_x": {Name: "team-x.*", RateLimit: 1},
+		"v2":     {Name: `/events\.v2\.(eu|us)/`},
+	}
+
+	t.Run("debug mode allows any match", func(t *testing.T) {
+		util.Config.App.Mode = util.DebugMode
+
+		err := downstream.Init()
+		assert.Nil(t, err)
+
+		assert.True(t, downstream.Producible("orders"))
+		assert.True(t, downstream.Producible("team-x.clicks"))
+		assert.True(t, downstream.Producible("events.v2.eu"))
+		assert.False(t, downstream.Producible("team-y.clicks"))
+		assert.False(t, downstream.Producible("events.v2.de"))
+		assert.False(t, downstream.Producible("xevents.v2.eu"))
+
+		// Matching topics share the pattern's settings
+		assert.Same(t, downstream.SettingsFor("team-x.clicks"), downstream.SettingsFor("team-x.views"))
+		assert.NotNil(t, downstream.SettingsFor("team-x.clicks").Limiter)
+	})
+
+	util.Config.App.Mode = util.ReleaseMode
+	util.Config.Kafka.Brokers = []string{"broker.foo.com"}
+
+	t.Run("requires discovery", func(t *testing.T) {
+		err := downstream.Init()
+
+		assert.EqualError(t, err, "topic patterns require discovery_interval or allow_auto_topic_creation")
+	})
+
+	t.Run("auto-creation allows any match", func(t *testing.T) {
+		util.Config.Kafka.AllowAutoTopicCreation = true
+
+		err := downstream.Init()
+		assert.Nil(t, err)
+
+		topic, ok := downstream.ResolveTopic("team-x.clicks")
+		assert.True(t, ok)
+		assert.Equal(t, "team-x.clicks", topic)
+
+		util.Config.Kafka.AllowAutoTopicCreation = false
+		assert.Nil(t, downstream.Close())
+	})
+
+	t.Run("discovers existing topics", func(t *testing.T) {
+		util.InitLogging()
+		util.Config.Kafka.DiscoveryInterval = 10 * time.Millisecond
+
+		var mu sync.Mutex
+		existing, listErr := []string{"team-x.clicks"}, error(nil)
+		original := downstream.KafkaListTopics
+		downstream.KafkaListTopics = func(ctx context.Context, cluster string) ([]string, error) {
+			mu.Lock()
+			defer mu.Unlock()
+			return existing, listErr
+		}
+
+		err := downstream.Init()
+		assert.Nil(t, err)
+
+		assert.True(t, downstream.Producible("team-x.clicks"))
+		assert.False(t, downstream.Producible("team-x.views"))
+		assert.True(t, downstream.Producible("orders"))
+
+		// Topics created later are picked up by the next listing
+		mu.Lock()
+		existing = []string{"team-x.clicks", "team-x.views"}
+		mu.Unlock()
+		assert.Eventually(t, func() bool { return downstream.Producible("team-x.views") }, time.Second, 5*time.Millisecond)
+
+		// Failed listings keep the previous topics
+		mu.Lock()
+		existing, listErr = nil, errors.New("no brokers")
+		mu.Unlock()
+		time.Sleep(30 * time.Millisecond)
+		assert.True(t, downstream.Producible("team-x.views"))
+
+		assert.Nil(t, downstream.Close())
+		downstream.KafkaListTopics = original
+		util.Config.Kafka.DiscoveryInterval = 0
+	})
+
+	t.Run("overlapping patterns", func(t *testing.T) {
+		util.Config.App.Mode = util.DebugMode
+		util.Config.Kafka.Topics = map[string]util.TopicConfig{
+			"eu":        {Name: "*.eu", RateLimit: 1},
+			"orders":    {Name: "orders.*", RateLimit: 2},
+			"orders_eu": {Name: "/orders\\.(eu|us)/", RateLimit: 3},
+			"o":         {Name: "o*.eu", RateLimit: 4},
+		}
+
+		err := downstream.Init()
+		assert.Nil(t, err)
+
+		// The pattern with the longest literal prefix wins, whatever its name
+		assert.Same(t, downstream.KafkaTopicSettings["orders.*"], downstream.SettingsFor("orders.de"))
+		assert.Same(t, downstream.KafkaTopicSettings["/orders\\.(eu|us)/"], downstream.SettingsFor("orders.eu"))
+		assert.Same(t, downstream.KafkaTopicSettings["o*.eu"], downstream.SettingsFor("offers.eu"))
+		assert.Same(t, downstream.KafkaTopicSettings["*.eu"], downstream.SettingsFor("clicks.eu"))
+
+		util.Config.App.Mode = util.ReleaseMode
+	})
+
+	t.Run("invalid pattern", func(t *testing.T) {
+		util.Config.Kafka.Topics = map[string]util.TopicConfig{"bad": {Name: "/events(/"}}
+
+		err := downstream.Init()
+
+		assert.ErrorContains(t, err, "topic /events(/: invalid pattern")
+	})
+
+	t.Run("pattern with alias", func(t *testing.T) {
+		util.Config.Kafka.Topics = map[string]util.TopicConfig{"team_x": {Name: "team-x.*", Alias: "team-x"}}
+
+		err := downstream.Init()
+
+		assert.EqualError(t, err, "topic team-x.*: patterns can't have an alias")
+	})
+
+	// Reset config
+	util.Config.App.Mode = util.DebugMode
+	util.Config.Kafka.Topics = nil
+	util.Config.Kafka.Brokers = []string{}
+}
@@ -8,79 +8,357 @@ package downstream
 import (
 	"beget/util"
 	"context"
+	"errors"
 	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
 
 	"github.com/segmentio/kafka-go"
 )
 
 var KafkaWriter *kafka.Writer
+
+// Writers for topics whose options differ from their cluster's, by topic or pattern
+var KafkaTopicWriters map[string]*kafka.Writer
+
+// Writers for the mirror clusters of topics whose options differ, by topic or pattern
+var KafkaMirrorWriters map[string]*kafka.Writer
+
+// Topics that may be produced to
 var KafkaTopics map[string]struct{} = make(map[string]struct{})
 
+// The header recording the ID of the request a message was produced in
+const RequestIDHeader = "beget-request-id"
+
 // Initializes the Kafka connection given env variables provided
 func Init() error {
 
 	// Parse topics
-	if len(util.Config.Kafka.Topics) > 0 {
-		for _, topic := range util.Config.Kafka.Topics {
-			KafkaTopics[topic] = struct{}{}
-		}
-	} else {
+	if len(util.Config.Kafka.Topics) == 0 {
 		return fmt.Errorf("no topics provided")
+	} else if err := initSinks(); err != nil {
+		return err
+	} else if err := initRedaction(); err != nil {
+		return err
+	} else if err := initTopics(); err != nil {
+		return err
+	} else if err := initRoutes(); err != nil {
+		return err
 	}
 
+	initConsumer()
+
 	if util.Config.App.Mode == util.ReleaseMode {
 		// Check for Kafka host or brokers
 		if len(util.Config.Kafka.Brokers) == 0 {
 			return fmt.Errorf("no brokers provided")
 		}
 
-		// All options can be found here: https://pkg.go.dev/github.com/segmentio/kafka-go?utm_source=godoc#Writer
-		// Since the values are evaluated at run time, we can safely set them here. i.e., it's
-		// okay to pass `0` for an int because the default will be used at runtime.
-		KafkaWriter = &kafka.Writer{
-			Addr:                   kafka.TCP(util.Config.Kafka.Brokers...),
-			Balancer:               &kafka.LeastBytes{},
-			Completion:             completionCallback,
-			MaxAttempts:            util.Config.Kafka.MaxAttempts,
-			WriteBackoffMin:        util.Config.Kafka.WriteBackoffMin,
-			WriteBackoffMax:        util.Config.Kafka.WriteBackoffMax,
-			BatchSize:              util.Config.Kafka.BatchSize,
-			BatchBytes:             util.Config.Kafka.BatchBytes,
-			BatchTimeout:           util.Config.Kafka.BatchTimeout,
-			ReadTimeout:            util.Config.Kafka.ReadTimeout,
-			WriteTimeout:           util.Config.Kafka.WriteTimeout,
-			RequiredAcks:           util.Config.Kafka.RequiredAcks,
-			Async:                  util.Config.Kafka.Async,
-			AllowAutoTopicCreation: util.Config.Kafka.AllowAutoTopicCreation,
+		if err := initClusters(); err != nil {
+			return err
+		}
+
+		var err error
+		if KafkaWriter, err = newWriter(kafkaClusters[defaultCluster], util.TopicConfig{}); err != nil {
+			return err
+		}
+
+		KafkaClusterWriters = make(map[string]*kafka.Writer)
+		for name := range util.Config.Kafka.Clusters {
+			if KafkaClusterWriters[name], err = newWriter(kafkaClusters[name], util.TopicConfig{}); err != nil {
+				return fmt.Errorf("cluster %s: %w", name, err)
+			}
+		}
+
+		// Topics that override writer options get their own writer on each cluster
+		// they're written to
+		KafkaTopicWriters = make(map[string]*kafka.Writer)
+		KafkaMirrorWriters = make(map[string]*kafka.Writer)
+		for topic, settings := range KafkaTopicSettings {
+			if !settings.customWriter() {
+				continue
+			}
+
+			// Options were already validated when parsing the settings
+			KafkaTopicWriters[topic], _ = newWriter(kafkaClusters[clusterName(settings.Cluster)], settings.TopicConfig)
+			if settings.Mirror != "" {
+				KafkaMirrorWriters[topic], _ = newWriter(kafkaClusters[settings.Mirror], settings.TopicConfig)
+			}
+		}
+
+		if err := initDiscovery(); err != nil {
+			return err
 		}
+
+		initTransactions()
 	}
 
 	return nil
 }
 
-// Called when the write completes producing a set of messages
-func completionCallback(_ []kafka.Message, err error) {
+// The writer's `BatchBytes` when it isn't configured, as with kafka-go
+const defaultBatchBytes = 1048576
+
+// Returns the largest message the topic's writer accepts, in bytes: the smallest
+// `batch_bytes` of the clusters it's written to. Returns 0 for topics that aren't
+// written to Kafka.
+func MaxMessageBytes(topic string) int64 {
+	settings := SettingsFor(topic)
+	if SinkFor(topic) != Sinks["kafka"] {
+		return 0
+	}
+
+	var max int64
+	for _, name := range []string{settings.Cluster, settings.Mirror} {
+		if name == "" && max > 0 {
+			continue
+		}
+
+		options := util.Config.Kafka.ClusterOptions
+		if c, ok := util.Config.Kafka.Clusters[name]; ok {
+			options = c.ClusterOptions.WithDefaults(options)
+		}
+
+		batchBytes := options.BatchBytes
+		if batchBytes <= 0 {
+			batchBytes = defaultBatchBytes
+		}
+		if max == 0 || batchBytes < max {
+			max = batchBytes
+		}
+	}
+
+	return max
+}
+
+// Creates a writer for the cluster using its options, overridden by a topic's settings
+func newWriter(c *cluster, topic util.TopicConfig) (*kafka.Writer, error) {
+	options := c.options
+
+	name := options.Compression
+	if topic.Compression != "" {
+		name = topic.Compression
+	}
+	compression, err := parseCompression(name)
+	if err != nil {
+		return nil, err
+	}
+
+	balancer, err := parseBalancer(topic.Balancer)
+	if err != nil {
+		return nil, err
+	}
+
+	acks := options.RequiredAcks
+	if topic.RequiredAcks != nil {
+		acks = *topic.RequiredAcks
+	}
+
+	// All options can be found here: https://pkg.go.dev/github.com/segmentio/kafka-go?utm_source=godoc#Writer
+	// Since the values are evaluated at run time, we can safely set them here. i.e., it's
+	// okay to pass `0` for an int because the default will be used at runtime.
+	return &kafka.Writer{
+		Addr:                   kafka.TCP(c.brokers...),
+		Balancer:               balancer,
+		Completion:             func(ms []kafka.Message, err error) { completionCallback(c, ms, err) },
+		MaxAttempts:            options.MaxAttempts,
+		WriteBackoffMin:        options.WriteBackoffMin,
+		WriteBackoffMax:        options.WriteBackoffMax,
+		BatchSize:              options.BatchSize,
+		BatchBytes:             options.BatchBytes,
+		BatchTimeout:           options.BatchTimeout,
+		ReadTimeout:            options.ReadTimeout,
+		WriteTimeout:           options.WriteTimeout,
+		RequiredAcks:           acks,
+		Async:                  options.Async,
+		AllowAutoTopicCreation: options.AllowAutoTopicCreation,
+		Compression:            compression,
+		Transport:              c.transport(),
+	}, nil
+}
+
+// Returns the compression codec with the given name
+func parseCompression(name string) (kafka.Compression, error) {
+	switch strings.ToLower(name) {
+	case "", "none":
+		return 0, nil
+	case "gzip":
+		return kafka.Gzip, nil
+	case "snappy":
+		return kafka.Snappy, nil
+	case "lz4":
+		return kafka.Lz4, nil
+	case "zstd":
+		return kafka.Zstd, nil
+	default:
+		return 0, fmt.Errorf("invalid compression %q", name)
+	}
+}
+
+// Returns the writers for the given topic: the one for its cluster and, if it's
+// mirrored, the one for its mirror cluster
+func writersFor(topic string) []*kafka.Writer {
+	key, ok := topicKey(topic)
+	if !ok {
+		return []*kafka.Writer{KafkaWriter}
+	}
+	settings := KafkaTopicSettings[key]
+
+	w, ok := KafkaTopicWriters[key]
+	if !ok {
+		w = clusterWriter(settings.Cluster)
+	}
+	if settings.Mirror == "" {
+		return []*kafka.Writer{w}
+	}
+
+	mirror, ok := KafkaMirrorWriters[key]
+	if !ok {
+		mirror = clusterWriter(settings.Mirror)
+	}
+	return []*kafka.Writer{w, mirror}
+}
+
+// Where a message was written to Kafka. Give a message a pointer to one as its
+// `WriterData` to have it filled in once the message is written.
+type Delivery struct {
+	mu        sync.Mutex
+	partition int
+	offset    int64
+	written   bool
+}
+
+// Returns the partition and offset the message was written to, and whether it has
+// been written yet. Messages written to sinks other than Kafka are never marked
+// as written.
+func (d *Delivery) Get() (partition int, offset int64, written bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	return d.partition, d.offset, d.written
+}
+
+func (d *Delivery) set(partition int, offset int64) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.partition, d.offset, d.written = partition, offset, true
+}
+
+// Called when the cluster's writer completes producing a set of messages. Records
+// the delivery of messages written to their topic's own cluster, rather than to
+// its mirror.
+func completionCallback(c *cluster, ms []kafka.Message, err error) {
 	if err != nil {
 		util.Sugar.Error(err)
+		return
+	}
+
+	for _, m := range ms {
+		if d, ok := m.WriterData.(*Delivery); ok && clusterName(SettingsFor(m.Topic).Cluster) == c.name {
+			d.set(m.Partition, m.Offset)
+		}
 	}
 }
 
 // Closes active downstream connections
 func Close() error {
+	errs := []error{closeSinks()}
+	stopDiscovery()
+	errs = append(errs, closeReaders())
+	return errors.Join(errs...)
+}
+
+// Writes messages to Kafka, to the cluster each topic is configured for
+type kafkaWriterSink struct{}
+
+func (s *kafkaWriterSink) Produce(ctx context.Context, m kafka.Message) error {
+	return writeGrouped(ctx, []kafka.Message{m})
+}
+
+func (s *kafkaWriterSink) ProduceBatch(ctx context.Context, ms []kafka.Message) error {
+	return writeGrouped(ctx, ms)
+}
+
+func (s *kafkaWriterSink) ProduceTransaction(ctx context.Context, ms []kafka.Message) error {
+	return transactions.produce(ctx, ms)
+}
+
+// Closes every writer
+func (s *kafkaWriterSink) Close() error {
+	var errs []error
 	if KafkaWriter != nil {
-		return KafkaWriter.Close()
+		errs = append(errs, KafkaWriter.Close())
+	}
+	for _, writers := range []map[string]*kafka.Writer{KafkaClusterWriters, KafkaTopicWriters, KafkaMirrorWriters} {
+		for _, w := range writers {
+			errs = append(errs, w.Close())
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Checks that every cluster's brokers respond
+func (s *kafkaWriterSink) Health(ctx context.Context) error {
+	for name, c := range kafkaClusters {
+		// Requesting an empty list of topics is the cheapest metadata request
+		if _, err := c.client(0).Metadata(ctx, &kafka.MetadataRequest{Topics: []string{}}); err != nil {
+			return fmt.Errorf("cluster %s: %w", name, err)
+		}
 	}
 	return nil
 }
 
-// Writes the given message to Kafka. This syntax allows us to stub the function
-// for testing.
-var KafkaProduce = func(ctx context.Context, m kafka.Message) error {
-	// If not in release mode, log message
-	if util.Config.App.Mode == util.DebugMode {
-		util.Sugar.Debugf("PRODUCE: %v", m)
-		return nil
+// A writer messages are written with, and whether it writes them to their mirror
+type writerGroup struct {
+	w      *kafka.Writer
+	mirror bool
+}
+
+// The number of messages that couldn't be written to their mirror cluster
+var mirrorFailures atomic.Int64
+
+// Returns the number of messages that couldn't be written to their mirror cluster
+// since startup
+func MirrorFailures() int64 {
+	return mirrorFailures.Load()
+}
+
+// Writes messages that may belong to different writers, writing each writer's
+// messages concurrently. Messages of mirrored topics are written by both of their
+// writers, but only fail if the write to their own cluster does, so a retry
+// doesn't write them to it twice. Failed mirror writes are logged and counted
+// instead. Failures are reported the same way as `WriteMessages`.
+func writeGrouped(ctx context.Context, ms []kafka.Message) error {
+	return writeGroups(ctx, ms,
+		func(m kafka.Message) []writerGroup {
+			ws := writersFor(m.Topic)
+			groups := []writerGroup{{w: ws[0]}}
+			if len(ws) > 1 {
+				groups = append(groups, writerGroup{w: ws[1], mirror: true})
+			}
+			return groups
+		},
+		func(ctx context.Context, g writerGroup, ms []kafka.Message) error {
+			err := g.w.WriteMessages(ctx, ms...)
+			if err != nil && g.mirror {
+				logMirrorFailure(ms, err)
+				return nil
+			}
+			return err
+		},
+	)
+}
+
+// Logs and counts the messages that couldn't be written to their mirror cluster
+func logMirrorFailure(ms []kafka.Message, err error) {
+	failed := int64(len(ms))
+	var werrs kafka.WriteErrors
+	if errors.As(err, &werrs) {
+		failed = int64(werrs.Count())
 	}
 
-	return KafkaWriter.WriteMessages(ctx, m)
+	total := mirrorFailures.Add(failed)
+	util.Sugar.Errorf("failed to write %d messages to mirror cluster %s (%d since startup): %v", failed, clusterName(SettingsFor(ms[0].Topic).Mirror), total, err)
 }
@@ -28,7 +28,7 @@ func TestInitDebug(t *testing.T) {
 	util.Config.App.Mode = util.DebugMode
 
 	// Set sample topics
-	util.Config.Kafka.Topics = []string{"foo"}
+	util.Config.Kafka.Topics = map[string]util.TopicConfig{"foo": {}}
 
 	t.Run("success in debug mode", func(t *testing.T) {
 		err := downstream.Init()
@@ -84,22 +84,22 @@ func TestInitDebug(t *testing.T) {
 		assert.Nil(t, err)
 
 		// Test default writer options
-		stats := downstream.KafkaWriter.Stats()
-		assert.Equal(t, int64(0), stats.MaxAttempts)
-		assert.Equal(t, time.Duration(0), stats.WriteBackoffMin)
-		assert.Equal(t, time.Duration(0), stats.WriteBackoffMax)
-		assert.Equal(t, 0, downstream.KafkaWriter.BatchSize)
-		assert.Equal(t, int64(0), downstream.KafkaWriter.BatchBytes)
-		assert.Equal(t, time.Duration(0), stats.BatchTimeout)
-		assert.Equal(t, time.Duration(0), stats.ReadTimeout)
-		assert.Equal(t, time.Duration(0), stats.WriteTimeout)
-		assert.Equal(t, int64(0), stats.RequiredAcks)
-		assert.Equal(t, false, stats.Async)
+		w := downstream.KafkaWriter
+		assert.Equal(t, 0, w.MaxAttempts)
+		assert.Equal(t, time.Duration(0), w.WriteBackoffMin)
+		assert.Equal(t, time.Duration(0), w.WriteBackoffMax)
+		assert.Equal(t, 0, w.BatchSize)
+		assert.Equal(t, int64(0), w.BatchBytes)
+		assert.Equal(t, time.Duration(0), w.BatchTimeout)
+		assert.Equal(t, time.Duration(0), w.ReadTimeout)
+		assert.Equal(t, time.Duration(0), w.WriteTimeout)
+		assert.Equal(t, kafka.RequireNone, w.RequiredAcks)
+		assert.Equal(t, false, w.Async)
 		assert.Equal(t, false, downstream.KafkaWriter.AllowAutoTopicCreation)
 	})
 
 	// Reset config
-	util.Config.Kafka.Topics = []string{}
+	util.Config.Kafka.Topics = nil
 	util.Config.Kafka.Brokers = []string{}
 }
 
@@ -157,3 +157,83 @@ kafka:
 		assert.Equal(t, true, downstream.KafkaWriter.AllowAutoTopicCreation)
 	})
 }
+
+func TestKafkaCompression(t *testing.T) {
+	t.Run("default and per-topic codecs", func(t *testing.T) {
+		config := `
+app:
+  mode: release
+
+kafka:
+  brokers:
+    - foo.bar.com
+  topics:
+    foo: {}
+    bar:
+      compression: gzip
+  compression: zstd
+`
+
+		err := util.InitConfigFromYaml(config)
+		assert.Nil(t, err)
+
+		err = downstream.Init()
+		assert.Nil(t, err)
+
+		assert.Equal(t, kafka.Zstd, downstream.KafkaWriter.Compression)
+		assert.Len(t, downstream.KafkaTopicWriters, 1)
+		assert.Equal(t, kafka.Gzip, downstream.KafkaTopicWriters["bar"].Compression)
+	})
+
+	t.Run("invalid codec", func(t *testing.T) {
+		util.Config.Kafka.Compression = "brotli"
+		util.Config.Kafka.Topics = map[string]util.TopicConfig{"foo": {}}
+
+		err := downstream.Init()
+
+		assert.EqualError(t, err, `invalid compression "brotli"`)
+	})
+
+	t.Run("invalid topic codec", func(t *testing.T) {
+		util.Config.Kafka.Compression = "none"
+		util.Config.Kafka.Topics = map[string]util.TopicConfig{"bar": {Compression: "brotli"}}
+
+		err := downstream.Init()
+
+		assert.EqualError(t, err, `topic bar: invalid compression "brotli"`)
+	})
+
+	// Reset config
+	util.Config.Kafka.Compression = ""
+	util.Config.Kafka.Topics = nil
+}
+
+func TestMaxMessageBytes(t *testing.T) {
+	util.Config.Kafka.BatchBytes = 2048
+	util.Config.Kafka.Clusters = map[string]util.ClusterConfig{
+		"small": {Brokers: []string{"small.foo.com"}, ClusterOptions: util.ClusterOptions{BatchBytes: 1024}},
+		"other": {Brokers: []string{"other.foo.com"}},
+	}
+	util.Config.Kafka.Topics = map[string]util.TopicConfig{
+		"foo":      {},
+		"small":    {Cluster: "small"},
+		"other":    {Cluster: "other"},
+		"mirrored": {Mirror: "small"},
+		"memory":   {Sink: "memory"},
+	}
+	assert.Nil(t, downstream.Init())
+
+	assert.Equal(t, int64(2048), downstream.MaxMessageBytes("foo"))
+	assert.Equal(t, int64(1024), downstream.MaxMessageBytes("small"))
+	assert.Equal(t, int64(2048), downstream.MaxMessageBytes("other"))
+	assert.Equal(t, int64(1024), downstream.MaxMessageBytes("mirrored"))
+	assert.Equal(t, int64(0), downstream.MaxMessageBytes("memory"))
+
+	// The writer's default
+	util.Config.Kafka.BatchBytes = 0
+	assert.Equal(t, int64(1048576), downstream.MaxMessageBytes("foo"))
+
+	// Reset config
+	util.Config.Kafka.Clusters = nil
+	util.Config.Kafka.Topics = nil
+}
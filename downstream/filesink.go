@@ -0,0 +1,169 @@
+// A sink that appends messages to a local file, rotating it by size
+//
+// Author: Kirk Morales
+// Copyright 2022. All Rights Reserved.
+
+package downstream
+
+import (
+	"beget/util"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+
+	"github.com/segmentio/kafka-go"
+)
+
+const (
+	defaultFileMaxBytes = 100 << 20
+	defaultFileMaxFiles = 5
+)
+
+// Appends messages to a file, one JSON object per line. Once the file would grow
+// past its maximum size it's renamed with a ".1" suffix, shifting older files up,
+// and a new file is started.
+type fileSink struct {
+	mu       sync.Mutex
+	path     string
+	maxBytes int64
+	maxFiles int
+	file     *os.File // nil once closed
+	size     int64
+}
+
+// Opens the sink's file, appending to it if it already exists
+func newFileSink(config util.SinkConfig) (*fileSink, error) {
+	if config.Path == "" {
+		return nil, fmt.Errorf("missing path")
+	}
+
+	s := &fileSink{
+		path:     config.Path,
+		maxBytes: config.MaxBytes,
+		maxFiles: config.MaxFiles,
+	}
+	if s.maxBytes <= 0 {
+		s.maxBytes = defaultFileMaxBytes
+	}
+	if s.maxFiles <= 0 {
+		s.maxFiles = defaultFileMaxFiles
+	}
+
+	if err := s.open(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *fileSink) open() error {
+	file, err := os.OpenFile(s.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		return err
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	s.file = file
+	s.size = info.Size()
+	return nil
+}
+
+func (s *fileSink) Produce(ctx context.Context, m kafka.Message) error {
+	return s.write([]kafka.Message{m})
+}
+
+func (s *fileSink) ProduceBatch(ctx context.Context, ms []kafka.Message) error {
+	return batchError(s.write(ms), len(ms))
+}
+
+// Writes the messages together, so they're never split across files
+func (s *fileSink) ProduceTransaction(ctx context.Context, ms []kafka.Message) error {
+	if err := s.write(ms); err != nil {
+		return fmt.Errorf("%w: %v", ErrTransactionAborted, err)
+	}
+	return nil
+}
+
+func (s *fileSink) write(ms []kafka.Message) error {
+	data := encodeRecords(ms)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.file == nil {
+		return os.ErrClosed
+	}
+
+	if s.size > 0 && s.size+int64(len(data)) > s.maxBytes {
+		if err := s.rotate(); err != nil {
+			return fmt.Errorf("failed to rotate %s: %w", s.path, err)
+		}
+	}
+
+	n, err := s.file.Write(data)
+	s.size += int64(n)
+	return err
+}
+
+// Moves the current file aside and starts a new one, removing the oldest file. If
+// the files can't be moved, the current file is reopened so later writes can
+// still succeed.
+func (s *fileSink) rotate() error {
+	err := s.file.Close()
+	s.file = nil
+	if err == nil {
+		err = s.shift()
+	}
+
+	if err != nil {
+		if openErr := s.open(); openErr != nil {
+			return errors.Join(err, openErr)
+		}
+		return err
+	}
+
+	return s.open()
+}
+
+// Renames each file to the next number, with the current file becoming ".1"
+func (s *fileSink) shift() error {
+	for i := s.maxFiles - 1; i >= 1; i-- {
+		err := os.Rename(fmt.Sprintf("%s.%d", s.path, i), fmt.Sprintf("%s.%d", s.path, i+1))
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+
+	return os.Rename(s.path, s.path+".1")
+}
+
+func (s *fileSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.file == nil {
+		return nil
+	}
+
+	err := s.file.Close()
+	s.file = nil
+	return err
+}
+
+func (s *fileSink) Health(ctx context.Context) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.file == nil {
+		return os.ErrClosed
+	}
+
+	_, err := s.file.Stat()
+	return err
+}
@@ -0,0 +1,592 @@
+// An in-process stand-in for a Kafka broker, for tests
+//
+// Author: Kirk Morales
+// Copyright 2022. All Rights Reserved.
+
+// Package kafkatest provides a fake Kafka broker that speaks enough of the wire
+// protocol (ApiVersions, Metadata, ListOffsets, Produce and the transaction APIs) for kafka-go
+// writers and clients to produce to it, with hooks to inject failures.
+package kafkatest
+
+import (
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+	"github.com/segmentio/kafka-go/protocol"
+	"github.com/segmentio/kafka-go/protocol/addpartitionstotxn"
+	"github.com/segmentio/kafka-go/protocol/apiversions"
+	"github.com/segmentio/kafka-go/protocol/endtxn"
+	"github.com/segmentio/kafka-go/protocol/findcoordinator"
+	"github.com/segmentio/kafka-go/protocol/initproducerid"
+	"github.com/segmentio/kafka-go/protocol/listoffsets"
+	"github.com/segmentio/kafka-go/protocol/metadata"
+	"github.com/segmentio/kafka-go/protocol/produce"
+)
+
+// The broker's node ID, which leads every partition
+const nodeID = 1
+
+// A single-node Kafka cluster listening on a local port. Every topic has a
+// single partition. The broker also coordinates transactions, whose messages
+// are only stored once committed.
+type Broker struct {
+	listener net.Listener
+	done     chan struct{}
+	wg       sync.WaitGroup
+
+	mu           sync.Mutex
+	conns        map[net.Conn]struct{}
+	topics       map[string]struct{}
+	batches      [][]kafka.Message
+	compressions []kafka.Compression
+	offsets      map[string]int64
+	faults       map[string][]kafka.Error
+	delay        time.Duration
+	producers    map[string]*producer // Transactional producers by transactional ID
+	producerIDs  int64
+}
+
+// A transactional producer and its open transaction
+type producer struct {
+	id        int64
+	epoch     int16
+	sequences map[string]int32    // The next sequence number expected, by topic
+	topics    map[string]struct{} // The topics added to the open transaction
+	pending   []batch             // The batches written in the open transaction
+}
+
+// Messages written to a topic in a single produce request
+type batch struct {
+	topic       string
+	messages    []kafka.Message
+	compression kafka.Compression
+}
+
+// Starts a broker with the given topics. Call `Close` once done with it.
+func NewBroker(topics ...string) (*Broker, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+
+	b := &Broker{
+		listener:  listener,
+		done:      make(chan struct{}),
+		conns:     make(map[net.Conn]struct{}),
+		topics:    make(map[string]struct{}),
+		offsets:   make(map[string]int64),
+		faults:    make(map[string][]kafka.Error),
+		producers: make(map[string]*producer),
+	}
+	for _, topic := range topics {
+		b.topics[topic] = struct{}{}
+	}
+
+	b.wg.Add(1)
+	go b.serve()
+
+	return b, nil
+}
+
+// The address clients connect to
+func (b *Broker) Addr() string {
+	return b.listener.Addr().String()
+}
+
+// Adds a topic, as if it had been created on the cluster
+func (b *Broker) CreateTopic(topic string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.topics[topic] = struct{}{}
+}
+
+// Fails the next produce requests for the topic, one per error, with the given
+// errors in order. Retriable errors, like `kafka.LeaderNotAvailable`, are retried
+// by writers.
+func (b *Broker) FailProduce(topic string, errs ...kafka.Error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.faults[topic] = append(b.faults[topic], errs...)
+}
+
+// Waits before responding to each produce request, simulating a slow broker
+func (b *Broker) SetDelay(d time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.delay = d
+}
+
+// Returns the messages written so far, in the order they were written
+func (b *Broker) Messages() []kafka.Message {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	var ms []kafka.Message
+	for _, batch := range b.batches {
+		ms = append(ms, batch...)
+	}
+	return ms
+}
+
+// Returns the messages written so far, grouped by the produce request and
+// topic they were written in
+func (b *Broker) Batches() [][]kafka.Message {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return append([][]kafka.Message(nil), b.batches...)
+}
+
+// Returns the codec each batch returned by `Batches` was compressed with
+func (b *Broker) Compressions() []kafka.Compression {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return append([]kafka.Compression(nil), b.compressions...)
+}
+
+// Returns the number of transactions that are open
+func (b *Broker) OpenTransactions() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	n := 0
+	for _, p := range b.producers {
+		if len(p.topics) > 0 {
+			n++
+		}
+	}
+	return n
+}
+
+// Discards the messages written so far, as well as any pending failures and delay
+func (b *Broker) Reset() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.batches = nil
+	b.compressions = nil
+	b.faults = make(map[string][]kafka.Error)
+	b.delay = 0
+}
+
+// Stops the broker, closing every open connection
+func (b *Broker) Close() error {
+	close(b.done)
+	err := b.listener.Close()
+
+	b.mu.Lock()
+	for conn := range b.conns {
+		conn.Close()
+	}
+	b.mu.Unlock()
+
+	b.wg.Wait()
+	return err
+}
+
+// Accepts connections until the broker is closed
+func (b *Broker) serve() {
+	defer b.wg.Done()
+
+	for {
+		conn, err := b.listener.Accept()
+		if err != nil {
+			return
+		}
+
+		b.mu.Lock()
+		b.conns[conn] = struct{}{}
+		b.mu.Unlock()
+
+		b.wg.Add(1)
+		go b.handle(conn)
+	}
+}
+
+// Serves requests on the connection, one at a time, until it's closed
+func (b *Broker) handle(conn net.Conn) {
+	defer b.wg.Done()
+	defer func() {
+		b.mu.Lock()
+		delete(b.conns, conn)
+		b.mu.Unlock()
+		conn.Close()
+	}()
+
+	for {
+		version, correlationID, _, req, err := protocol.ReadRequest(conn)
+		if err != nil {
+			return
+		}
+
+		var res protocol.Message
+		switch req := req.(type) {
+		case *apiversions.Request:
+			res = b.apiVersions()
+		case *metadata.Request:
+			res = b.metadata(req)
+		case *listoffsets.Request:
+			res = b.listOffsets(req)
+		case *produce.Request:
+			res = b.produce(req)
+			if !req.HasResponse() {
+				continue
+			}
+		case *findcoordinator.Request:
+			res = b.findCoordinator()
+		case *initproducerid.Request:
+			res = b.initProducerID(req)
+		case *addpartitionstotxn.Request:
+			res = b.addPartitionsToTxn(req)
+		case *endtxn.Request:
+			res = b.endTxn(req)
+		default:
+			// Unsupported requests close the connection, as a broker would for
+			// requests it can't parse
+			return
+		}
+
+		if res == nil {
+			return
+		}
+		if err := protocol.WriteResponse(conn, version, correlationID, res); err != nil {
+			return
+		}
+	}
+}
+
+func (b *Broker) apiVersions() protocol.Message {
+	res := &apiversions.Response{}
+	keys := []protocol.ApiKey{
+		protocol.ApiVersions, protocol.Metadata, protocol.ListOffsets, protocol.Produce, protocol.FindCoordinator,
+		protocol.InitProducerId, protocol.AddPartitionsToTxn, protocol.EndTxn,
+	}
+	for _, key := range keys {
+		res.ApiKeys = append(res.ApiKeys, apiversions.ApiKeyResponse{
+			ApiKey:     int16(key),
+			MinVersion: key.MinVersion(),
+			MaxVersion: key.MaxVersion(),
+		})
+	}
+	return res
+}
+
+// Describes the requested topics, or every topic when none are requested
+func (b *Broker) metadata(req *metadata.Request) protocol.Message {
+	host, port := b.hostPort()
+	res := &metadata.Response{
+		Brokers:      []metadata.ResponseBroker{{NodeID: nodeID, Host: host, Port: port}},
+		ClusterID:    "kafkatest",
+		ControllerID: nodeID,
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	names := req.TopicNames
+	if names == nil {
+		for topic := range b.topics {
+			names = append(names, topic)
+		}
+	}
+
+	for _, name := range names {
+		if _, ok := b.topics[name]; !ok && req.AllowAutoTopicCreation {
+			b.topics[name] = struct{}{}
+		}
+
+		topic := metadata.ResponseTopic{Name: name}
+		if _, ok := b.topics[name]; ok {
+			topic.Partitions = []metadata.ResponsePartition{{
+				LeaderID:     nodeID,
+				ReplicaNodes: []int32{nodeID},
+				IsrNodes:     []int32{nodeID},
+			}}
+		} else {
+			topic.ErrorCode = int16(kafka.UnknownTopicOrPartition)
+		}
+		res.Topics = append(res.Topics, topic)
+	}
+
+	return res
+}
+
+// Returns the first offset (always 0) or the next offset of the requested
+// partitions, depending on the timestamp asked for
+func (b *Broker) listOffsets(req *listoffsets.Request) protocol.Message {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	res := &listoffsets.Response{}
+	for _, t := range req.Topics {
+		topic := listoffsets.ResponseTopic{Topic: t.Topic}
+
+		_, exists := b.topics[t.Topic]
+		for _, p := range t.Partitions {
+			partition := listoffsets.ResponsePartition{Partition: p.Partition, Timestamp: p.Timestamp}
+			switch {
+			case !exists || p.Partition != 0:
+				partition.ErrorCode = int16(kafka.UnknownTopicOrPartition)
+			case p.Timestamp == kafka.LastOffset:
+				partition.Offset = b.offsets[t.Topic]
+			}
+			topic.Partitions = append(topic.Partitions, partition)
+		}
+		res.Topics = append(res.Topics, topic)
+	}
+
+	return res
+}
+
+// Stores the produced messages, unless a failure was injected for their topic.
+// Returns nil if the broker was closed while delaying the response.
+func (b *Broker) produce(req *produce.Request) protocol.Message {
+	b.mu.Lock()
+	delay := b.delay
+	b.mu.Unlock()
+
+	if delay > 0 {
+		select {
+		case <-time.After(delay):
+		case <-b.done:
+			return nil
+		}
+	}
+
+	res := &produce.Response{}
+	for _, t := range req.Topics {
+		topic := produce.ResponseTopic{Topic: t.Topic}
+
+		for _, p := range t.Partitions {
+			partition := produce.ResponsePartition{Partition: p.Partition}
+
+			compression := p.RecordSet.Attributes.Compression()
+			records := recordBatch(p.RecordSet)
+
+			ms, err := readRecords(t.Topic, p.RecordSet)
+			switch {
+			case err != nil:
+				partition.ErrorCode = int16(kafka.InvalidMessage)
+			case req.TransactionalID != "":
+				partition.ErrorCode = b.produceTransactional(req, t.Topic, records, batch{t.Topic, ms, compression})
+			default:
+				partition.ErrorCode, partition.BaseOffset = b.append(batch{t.Topic, ms, compression})
+			}
+			topic.Partitions = append(topic.Partitions, partition)
+		}
+		res.Topics = append(res.Topics, topic)
+	}
+
+	return res
+}
+
+// Appends the messages to the topic, returning the error code and offset of the
+// first message
+func (b *Broker) append(bt batch) (int16, int64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if code := b.check(bt.topic); code != 0 {
+		return code, -1
+	}
+	return 0, b.store(bt)
+}
+
+// Returns the error code for a write to the topic, consuming an injected failure
+// if there is one. Must be called with the lock held.
+func (b *Broker) check(topic string) int16 {
+	if _, ok := b.topics[topic]; !ok {
+		return int16(kafka.UnknownTopicOrPartition)
+	}
+
+	if faults := b.faults[topic]; len(faults) > 0 {
+		b.faults[topic] = faults[1:]
+		return int16(faults[0])
+	}
+	return 0
+}
+
+// Stores the batch, assigning offsets to its messages. Returns the offset of the
+// first message. Must be called with the lock held.
+func (b *Broker) store(bt batch) int64 {
+	offset := b.offsets[bt.topic]
+	for i := range bt.messages {
+		bt.messages[i].Offset = offset + int64(i)
+	}
+	b.offsets[bt.topic] += int64(len(bt.messages))
+	b.batches = append(b.batches, bt.messages)
+	b.compressions = append(b.compressions, bt.compression)
+
+	return offset
+}
+
+// The broker coordinates every transaction itself
+func (b *Broker) findCoordinator() protocol.Message {
+	host, port := b.hostPort()
+	return &findcoordinator.Response{NodeID: nodeID, Host: host, Port: port}
+}
+
+// Assigns the transactional ID a producer ID, or bumps the epoch of the one it
+// has, aborting its open transaction
+func (b *Broker) initProducerID(req *initproducerid.Request) protocol.Message {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	p, ok := b.producers[req.TransactionalID]
+	if ok {
+		p.epoch++
+	} else {
+		b.producerIDs++
+		p = &producer{id: b.producerIDs}
+		b.producers[req.TransactionalID] = p
+	}
+
+	p.sequences = make(map[string]int32)
+	p.topics, p.pending = nil, nil
+
+	return &initproducerid.Response{ProducerID: p.id, ProducerEpoch: p.epoch}
+}
+
+// Returns the producer of the transactional ID, or the error code if the producer
+// ID or epoch are stale. Must be called with the lock held.
+func (b *Broker) lookupProducer(transactionalID string, id int64, epoch int16) (*producer, int16) {
+	p, ok := b.producers[transactionalID]
+	if !ok || p.id != id {
+		return nil, int16(kafka.InvalidProducerIDMapping)
+	} else if p.epoch != epoch {
+		return nil, int16(kafka.InvalidProducerEpoch)
+	}
+	return p, 0
+}
+
+// Adds the topics to the producer's open transaction
+func (b *Broker) addPartitionsToTxn(req *addpartitionstotxn.Request) protocol.Message {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	p, code := b.lookupProducer(req.TransactionalID, req.ProducerID, req.ProducerEpoch)
+
+	res := &addpartitionstotxn.Response{}
+	for _, t := range req.Topics {
+		result := addpartitionstotxn.ResponseResult{Name: t.Name}
+		for _, partition := range t.Partitions {
+			code := code
+			if _, ok := b.topics[t.Name]; code == 0 && !ok {
+				code = int16(kafka.UnknownTopicOrPartition)
+			} else if code == 0 {
+				if p.topics == nil {
+					p.topics = make(map[string]struct{})
+				}
+				p.topics[t.Name] = struct{}{}
+			}
+			result.Results = append(result.Results, addpartitionstotxn.ResponsePartition{PartitionIndex: partition, ErrorCode: code})
+		}
+		res.Results = append(res.Results, result)
+	}
+
+	return res
+}
+
+// Holds a batch written within a transaction until the transaction ends. The
+// batch must be transactional, belong to the producer's current epoch, continue
+// its sequence and be written to a topic added to the transaction.
+func (b *Broker) produceTransactional(req *produce.Request, topic string, records *protocol.RecordBatch, bt batch) int16 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if records == nil || !records.Attributes.Transactional() {
+		return int16(kafka.InvalidRecord)
+	} else if req.Acks != -1 {
+		return int16(kafka.InvalidRequiredAcks)
+	}
+
+	p, code := b.lookupProducer(req.TransactionalID, records.ProducerID, records.ProducerEpoch)
+	if code != 0 {
+		return code
+	} else if _, ok := p.topics[topic]; !ok {
+		return int16(kafka.InvalidTransactionState)
+	} else if records.BaseSequence != p.sequences[topic] {
+		return int16(kafka.OutOfOrderSequenceNumber)
+	} else if code := b.check(topic); code != 0 {
+		return code
+	}
+
+	p.sequences[topic] += int32(len(bt.messages))
+	p.pending = append(p.pending, bt)
+	return 0
+}
+
+// Commits or aborts the producer's open transaction
+func (b *Broker) endTxn(req *endtxn.Request) protocol.Message {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	p, code := b.lookupProducer(req.TransactionalID, req.ProducerID, req.ProducerEpoch)
+	if code != 0 {
+		return &endtxn.Response{ErrorCode: code}
+	}
+
+	if req.Committed {
+		for _, bt := range p.pending {
+			b.store(bt)
+		}
+	}
+	p.topics, p.pending = nil, nil
+
+	return &endtxn.Response{}
+}
+
+func (b *Broker) hostPort() (string, int32) {
+	addr := b.listener.Addr().(*net.TCPAddr)
+	return addr.IP.String(), int32(addr.Port)
+}
+
+// Returns the record set's only v2 batch, or nil if it has none or several
+func recordBatch(rs protocol.RecordSet) *protocol.RecordBatch {
+	records := rs.Records
+	if stream, ok := records.(*protocol.RecordStream); ok {
+		if len(stream.Records) != 1 {
+			return nil
+		}
+		records = stream.Records[0]
+	}
+
+	batch, _ := records.(*protocol.RecordBatch)
+	return batch
+}
+
+// Decodes the records in a produce request
+func readRecords(topic string, rs protocol.RecordSet) ([]kafka.Message, error) {
+	if rs.Records == nil {
+		return nil, nil
+	}
+	var ms []kafka.Message
+	for {
+		r, err := rs.Records.ReadRecord()
+		if errors.Is(err, io.EOF) {
+			return ms, nil
+		} else if err != nil {
+			return nil, err
+		}
+
+		m := kafka.Message{Topic: topic, Time: r.Time}
+		if m.Key, err = protocol.ReadAll(r.Key); err != nil {
+			return nil, err
+		}
+		if m.Value, err = protocol.ReadAll(r.Value); err != nil {
+			return nil, err
+		}
+		for _, h := range r.Headers {
+			m.Headers = append(m.Headers, kafka.Header{Key: h.Key, Value: h.Value})
+		}
+		ms = append(ms, m)
+	}
+}
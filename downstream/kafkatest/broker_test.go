@@ -0,0 +1,116 @@
+package kafkatest_test
+
+import (
+	"beget/downstream/kafkatest"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBroker(t *testing.T) {
+	ctx := context.Background()
+
+	broker, err := kafkatest.NewBroker("events")
+	assert.Nil(t, err)
+	defer broker.Close()
+
+	writer := &kafka.Writer{
+		Addr:         kafka.TCP(broker.Addr()),
+		BatchTimeout: time.Millisecond,
+		RequiredAcks: kafka.RequireAll,
+	}
+	defer writer.Close()
+
+	t.Run("stores messages", func(t *testing.T) {
+		err := writer.WriteMessages(ctx,
+			kafka.Message{Topic: "events", Key: []byte("a"), Value: []byte("1")},
+			kafka.Message{Topic: "events", Value: []byte("2")},
+		)
+
+		assert.Nil(t, err)
+		ms := broker.Messages()
+		if assert.Len(t, ms, 2) {
+			assert.Equal(t, []byte("a"), ms[0].Key)
+			assert.Equal(t, []byte("1"), ms[0].Value)
+			assert.Equal(t, int64(1), ms[1].Offset)
+		}
+	})
+
+	t.Run("lists topics", func(t *testing.T) {
+		broker.CreateTopic("orders")
+
+		// The writer's transport caches metadata, so use a new one
+		client := &kafka.Client{Addr: kafka.TCP(broker.Addr()), Transport: &kafka.Transport{}}
+
+		res, err := client.Metadata(ctx, &kafka.MetadataRequest{})
+
+		assert.Nil(t, err)
+		var names []string
+		for _, topic := range res.Topics {
+			names = append(names, topic.Name)
+		}
+		assert.ElementsMatch(t, []string{"events", "orders"}, names)
+	})
+
+	t.Run("lists offsets", func(t *testing.T) {
+		client := &kafka.Client{Addr: kafka.TCP(broker.Addr()), Transport: &kafka.Transport{}}
+
+		res, err := client.ListOffsets(ctx, &kafka.ListOffsetsRequest{Topics: map[string][]kafka.OffsetRequest{
+			"events": {kafka.FirstOffsetOf(0), kafka.LastOffsetOf(0)},
+		}})
+
+		assert.Nil(t, err)
+		if assert.Len(t, res.Topics["events"], 1) {
+			assert.Nil(t, res.Topics["events"][0].Error)
+			assert.Equal(t, int64(0), res.Topics["events"][0].FirstOffset)
+			assert.Equal(t, int64(2), res.Topics["events"][0].LastOffset)
+		}
+	})
+
+	t.Run("injects failures", func(t *testing.T) {
+		broker.Reset()
+		broker.FailProduce("events", kafka.TopicAuthorizationFailed)
+
+		err := writer.WriteMessages(ctx, kafka.Message{Topic: "events", Value: []byte("1")})
+
+		assert.Equal(t, kafka.WriteErrors{kafka.TopicAuthorizationFailed}, err)
+		assert.Empty(t, broker.Messages())
+	})
+
+	t.Run("coordinates transactions", func(t *testing.T) {
+		client := &kafka.Client{Addr: kafka.TCP(broker.Addr()), Transport: &kafka.Transport{}}
+
+		init, err := client.InitProducerID(ctx, &kafka.InitProducerIDRequest{TransactionalID: "t1", TransactionTimeoutMs: 1000})
+		assert.Nil(t, err)
+		assert.Nil(t, init.Error)
+
+		add, err := client.AddPartitionsToTxn(ctx, &kafka.AddPartitionsToTxnRequest{
+			TransactionalID: "t1",
+			ProducerID:      init.Producer.ProducerID,
+			ProducerEpoch:   init.Producer.ProducerEpoch,
+			Topics:          map[string][]kafka.AddPartitionToTxn{"events": {{Partition: 0}}},
+		})
+		assert.Nil(t, err)
+		assert.Nil(t, add.Topics["events"][0].Error)
+		assert.Equal(t, 1, broker.OpenTransactions())
+
+		// Initializing again bumps the epoch, fencing off the old producer
+		reinit, err := client.InitProducerID(ctx, &kafka.InitProducerIDRequest{TransactionalID: "t1", TransactionTimeoutMs: 1000})
+		assert.Nil(t, err)
+		assert.Equal(t, init.Producer.ProducerID, reinit.Producer.ProducerID)
+		assert.Equal(t, init.Producer.ProducerEpoch+1, reinit.Producer.ProducerEpoch)
+		assert.Zero(t, broker.OpenTransactions())
+
+		end, err := client.EndTxn(ctx, &kafka.EndTxnRequest{
+			TransactionalID: "t1",
+			ProducerID:      init.Producer.ProducerID,
+			ProducerEpoch:   init.Producer.ProducerEpoch,
+			Committed:       true,
+		})
+		assert.Nil(t, err)
+		assert.Equal(t, kafka.InvalidProducerEpoch, end.Error)
+	})
+}
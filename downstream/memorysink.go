@@ -0,0 +1,103 @@
+// A sink that keeps messages in memory
+//
+// Author: Kirk Morales
+// Copyright 2022. All Rights Reserved.
+
+package downstream
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/segmentio/kafka-go"
+)
+
+// Keeps written messages in memory, in the order they were written. Mostly useful
+// for testing.
+type MemorySink struct {
+	mu       sync.Mutex
+	messages []kafka.Message
+
+	// If set, called with each message before it's written. A non-nil error fails
+	// the message instead.
+	Fail func(m kafka.Message) error
+}
+
+func NewMemorySink() *MemorySink {
+	return &MemorySink{}
+}
+
+func (s *MemorySink) Produce(ctx context.Context, m kafka.Message) error {
+	return s.ProduceBatch(ctx, []kafka.Message{m})
+}
+
+// Writes the messages that don't fail. When more than one message is written,
+// failures are reported as `kafka.WriteErrors`.
+func (s *MemorySink) ProduceBatch(ctx context.Context, ms []kafka.Message) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	errs := make(kafka.WriteErrors, len(ms))
+	failed := false
+	for i, m := range ms {
+		if errs[i] = s.check(m); errs[i] != nil {
+			failed = true
+		} else {
+			s.messages = append(s.messages, m)
+		}
+	}
+
+	if !failed {
+		return nil
+	} else if len(ms) == 1 {
+		return errs[0]
+	}
+	return errs
+}
+
+// Writes the messages only if none of them fail
+func (s *MemorySink) ProduceTransaction(ctx context.Context, ms []kafka.Message) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, m := range ms {
+		if err := s.check(m); err != nil {
+			return fmt.Errorf("%w: %v", ErrTransactionAborted, err)
+		}
+	}
+
+	s.messages = append(s.messages, ms...)
+	return nil
+}
+
+func (s *MemorySink) check(m kafka.Message) error {
+	if s.Fail == nil {
+		return nil
+	}
+	return s.Fail(m)
+}
+
+// Returns the messages written so far
+func (s *MemorySink) Messages() []kafka.Message {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return append([]kafka.Message(nil), s.messages...)
+}
+
+// Discards the messages written so far
+func (s *MemorySink) Reset() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.messages = nil
+}
+
+func (s *MemorySink) Close() error {
+	return nil
+}
+
+func (s *MemorySink) Health(ctx context.Context) error {
+	return nil
+}
@@ -0,0 +1,209 @@
+// Functions associated with redacting fields before messages are written
+//
+// Author: Kirk Morales
+// Copyright 2022. All Rights Reserved.
+
+package downstream
+
+import (
+	"beget/util"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// The header recording the ID of the key a message's fields were encrypted with
+const KeyIDHeader = "beget-key-id"
+
+const defaultMaskKeep = 4
+
+// The cipher fields are encrypted with, or nil if encryption isn't configured
+var encryptionCipher cipher.AEAD
+
+// A redacted field whose path has been parsed
+type redaction struct {
+	util.RedactFieldConfig
+	field []pathStep
+}
+
+// Loads the encryption key from `Config.Redaction`
+func initRedaction() error {
+	encryptionCipher = nil
+
+	config := util.Config.Redaction
+	if config.Keyring == "" {
+		return nil
+	} else if config.EncryptionKey == "" {
+		return fmt.Errorf("redaction: missing encryption_key")
+	}
+
+	data, err := os.ReadFile(config.Keyring)
+	if err != nil {
+		return fmt.Errorf("redaction: %w", err)
+	}
+
+	var keyring map[string]string
+	if err := json.Unmarshal(data, &keyring); err != nil {
+		return fmt.Errorf("redaction: invalid keyring: %w", err)
+	}
+
+	encoded, ok := keyring[config.EncryptionKey]
+	if !ok {
+		return fmt.Errorf("redaction: key %q is not in the keyring", config.EncryptionKey)
+	}
+
+	key, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return fmt.Errorf("redaction: key %q isn't valid base64", config.EncryptionKey)
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return fmt.Errorf("redaction: key %q: %w", config.EncryptionKey, err)
+	}
+
+	if encryptionCipher, err = cipher.NewGCM(block); err != nil {
+		return fmt.Errorf("redaction: key %q: %w", config.EncryptionKey, err)
+	}
+	return nil
+}
+
+// Parses and checks the topic's redacted fields
+func parseRedactions(configs []util.RedactFieldConfig) ([]redaction, error) {
+	redactions := make([]redaction, 0, len(configs))
+	for i, config := range configs {
+		r := redaction{RedactFieldConfig: config}
+		r.Action = strings.ToLower(config.Action)
+
+		var err error
+		if r.field, err = parsePath(config.Field); err != nil {
+			return nil, fmt.Errorf("redact %d: %w", i, err)
+		}
+
+		switch r.Action {
+		case "drop":
+		case "mask":
+			if config.Keep != nil && *config.Keep < 0 {
+				return nil, fmt.Errorf("redact %d: keep must not be negative", i)
+			}
+		case "hash":
+			if util.Config.Redaction.HashSalt == "" {
+				return nil, fmt.Errorf("redact %d: hashing requires redaction.hash_salt", i)
+			}
+		case "encrypt":
+			if encryptionCipher == nil {
+				return nil, fmt.Errorf("redact %d: encryption requires redaction.keyring", i)
+			}
+		default:
+			return nil, fmt.Errorf("redact %d: invalid action %q", i, config.Action)
+		}
+
+		redactions = append(redactions, r)
+	}
+	return redactions, nil
+}
+
+// Redacts the topic's fields in a message value, returning the new value and the
+// ID of the key fields were encrypted with, if any were. The value must be a JSON
+// object unless the topic has no redacted fields.
+func (s *TopicSettings) Redact(value []byte) ([]byte, string, error) {
+	if len(s.redactions) == 0 {
+		return value, "", nil
+	}
+
+	v, err := decodeObject(value)
+	if err != nil {
+		return nil, "", err
+	}
+
+	keyID := ""
+	for _, r := range s.redactions {
+		x, ok := getPath(v, r.field)
+		if !ok || x == nil {
+			continue
+		}
+
+		switch r.Action {
+		case "drop":
+			deletePath(v, r.field)
+			continue
+		case "hash":
+			x = hashField(x)
+		case "mask":
+			keep := defaultMaskKeep
+			if r.Keep != nil {
+				keep = *r.Keep
+			}
+			x = maskField(x, keep)
+		case "encrypt":
+			if x, err = encryptField(x); err != nil {
+				return nil, "", fmt.Errorf("field %s: %w", r.Field, err)
+			}
+			keyID = util.Config.Redaction.EncryptionKey
+		}
+
+		if err := setPath(v, r.field, x); err != nil {
+			return nil, "", fmt.Errorf("field %s: %w", r.Field, err)
+		}
+	}
+
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, "", err
+	}
+	return data, keyID, nil
+}
+
+// Returns the field's value as a string: strings as they are, and anything else
+// encoded as JSON
+func fieldString(x interface{}) string {
+	if s, ok := x.(string); ok {
+		return s
+	}
+
+	data, _ := json.Marshal(x)
+	return string(data)
+}
+
+// Returns the hex-encoded SHA-256 of the salt followed by the value
+func hashField(x interface{}) string {
+	sum := sha256.Sum256([]byte(util.Config.Redaction.HashSalt + fieldString(x)))
+	return hex.EncodeToString(sum[:])
+}
+
+// Replaces all but the last `keep` characters of the value with "*"
+func maskField(x interface{}, keep int) string {
+	r := []rune(fieldString(x))
+
+	n := len(r) - keep
+	if n <= 0 {
+		n = len(r)
+	}
+	for i := 0; i < n; i++ {
+		r[i] = '*'
+	}
+	return string(r)
+}
+
+// Encrypts the JSON encoding of the value, returning the nonce followed by the
+// ciphertext, base64-encoded
+func encryptField(x interface{}) (string, error) {
+	plaintext, err := json.Marshal(x)
+	if err != nil {
+		return "", err
+	}
+
+	nonce := make([]byte, encryptionCipher.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+
+	return base64.StdEncoding.EncodeToString(encryptionCipher.Seal(nonce, nonce, plaintext, nil)), nil
+}
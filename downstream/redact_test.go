@@ -0,0 +1,131 @@
+package downstream_test
+
+import (
+	"beget/downstream"
+	"beget/util"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRedaction(t *testing.T) {
+	keep := 0
+
+	util.Config.Redaction = util.RedactionConfig{
+		HashSalt:      "salt",
+		Keyring:       "testdata/keyring.json",
+		EncryptionKey: "2022-06",
+	}
+	util.Config.Kafka.Topics = map[string]util.TopicConfig{
+		"users": {
+			Redact: []util.RedactFieldConfig{
+				{Field: "password", Action: "drop"},
+				{Field: "email", Action: "hash"},
+				{Field: "phone", Action: "mask"},
+				{Field: "pin", Action: "mask", Keep: &keep},
+				{Field: "$.address.street", Action: "encrypt"},
+				{Field: "missing", Action: "encrypt"},
+			},
+		},
+		"events": {},
+	}
+
+	assert.Nil(t, downstream.Init())
+
+	t.Run("redacts fields", func(t *testing.T) {
+		value, keyID, err := downstream.SettingsFor("users").Redact([]byte(`{
+			"password": "hunter2",
+			"email": "jane@example.com",
+			"phone": "+1 555 0100",
+			"pin": 1234,
+			"address": {"street": "1 Main St", "city": "Springfield"}
+		}`))
+
+		assert.Nil(t, err)
+		assert.Equal(t, "2022-06", keyID)
+
+		var v map[string]interface{}
+		assert.Nil(t, json.Unmarshal(value, &v))
+
+		sum := sha256.Sum256([]byte("saltjane@example.com"))
+		assert.NotContains(t, v, "password")
+		assert.Equal(t, hex.EncodeToString(sum[:]), v["email"])
+		assert.Equal(t, "*******0100", v["phone"])
+		assert.Equal(t, "****", v["pin"])
+		assert.Equal(t, "Springfield", v["address"].(map[string]interface{})["city"])
+		assert.NotContains(t, v, "missing")
+
+		// Encrypted fields are the nonce followed by the ciphertext
+		data, err := base64.StdEncoding.DecodeString(v["address"].(map[string]interface{})["street"].(string))
+		assert.Nil(t, err)
+
+		key, _ := base64.StdEncoding.DecodeString("ICEiIyQlJicoKSorLC0uLzAxMjM0NTY3ODk6Ozw9Pj8=")
+		block, _ := aes.NewCipher(key)
+		gcm, _ := cipher.NewGCM(block)
+		plaintext, err := gcm.Open(nil, data[:gcm.NonceSize()], data[gcm.NonceSize():], nil)
+		assert.Nil(t, err)
+		assert.Equal(t, `"1 Main St"`, string(plaintext))
+	})
+
+	t.Run("without encrypted fields", func(t *testing.T) {
+		value, keyID, err := downstream.SettingsFor("users").Redact([]byte(`{"phone":"555"}`))
+
+		assert.Nil(t, err)
+		assert.Equal(t, "", keyID)
+		assert.JSONEq(t, `{"phone":"***"}`, string(value))
+	})
+
+	t.Run("topics without redaction", func(t *testing.T) {
+		value, keyID, err := downstream.SettingsFor("events").Redact([]byte("not json"))
+
+		assert.Nil(t, err)
+		assert.Equal(t, "", keyID)
+		assert.Equal(t, "not json", string(value))
+	})
+
+	t.Run("invalid values", func(t *testing.T) {
+		_, _, err := downstream.SettingsFor("users").Redact([]byte(`["jane@example.com"]`))
+
+		assert.EqualError(t, err, "message value must be a JSON object")
+	})
+
+	t.Run("invalid config", func(t *testing.T) {
+		negative := -1
+		tests := []struct {
+			name      string
+			redaction util.RedactionConfig
+			field     util.RedactFieldConfig
+			err       string
+		}{
+			{"invalid action", util.RedactionConfig{}, util.RedactFieldConfig{Field: "a", Action: "shred"}, `topic foo: redact 0: invalid action "shred"`},
+			{"missing field", util.RedactionConfig{}, util.RedactFieldConfig{Action: "drop"}, "topic foo: redact 0: missing field"},
+			{"negative keep", util.RedactionConfig{}, util.RedactFieldConfig{Field: "a", Action: "mask", Keep: &negative}, "topic foo: redact 0: keep must not be negative"},
+			{"missing salt", util.RedactionConfig{}, util.RedactFieldConfig{Field: "a", Action: "hash"}, "topic foo: redact 0: hashing requires redaction.hash_salt"},
+			{"missing keyring", util.RedactionConfig{}, util.RedactFieldConfig{Field: "a", Action: "encrypt"}, "topic foo: redact 0: encryption requires redaction.keyring"},
+			{"missing key", util.RedactionConfig{Keyring: "testdata/keyring.json"}, util.RedactFieldConfig{}, "redaction: missing encryption_key"},
+			{"unknown key", util.RedactionConfig{Keyring: "testdata/keyring.json", EncryptionKey: "2021"}, util.RedactFieldConfig{}, `redaction: key "2021" is not in the keyring`},
+			{"invalid key", util.RedactionConfig{Keyring: "testdata/keyring.json", EncryptionKey: "short"}, util.RedactFieldConfig{}, `redaction: key "short": crypto/aes: invalid key size 3`},
+		}
+
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				util.Config.Redaction = tt.redaction
+				util.Config.Kafka.Topics = map[string]util.TopicConfig{"foo": {Redact: []util.RedactFieldConfig{tt.field}}}
+
+				err := downstream.Init()
+
+				assert.EqualError(t, err, tt.err)
+			})
+		}
+	})
+
+	// Reset config
+	util.Config.Redaction = util.RedactionConfig{}
+	util.Config.Kafka.Topics = nil
+}
@@ -0,0 +1,81 @@
+// Functions associated with checking messages against CEL rules
+//
+// Author: Kirk Morales
+// Copyright 2022. All Rights Reserved.
+
+package downstream
+
+import (
+	"beget/util"
+	"fmt"
+
+	"github.com/google/cel-go/cel"
+)
+
+// The most a single rule may cost to evaluate, in CEL's cost units
+const ruleCostLimit = 100000
+
+// A compiled rule
+type Rule struct {
+	util.RuleConfig
+	program cel.Program
+}
+
+// Compiles the topic's rules
+func parseRules(configs []util.RuleConfig) ([]*Rule, error) {
+	if len(configs) == 0 {
+		return nil, nil
+	}
+
+	env, err := cel.NewEnv(
+		cel.Variable("value", cel.DynType),
+		cel.Variable("key", cel.StringType),
+		cel.Variable("headers", cel.MapType(cel.StringType, cel.StringType)),
+		cel.CrossTypeNumericComparisons(true),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	rules := make([]*Rule, 0, len(configs))
+	for i, config := range configs {
+		ast, issues := env.Compile(config.Expr)
+		if issues.Err() != nil {
+			return nil, fmt.Errorf("rule %d: %w", i, issues.Err())
+		} else if t := ast.OutputType(); t != cel.BoolType && t != cel.DynType {
+			return nil, fmt.Errorf("rule %d: expression must return a bool, not %s", i, t)
+		}
+
+		program, err := env.Program(ast, cel.CostLimit(ruleCostLimit))
+		if err != nil {
+			return nil, fmt.Errorf("rule %d: %w", i, err)
+		}
+
+		if config.Message == "" {
+			config.Message = "message breaks rule: " + config.Expr
+		}
+		rules = append(rules, &Rule{RuleConfig: config, program: program})
+	}
+
+	return rules, nil
+}
+
+// Returns whether the message satisfies the rule. `value` is the decoded JSON value,
+// or a string if the value isn't JSON. An expression that can't be evaluated, such
+// as one referring to a missing field, isn't satisfied.
+func (r *Rule) Check(value interface{}, key string, headers map[string]string) (bool, error) {
+	out, _, err := r.program.Eval(map[string]interface{}{
+		"value":   value,
+		"key":     key,
+		"headers": headers,
+	})
+	if err != nil {
+		return false, err
+	}
+
+	ok, isBool := out.Value().(bool)
+	if !isBool {
+		return false, fmt.Errorf("expression returned %s, not a bool", out.Type())
+	}
+	return ok, nil
+}
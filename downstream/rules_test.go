@@ -0,0 +1,78 @@
+package downstream_test
+
+import (
+	"beget/downstream"
+	"beget/util"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRules(t *testing.T) {
+	// Initializes a topic with the rule and returns it compiled
+	compile := func(t *testing.T, rule util.RuleConfig) (*downstream.Rule, error) {
+		util.Config.Kafka.Topics = map[string]util.TopicConfig{"foo": {Rules: []util.RuleConfig{rule}}}
+		if err := downstream.Init(); err != nil {
+			return nil, err
+		}
+		return downstream.SettingsFor("foo").Rules[0], nil
+	}
+
+	t.Run("checks messages", func(t *testing.T) {
+		value := map[string]interface{}{"amount": 5.0, "user_id": "u1", "items": []interface{}{"a"}}
+
+		tests := []struct {
+			expr  string
+			value interface{}
+			want  bool
+		}{
+			{"value.amount > 0 && has(value.user_id)", value, true},
+			{"value.amount > 10", value, false},
+			{"size(value.items) == 1", value, true},
+			{"key.startsWith('order-')", value, true},
+			{"headers['source'] == 'web'", value, true},
+			{"value == 'ok'", "ok", true},
+		}
+
+		for _, tt := range tests {
+			t.Run(tt.expr, func(t *testing.T) {
+				rule, err := compile(t, util.RuleConfig{Expr: tt.expr})
+				assert.Nil(t, err)
+
+				ok, err := rule.Check(tt.value, "order-1", map[string]string{"source": "web"})
+				assert.Nil(t, err)
+				assert.Equal(t, tt.want, ok)
+			})
+		}
+	})
+
+	t.Run("missing fields", func(t *testing.T) {
+		rule, _ := compile(t, util.RuleConfig{Expr: "value.amount > 0"})
+
+		ok, err := rule.Check(map[string]interface{}{}, "", nil)
+		assert.False(t, ok)
+		assert.ErrorContains(t, err, "no such key")
+	})
+
+	t.Run("messages", func(t *testing.T) {
+		rule, _ := compile(t, util.RuleConfig{Expr: "value.amount > 0", Message: "amount must be positive"})
+		assert.Equal(t, "amount must be positive", rule.Message)
+
+		rule, _ = compile(t, util.RuleConfig{Expr: "value.amount > 0"})
+		assert.Equal(t, "message breaks rule: value.amount > 0", rule.Message)
+	})
+
+	t.Run("invalid rules", func(t *testing.T) {
+		_, err := compile(t, util.RuleConfig{Expr: "value.amount >"})
+		assert.ErrorContains(t, err, "topic foo: rule 0: ")
+
+		_, err = compile(t, util.RuleConfig{Expr: "key + 'x'"})
+		assert.EqualError(t, err, "topic foo: rule 0: expression must return a bool, not string")
+
+		_, err = compile(t, util.RuleConfig{Expr: "user.admin"})
+		assert.ErrorContains(t, err, "undeclared reference to 'user'")
+	})
+
+	// Reset config
+	util.Config.Kafka.Topics = nil
+}
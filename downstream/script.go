@@ -0,0 +1,243 @@
+// Functions associated with running topic scripts
+//
+// Author: Kirk Morales
+// Copyright 2022. All Rights Reserved.
+
+package downstream
+
+import (
+	"beget/util"
+	"bytes"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"go.starlark.net/lib/json"
+	"go.starlark.net/starlark"
+	"go.starlark.net/syntax"
+)
+
+const (
+	defaultScriptMaxSteps = 100000
+	defaultScriptMaxBytes = 1 << 20
+	defaultScriptTimeout  = 100 * time.Millisecond
+)
+
+// Returned when a message is larger than `Config.Scripts.MaxBytes` before the
+// script runs
+var ErrScriptInputTooLarge = errors.New("message is too large for the topic's script")
+
+// A compiled topic script
+type Script struct {
+	name    string
+	process starlark.Callable
+}
+
+// A message as seen by a script
+type ScriptMessage struct {
+	Topic   string
+	Key     string
+	Value   []byte
+	Headers map[string]string
+}
+
+// Returns the size of the message's topic, key, value and headers in bytes
+func (m ScriptMessage) size() int {
+	n := len(m.Topic) + len(m.Key) + len(m.Value)
+	for k, v := range m.Headers {
+		n += len(k) + len(v)
+	}
+	return n
+}
+
+// Returned when a script rejects a message with `reject(status, message)`
+type ScriptRejection struct {
+	Status  int
+	Message string
+}
+
+func (r *ScriptRejection) Error() string {
+	return r.Message
+}
+
+// Names available to scripts in addition to Starlark's builtins
+var scriptPredeclared = starlark.StringDict{
+	"json":   json.Module,
+	"reject": starlark.NewBuiltin("reject", scriptReject),
+}
+
+// Compiles a script, which must define a `process` function. The script is read
+// from `filename` unless `src` isn't nil.
+func NewScript(filename string, src interface{}) (*Script, error) {
+	thread := &starlark.Thread{Name: filename, Print: scriptPrint}
+
+	options := &syntax.FileOptions{Set: true, While: true}
+	globals, err := starlark.ExecFileOptions(options, thread, filename, src, scriptPredeclared)
+	if err != nil {
+		return nil, err
+	}
+
+	// Frozen globals can be shared by concurrent calls
+	globals.Freeze()
+
+	process, ok := globals["process"].(starlark.Callable)
+	if !ok {
+		return nil, fmt.Errorf("%s doesn't define a process function", filename)
+	}
+
+	return &Script{name: filename, process: process}, nil
+}
+
+// Calls the script's `process` function with the message, returning the message as
+// the script left it. A `*ScriptRejection` is returned if the script rejected it.
+// Each call is limited by `Config.Scripts`, and `ErrScriptInputTooLarge` is
+// returned without running the script if the message is over `MaxBytes`.
+func (s *Script) Run(m ScriptMessage) (ScriptMessage, error) {
+	config := util.Config.Scripts
+
+	maxSteps := config.MaxSteps
+	if maxSteps == 0 {
+		maxSteps = defaultScriptMaxSteps
+	}
+
+	maxBytes := config.MaxBytes
+	if maxBytes <= 0 {
+		maxBytes = defaultScriptMaxBytes
+	}
+
+	if size := m.size(); size > maxBytes {
+		return m, fmt.Errorf("%w: %d bytes is over %d", ErrScriptInputTooLarge, size, maxBytes)
+	}
+
+	timeout := config.Timeout
+	if timeout <= 0 {
+		timeout = defaultScriptTimeout
+	}
+
+	thread := &starlark.Thread{Name: s.name, Print: scriptPrint}
+	thread.SetMaxExecutionSteps(maxSteps)
+
+	timer := time.AfterFunc(timeout, func() { thread.Cancel("timed out") })
+	defer timer.Stop()
+
+	msg := scriptMessageDict(thread, m)
+	if _, err := starlark.Call(thread, s.process, starlark.Tuple{msg}, nil); err != nil {
+		var rejection *ScriptRejection
+		if errors.As(err, &rejection) {
+			return m, rejection
+		}
+		return m, err
+	}
+
+	out, err := scriptMessage(thread, msg)
+	if err != nil {
+		return m, err
+	} else if size := out.size(); size > maxBytes {
+		return m, fmt.Errorf("script produced a %d byte message, over %d", size, maxBytes)
+	}
+	return out, nil
+}
+
+// Converts the message to the dict passed to scripts. Values that are JSON objects
+// or arrays are decoded, and other values are passed as strings.
+func scriptMessageDict(thread *starlark.Thread, m ScriptMessage) *starlark.Dict {
+	var value starlark.Value = starlark.String(m.Value)
+	if trimmed := bytes.TrimSpace(m.Value); len(trimmed) > 0 && (trimmed[0] == '{' || trimmed[0] == '[') {
+		if decoded, err := starlark.Call(thread, json.Module.Members["decode"], starlark.Tuple{value}, nil); err == nil {
+			value = decoded
+		}
+	}
+
+	headers := starlark.NewDict(len(m.Headers))
+	for k, v := range m.Headers {
+		headers.SetKey(starlark.String(k), starlark.String(v))
+	}
+
+	msg := starlark.NewDict(4)
+	msg.SetKey(starlark.String("topic"), starlark.String(m.Topic))
+	msg.SetKey(starlark.String("key"), starlark.String(m.Key))
+	msg.SetKey(starlark.String("value"), value)
+	msg.SetKey(starlark.String("headers"), headers)
+
+	return msg
+}
+
+// Converts the dict a script was called with back to a message. String values are
+// written as they are, and any other value is encoded as JSON.
+func scriptMessage(thread *starlark.Thread, msg *starlark.Dict) (ScriptMessage, error) {
+	var m ScriptMessage
+
+	get := func(name string) starlark.Value {
+		v, _, _ := msg.Get(starlark.String(name))
+		return v
+	}
+
+	topic, ok := get("topic").(starlark.String)
+	if !ok {
+		return m, fmt.Errorf(`msg["topic"] must be a string`)
+	}
+	m.Topic = string(topic)
+
+	switch key := get("key").(type) {
+	case nil, starlark.NoneType:
+	case starlark.String:
+		m.Key = string(key)
+	default:
+		return m, fmt.Errorf(`msg["key"] must be a string or None`)
+	}
+
+	switch value := get("value").(type) {
+	case nil:
+		return m, fmt.Errorf(`msg["value"] is missing`)
+	case starlark.String:
+		m.Value = []byte(value)
+	default:
+		encoded, err := starlark.Call(thread, json.Module.Members["encode"], starlark.Tuple{value}, nil)
+		if err != nil {
+			return m, fmt.Errorf(`msg["value"] can't be encoded: %w`, err)
+		}
+		m.Value = []byte(encoded.(starlark.String))
+	}
+
+	switch headers := get("headers").(type) {
+	case nil, starlark.NoneType:
+	case *starlark.Dict:
+		m.Headers = make(map[string]string, headers.Len())
+		for _, item := range headers.Items() {
+			k, kok := starlark.AsString(item[0])
+			v, vok := starlark.AsString(item[1])
+			if !kok || !vok {
+				return m, fmt.Errorf(`msg["headers"] must map strings to strings`)
+			}
+			m.Headers[k] = v
+		}
+	default:
+		return m, fmt.Errorf(`msg["headers"] must be a dict`)
+	}
+
+	return m, nil
+}
+
+// Implements `reject(status, message)`, which stops the script and rejects the
+// message with a 4xx status
+func scriptReject(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var status int
+	var message string
+	if err := starlark.UnpackArgs(b.Name(), args, kwargs, "status", &status, "message?", &message); err != nil {
+		return nil, err
+	}
+
+	if status < 400 || status > 499 {
+		return nil, fmt.Errorf("status must be 4xx, got %d", status)
+	} else if message == "" {
+		message = http.StatusText(status)
+	}
+
+	return nil, &ScriptRejection{Status: status, Message: message}
+}
+
+// Logs the output of `print` in scripts
+func scriptPrint(thread *starlark.Thread, msg string) {
+	util.Sugar.Infof("%s: %s", thread.Name, msg)
+}
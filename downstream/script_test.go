@@ -0,0 +1,161 @@
+package downstream_test
+
+import (
+	"beget/downstream"
+	"beget/util"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestScripts(t *testing.T) {
+	util.InitLogging()
+
+	m := downstream.ScriptMessage{
+		Topic:   "orders",
+		Key:     "o1",
+		Value:   []byte(`{"total":5,"items":["a"]}`),
+		Headers: map[string]string{"source": "web"},
+	}
+
+	run := func(t *testing.T, src string, m downstream.ScriptMessage) (downstream.ScriptMessage, error) {
+		script, err := downstream.NewScript("test.star", src)
+		assert.Nil(t, err)
+		return script.Run(m)
+	}
+
+	t.Run("modifies messages", func(t *testing.T) {
+		out, err := run(t, `
+def process(msg):
+    msg["value"]["total"] += 1
+    msg["value"]["items"].append("b")
+    msg["key"] = msg["headers"].pop("source") + "-" + msg["key"]
+    msg["headers"]["scripted"] = "true"
+    msg["topic"] = "orders.big" if msg["value"]["total"] > 5 else msg["topic"]
+`, m)
+
+		assert.Nil(t, err)
+		assert.Equal(t, "orders.big", out.Topic)
+		assert.Equal(t, "web-o1", out.Key)
+		assert.JSONEq(t, `{"total":6,"items":["a","b"]}`, string(out.Value))
+		assert.Equal(t, map[string]string{"scripted": "true"}, out.Headers)
+	})
+
+	t.Run("string values", func(t *testing.T) {
+		out, err := run(t, `
+def process(msg):
+    msg["value"] = msg["value"].upper()
+    msg["key"] = None
+`, downstream.ScriptMessage{Topic: "logs", Key: "k", Value: []byte("hello")})
+
+		assert.Nil(t, err)
+		assert.Equal(t, "HELLO", string(out.Value))
+		assert.Equal(t, "", out.Key)
+	})
+
+	t.Run("rejects messages", func(t *testing.T) {
+		_, err := run(t, `
+def process(msg):
+    if msg["value"]["total"] < 10:
+        reject(422, "total is too low")
+`, m)
+		assert.Equal(t, &downstream.ScriptRejection{Status: 422, Message: "total is too low"}, err)
+
+		_, err = run(t, `
+def process(msg):
+    reject(403)
+`, m)
+		assert.Equal(t, &downstream.ScriptRejection{Status: 403, Message: "Forbidden"}, err)
+
+		_, err = run(t, `
+def process(msg):
+    reject(500, "oops")
+`, m)
+		assert.ErrorContains(t, err, "status must be 4xx, got 500")
+	})
+
+	t.Run("invalid messages", func(t *testing.T) {
+		_, err := run(t, `
+def process(msg):
+    msg["topic"] = 1
+`, m)
+		assert.EqualError(t, err, `msg["topic"] must be a string`)
+
+		_, err = run(t, `
+def process(msg):
+    msg["headers"]["n"] = 1
+`, m)
+		assert.EqualError(t, err, `msg["headers"] must map strings to strings`)
+	})
+
+	t.Run("step limit", func(t *testing.T) {
+		util.Config.Scripts.MaxSteps = 1000
+
+		_, err := run(t, `
+def process(msg):
+    for i in range(10000):
+        pass
+`, m)
+
+		assert.ErrorContains(t, err, "too many steps")
+		util.Config.Scripts.MaxSteps = 0
+	})
+
+	t.Run("size limit", func(t *testing.T) {
+		util.Config.Scripts.MaxBytes = 64
+
+		_, err := run(t, `
+def process(msg):
+    pass
+`, downstream.ScriptMessage{Topic: "orders", Value: []byte(strings.Repeat("a", 64))})
+		assert.ErrorIs(t, err, downstream.ErrScriptInputTooLarge)
+
+		_, err = run(t, `
+def process(msg):
+    msg["key"] = msg["key"] * 64
+`, m)
+		assert.ErrorContains(t, err, "over 64")
+
+		util.Config.Scripts.MaxBytes = 0
+	})
+
+	t.Run("timeout", func(t *testing.T) {
+		util.Config.Scripts.MaxSteps = 1 << 40
+		util.Config.Scripts.Timeout = 10 * time.Millisecond
+
+		start := time.Now()
+		_, err := run(t, `
+def process(msg):
+    while True:
+        pass
+`, m)
+
+		assert.ErrorContains(t, err, "timed out")
+		assert.Less(t, time.Since(start), time.Second)
+		util.Config.Scripts = util.ScriptConfig{}
+	})
+
+	t.Run("invalid scripts", func(t *testing.T) {
+		_, err := downstream.NewScript("test.star", "x = 1")
+		assert.EqualError(t, err, "test.star doesn't define a process function")
+
+		_, err = downstream.NewScript("test.star", "def process(msg):\n  return msg[")
+		assert.ErrorContains(t, err, "test.star:2")
+
+		util.Config.Kafka.Topics = map[string]util.TopicConfig{"foo": {Script: "testdata/missing.star"}}
+		err = downstream.Init()
+		assert.ErrorContains(t, err, "topic foo: invalid script")
+	})
+
+	t.Run("topic scripts", func(t *testing.T) {
+		util.Config.Kafka.Topics = map[string]util.TopicConfig{"foo": {Script: "testdata/order.star"}}
+
+		assert.Nil(t, downstream.Init())
+		assert.NotNil(t, downstream.SettingsFor("foo").Script)
+	})
+
+	// Reset config
+	util.Config.Kafka.Topics = nil
+}
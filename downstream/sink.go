@@ -0,0 +1,332 @@
+// Functions associated with the sinks messages are produced to
+//
+// Author: Kirk Morales
+// Copyright 2022. All Rights Reserved.
+
+package downstream
+
+import (
+	"beget/util"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+)
+
+// A destination messages are produced to
+type Sink interface {
+	// Writes a single message
+	Produce(ctx context.Context, m kafka.Message) error
+
+	// Writes messages in a single call. When more than one message is written,
+	// failures are reported as `kafka.WriteErrors` with an entry per message.
+	ProduceBatch(ctx context.Context, ms []kafka.Message) error
+
+	// Releases the sink's resources
+	Close() error
+
+	// Returns an error if the sink can't currently accept messages
+	Health(ctx context.Context) error
+}
+
+// A sink that can write several messages atomically
+type TransactionalSink interface {
+	Sink
+
+	// Writes the messages so that either all of them are written or, if an error
+	// is returned, none are
+	ProduceTransaction(ctx context.Context, ms []kafka.Message) error
+}
+
+// The sink topics are written to unless their settings name another
+var DefaultSink Sink = newStdoutSink()
+
+// Sinks by name, including the built-in "kafka", "stdout" and "memory" sinks
+var Sinks map[string]Sink
+
+// Creates the built-in sinks and those in `Config.Sinks`, closing any created
+// before
+func initSinks() error {
+	if err := closeSinks(); err != nil {
+		return fmt.Errorf("failed to close sinks: %w", err)
+	}
+
+	stdout := newStdoutSink()
+
+	// Debug mode never connects to Kafka
+	var kafkaSink Sink = stdout
+	if util.Config.App.Mode == util.ReleaseMode {
+		kafkaSink = &kafkaWriterSink{}
+	}
+
+	Sinks = map[string]Sink{
+		"kafka":  kafkaSink,
+		"stdout": stdout,
+		"memory": NewMemorySink(),
+	}
+
+	for name, config := range util.Config.Sinks {
+		var sink Sink
+		switch strings.ToLower(config.Type) {
+		case "kafka", "stdout":
+			sink = Sinks[strings.ToLower(config.Type)]
+		case "memory":
+			sink = NewMemorySink()
+		case "file":
+			var err error
+			if sink, err = newFileSink(config); err != nil {
+				return fmt.Errorf("sink %s: %w", name, err)
+			}
+		default:
+			return fmt.Errorf("sink %s: invalid type %q", name, config.Type)
+		}
+		Sinks[name] = sink
+	}
+
+	DefaultSink = kafkaSink
+
+	return nil
+}
+
+// Returns the sink the topic is written to
+func SinkFor(topic string) Sink {
+	if name := SettingsFor(topic).Sink; name != "" {
+		if sink, ok := Sinks[name]; ok {
+			return sink
+		}
+	}
+	return DefaultSink
+}
+
+// Writes the message to its topic's sink
+func Produce(ctx context.Context, m kafka.Message) error {
+	return SinkFor(m.Topic).Produce(ctx, m)
+}
+
+// Writes the messages to their topics' sinks, writing to each sink concurrently.
+// When more than one message is written, failures are reported as `kafka.WriteErrors`
+// with an entry per message.
+func ProduceBatch(ctx context.Context, ms []kafka.Message) error {
+	return writeGroups(ctx, ms,
+		func(m kafka.Message) []Sink { return []Sink{SinkFor(m.Topic)} },
+		func(ctx context.Context, sink Sink, ms []kafka.Message) error { return sink.ProduceBatch(ctx, ms) },
+	)
+}
+
+// Writes the messages, which may span several topics, atomically: either all of
+// them are written or, if an error is returned, none are. Every topic must be
+// written to the same sink, which must support transactions.
+func ProduceTransaction(ctx context.Context, ms []kafka.Message) error {
+	if len(ms) == 0 {
+		return nil
+	}
+
+	sink := SinkFor(ms[0].Topic)
+	for _, m := range ms[1:] {
+		if SinkFor(m.Topic) != sink {
+			return fmt.Errorf("%w: topics are written to different sinks", ErrTransactionAborted)
+		}
+	}
+
+	ts, ok := sink.(TransactionalSink)
+	if !ok {
+		return fmt.Errorf("%w: sink doesn't support transactions", ErrTransactionAborted)
+	}
+	return ts.ProduceTransaction(ctx, ms)
+}
+
+// Checks the health of every sink topics may be written to, returning the errors
+// of unhealthy sinks by name
+func Health(ctx context.Context) map[string]error {
+	errs := make(map[string]error)
+	for name, sink := range Sinks {
+		if err := sink.Health(ctx); err != nil {
+			errs[name] = err
+		}
+	}
+	return errs
+}
+
+// Closes every sink, closing sinks known by several names once
+func closeSinks() error {
+	var errs []error
+	closed := make(map[Sink]bool)
+	for _, sink := range Sinks {
+		if !closed[sink] {
+			closed[sink] = true
+			errs = append(errs, sink.Close())
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Writes messages that belong to different groups, writing each group's messages
+// concurrently. A message may belong to several groups and fails if any of its
+// writes do. Failures are reported the same way as `ProduceBatch`.
+func writeGroups[K comparable](ctx context.Context, ms []kafka.Message, groupsOf func(kafka.Message) []K, write func(context.Context, K, []kafka.Message) error) error {
+	if len(ms) == 0 {
+		return nil
+	}
+
+	indexes := make(map[K][]int)
+	for i, m := range ms {
+		for _, k := range groupsOf(m) {
+			indexes[k] = append(indexes[k], i)
+		}
+	}
+
+	// Most batches only need a single group
+	if len(indexes) == 1 {
+		for k := range indexes {
+			return write(ctx, k, ms)
+		}
+	}
+
+	errs := make(kafka.WriteErrors, len(ms))
+	failed := false
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for k, is := range indexes {
+		group := make([]kafka.Message, len(is))
+		for j, i := range is {
+			group[j] = ms[i]
+		}
+
+		wg.Add(1)
+		go func(k K, is []int) {
+			defer wg.Done()
+
+			err := write(ctx, k, group)
+			if err == nil {
+				return
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+			failed = true
+
+			var werrs kafka.WriteErrors
+			for j, i := range is {
+				if errs[i] != nil {
+					// Already failed in another group
+					continue
+				} else if errors.As(err, &werrs) && len(werrs) == len(is) {
+					errs[i] = werrs[j]
+				} else {
+					errs[i] = err
+				}
+			}
+		}(k, is)
+	}
+	wg.Wait()
+
+	if !failed {
+		return nil
+	} else if len(ms) == 1 {
+		return errs[0]
+	}
+	return errs
+}
+
+// Returns the error for a batch of messages that all failed with `err`
+func batchError(err error, n int) error {
+	if err == nil || n == 1 {
+		return err
+	}
+
+	errs := make(kafka.WriteErrors, n)
+	for i := range errs {
+		errs[i] = err
+	}
+	return errs
+}
+
+// A message as written by the file and stdout sinks
+type sinkRecord struct {
+	Topic     string            `json:"topic"`
+	Key       string            `json:"key,omitempty"`
+	Value     json.RawMessage   `json:"value"`
+	Headers   map[string]string `json:"headers,omitempty"`
+	Timestamp time.Time         `json:"timestamp"`
+}
+
+// Encodes the messages as JSON, one object per line. Values that are valid JSON
+// are written as-is and anything else is written as a string.
+func encodeRecords(ms []kafka.Message) []byte {
+	var b []byte
+	for _, m := range ms {
+		record := sinkRecord{
+			Topic:     m.Topic,
+			Key:       string(m.Key),
+			Value:     m.Value,
+			Timestamp: m.Time,
+		}
+
+		if record.Timestamp.IsZero() {
+			record.Timestamp = time.Now().UTC()
+		}
+
+		if !json.Valid(m.Value) {
+			record.Value, _ = json.Marshal(string(m.Value))
+		}
+
+		if len(m.Headers) > 0 {
+			record.Headers = make(map[string]string, len(m.Headers))
+			for _, h := range m.Headers {
+				record.Headers[h.Key] = string(h.Value)
+			}
+		}
+
+		line, _ := json.Marshal(record)
+		b = append(append(b, line...), '\n')
+	}
+	return b
+}
+
+// Writes messages to standard output, one JSON object per line
+type stdoutSink struct {
+	mu  sync.Mutex
+	out *os.File
+}
+
+func newStdoutSink() *stdoutSink {
+	return &stdoutSink{out: os.Stdout}
+}
+
+func (s *stdoutSink) Produce(ctx context.Context, m kafka.Message) error {
+	return s.write([]kafka.Message{m})
+}
+
+func (s *stdoutSink) ProduceBatch(ctx context.Context, ms []kafka.Message) error {
+	return batchError(s.write(ms), len(ms))
+}
+
+func (s *stdoutSink) ProduceTransaction(ctx context.Context, ms []kafka.Message) error {
+	if err := s.write(ms); err != nil {
+		return fmt.Errorf("%w: %v", ErrTransactionAborted, err)
+	}
+	return nil
+}
+
+func (s *stdoutSink) write(ms []kafka.Message) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	_, err := s.out.Write(encodeRecords(ms))
+	return err
+}
+
+func (s *stdoutSink) Close() error {
+	return nil
+}
+
+func (s *stdoutSink) Health(ctx context.Context) error {
+	return nil
+}
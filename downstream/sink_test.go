@@ -0,0 +1,190 @@
+package downstream_test
+
+import (
+	"beget/downstream"
+	"beget/util"
+	"bufio"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/segmentio/kafka-go"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSinks(t *testing.T) {
+	dir := t.TempDir()
+	ctx := context.Background()
+
+	util.Config.App.Mode = util.DebugMode
+	util.Config.Kafka.Topics = map[string]util.TopicConfig{
+		"events": {},
+		"audit":  {Sink: "audit_log"},
+		"tests":  {Sink: "memory"},
+	}
+	util.Config.Sinks = map[string]util.SinkConfig{
+		"audit_log": {Type: "file", Path: filepath.Join(dir, "audit.log"), MaxBytes: 200, MaxFiles: 2},
+	}
+
+	t.Run("selects sinks per topic", func(t *testing.T) {
+		err := downstream.Init()
+		assert.Nil(t, err)
+
+		// Debug mode writes Kafka topics to stdout
+		assert.Same(t, downstream.Sinks["stdout"], downstream.DefaultSink)
+		assert.Same(t, downstream.DefaultSink, downstream.SinkFor("events"))
+		assert.Same(t, downstream.Sinks["audit_log"], downstream.SinkFor("audit"))
+		assert.Same(t, downstream.Sinks["memory"], downstream.SinkFor("tests"))
+
+		assert.True(t, downstream.Transactional("audit"))
+		assert.Empty(t, downstream.Health(ctx))
+	})
+
+	t.Run("batches span sinks", func(t *testing.T) {
+		memory := downstream.Sinks["memory"].(*downstream.MemorySink)
+		memory.Fail = func(m kafka.Message) error {
+			if string(m.Value) == "fail" {
+				return errors.New("write failed")
+			}
+			return nil
+		}
+
+		err := downstream.ProduceBatch(ctx, []kafka.Message{
+			{Topic: "tests", Value: []byte("a")},
+			{Topic: "audit", Key: []byte("k"), Value: []byte(`{"id":1}`)},
+			{Topic: "tests", Value: []byte("fail")},
+		})
+
+		assert.Equal(t, kafka.WriteErrors{nil, nil, errors.New("write failed")}, err)
+		assert.Equal(t, []kafka.Message{{Topic: "tests", Value: []byte("a")}}, memory.Messages())
+
+		lines := readLines(t, filepath.Join(dir, "audit.log"))
+		assert.Len(t, lines, 1)
+		assert.Contains(t, lines[0], `"topic":"audit","key":"k","value":{"id":1}`)
+	})
+
+	t.Run("transactions are all or nothing", func(t *testing.T) {
+		memory := downstream.Sinks["memory"].(*downstream.MemorySink)
+		memory.Reset()
+
+		err := downstream.ProduceTransaction(ctx, []kafka.Message{
+			{Topic: "tests", Value: []byte("a")},
+			{Topic: "tests", Value: []byte("fail")},
+		})
+
+		assert.ErrorIs(t, err, downstream.ErrTransactionAborted)
+		assert.Empty(t, memory.Messages())
+
+		err = downstream.ProduceTransaction(ctx, []kafka.Message{
+			{Topic: "tests", Value: []byte("a")},
+			{Topic: "audit", Value: []byte("b")},
+		})
+
+		assert.ErrorIs(t, err, downstream.ErrTransactionAborted)
+		assert.Empty(t, memory.Messages())
+	})
+
+	t.Run("rotates files", func(t *testing.T) {
+		for _, value := range []string{"one", "two", "three", "four"} {
+			err := downstream.Produce(ctx, kafka.Message{Topic: "audit", Value: []byte(value)})
+			assert.Nil(t, err)
+		}
+
+		// Each record is over 80 bytes, so every file holds two at most and only
+		// two rotated files are kept
+		assert.Len(t, readLines(t, filepath.Join(dir, "audit.log")), 1)
+		assert.Len(t, readLines(t, filepath.Join(dir, "audit.log.1")), 2)
+		assert.Len(t, readLines(t, filepath.Join(dir, "audit.log.2")), 2)
+		assert.NoFileExists(t, filepath.Join(dir, "audit.log.3"))
+	})
+
+	t.Run("failed rotations keep the file open", func(t *testing.T) {
+		// A directory in the way of the oldest file stops it from being replaced
+		oldest := filepath.Join(dir, "audit.log.2")
+		assert.Nil(t, os.Remove(oldest))
+		assert.Nil(t, os.MkdirAll(filepath.Join(oldest, "blocked"), 0o755))
+
+		err := downstream.Produce(ctx, kafka.Message{Topic: "audit", Value: []byte("five")})
+		assert.Nil(t, err)
+		err = downstream.Produce(ctx, kafka.Message{Topic: "audit", Value: []byte("six")})
+		assert.ErrorContains(t, err, "failed to rotate")
+		assert.Nil(t, downstream.Sinks["audit_log"].Health(ctx))
+
+		// Once the directory is gone, rotation succeeds again
+		assert.Nil(t, os.RemoveAll(oldest))
+		err = downstream.Produce(ctx, kafka.Message{Topic: "audit", Value: []byte("seven")})
+		assert.Nil(t, err)
+		assert.Len(t, readLines(t, filepath.Join(dir, "audit.log")), 1)
+		assert.Len(t, readLines(t, filepath.Join(dir, "audit.log.1")), 2)
+	})
+
+	t.Run("reinitializing closes sinks", func(t *testing.T) {
+		previous := downstream.Sinks["audit_log"]
+
+		err := downstream.Init()
+		assert.Nil(t, err)
+
+		assert.NotSame(t, previous, downstream.Sinks["audit_log"])
+		assert.ErrorIs(t, previous.Health(ctx), os.ErrClosed)
+		assert.Nil(t, downstream.Sinks["audit_log"].Health(ctx))
+	})
+
+	t.Run("closed sinks are unhealthy", func(t *testing.T) {
+		err := downstream.Close()
+		assert.Nil(t, err)
+
+		errs := downstream.Health(ctx)
+		assert.Equal(t, map[string]error{"audit_log": os.ErrClosed}, errs)
+
+		err = downstream.Produce(ctx, kafka.Message{Topic: "audit", Value: []byte("a")})
+		assert.ErrorIs(t, err, os.ErrClosed)
+	})
+
+	t.Run("invalid sinks", func(t *testing.T) {
+		tests := []struct {
+			name   string
+			sinks  map[string]util.SinkConfig
+			topics map[string]util.TopicConfig
+			err    string
+		}{
+			{"invalid type", map[string]util.SinkConfig{"s3": {Type: "s3"}}, nil, `sink s3: invalid type "s3"`},
+			{"missing path", map[string]util.SinkConfig{"log": {Type: "file"}}, nil, "sink log: missing path"},
+			{"unknown sink", nil, map[string]util.TopicConfig{"foo": {Sink: "log"}}, `topic foo: unknown sink "log"`},
+		}
+
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				util.Config.Sinks = tt.sinks
+				util.Config.Kafka.Topics = tt.topics
+				if tt.topics == nil {
+					util.Config.Kafka.Topics = map[string]util.TopicConfig{"foo": {}}
+				}
+
+				err := downstream.Init()
+
+				assert.EqualError(t, err, tt.err)
+			})
+		}
+	})
+
+	// Reset config
+	util.Config.Sinks = nil
+	util.Config.Kafka.Topics = nil
+	downstream.Sinks = nil
+}
+
+// Returns the lines of the file
+func readLines(t *testing.T, path string) []string {
+	file, err := os.Open(path)
+	assert.Nil(t, err)
+	defer file.Close()
+
+	var lines []string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+	}
+	return lines
+}
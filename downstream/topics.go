@@ -0,0 +1,300 @@
+// Functions associated with per-topic settings
+//
+// Author: Kirk Morales
+// Copyright 2022. All Rights Reserved.
+
+package downstream
+
+import (
+	"beget/util"
+	"fmt"
+	"math"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/santhosh-tekuri/jsonschema/v5"
+	"github.com/segmentio/kafka-go"
+	"golang.org/x/time/rate"
+)
+
+// The settings of a topic, parsed from `Config.Kafka.Topics`
+type TopicSettings struct {
+	util.TopicConfig
+
+	Schema  *jsonschema.Schema // The compiled schema, or nil if values aren't validated
+	Limiter *rate.Limiter      // The topic's rate limiter, or nil if it isn't rate limited
+	Script  *Script            // The compiled script, or nil if the topic doesn't have one
+	Rules   []*Rule            // The compiled rules
+
+	transforms []transform
+	redactions []redaction
+}
+
+// Settings by topic name, for topics that have any
+var KafkaTopicSettings map[string]*TopicSettings
+
+// Topic names by alias
+var KafkaTopicAliases map[string]string
+
+// A configured topic pattern. Its settings and writer are stored under the pattern itself.
+type topicPattern struct {
+	pattern string
+	re      *regexp.Regexp
+}
+
+// Topic patterns, in order of precedence
+var kafkaTopicPatterns []topicPattern
+
+// Parses the configured topics and their settings
+func initTopics() error {
+	KafkaTopics = make(map[string]struct{})
+	KafkaTopicSettings = make(map[string]*TopicSettings)
+	KafkaTopicAliases = make(map[string]string)
+	kafkaTopicPatterns = nil
+
+	for key, config := range util.Config.Kafka.Topics {
+		topic := config.TopicName(key)
+
+		re, err := parseTopicPattern(topic)
+		if err != nil {
+			return fmt.Errorf("topic %s: %w", topic, err)
+		} else if re != nil {
+			if config.Alias != "" {
+				return fmt.Errorf("topic %s: patterns can't have an alias", topic)
+			}
+			kafkaTopicPatterns = append(kafkaTopicPatterns, topicPattern{topic, re})
+		} else {
+			KafkaTopics[topic] = struct{}{}
+		}
+
+		settings, err := parseTopicSettings(config)
+		if err != nil {
+			return fmt.Errorf("topic %s: %w", topic, err)
+		}
+		KafkaTopicSettings[topic] = settings
+
+		if config.Alias != "" {
+			if other, ok := KafkaTopicAliases[config.Alias]; ok {
+				return fmt.Errorf("topics %s and %s have the same alias", other, topic)
+			}
+			KafkaTopicAliases[config.Alias] = topic
+		}
+	}
+
+	// The first matching pattern wins, so put the most specific first: those with
+	// the longest literal prefix, then the longest patterns, then alphabetically
+	sort.Slice(kafkaTopicPatterns, func(i, j int) bool {
+		a, b := kafkaTopicPatterns[i], kafkaTopicPatterns[j]
+		prefixA, _ := a.re.LiteralPrefix()
+		prefixB, _ := b.re.LiteralPrefix()
+		if len(prefixA) != len(prefixB) {
+			return len(prefixA) > len(prefixB)
+		} else if len(a.pattern) != len(b.pattern) {
+			return len(a.pattern) > len(b.pattern)
+		}
+		return a.pattern < b.pattern
+	})
+
+	return nil
+}
+
+// Compiles a topic name that's a glob pattern or a regular expression wrapped in
+// slashes. Returns nil for plain topic names.
+func parseTopicPattern(name string) (*regexp.Regexp, error) {
+	var expr string
+	if len(name) > 2 && strings.HasPrefix(name, "/") && strings.HasSuffix(name, "/") {
+		expr = name[1 : len(name)-1]
+	} else if strings.ContainsAny(name, "*?") {
+		var b strings.Builder
+		for _, r := range name {
+			switch r {
+			case '*':
+				b.WriteString(".*")
+			case '?':
+				b.WriteString(".")
+			default:
+				b.WriteString(regexp.QuoteMeta(string(r)))
+			}
+		}
+		expr = b.String()
+	} else {
+		return nil, nil
+	}
+
+	re, err := regexp.Compile("^(?:" + expr + ")$")
+	if err != nil {
+		return nil, fmt.Errorf("invalid pattern: %w", err)
+	}
+	return re, nil
+}
+
+// Returns the configured topic or pattern that covers the topic, and whether there is one
+func topicKey(topic string) (string, bool) {
+	if _, ok := KafkaTopics[topic]; ok {
+		return topic, true
+	}
+	for _, p := range kafkaTopicPatterns {
+		if p.re.MatchString(topic) {
+			return p.pattern, true
+		}
+	}
+	return "", false
+}
+
+// Returns whether the topic may be produced to. Topics that are only allowed by a
+// pattern must also exist, unless they'd be created automatically.
+func Producible(topic string) bool {
+	if _, ok := KafkaTopics[topic]; ok {
+		return true
+	} else if _, ok := topicKey(topic); !ok {
+		return false
+	}
+
+	return util.Config.App.Mode == util.DebugMode || autoCreates(SettingsFor(topic).Cluster) || topicDiscovered(topic)
+}
+
+// Validates a topic's settings, compiling its schema, script and rules and creating
+// its rate limiter
+func parseTopicSettings(config util.TopicConfig) (*TopicSettings, error) {
+	settings := &TopicSettings{TopicConfig: config}
+
+	if _, err := parseCompression(config.Compression); err != nil {
+		return nil, err
+	} else if _, err := parseBalancer(config.Balancer); err != nil {
+		return nil, err
+	} else if err := checkTopicClusters(config); err != nil {
+		return nil, err
+	}
+
+	if _, ok := Sinks[config.Sink]; config.Sink != "" && !ok {
+		return nil, fmt.Errorf("unknown sink %q", config.Sink)
+	}
+
+	if config.Schema != "" {
+		schema, err := jsonschema.Compile(config.Schema)
+		if err != nil {
+			return nil, fmt.Errorf("invalid schema: %w", err)
+		}
+		settings.Schema = schema
+	}
+
+	var err error
+	if settings.transforms, err = parseTransforms(config.Transforms); err != nil {
+		return nil, err
+	}
+
+	if config.Script != "" {
+		if settings.Script, err = NewScript(config.Script, nil); err != nil {
+			return nil, fmt.Errorf("invalid script: %w", err)
+		}
+	}
+
+	if settings.Rules, err = parseRules(config.Rules); err != nil {
+		return nil, err
+	} else if settings.redactions, err = parseRedactions(config.Redact); err != nil {
+		return nil, err
+	}
+
+	if config.RateLimit > 0 {
+		burst := config.RateBurst
+		if burst <= 0 {
+			burst = int(math.Ceil(config.RateLimit))
+		}
+		settings.Limiter = rate.NewLimiter(rate.Limit(config.RateLimit), burst)
+	}
+
+	return settings, nil
+}
+
+// Returns the name of the topic that clients refer to by `name`, and whether it's
+// producible. Topics that have an alias may only be referred to by their alias.
+func ResolveTopic(name string) (string, bool) {
+	if topic, ok := KafkaTopicAliases[name]; ok {
+		return topic, true
+	}
+
+	if !Producible(name) {
+		return "", false
+	} else if s := KafkaTopicSettings[name]; s != nil && s.Alias != "" {
+		return "", false
+	}
+
+	return name, true
+}
+
+// Returns the settings for the topic, which topics matching a pattern share with
+// each other. Topics without settings get the zero value.
+func SettingsFor(topic string) *TopicSettings {
+	if key, ok := topicKey(topic); ok {
+		if s, ok := KafkaTopicSettings[key]; ok {
+			return s
+		}
+	}
+	return &TopicSettings{}
+}
+
+// Returns whether the topic's writer options differ from the defaults, so it needs its own writer
+func (s *TopicSettings) customWriter() bool {
+	return s.RequiredAcks != nil || s.Compression != "" || s.Balancer != ""
+}
+
+// Returns the balancer with the given name
+func parseBalancer(name string) (kafka.Balancer, error) {
+	switch strings.ToLower(name) {
+	case "", "least_bytes":
+		return &kafka.LeastBytes{}, nil
+	case "round_robin":
+		return &kafka.RoundRobin{}, nil
+	case "hash":
+		return &kafka.Hash{}, nil
+	case "crc32":
+		return &kafka.CRC32Balancer{}, nil
+	case "murmur2":
+		return &kafka.Murmur2Balancer{}, nil
+	default:
+		return nil, fmt.Errorf("invalid balancer %q", name)
+	}
+}
+
+// Routes by logical name
+var KafkaRoutes map[string]util.RouteConfig
+
+// Parses the configured routes, checking that they only route to allowed topics
+func initRoutes() error {
+	KafkaRoutes = make(map[string]util.RouteConfig)
+
+	for _, route := range util.Config.Routes {
+		if route.Name == "" {
+			return fmt.Errorf("route is missing a name")
+		} else if _, ok := KafkaRoutes[route.Name]; ok {
+			return fmt.Errorf("route %s is defined more than once", route.Name)
+		}
+
+		topics := make([]string, 0, len(route.Rules)+1)
+		for _, rule := range route.Rules {
+			topics = append(topics, rule.Topic)
+		}
+		if route.Default != "" {
+			topics = append(topics, route.Default)
+		}
+
+		for _, topic := range topics {
+			if _, ok := topicKey(topic); !ok {
+				return fmt.Errorf("route %s: unknown topic %q", route.Name, topic)
+			}
+		}
+
+		KafkaRoutes[route.Name] = route
+	}
+
+	// Events aren't run through scripts, so they can't be written to topics that
+	// may rely on a script to check messages
+	for _, route := range util.Config.CloudEvents.Routes {
+		if SettingsFor(route.Topic).Script != nil {
+			return fmt.Errorf("cloudevents route to %s: topics with a script can't receive events", route.Topic)
+		}
+	}
+
+	return nil
+}
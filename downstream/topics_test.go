@@ -0,0 +1,161 @@
+package downstream_test
+
+import (
+	"beget/downstream"
+	"beget/util"
+	"testing"
+
+	"github.com/segmentio/kafka-go"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTopicSettings(t *testing.T) {
+	util.Config.App.Mode = util.ReleaseMode
+	util.Config.Kafka.Brokers = []string{"broker.foo.com"}
+
+	t.Run("parses settings", func(t *testing.T) {
+		acks := kafka.RequireAll
+		util.Config.Kafka.Topics = map[string]util.TopicConfig{
+			"foo": {},
+			"orders_v1": {
+				Name:         "Orders.v1",
+				Alias:        "orders",
+				Schema:       "testdata/order.schema.json",
+				RateLimit:    2.5,
+				RequiredAcks: &acks,
+				Balancer:     "murmur2",
+			},
+		}
+
+		err := downstream.Init()
+
+		assert.Nil(t, err)
+		assert.EqualValues(t, map[string]struct{}{"foo": {}, "Orders.v1": {}}, downstream.KafkaTopics)
+		assert.Equal(t, map[string]string{"orders": "Orders.v1"}, downstream.KafkaTopicAliases)
+
+		settings := downstream.SettingsFor("Orders.v1")
+		assert.NotNil(t, settings.Schema)
+		assert.NotNil(t, settings.Limiter)
+		assert.Equal(t, 3, settings.Limiter.Burst())
+
+		// Only the topic that overrides writer options gets its own writer
+		assert.Len(t, downstream.KafkaTopicWriters, 1)
+		w := downstream.KafkaTopicWriters["Orders.v1"]
+		assert.Equal(t, kafka.RequireAll, w.RequiredAcks)
+		assert.IsType(t, &kafka.Murmur2Balancer{}, w.Balancer)
+		assert.IsType(t, &kafka.LeastBytes{}, downstream.KafkaWriter.Balancer)
+
+		assert.Nil(t, downstream.SettingsFor("foo").Schema)
+		assert.Nil(t, downstream.SettingsFor("bar").Limiter)
+
+		assert.Nil(t, downstream.Close())
+	})
+
+	t.Run("resolves aliases", func(t *testing.T) {
+		topic, ok := downstream.ResolveTopic("orders")
+		assert.True(t, ok)
+		assert.Equal(t, "Orders.v1", topic)
+
+		topic, ok = downstream.ResolveTopic("foo")
+		assert.True(t, ok)
+		assert.Equal(t, "foo", topic)
+
+		// Topics with an alias are only exposed by their alias
+		_, ok = downstream.ResolveTopic("Orders.v1")
+		assert.False(t, ok)
+
+		_, ok = downstream.ResolveTopic("bar")
+		assert.False(t, ok)
+	})
+
+	t.Run("invalid balancer", func(t *testing.T) {
+		util.Config.Kafka.Topics = map[string]util.TopicConfig{"foo": {Balancer: "random"}}
+
+		err := downstream.Init()
+
+		assert.EqualError(t, err, `topic foo: invalid balancer "random"`)
+	})
+
+	t.Run("invalid schema", func(t *testing.T) {
+		util.Config.Kafka.Topics = map[string]util.TopicConfig{"foo": {Schema: "testdata/missing.json"}}
+
+		err := downstream.Init()
+
+		assert.ErrorContains(t, err, "topic foo: invalid schema")
+	})
+
+	t.Run("duplicate alias", func(t *testing.T) {
+		util.Config.Kafka.Topics = map[string]util.TopicConfig{"foo": {Alias: "x"}, "bar": {Alias: "x"}}
+
+		err := downstream.Init()
+
+		assert.ErrorContains(t, err, "have the same alias")
+	})
+
+	// Reset config
+	util.Config.App.Mode = util.DebugMode
+	util.Config.Kafka.Topics = nil
+	util.Config.Kafka.Brokers = []string{}
+}
+
+func TestRoutes(t *testing.T) {
+	util.Config.Kafka.Topics = map[string]util.TopicConfig{"events.eu": {}, "events.us": {}}
+
+	t.Run("parses routes", func(t *testing.T) {
+		util.Config.Routes = []util.RouteConfig{{
+			Name:    "events",
+			Rules:   []util.RouteRule{{Field: "region", Match: "eu", Topic: "events.eu"}},
+			Default: "events.us",
+		}}
+
+		err := downstream.Init()
+
+		assert.Nil(t, err)
+		assert.Equal(t, map[string]util.RouteConfig{"events": util.Config.Routes[0]}, downstream.KafkaRoutes)
+	})
+
+	t.Run("unknown topic", func(t *testing.T) {
+		util.Config.Routes = []util.RouteConfig{{
+			Name:  "events",
+			Rules: []util.RouteRule{{Field: "region", Match: "eu", Topic: "events.de"}},
+		}}
+
+		err := downstream.Init()
+
+		assert.EqualError(t, err, `route events: unknown topic "events.de"`)
+	})
+
+	t.Run("missing name", func(t *testing.T) {
+		util.Config.Routes = []util.RouteConfig{{Default: "events.us"}}
+
+		err := downstream.Init()
+
+		assert.EqualError(t, err, "route is missing a name")
+	})
+
+	t.Run("duplicate name", func(t *testing.T) {
+		util.Config.Routes = []util.RouteConfig{{Name: "events", Default: "events.us"}, {Name: "events", Default: "events.eu"}}
+
+		err := downstream.Init()
+
+		assert.EqualError(t, err, "route events is defined more than once")
+	})
+
+	t.Run("events routed to scripted topics", func(t *testing.T) {
+		util.Config.Routes = nil
+		util.Config.Kafka.Topics = map[string]util.TopicConfig{"events.eu": {}, "orders": {Script: "testdata/order.star"}}
+		util.Config.CloudEvents.Routes = []util.CloudEventRoute{{Type: "com.example.*", Topic: "orders"}}
+
+		err := downstream.Init()
+
+		assert.EqualError(t, err, "cloudevents route to orders: topics with a script can't receive events")
+
+		util.Config.CloudEvents.Routes = []util.CloudEventRoute{{Type: "com.example.*", Topic: "events.eu"}}
+		assert.Nil(t, downstream.Init())
+	})
+
+	// Reset config
+	util.Config.Routes = nil
+	util.Config.CloudEvents.Routes = nil
+	util.Config.Kafka.Topics = nil
+}
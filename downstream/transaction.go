@@ -0,0 +1,274 @@
+// Functions associated with transactional Kafka production
+//
+// Author: Kirk Morales
+// Copyright 2022. All Rights Reserved.
+
+package downstream
+
+import (
+	"beget/util"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+)
+
+// How long a transaction may stay open before the broker aborts it, unless configured
+const defaultTransactionTimeout = time.Minute
+
+// Returned when the transaction was aborted and none of its messages were written
+var ErrTransactionAborted = errors.New("transaction aborted")
+
+// Writes messages within Kafka transactions using this instance's transactional ID.
+// Only one transaction may be open per transactional ID, so transactions are serialized.
+type transactionalProducer struct {
+	mu        sync.Mutex
+	cluster   *cluster // Transactions are only written to the default cluster
+	client    *kafka.Client
+	id        string
+	timeout   time.Duration
+	balancer  kafka.Hash
+	producer  *kafka.ProducerSession // nil until initialized, or after a failure
+	sequences map[topicPartition]int32
+}
+
+type topicPartition struct {
+	topic     string
+	partition int
+}
+
+var transactions *transactionalProducer
+
+// Sets up the transactional producer. The producer ID is requested lazily, when
+// the first transaction begins.
+func initTransactions() {
+	id := util.Config.Kafka.TransactionalID
+	if id == "" {
+		hostname, _ := os.Hostname()
+		id = "beget-" + hostname
+	}
+
+	timeout := util.Config.Kafka.TransactionTimeout
+	if timeout <= 0 {
+		timeout = defaultTransactionTimeout
+	}
+
+	transactions = &transactionalProducer{
+		cluster: getDefaultCluster(),
+		client:  getDefaultCluster().client(timeout),
+		id:      id,
+		timeout: timeout,
+	}
+}
+
+// Returns whether the topic may be written in a transaction. Kafka transactions only
+// span the default cluster, so topics on other clusters or mirrored to one can't be.
+func Transactional(topic string) bool {
+	switch sink := SinkFor(topic).(type) {
+	case *kafkaWriterSink:
+		settings := SettingsFor(topic)
+		return clusterName(settings.Cluster) == defaultCluster && settings.Mirror == ""
+	default:
+		_, ok := sink.(TransactionalSink)
+		return ok
+	}
+}
+
+// Writes the messages in a single transaction, aborting it on failure
+func (p *transactionalProducer) produce(ctx context.Context, ms []kafka.Message) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if err := p.init(ctx); err != nil {
+		return fmt.Errorf("%w: failed to initialize producer: %v", ErrTransactionAborted, err)
+	}
+
+	leaders, batches, err := p.assign(ctx, ms)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrTransactionAborted, err)
+	}
+
+	if err := p.begin(ctx, batches); err != nil {
+		p.abort()
+		return fmt.Errorf("%w: %v", ErrTransactionAborted, err)
+	}
+
+	for addr, bs := range leaders {
+		if err := writeTransactional(ctx, p.cluster, addr, p.id, p.producer, p.timeout, bs); err != nil {
+			p.abort()
+			return fmt.Errorf("%w: %v", ErrTransactionAborted, err)
+		}
+	}
+
+	if err := p.end(ctx, true); err != nil {
+		// The outcome is unknown if the commit itself failed, so make sure it's aborted
+		p.abort()
+		return fmt.Errorf("%w: failed to commit: %v", ErrTransactionAborted, err)
+	}
+
+	for _, b := range batches {
+		p.sequences[topicPartition{b.topic, b.partition}] += int32(len(b.messages))
+	}
+
+	return nil
+}
+
+// Requests a producer ID and epoch if there isn't one. Doing so fences off any
+// earlier producer with the same transactional ID and aborts its open transaction.
+func (p *transactionalProducer) init(ctx context.Context) error {
+	if p.producer != nil {
+		return nil
+	}
+
+	res, err := p.client.InitProducerID(ctx, &kafka.InitProducerIDRequest{
+		TransactionalID:      p.id,
+		TransactionTimeoutMs: int(p.timeout.Milliseconds()),
+	})
+	if err != nil {
+		return err
+	} else if res.Error != nil {
+		return res.Error
+	}
+
+	p.producer = res.Producer
+	p.sequences = make(map[topicPartition]int32)
+	return nil
+}
+
+// Assigns each message to a partition and groups the resulting batches by the
+// address of the partition's leader
+func (p *transactionalProducer) assign(ctx context.Context, ms []kafka.Message) (map[string][]*partitionBatch, []*partitionBatch, error) {
+	// Batches are compressed as the topic's writer would compress them
+	var topics []string
+	compression := make(map[string]kafka.Compression)
+	for _, m := range ms {
+		if _, ok := compression[m.Topic]; !ok {
+			codec, err := p.compression(m.Topic)
+			if err != nil {
+				return nil, nil, err
+			}
+			compression[m.Topic] = codec
+			topics = append(topics, m.Topic)
+		}
+	}
+
+	res, err := p.client.Metadata(ctx, &kafka.MetadataRequest{Topics: topics})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Partition IDs and leaders by topic
+	partitions := make(map[string][]int, len(res.Topics))
+	leaderOf := make(map[topicPartition]kafka.Broker)
+	for _, t := range res.Topics {
+		if t.Error != nil {
+			return nil, nil, fmt.Errorf("%s: %w", t.Name, t.Error)
+		}
+		for _, tp := range t.Partitions {
+			partitions[t.Name] = append(partitions[t.Name], tp.ID)
+			leaderOf[topicPartition{t.Name, tp.ID}] = tp.Leader
+		}
+		sort.Ints(partitions[t.Name])
+	}
+
+	leaders := make(map[string][]*partitionBatch)
+	byPartition := make(map[topicPartition]*partitionBatch)
+	var batches []*partitionBatch
+
+	for _, m := range ms {
+		ids := partitions[m.Topic]
+		if len(ids) == 0 {
+			return nil, nil, fmt.Errorf("%s: %w", m.Topic, kafka.UnknownTopicOrPartition)
+		}
+
+		tp := topicPartition{m.Topic, p.balancer.Balance(m, ids...)}
+
+		b, ok := byPartition[tp]
+		if !ok {
+			b = &partitionBatch{topic: tp.topic, partition: tp.partition, sequence: p.sequences[tp], compression: compression[tp.topic]}
+			byPartition[tp] = b
+			batches = append(batches, b)
+
+			leader := leaderOf[tp]
+			addr := net.JoinHostPort(leader.Host, strconv.Itoa(leader.Port))
+			leaders[addr] = append(leaders[addr], b)
+		}
+		b.messages = append(b.messages, m)
+	}
+
+	return leaders, batches, nil
+}
+
+// Returns the codec the topic's batches are compressed with: the topic's own
+// `compression`, or else the cluster's
+func (p *transactionalProducer) compression(topic string) (kafka.Compression, error) {
+	name := p.cluster.options.Compression
+	if settings := SettingsFor(topic); settings.Compression != "" {
+		name = settings.Compression
+	}
+	return parseCompression(name)
+}
+
+// Begins the transaction by adding the partitions that will be written to it
+func (p *transactionalProducer) begin(ctx context.Context, batches []*partitionBatch) error {
+	topics := make(map[string][]kafka.AddPartitionToTxn)
+	for _, b := range batches {
+		topics[b.topic] = append(topics[b.topic], kafka.AddPartitionToTxn{Partition: b.partition})
+	}
+
+	res, err := p.client.AddPartitionsToTxn(ctx, &kafka.AddPartitionsToTxnRequest{
+		TransactionalID: p.id,
+		ProducerID:      p.producer.ProducerID,
+		ProducerEpoch:   p.producer.ProducerEpoch,
+		Topics:          topics,
+	})
+	if err != nil {
+		return err
+	}
+
+	for topic, partitions := range res.Topics {
+		for _, partition := range partitions {
+			if partition.Error != nil {
+				return fmt.Errorf("%s[%d]: %w", topic, partition.Partition, partition.Error)
+			}
+		}
+	}
+
+	return nil
+}
+
+// Commits or aborts the open transaction
+func (p *transactionalProducer) end(ctx context.Context, commit bool) error {
+	res, err := p.client.EndTxn(ctx, &kafka.EndTxnRequest{
+		TransactionalID: p.id,
+		ProducerID:      p.producer.ProducerID,
+		ProducerEpoch:   p.producer.ProducerEpoch,
+		Committed:       commit,
+	})
+	if err != nil {
+		return err
+	}
+	return res.Error
+}
+
+// Aborts the open transaction. The producer is reinitialized before the next
+// transaction since sequence numbers are unknown after a failure, and doing so
+// also aborts the transaction if this attempt didn't succeed. Uses a fresh context
+// since the transaction should be aborted even if the request timed out.
+func (p *transactionalProducer) abort() {
+	ctx, cancel := context.WithTimeout(context.Background(), p.timeout)
+	defer cancel()
+
+	if err := p.end(ctx, false); err != nil {
+		util.Sugar.Error("failed to abort kafka transaction:", err)
+	}
+
+	p.producer = nil
+}
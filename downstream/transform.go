@@ -0,0 +1,384 @@
+// Functions associated with transforming messages before they're written
+//
+// Author: Kirk Morales
+// Copyright 2022. All Rights Reserved.
+
+package downstream
+
+import (
+	"beget/util"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Metadata about the request a message was received in, available to transforms
+type RequestMeta struct {
+	ClientIP  string
+	RequestID string
+	Received  time.Time
+}
+
+// A transform whose paths have been parsed
+type transform struct {
+	util.TransformConfig
+	field []pathStep
+	to    []pathStep
+
+	// `Value` encoded as JSON, decoded afresh for each message so that messages
+	// never share it
+	value []byte
+}
+
+// A step of a field path: an object's field or, if `index` isn't negative, an array element
+type pathStep struct {
+	name  string
+	index int
+}
+
+// Parses and checks the topic's transforms
+func parseTransforms(configs []util.TransformConfig) ([]transform, error) {
+	transforms := make([]transform, 0, len(configs))
+	for i, config := range configs {
+		t, err := parseTransform(config)
+		if err != nil {
+			return nil, fmt.Errorf("transform %d: %w", i, err)
+		}
+		transforms = append(transforms, t)
+	}
+	return transforms, nil
+}
+
+func parseTransform(config util.TransformConfig) (transform, error) {
+	t := transform{TransformConfig: config}
+	t.Op = strings.ToLower(config.Op)
+
+	var err error
+	if t.field, err = parsePath(config.Field); err != nil {
+		return t, err
+	}
+
+	switch t.Op {
+	case "drop", "key":
+	case "rename":
+		if t.to, err = parsePath(config.To); err != nil {
+			return t, fmt.Errorf("invalid to: %w", err)
+		}
+	case "add", "default":
+		if config.Value == nil {
+			return t, fmt.Errorf("missing value")
+		} else if t.value, err = json.Marshal(config.Value); err != nil {
+			return t, fmt.Errorf("invalid value: %w", err)
+		}
+	case "cast":
+		switch config.Type {
+		case "string", "number", "integer", "boolean":
+		default:
+			return t, fmt.Errorf("invalid type %q", config.Type)
+		}
+	case "timestamp":
+		switch config.Format {
+		case "", "rfc3339", "unix", "unix_ms":
+		default:
+			return t, fmt.Errorf("invalid format %q", config.Format)
+		}
+	case "metadata":
+		switch config.Source {
+		case "client_ip", "request_id":
+		default:
+			return t, fmt.Errorf("invalid source %q", config.Source)
+		}
+	default:
+		return t, fmt.Errorf("invalid op %q", config.Op)
+	}
+
+	return t, nil
+}
+
+// Parses a path of dot-separated field names, optionally starting with "$." and
+// with "[n]" selecting array elements, e.g. "$.items[0].sku"
+func parsePath(path string) ([]pathStep, error) {
+	s := strings.TrimPrefix(path, "$.")
+	if s == "" {
+		return nil, fmt.Errorf("missing field")
+	}
+
+	var steps []pathStep
+	for _, part := range strings.Split(s, ".") {
+		name := part
+		var indexes []int
+		if i := strings.IndexByte(part, '['); i >= 0 {
+			name = part[:i]
+			for rest := part[i:]; rest != ""; {
+				end := strings.IndexByte(rest, ']')
+				if rest[0] != '[' || end < 0 {
+					return nil, fmt.Errorf("invalid path %q", path)
+				}
+				n, err := strconv.Atoi(rest[1:end])
+				if err != nil || n < 0 {
+					return nil, fmt.Errorf("invalid path %q", path)
+				}
+				indexes = append(indexes, n)
+				rest = rest[end+1:]
+			}
+		}
+
+		if name == "" && (len(steps) > 0 || len(indexes) == 0) {
+			return nil, fmt.Errorf("invalid path %q", path)
+		} else if name != "" {
+			steps = append(steps, pathStep{name: name, index: -1})
+		}
+		for _, n := range indexes {
+			steps = append(steps, pathStep{index: n})
+		}
+	}
+
+	return steps, nil
+}
+
+// Applies the topic's transforms to a message's value and key, returning the new
+// value and key. The value must be a JSON object unless the topic has no transforms.
+func (s *TopicSettings) Transform(value []byte, key string, meta RequestMeta) ([]byte, string, error) {
+	if len(s.transforms) == 0 {
+		return value, key, nil
+	}
+
+	v, err := decodeObject(value)
+	if err != nil {
+		return nil, "", err
+	}
+
+	for _, t := range s.transforms {
+		if key, err = t.apply(v, key, meta); err != nil {
+			return nil, "", fmt.Errorf("field %s: %w", t.Field, err)
+		}
+	}
+
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, "", err
+	}
+	return data, key, nil
+}
+
+// Decodes a message value that must be a JSON object, keeping numbers as they were
+// written rather than converting them to floats
+func decodeObject(value []byte) (interface{}, error) {
+	dec := json.NewDecoder(bytes.NewReader(value))
+	dec.UseNumber()
+
+	var v interface{}
+	if err := dec.Decode(&v); err != nil {
+		return nil, fmt.Errorf("message value must be a JSON object")
+	} else if _, ok := v.(map[string]interface{}); !ok {
+		return nil, fmt.Errorf("message value must be a JSON object")
+	}
+	return v, nil
+}
+
+// Applies the transform to the decoded value in place, returning the message's key
+func (t transform) apply(v interface{}, key string, meta RequestMeta) (string, error) {
+	switch t.Op {
+	case "rename":
+		if x, ok := getPath(v, t.field); ok {
+			deletePath(v, t.field)
+			return key, setPath(v, t.to, x)
+		}
+
+	case "drop":
+		deletePath(v, t.field)
+
+	case "add":
+		return key, setPath(v, t.field, t.newValue())
+
+	case "default":
+		if x, ok := getPath(v, t.field); !ok || x == nil {
+			return key, setPath(v, t.field, t.newValue())
+		}
+
+	case "cast":
+		if x, ok := getPath(v, t.field); ok && x != nil {
+			cast, err := castValue(x, t.Type)
+			if err != nil {
+				return key, err
+			}
+			return key, setPath(v, t.field, cast)
+		}
+
+	case "timestamp":
+		var x interface{}
+		switch t.Format {
+		case "unix":
+			x = meta.Received.Unix()
+		case "unix_ms":
+			x = meta.Received.UnixMilli()
+		default:
+			x = meta.Received.UTC().Format(time.RFC3339Nano)
+		}
+		return key, setPath(v, t.field, x)
+
+	case "metadata":
+		x := meta.ClientIP
+		if t.Source == "request_id" {
+			x = meta.RequestID
+		}
+		if x != "" {
+			return key, setPath(v, t.field, x)
+		}
+
+	case "key":
+		if x, ok := getPath(v, t.field); ok && x != nil {
+			if s, ok := x.(string); ok {
+				return s, nil
+			}
+			data, _ := json.Marshal(x)
+			return string(data), nil
+		}
+	}
+
+	return key, nil
+}
+
+// Returns a copy of the value an "add" or "default" transform sets
+func (t transform) newValue() interface{} {
+	dec := json.NewDecoder(bytes.NewReader(t.value))
+	dec.UseNumber()
+
+	// The value was encoded when it was parsed, so it always decodes
+	var x interface{}
+	dec.Decode(&x)
+	return x
+}
+
+// Returns the value at the path, and whether it's present
+func getPath(v interface{}, path []pathStep) (interface{}, bool) {
+	for _, step := range path {
+		switch c := v.(type) {
+		case map[string]interface{}:
+			if step.index >= 0 {
+				return nil, false
+			}
+			var ok bool
+			if v, ok = c[step.name]; !ok {
+				return nil, false
+			}
+		case []interface{}:
+			if step.index < 0 || step.index >= len(c) {
+				return nil, false
+			}
+			v = c[step.index]
+		default:
+			return nil, false
+		}
+	}
+	return v, true
+}
+
+// Sets the value at the path, creating any missing objects along the way. Array
+// elements must already exist.
+func setPath(v interface{}, path []pathStep, x interface{}) error {
+	for i, step := range path {
+		last := i == len(path)-1
+
+		switch c := v.(type) {
+		case map[string]interface{}:
+			if step.index >= 0 {
+				return fmt.Errorf("not an array")
+			} else if last {
+				c[step.name] = x
+				return nil
+			}
+
+			next, ok := c[step.name]
+			if !ok || next == nil {
+				next = make(map[string]interface{})
+				c[step.name] = next
+			}
+			v = next
+		case []interface{}:
+			if step.index < 0 {
+				return fmt.Errorf("not an object")
+			} else if step.index >= len(c) {
+				return fmt.Errorf("index %d out of range", step.index)
+			} else if last {
+				c[step.index] = x
+				return nil
+			}
+			v = c[step.index]
+		default:
+			return fmt.Errorf("not an object")
+		}
+	}
+	return nil
+}
+
+// Removes the field at the path, if present. Array elements are set to null rather
+// than removed so the positions of other elements don't change.
+func deletePath(v interface{}, path []pathStep) {
+	parent, ok := getPath(v, path[:len(path)-1])
+	if !ok {
+		return
+	}
+
+	last := path[len(path)-1]
+	switch c := parent.(type) {
+	case map[string]interface{}:
+		if last.index < 0 {
+			delete(c, last.name)
+		}
+	case []interface{}:
+		if last.index >= 0 && last.index < len(c) {
+			c[last.index] = nil
+		}
+	}
+}
+
+// Converts a decoded JSON value to the given type
+func castValue(x interface{}, typ string) (interface{}, error) {
+	switch typ {
+	case "string":
+		switch x := x.(type) {
+		case string:
+			return x, nil
+		case json.Number:
+			return x.String(), nil
+		case bool:
+			return strconv.FormatBool(x), nil
+		}
+
+	case "number", "integer":
+		var s string
+		switch x := x.(type) {
+		case string:
+			s = strings.TrimSpace(x)
+		case json.Number:
+			s = x.String()
+		}
+
+		f, err := strconv.ParseFloat(s, 64)
+		if err != nil || math.IsInf(f, 0) || math.IsNaN(f) {
+			break
+		} else if typ == "number" {
+			return json.Number(strconv.FormatFloat(f, 'f', -1, 64)), nil
+		} else if f == math.Trunc(f) && math.Abs(f) < 1<<53 {
+			return int64(f), nil
+		}
+
+	case "boolean":
+		switch x := x.(type) {
+		case bool:
+			return x, nil
+		case string:
+			if b, err := strconv.ParseBool(x); err == nil {
+				return b, nil
+			}
+		}
+	}
+
+	data, _ := json.Marshal(x)
+	return nil, fmt.Errorf("can't cast %s to %s", data, typ)
+}
@@ -0,0 +1,170 @@
+package downstream_test
+
+import (
+	"beget/downstream"
+	"beget/util"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTransforms(t *testing.T) {
+	meta := downstream.RequestMeta{
+		ClientIP:  "10.0.0.1",
+		RequestID: "req-1",
+		Received:  time.Date(2022, 6, 1, 12, 0, 0, 0, time.UTC),
+	}
+
+	// Initializes a topic with the transforms and applies them to the value
+	transform := func(t *testing.T, transforms []util.TransformConfig, value string) (string, string, error) {
+		util.Config.Kafka.Topics = map[string]util.TopicConfig{"foo": {Transforms: transforms}}
+		assert.Nil(t, downstream.Init())
+
+		v, key, err := downstream.SettingsFor("foo").Transform([]byte(value), "k", meta)
+		return string(v), key, err
+	}
+
+	t.Run("applies transforms", func(t *testing.T) {
+		tests := []struct {
+			name       string
+			transforms []util.TransformConfig
+			value      string
+			want       string
+			key        string
+		}{
+			{"rename", []util.TransformConfig{{Op: "rename", Field: "a", To: "b.c"}}, `{"a":1}`, `{"b":{"c":1}}`, "k"},
+			{"rename missing", []util.TransformConfig{{Op: "rename", Field: "a", To: "b"}}, `{"x":1}`, `{"x":1}`, "k"},
+			{"drop", []util.TransformConfig{{Op: "drop", Field: "$.user.password"}}, `{"user":{"name":"a","password":"b"}}`, `{"user":{"name":"a"}}`, "k"},
+			{"drop array element", []util.TransformConfig{{Op: "drop", Field: "items[1]"}}, `{"items":[1,2,3]}`, `{"items":[1,null,3]}`, "k"},
+			{"add", []util.TransformConfig{{Op: "add", Field: "source", Value: "web"}}, `{"source":"app"}`, `{"source":"web"}`, "k"},
+			{"default", []util.TransformConfig{{Op: "default", Field: "source", Value: "web"}, {Op: "default", Field: "n", Value: 1}}, `{"source":"app","n":null}`, `{"n":1,"source":"app"}`, "k"},
+			{"cast string", []util.TransformConfig{{Op: "cast", Field: "id", Type: "string"}}, `{"id":12345678901234567890}`, `{"id":"12345678901234567890"}`, "k"},
+			{"cast number", []util.TransformConfig{{Op: "cast", Field: "total", Type: "number"}}, `{"total":" 4.50 "}`, `{"total":4.5}`, "k"},
+			{"cast integer", []util.TransformConfig{{Op: "cast", Field: "items[0].qty", Type: "integer"}}, `{"items":[{"qty":"3"}]}`, `{"items":[{"qty":3}]}`, "k"},
+			{"cast boolean", []util.TransformConfig{{Op: "cast", Field: "ok", Type: "boolean"}}, `{"ok":"true"}`, `{"ok":true}`, "k"},
+			{"timestamp", []util.TransformConfig{{Op: "timestamp", Field: "received"}}, `{}`, `{"received":"2022-06-01T12:00:00Z"}`, "k"},
+			{"timestamp unix_ms", []util.TransformConfig{{Op: "timestamp", Field: "received", Format: "unix_ms"}}, `{}`, `{"received":1654084800000}`, "k"},
+			{"metadata", []util.TransformConfig{{Op: "metadata", Field: "meta.ip", Source: "client_ip"}, {Op: "metadata", Field: "meta.id", Source: "request_id"}}, `{}`, `{"meta":{"id":"req-1","ip":"10.0.0.1"}}`, "k"},
+			{"key", []util.TransformConfig{{Op: "key", Field: "order.id"}}, `{"order":{"id":"o1"}}`, `{"order":{"id":"o1"}}`, "o1"},
+			{"numeric key", []util.TransformConfig{{Op: "key", Field: "id"}}, `{"id":42}`, `{"id":42}`, "42"},
+			{"missing key", []util.TransformConfig{{Op: "key", Field: "id"}}, `{}`, `{}`, "k"},
+		}
+
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				value, key, err := transform(t, tt.transforms, tt.value)
+
+				assert.Nil(t, err)
+				assert.JSONEq(t, tt.want, value)
+				assert.Equal(t, tt.key, key)
+			})
+		}
+	})
+
+	t.Run("messages don't share added values", func(t *testing.T) {
+		util.Config.Kafka.Topics = map[string]util.TopicConfig{"foo": {Transforms: []util.TransformConfig{
+			{Op: "add", Field: "meta", Value: map[string]interface{}{}},
+			{Op: "metadata", Field: "meta.ip", Source: "client_ip"},
+		}}}
+		assert.Nil(t, downstream.Init())
+		settings := downstream.SettingsFor("foo")
+
+		value, _, err := settings.Transform([]byte(`{}`), "", meta)
+		assert.Nil(t, err)
+		assert.JSONEq(t, `{"meta":{"ip":"10.0.0.1"}}`, string(value))
+
+		// The next client's message doesn't get the first one's IP
+		value, _, err = settings.Transform([]byte(`{}`), "", downstream.RequestMeta{})
+		assert.Nil(t, err)
+		assert.JSONEq(t, `{"meta":{}}`, string(value))
+		assert.Equal(t, map[string]interface{}{}, util.Config.Kafka.Topics["foo"].Transforms[0].Value)
+	})
+
+	t.Run("concurrent transforms", func(t *testing.T) {
+		util.Config.Kafka.Topics = map[string]util.TopicConfig{"foo": {Transforms: []util.TransformConfig{
+			{Op: "add", Field: "meta", Value: map[string]interface{}{"tags": []interface{}{"a"}}},
+			{Op: "metadata", Field: "meta.id", Source: "request_id"},
+		}}}
+		assert.Nil(t, downstream.Init())
+		settings := downstream.SettingsFor("foo")
+
+		// Run with -race to catch messages sharing the added value
+		var wg sync.WaitGroup
+		for i := 0; i < 10; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+
+				id := strconv.Itoa(i)
+				value, _, err := settings.Transform([]byte(`{}`), "", downstream.RequestMeta{RequestID: id})
+				assert.Nil(t, err)
+				assert.JSONEq(t, `{"meta":{"tags":["a"],"id":"`+id+`"}}`, string(value))
+			}(i)
+		}
+		wg.Wait()
+	})
+
+	t.Run("transform errors", func(t *testing.T) {
+		tests := []struct {
+			name       string
+			transforms []util.TransformConfig
+			value      string
+			err        string
+		}{
+			{"not an object", []util.TransformConfig{{Op: "drop", Field: "a"}}, `[1]`, "message value must be a JSON object"},
+			{"not JSON", []util.TransformConfig{{Op: "drop", Field: "a"}}, `foo`, "message value must be a JSON object"},
+			{"invalid cast", []util.TransformConfig{{Op: "cast", Field: "n", Type: "integer"}}, `{"n":"1.5"}`, `field n: can't cast "1.5" to integer`},
+			{"set through a value", []util.TransformConfig{{Op: "add", Field: "a.b", Value: 1}}, `{"a":"x"}`, "field a.b: not an object"},
+			{"index out of range", []util.TransformConfig{{Op: "add", Field: "a[2]", Value: 1}}, `{"a":[]}`, "field a[2]: index 2 out of range"},
+		}
+
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				_, _, err := transform(t, tt.transforms, tt.value)
+
+				assert.EqualError(t, err, tt.err)
+			})
+		}
+	})
+
+	t.Run("topics without transforms", func(t *testing.T) {
+		value, key, err := transform(t, nil, "not json")
+
+		assert.Nil(t, err)
+		assert.Equal(t, "not json", value)
+		assert.Equal(t, "k", key)
+	})
+
+	t.Run("invalid transforms", func(t *testing.T) {
+		tests := []struct {
+			name      string
+			transform util.TransformConfig
+			err       string
+		}{
+			{"invalid op", util.TransformConfig{Op: "upper", Field: "a"}, `invalid op "upper"`},
+			{"missing field", util.TransformConfig{Op: "drop"}, "missing field"},
+			{"invalid path", util.TransformConfig{Op: "drop", Field: "a[x]"}, `invalid path "a[x]"`},
+			{"invalid to", util.TransformConfig{Op: "rename", Field: "a"}, "invalid to: missing field"},
+			{"missing value", util.TransformConfig{Op: "add", Field: "a"}, "missing value"},
+			{"invalid type", util.TransformConfig{Op: "cast", Field: "a", Type: "date"}, `invalid type "date"`},
+			{"invalid format", util.TransformConfig{Op: "timestamp", Field: "a", Format: "iso"}, `invalid format "iso"`},
+			{"invalid source", util.TransformConfig{Op: "metadata", Field: "a", Source: "user_agent"}, `invalid source "user_agent"`},
+		}
+
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				util.Config.Kafka.Topics = map[string]util.TopicConfig{"foo": {Transforms: []util.TransformConfig{{Op: "drop", Field: "x"}, tt.transform}}}
+
+				err := downstream.Init()
+
+				assert.EqualError(t, err, "topic foo: transform 1: "+tt.err)
+			})
+		}
+	})
+
+	// Reset config
+	util.Config.Kafka.Topics = nil
+}
@@ -0,0 +1,269 @@
+// Encoding of transactional produce requests. kafka-go always writes record batches
+// without a producer ID, so batches that belong to a transaction are encoded here.
+//
+// Author: Kirk Morales
+// Copyright 2022. All Rights Reserved.
+
+package downstream
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+)
+
+const (
+	produceApiKey     = 0
+	produceApiVersion = 3 // The first version supporting transactions
+	clientID          = "beget"
+
+	// Marks a record batch as part of a transaction
+	transactionalAttribute = 1 << 4
+)
+
+var crc32c = crc32.MakeTable(crc32.Castagnoli)
+
+// The messages written to a single partition within a transaction
+type partitionBatch struct {
+	topic       string
+	partition   int
+	sequence    int32             // The sequence number of the first message
+	compression kafka.Compression // The codec the records are compressed with, if any
+	messages    []kafka.Message
+}
+
+// Sends a produce request for the given batches to the cluster's broker at `addr`, which
+// must lead every partition involved. Returns the first error reported for a partition.
+func writeTransactional(ctx context.Context, c *cluster, addr, transactionalID string, producer *kafka.ProducerSession, timeout time.Duration, batches []*partitionBatch) error {
+	conn, err := c.dial(ctx, addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(timeout)
+	}
+	conn.SetDeadline(deadline)
+
+	req, err := encodeProduceRequest(transactionalID, producer, timeout, batches)
+	if err != nil {
+		return err
+	}
+
+	if _, err := conn.Write(req); err != nil {
+		return err
+	}
+
+	var size int32
+	if err := binary.Read(conn, binary.BigEndian, &size); err != nil {
+		return err
+	}
+
+	if size < 4 {
+		return errTruncated
+	}
+
+	res := make([]byte, size)
+	if _, err := io.ReadFull(conn, res); err != nil {
+		return err
+	}
+
+	return decodeProduceResponse(res)
+}
+
+// Encodes a produce request, including its size prefix. Transactions require acks
+// from all in-sync replicas, whatever the topics' `required_acks`.
+func encodeProduceRequest(transactionalID string, producer *kafka.ProducerSession, timeout time.Duration, batches []*partitionBatch) ([]byte, error) {
+	b := make([]byte, 4, 1024) // Placeholder for the size
+	b = binary.BigEndian.AppendUint16(b, produceApiKey)
+	b = binary.BigEndian.AppendUint16(b, produceApiVersion)
+	b = binary.BigEndian.AppendUint32(b, 0) // Correlation ID; only one request is sent per connection
+	b = appendString(b, clientID)
+
+	b = appendString(b, transactionalID)
+	b = binary.BigEndian.AppendUint16(b, 0xffff) // Acks from all in-sync replicas
+	b = binary.BigEndian.AppendUint32(b, uint32(timeout.Milliseconds()))
+
+	// Group the batches by topic, preserving their order
+	var topics []string
+	byTopic := make(map[string][]*partitionBatch)
+	for _, batch := range batches {
+		if _, ok := byTopic[batch.topic]; !ok {
+			topics = append(topics, batch.topic)
+		}
+		byTopic[batch.topic] = append(byTopic[batch.topic], batch)
+	}
+
+	b = binary.BigEndian.AppendUint32(b, uint32(len(topics)))
+	for _, topic := range topics {
+		b = appendString(b, topic)
+		b = binary.BigEndian.AppendUint32(b, uint32(len(byTopic[topic])))
+
+		for _, batch := range byTopic[topic] {
+			records, err := encodeRecordBatch(producer, batch)
+			if err != nil {
+				return nil, err
+			}
+			b = binary.BigEndian.AppendUint32(b, uint32(batch.partition))
+			b = binary.BigEndian.AppendUint32(b, uint32(len(records)))
+			b = append(b, records...)
+		}
+	}
+
+	binary.BigEndian.PutUint32(b, uint32(len(b)-4))
+	return b, nil
+}
+
+// Encodes the messages of a batch as a transactional v2 record batch, compressing
+// the records with the batch's codec
+func encodeRecordBatch(producer *kafka.ProducerSession, batch *partitionBatch) ([]byte, error) {
+	now := time.Now()
+	first := batch.messages[0].Time
+	if first.IsZero() {
+		first = now
+	}
+
+	var records []byte
+	last := first.UnixMilli()
+
+	for i, m := range batch.messages {
+		t := m.Time
+		if t.IsZero() {
+			t = now
+		}
+		if t.UnixMilli() > last {
+			last = t.UnixMilli()
+		}
+
+		var r []byte
+		r = append(r, 0) // Attributes
+		r = binary.AppendVarint(r, t.UnixMilli()-first.UnixMilli())
+		r = binary.AppendVarint(r, int64(i))
+		r = appendVarBytes(r, m.Key)
+		r = appendVarBytes(r, m.Value)
+		r = binary.AppendVarint(r, int64(len(m.Headers)))
+		for _, h := range m.Headers {
+			r = appendVarBytes(r, []byte(h.Key))
+			r = appendVarBytes(r, h.Value)
+		}
+
+		records = binary.AppendVarint(records, int64(len(r)))
+		records = append(records, r...)
+	}
+
+	attributes := uint16(transactionalAttribute)
+	if codec := batch.compression.Codec(); codec != nil {
+		var buf bytes.Buffer
+		w := codec.NewWriter(&buf)
+		if _, err := w.Write(records); err != nil {
+			w.Close()
+			return nil, err
+		}
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+
+		records = buf.Bytes()
+		attributes |= uint16(batch.compression)
+	}
+
+	// Everything from the attributes on is covered by the CRC
+	var body []byte
+	body = binary.BigEndian.AppendUint16(body, attributes)
+	body = binary.BigEndian.AppendUint32(body, uint32(len(batch.messages)-1)) // Last offset delta
+	body = binary.BigEndian.AppendUint64(body, uint64(first.UnixMilli()))
+	body = binary.BigEndian.AppendUint64(body, uint64(last))
+	body = binary.BigEndian.AppendUint64(body, uint64(producer.ProducerID))
+	body = binary.BigEndian.AppendUint16(body, uint16(producer.ProducerEpoch))
+	body = binary.BigEndian.AppendUint32(body, uint32(batch.sequence))
+	body = binary.BigEndian.AppendUint32(body, uint32(len(batch.messages)))
+	body = append(body, records...)
+
+	var b []byte
+	b = binary.BigEndian.AppendUint64(b, 0)                   // Base offset; assigned by the broker
+	b = binary.BigEndian.AppendUint32(b, uint32(len(body)+9)) // Length of everything that follows
+	b = binary.BigEndian.AppendUint32(b, 0xffffffff)          // Partition leader epoch
+	b = append(b, 2)                                          // Magic byte
+	b = binary.BigEndian.AppendUint32(b, crc32.Checksum(body, crc32c))
+	return append(b, body...), nil
+}
+
+// Decodes a produce response, returning the first error reported for a partition
+func decodeProduceResponse(b []byte) error {
+	d := decoder{b: b}
+	d.int32() // Correlation ID
+
+	for topics := d.int32(); topics > 0 && d.err == nil; topics-- {
+		topic := d.string()
+		for partitions := d.int32(); partitions > 0 && d.err == nil; partitions-- {
+			partition := d.int32()
+			code := d.int16()
+			d.skip(16) // Base offset and log append time
+
+			if code != 0 && d.err == nil {
+				return fmt.Errorf("failed to write to %s[%d]: %w", topic, partition, kafka.Error(code))
+			}
+		}
+	}
+
+	return d.err
+}
+
+func appendString(b []byte, s string) []byte {
+	b = binary.BigEndian.AppendUint16(b, uint16(len(s)))
+	return append(b, s...)
+}
+
+// Appends a varint length followed by the bytes, or a length of -1 if they're nil
+func appendVarBytes(b []byte, v []byte) []byte {
+	if v == nil {
+		return binary.AppendVarint(b, -1)
+	}
+	b = binary.AppendVarint(b, int64(len(v)))
+	return append(b, v...)
+}
+
+var errTruncated = errors.New("truncated produce response")
+
+// Reads big-endian values from a response, recording the first error
+type decoder struct {
+	b   []byte
+	err error
+}
+
+func (d *decoder) next(n int) []byte {
+	if d.err == nil && (n < 0 || len(d.b) < n) {
+		d.err = errTruncated
+	}
+	if d.err != nil {
+		return make([]byte, max(n, 0))
+	}
+	v := d.b[:n]
+	d.b = d.b[n:]
+	return v
+}
+
+func (d *decoder) skip(n int) {
+	d.next(n)
+}
+
+func (d *decoder) int16() int16 {
+	return int16(binary.BigEndian.Uint16(d.next(2)))
+}
+
+func (d *decoder) int32() int32 {
+	return int32(binary.BigEndian.Uint32(d.next(4)))
+}
+
+func (d *decoder) string() string {
+	return string(d.next(int(d.int16())))
+}
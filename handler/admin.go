@@ -0,0 +1,83 @@
+// Handles administrative requests.
+//
+// Author: Kirk Morales
+// Copyright 2022. All Rights Reserved.
+
+package handler
+
+import (
+	"beget/util"
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+
+	"go.uber.org/zap/zapcore"
+)
+
+// The body of a request to change the log level, and of its response
+type logLevelBody struct {
+	Level string `json:"level"`
+}
+
+// Middleware requiring admin requests to carry `Config.Server.AdminToken` as a
+// bearer token. Admin endpoints aren't found when no token is configured.
+func requireAdmin(next http.Handler) http.Handler {
+
+	fn := func(w http.ResponseWriter, r *http.Request) {
+		token := util.Config.Server.AdminToken
+		if token == "" {
+			writeError(w, r, &validationError{http.StatusNotFound, codeNotFound, "not found", ""})
+			return
+		}
+
+		auth := r.Header.Get("Authorization")
+		if subtle.ConstantTimeCompare([]byte(auth), []byte("Bearer "+token)) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			writeError(w, r, &validationError{http.StatusUnauthorized, codeUnauthorized, "invalid admin token", ""})
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	}
+	return http.HandlerFunc(fn)
+}
+
+// Handles a request for the current log level
+func logLevelHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(logLevelBody{util.LogLevel.Level().String()})
+}
+
+// Handles a request to change the log level. The change lasts until the service
+// restarts.
+func setLogLevelHandler(w http.ResponseWriter, r *http.Request) {
+	if !checkContentType(w, r, "application/json") {
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, maxBodyBytes())
+	dec := json.NewDecoder(r.Body)
+	dec.DisallowUnknownFields()
+
+	var b logLevelBody
+	if err := dec.Decode(&b); err != nil {
+		writeError(w, r, decodeError(err))
+		return
+	}
+
+	if b.Level == "" {
+		writeError(w, r, &validationError{http.StatusBadRequest, codeMissingField, "missing level", "/level"})
+		return
+	}
+
+	var level zapcore.Level
+	if err := level.UnmarshalText([]byte(b.Level)); err != nil {
+		writeError(w, r, &validationError{http.StatusBadRequest, codeInvalidField, "invalid level", "/level"})
+		return
+	}
+
+	util.LogLevel.SetLevel(level)
+	util.SugarFor(r.Context()).Infof("log level set to %s", level)
+
+	logLevelHandler(w, r)
+}
@@ -0,0 +1,79 @@
+package handler
+
+import (
+	"beget/util"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap/zapcore"
+)
+
+func TestLogLevelHandler(t *testing.T) {
+	util.InitLogging()
+
+	request := func(method, token, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest(method, "/admin/loglevel", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+
+		InitRouter().ServeHTTP(w, req)
+		return w
+	}
+
+	t.Run("disabled", func(t *testing.T) {
+		w := request(http.MethodGet, "secret", "")
+
+		assert.Equal(t, 404, w.Code)
+	})
+
+	util.Config.Server.AdminToken = "secret"
+
+	t.Run("unauthorized", func(t *testing.T) {
+		for _, token := range []string{"", "wrong"} {
+			w := request(http.MethodGet, token, "")
+
+			assert.Equal(t, 401, w.Code)
+			assert.Equal(t, "Bearer", w.Header().Get("WWW-Authenticate"))
+			assertProblem(t, w.Header(), w.Body.Bytes(), codeUnauthorized, "invalid admin token")
+		}
+	})
+
+	t.Run("get", func(t *testing.T) {
+		util.LogLevel.SetLevel(zapcore.InfoLevel)
+
+		w := request(http.MethodGet, "secret", "")
+
+		assert.Equal(t, 200, w.Code)
+		assert.JSONEq(t, `{"level":"info"}`, w.Body.String())
+	})
+
+	t.Run("put", func(t *testing.T) {
+		w := request(http.MethodPut, "secret", `{"level":"debug"}`)
+
+		assert.Equal(t, 200, w.Code)
+		assert.JSONEq(t, `{"level":"debug"}`, w.Body.String())
+		assert.Equal(t, zapcore.DebugLevel, util.LogLevel.Level())
+	})
+
+	t.Run("invalid levels", func(t *testing.T) {
+		w := request(http.MethodPut, "secret", `{"level":"loud"}`)
+		assert.Equal(t, 400, w.Code)
+		assertProblem(t, w.Header(), w.Body.Bytes(), codeInvalidField, "invalid level")
+
+		w = request(http.MethodPut, "secret", `{}`)
+		assert.Equal(t, 400, w.Code)
+		assertProblem(t, w.Header(), w.Body.Bytes(), codeMissingField, "missing level")
+
+		assert.Equal(t, zapcore.DebugLevel, util.LogLevel.Level())
+	})
+
+	// Reset config
+	util.Config.Server.AdminToken = ""
+	util.InitLogging()
+}
@@ -0,0 +1,301 @@
+// Handles writes that are acknowledged right away, with their outcome sent to a
+// callback URL once known.
+//
+// Author: Kirk Morales
+// Copyright 2022. All Rights Reserved.
+
+package handler
+
+import (
+	"beget/downstream"
+	"beget/util"
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+)
+
+const (
+	defaultCallbackMaxAttempts = 5
+	defaultCallbackBackoff     = time.Second
+	defaultCallbackTimeout     = 10 * time.Second
+)
+
+// The client callbacks are sent with. Redirects aren't followed, since they could
+// point callbacks at hosts that aren't allowed.
+var callbackClient = &http.Client{
+	Transport: &http.Transport{
+		DialContext:         dialCallback,
+		ForceAttemptHTTP2:   true,
+		MaxIdleConns:        100,
+		IdleConnTimeout:     90 * time.Second,
+		TLSHandshakeTimeout: 10 * time.Second,
+	},
+	CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	},
+}
+
+// Returned when a callback would connect to an address that isn't allowed
+var errCallbackAddressNotAllowed = errors.New("callback address is not allowed")
+
+// Tracks receipts that are still being written or sent
+var pendingReceipts sync.WaitGroup
+
+// Returns the request's `Callback-Url`, or "" if it has none. If the URL can't be
+// used, an error is written to the `http.ResponseWriter` and false is returned.
+func callbackURL(w http.ResponseWriter, r *http.Request) (string, bool) {
+	raw := r.Header.Get("Callback-Url")
+	if raw == "" {
+		return "", true
+	}
+
+	config := util.Config.Server.Callbacks
+	if config.Secret == "" {
+		writeError(w, r, &validationError{http.StatusBadRequest, codeCallbacksDisabled, "callbacks are not enabled", ""})
+		return "", false
+	}
+
+	u, err := url.Parse(raw)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		writeError(w, r, &validationError{http.StatusBadRequest, codeInvalidParameter, "invalid Callback-Url", ""})
+		return "", false
+	}
+
+	if len(config.AllowedHosts) > 0 && !listedCallbackHost(u.Hostname()) {
+		writeError(w, r, &validationError{http.StatusBadRequest, codeCallbackHostNotAllowed, "Callback-Url host is not allowed", ""})
+		return "", false
+	}
+
+	return u.String(), true
+}
+
+// Returns whether the host is in `Config.Server.Callbacks.AllowedHosts`
+func listedCallbackHost(host string) bool {
+	for _, allowed := range util.Config.Server.Callbacks.AllowedHosts {
+		if strings.EqualFold(allowed, host) {
+			return true
+		}
+	}
+	return false
+}
+
+// Connects to a callback host. Unless the host is listed in `AllowedHosts`, it
+// may only resolve to public addresses, so that callbacks can't reach loopback,
+// private or link-local services such as cloud metadata endpoints.
+func dialCallback(ctx context.Context, network, addr string) (net.Conn, error) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	dialer := &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}
+	if !listedCallbackHost(host) {
+		// Checked once the host is resolved, so that it can't resolve differently
+		// between checking and connecting
+		dialer.Control = func(network, address string, c syscall.RawConn) error {
+			ip, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			} else if !publicIP(net.ParseIP(ip)) {
+				return fmt.Errorf("%w: %s", errCallbackAddressNotAllowed, ip)
+			}
+			return nil
+		}
+	}
+
+	return dialer.DialContext(ctx, network, addr)
+}
+
+// Special-purpose ranges that aren't covered by the `net.IP` methods and may
+// reach internal services
+var nonPublicNets = parseCIDRs(
+	"0.0.0.0/8",       // "This network"
+	"100.64.0.0/10",   // Carrier-grade NAT, used by some clouds for metadata endpoints
+	"192.0.0.0/24",    // IETF protocol assignments
+	"192.0.2.0/24",    // Documentation
+	"198.18.0.0/15",   // Benchmarking
+	"198.51.100.0/24", // Documentation
+	"203.0.113.0/24",  // Documentation
+	"240.0.0.0/4",     // Reserved, including broadcast
+	"64:ff9b::/96",    // NAT64, which maps to IPv4 addresses
+	"64:ff9b:1::/48",  // Local-use NAT64
+	"100::/64",        // Discard
+	"2001:db8::/32",   // Documentation
+	"fec0::/10",       // Site-local
+)
+
+// Parses CIDR notation ranges, panicking if any are invalid
+func parseCIDRs(cidrs ...string) []*net.IPNet {
+	nets := make([]*net.IPNet, len(cidrs))
+	for i, cidr := range cidrs {
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		nets[i] = n
+	}
+	return nets
+}
+
+// Returns whether the IP is routable on the internet
+func publicIP(ip net.IP) bool {
+	if ip == nil || ip.IsUnspecified() || ip.IsLoopback() || ip.IsPrivate() ||
+		ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast() || ip.IsMulticast() {
+		return false
+	}
+
+	for _, n := range nonPublicNets {
+		if n.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// Starts writing the message in the background and returns its receipt. Once the
+// write finishes, `done` is called with its outcome and the receipt is sent to the
+// callback URL. The receipt can also be polled for at `/produce/status/{id}`.
+func produceWithReceipt(m kafka.Message, callback string, done func(err error)) produceStatus {
+	receipt := produceStatus{ID: util.NewID(), Status: statusPending, Topic: m.Topic}
+	produceStatuses.Set(receipt.ID, receipt)
+
+	pendingReceipts.Add(1)
+	go func() {
+		defer pendingReceipts.Done()
+
+		delivery := &downstream.Delivery{}
+		m.WriterData = delivery
+
+		err := downstream.Produce(context.Background(), m)
+		done(err)
+
+		receipt := receipt
+		if err != nil {
+			receipt.Status, receipt.Error = statusFailed, err.Error()
+		} else {
+			receipt.Status = statusProduced
+			if partition, offset, ok := delivery.Get(); ok {
+				receipt.Partition, receipt.Offset = &partition, &offset
+			}
+		}
+
+		produceStatuses.Set(receipt.ID, receipt)
+		sendCallback(callback, receipt)
+	}()
+
+	return receipt
+}
+
+// Posts the receipt to the callback URL, retrying with backoff until it's accepted
+// or `Config.Server.Callbacks.MaxAttempts` is reached
+func sendCallback(callback string, receipt produceStatus) {
+	config := util.Config.Server.Callbacks
+
+	maxAttempts := config.MaxAttempts
+	if maxAttempts <= 0 {
+		maxAttempts = defaultCallbackMaxAttempts
+	}
+
+	backoff := config.Backoff
+	if backoff <= 0 {
+		backoff = defaultCallbackBackoff
+	}
+
+	body, _ := json.Marshal(receipt)
+
+	for attempt := 1; ; attempt++ {
+		retry, err := postCallback(callback, body)
+		if err == nil {
+			return
+		} else if !retry || attempt >= maxAttempts {
+			util.Sugar.Errorf("failed to send callback for %s after %d attempts: %v", receipt.ID, attempt, err)
+			return
+		}
+
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// Makes a single attempt at posting the body to the callback URL. Returns whether
+// a failed attempt may be retried.
+func postCallback(callback string, body []byte) (bool, error) {
+	config := util.Config.Server.Callbacks
+
+	timeout := config.Timeout
+	if timeout <= 0 {
+		timeout = defaultCallbackTimeout
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, callback, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Beget-Timestamp", timestamp)
+	req.Header.Set("Beget-Signature", "sha256="+signCallback(config.Secret, timestamp, body))
+
+	res, err := callbackClient.Do(req)
+	if errors.Is(err, errCallbackAddressNotAllowed) {
+		return false, err
+	} else if err != nil {
+		return true, err
+	}
+	defer res.Body.Close()
+	io.Copy(io.Discard, res.Body)
+
+	switch {
+	case res.StatusCode >= 200 && res.StatusCode < 300:
+		return false, nil
+	case res.StatusCode >= 500, res.StatusCode == http.StatusRequestTimeout, res.StatusCode == http.StatusTooManyRequests:
+		return true, fmt.Errorf("callback responded with %d", res.StatusCode)
+	default:
+		return false, fmt.Errorf("callback responded with %d", res.StatusCode)
+	}
+}
+
+// Returns the hex-encoded HMAC-SHA256 of the timestamp and body, joined by a "."
+func signCallback(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Waits for receipts that are still being written or sent, or until the context is
+// done. Should be called before closing `downstream` on shutdown.
+func WaitForReceipts(ctx context.Context) error {
+	finished := make(chan struct{})
+	go func() {
+		pendingReceipts.Wait()
+		close(finished)
+	}()
+
+	select {
+	case <-finished:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
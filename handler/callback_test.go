@@ -0,0 +1,219 @@
+package handler
+
+import (
+	"beget/downstream"
+	"beget/util"
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCallbacks(t *testing.T) {
+	util.InitLogging()
+	initProduceStatuses()
+	Idempotency = nil
+	initIdempotency()
+
+	sink := downstream.NewMemorySink()
+	stubSink := downstream.DefaultSink
+	downstream.DefaultSink = sink
+	downstream.KafkaTopics = map[string]struct{}{"foo": {}}
+
+	// Receives callbacks, failing the first attempt of each
+	type callback struct {
+		receipt   produceStatus
+		timestamp string
+		signature string
+	}
+	callbacks := make(chan callback, 10)
+	var attempts int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&attempts, 1)%2 == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+
+		body, _ := ioutil.ReadAll(r.Body)
+		var c callback
+		json.Unmarshal(body, &c.receipt)
+		c.timestamp = r.Header.Get("Beget-Timestamp")
+		c.signature = r.Header.Get("Beget-Signature")
+		assert.Equal(t, "sha256="+signCallback("secret", c.timestamp, body), c.signature)
+
+		callbacks <- c
+	}))
+	defer server.Close()
+
+	produce := func(callbackURL, key string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest(http.MethodPost, "/produce", strings.NewReader(`{"topic":"foo","value":"a"}`))
+		req.Header.Add("Content-Type", "application/json")
+		req.Header.Add("Callback-Url", callbackURL)
+		if key != "" {
+			req.Header.Add("Idempotency-Key", key)
+		}
+		topicProduceHandler(w, req)
+		return w
+	}
+
+	t.Run("invalid callbacks", func(t *testing.T) {
+		tests := []struct {
+			name   string
+			config util.CallbackConfig
+			url    string
+			code   string
+			err    string
+		}{
+			{"not enabled", util.CallbackConfig{}, server.URL, codeCallbacksDisabled, "callbacks are not enabled"},
+			{"invalid URL", util.CallbackConfig{Secret: "secret"}, "ftp://foo.com", codeInvalidParameter, "invalid Callback-Url"},
+			{"relative URL", util.CallbackConfig{Secret: "secret"}, "/callback", codeInvalidParameter, "invalid Callback-Url"},
+			{"host not allowed", util.CallbackConfig{Secret: "secret", AllowedHosts: []string{"foo.com"}}, "https://bar.com/callback", codeCallbackHostNotAllowed, "Callback-Url host is not allowed"},
+		}
+
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				util.Config.Server.Callbacks = tt.config
+
+				w := produce(tt.url, "")
+
+				assert.Equal(t, 400, w.Code)
+				assertProblem(t, w.Header(), w.Body.Bytes(), tt.code, tt.err)
+			})
+		}
+
+		assert.Empty(t, sink.Messages())
+	})
+
+	util.Config.Server.Callbacks = util.CallbackConfig{
+		Secret:       "secret",
+		AllowedHosts: []string{"127.0.0.1"},
+		Backoff:      10 * time.Millisecond,
+	}
+
+	t.Run("sends signed receipts", func(t *testing.T) {
+		w := produce(server.URL+"/callback", "key-1")
+
+		var receipt produceStatus
+		assert.Equal(t, 202, w.Code)
+		assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &receipt))
+		assert.Equal(t, produceStatus{ID: receipt.ID, Status: statusPending, Topic: "foo"}, receipt)
+		assert.Equal(t, "/produce/status/"+receipt.ID, w.Header().Get("Location"))
+
+		select {
+		case c := <-callbacks:
+			assert.Equal(t, produceStatus{ID: receipt.ID, Status: statusProduced, Topic: "foo"}, c.receipt)
+		case <-time.After(time.Second):
+			assert.Fail(t, "callback not sent")
+		}
+
+		status, _ := produceStatuses.Get(receipt.ID)
+		assert.Equal(t, statusProduced, status.Status)
+		assert.Len(t, sink.Messages(), 1)
+
+		// Retries get the original receipt
+		w = produce(server.URL+"/callback", "key-1")
+		assert.Equal(t, 202, w.Code)
+		assert.Contains(t, w.Body.String(), receipt.ID)
+		assert.Len(t, sink.Messages(), 1)
+	})
+
+	t.Run("reports failed writes", func(t *testing.T) {
+		sink.Fail = func(m kafka.Message) error { return errors.New("write failed") }
+
+		w := produce(server.URL+"/callback", "")
+		assert.Equal(t, 202, w.Code)
+
+		select {
+		case c := <-callbacks:
+			assert.Equal(t, statusFailed, c.receipt.Status)
+			assert.Equal(t, "write failed", c.receipt.Error)
+		case <-time.After(time.Second):
+			assert.Fail(t, "callback not sent")
+		}
+
+		sink.Fail = nil
+	})
+
+	t.Run("refuses private addresses and redirects", func(t *testing.T) {
+		var redirected int32
+		target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt32(&redirected, 1)
+		}))
+		defer target.Close()
+
+		redirect := httptest.NewServer(http.RedirectHandler(target.URL, http.StatusTemporaryRedirect))
+		defer redirect.Close()
+
+		// Hosts that aren't listed can't resolve to loopback addresses
+		util.Config.Server.Callbacks.AllowedHosts = nil
+		retry, err := postCallback(target.URL, []byte("{}"))
+		assert.False(t, retry)
+		assert.ErrorIs(t, err, errCallbackAddressNotAllowed)
+
+		util.Config.Server.Callbacks.AllowedHosts = []string{"127.0.0.1"}
+		retry, err = postCallback(redirect.URL, []byte("{}"))
+		assert.False(t, retry)
+		assert.EqualError(t, err, "callback responded with 307")
+		assert.Zero(t, atomic.LoadInt32(&redirected))
+	})
+
+	assert.Nil(t, WaitForReceipts(context.Background()))
+
+	// Restore stubs
+	util.Config.Server.Callbacks = util.CallbackConfig{}
+	downstream.KafkaTopics = make(map[string]struct{})
+	downstream.DefaultSink = stubSink
+}
+
+func TestPublicIP(t *testing.T) {
+	tests := []struct {
+		ip     string
+		public bool
+	}{
+		{"93.184.216.34", true},
+		{"2606:2800:220:1:248:1893:25c8:1946", true},
+		{"127.0.0.1", false},
+		{"10.1.2.3", false},
+		{"172.16.0.1", false},
+		{"192.168.1.1", false},
+		{"169.254.169.254", false},
+		{"0.0.0.0", false},
+		{"0.1.2.3", false},
+		{"100.64.0.1", false},
+		{"100.100.100.200", false},
+		{"100.127.255.255", false},
+		{"100.128.0.1", true},
+		{"192.0.0.8", false},
+		{"192.0.2.1", false},
+		{"198.18.0.1", false},
+		{"198.19.255.255", false},
+		{"198.51.100.1", false},
+		{"203.0.113.1", false},
+		{"240.0.0.1", false},
+		{"255.255.255.255", false},
+		{"224.0.0.1", false},
+		{"::1", false},
+		{"::ffff:127.0.0.1", false},
+		{"::ffff:100.100.100.200", false},
+		{"fd00::1", false},
+		{"fe80::1", false},
+		{"fec0::1", false},
+		{"64:ff9b::a9fe:a9fe", false},
+		{"2001:db8::1", false},
+	}
+
+	for _, tt := range tests {
+		assert.Equal(t, tt.public, publicIP(net.ParseIP(tt.ip)), tt.ip)
+	}
+}
@@ -0,0 +1,363 @@
+// Handles CloudEvents received over the HTTP protocol binding.
+//
+// Author: Kirk Morales
+// Copyright 2022. All Rights Reserved.
+
+package handler
+
+import (
+	"beget/downstream"
+	"beget/util"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+
+	"github.com/golang/gddo/httputil/header"
+	"github.com/segmentio/kafka-go"
+)
+
+const (
+	cloudEventsContentType      = "application/cloudevents+json"
+	cloudEventsBatchContentType = "application/cloudevents-batch+json"
+)
+
+// A CloudEvent decoded from either HTTP content mode
+type cloudEvent struct {
+	attrs    map[string]string // Context attributes (including extensions) by name, excluding data
+	data     []byte            // The event payload
+	dataJSON json.RawMessage   // The payload as JSON, if it was received as JSON in structured mode
+}
+
+// Handles a request containing one or more CloudEvents in structured, batched or
+// binary content mode, routing each event to a topic using `Config.CloudEvents.Routes`.
+func cloudEventsHandler(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxBodyBytes())
+
+	var events []*cloudEvent
+	var verr *validationError
+
+	contentType, _ := header.ParseValueAndParams(r.Header, "Content-Type")
+	switch {
+	case contentType == cloudEventsContentType:
+		var event *cloudEvent
+		if event, verr = decodeStructuredEvent(r.Body); verr == nil {
+			events = []*cloudEvent{event}
+		}
+	case contentType == cloudEventsBatchContentType:
+		events, verr = decodeEventBatch(r.Body)
+	case r.Header.Get("ce-specversion") != "":
+		var event *cloudEvent
+		if event, verr = decodeBinaryEvent(r); verr == nil {
+			events = []*cloudEvent{event}
+		}
+	default:
+		verr = &validationError{http.StatusUnsupportedMediaType, codeUnsupportedMediaType, "request is not a CloudEvent", ""}
+	}
+
+	if verr != nil {
+		writeError(w, r, verr)
+		return
+	}
+
+	messages := make([]kafka.Message, 0, len(events))
+	for i, event := range events {
+		message, verr := event.message(util.RequestIDFrom(r.Context()))
+		if verr != nil {
+			if len(events) > 1 {
+				verr.msg = fmt.Sprintf("event %d: %s", i, verr.msg)
+				if verr.pointer != "" {
+					verr.pointer = fmt.Sprintf("/%d%s", i, verr.pointer)
+				}
+			}
+			writeError(w, r, verr)
+			return
+		}
+		messages = append(messages, message)
+	}
+
+	// Unlike `/produce`, failures are reported so that CloudEvents senders retry
+	if len(messages) > 0 {
+		produce := func(ctx context.Context) error {
+			return downstream.ProduceBatch(ctx, messages)
+		}
+		done := func(err error) {
+			if err != nil {
+				util.SugarFor(r.Context()).Error("failed to write kafka messages:", err)
+			}
+		}
+
+		if ok, err := produceWithPolicy(w, r, produce, done); !ok {
+			return
+		} else if err != nil {
+			writeError(w, r, &validationError{http.StatusInternalServerError, codeProduceFailed, "failed to produce events", ""})
+			return
+		}
+	}
+
+	w.Write([]byte("OK"))
+}
+
+// Decodes an event in structured content mode
+func decodeStructuredEvent(body io.Reader) (*cloudEvent, *validationError) {
+	var raw map[string]json.RawMessage
+	if err := json.NewDecoder(body).Decode(&raw); err != nil {
+		return nil, decodeError(err)
+	}
+
+	return parseStructuredEvent(raw)
+}
+
+// Decodes a batch of events in structured content mode
+func decodeEventBatch(body io.Reader) ([]*cloudEvent, *validationError) {
+	var raw []map[string]json.RawMessage
+	if err := json.NewDecoder(body).Decode(&raw); err != nil {
+		return nil, decodeError(err)
+	}
+
+	events := make([]*cloudEvent, 0, len(raw))
+	for i, r := range raw {
+		event, verr := parseStructuredEvent(r)
+		if verr != nil {
+			verr.msg = fmt.Sprintf("event %d: %s", i, verr.msg)
+			if verr.pointer != "" {
+				verr.pointer = fmt.Sprintf("/%d%s", i, verr.pointer)
+			}
+			return nil, verr
+		}
+		events = append(events, event)
+	}
+
+	return events, nil
+}
+
+// Builds an event from the members of a structured mode JSON object
+func parseStructuredEvent(raw map[string]json.RawMessage) (*cloudEvent, *validationError) {
+	event := &cloudEvent{attrs: make(map[string]string)}
+
+	// The content type determines how `data` is interpreted, so look it up first
+	var contentType string
+	json.Unmarshal(raw["datacontenttype"], &contentType)
+
+	for name, value := range raw {
+		switch name {
+		case "data":
+			// Non-JSON data is carried as a JSON string
+			var str string
+			if !isJSONContentType(contentType) && json.Unmarshal(value, &str) == nil {
+				event.data = []byte(str)
+			} else {
+				event.data = value
+				event.dataJSON = value
+			}
+
+		case "data_base64":
+			var str string
+			if err := json.Unmarshal(value, &str); err != nil {
+				return nil, &validationError{http.StatusBadRequest, codeInvalidField, "data_base64 must be a string", "/data_base64"}
+			}
+			data, err := base64.StdEncoding.DecodeString(str)
+			if err != nil {
+				return nil, &validationError{http.StatusBadRequest, codeInvalidField, "data_base64 is not valid base64", "/data_base64"}
+			}
+			event.data = data
+
+		default:
+			if string(value) == "null" {
+				continue
+			}
+
+			// Attributes other than strings are kept in their JSON form
+			var str string
+			if err := json.Unmarshal(value, &str); err != nil {
+				str = string(value)
+			}
+			event.attrs[strings.ToLower(name)] = str
+		}
+	}
+
+	if verr := event.validate(); verr != nil {
+		return nil, verr
+	}
+
+	return event, nil
+}
+
+// Decodes an event in binary content mode, where attributes are in `ce-` headers
+func decodeBinaryEvent(r *http.Request) (*cloudEvent, *validationError) {
+	event := &cloudEvent{attrs: make(map[string]string)}
+
+	for name, values := range r.Header {
+		name = strings.ToLower(name)
+		if !strings.HasPrefix(name, "ce-") || len(values) == 0 {
+			continue
+		}
+
+		// The HTTP binding percent-encodes characters that can't appear in headers
+		value, err := url.PathUnescape(values[0])
+		if err != nil {
+			msg := fmt.Sprintf("invalid %s header", name)
+			return nil, &validationError{http.StatusBadRequest, codeInvalidParameter, msg, ""}
+		}
+		event.attrs[strings.TrimPrefix(name, "ce-")] = value
+	}
+
+	if contentType := r.Header.Get("Content-Type"); contentType != "" {
+		event.attrs["datacontenttype"] = contentType
+	}
+
+	data, err := io.ReadAll(r.Body)
+	if err != nil {
+		return nil, decodeError(err)
+	}
+	event.data = data
+
+	// Attributes are in headers, so there's no field to point to
+	if verr := event.validate(); verr != nil {
+		verr.pointer = ""
+		return nil, verr
+	}
+
+	return event, nil
+}
+
+// Checks that the event has the required context attributes
+func (e *cloudEvent) validate() *validationError {
+	if e.attrs["specversion"] != "1.0" {
+		return &validationError{http.StatusBadRequest, codeInvalidField, "unsupported specversion", "/specversion"}
+	}
+
+	for _, name := range []string{"id", "source", "type"} {
+		if e.attrs[name] == "" {
+			return &validationError{http.StatusBadRequest, codeMissingField, fmt.Sprintf("missing %s", name), "/" + name}
+		}
+	}
+
+	return nil
+}
+
+// Returns the Kafka message for the event, routed to its topic, checked against the
+// topic's settings and redacted. The ID of the request it was sent in is added as a
+// header unless it's "".
+func (e *cloudEvent) message(requestID string) (kafka.Message, *validationError) {
+	topic := routeEvent(e)
+	if topic == "" {
+		return kafka.Message{}, &validationError{http.StatusBadRequest, codeNoRoute, "no route for event", ""}
+	} else if !downstream.Producible(topic) {
+		return kafka.Message{}, &validationError{http.StatusBadRequest, codeTopicNotAllowed, "invalid topic", ""}
+	}
+
+	message := e.encode(topic)
+	if requestID != "" {
+		message.Headers = append(message.Headers, kafka.Header{Key: downstream.RequestIDHeader, Value: []byte(requestID)})
+	}
+
+	verr := checkTopicSettings(message)
+	if verr == nil {
+		verr = redactMessage(&message)
+	}
+	if verr == nil {
+		verr = checkMessageSize(message)
+	}
+	if verr == nil {
+		verr = allowTopic(message.Topic)
+	}
+
+	// Pointers are to the fields of a `/produce` body, which events don't have
+	if verr != nil {
+		verr.pointer = ""
+		return message, verr
+	}
+	return message, nil
+}
+
+// Encodes the event as a message for the topic using the configured protocol binding mode
+func (e *cloudEvent) encode(topic string) kafka.Message {
+	message := kafka.Message{Topic: topic}
+
+	// The Kafka binding maps the `partitionkey` extension to the message key
+	if key := e.attrs["partitionkey"]; key != "" {
+		message.Key = []byte(key)
+	}
+
+	if util.Config.CloudEvents.Mode == util.StructuredEvents {
+		message.Value = e.structured()
+		message.Headers = []kafka.Header{{Key: "content-type", Value: []byte(cloudEventsContentType)}}
+		return message
+	}
+
+	message.Value = e.data
+
+	names := make([]string, 0, len(e.attrs))
+	for name := range e.attrs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		key := "ce_" + name
+		if name == "datacontenttype" {
+			key = "content-type"
+		}
+		message.Headers = append(message.Headers, kafka.Header{Key: key, Value: []byte(e.attrs[name])})
+	}
+
+	return message
+}
+
+// Returns the event encoded in the JSON event format
+func (e *cloudEvent) structured() []byte {
+	obj := make(map[string]interface{}, len(e.attrs)+1)
+	for name, value := range e.attrs {
+		obj[name] = value
+	}
+
+	switch {
+	case e.dataJSON != nil:
+		obj["data"] = e.dataJSON
+	case len(e.data) == 0:
+	case isJSONContentType(e.attrs["datacontenttype"]) && json.Valid(e.data):
+		obj["data"] = json.RawMessage(e.data)
+	default:
+		obj["data_base64"] = base64.StdEncoding.EncodeToString(e.data)
+	}
+
+	str, _ := json.Marshal(obj)
+	return str
+}
+
+// Returns the topic of the first route matching the event, or "" if none match
+func routeEvent(e *cloudEvent) string {
+	for _, route := range util.Config.CloudEvents.Routes {
+		if matchPattern(route.Type, e.attrs["type"]) && matchPattern(route.Source, e.attrs["source"]) {
+			return route.Topic
+		}
+	}
+	return ""
+}
+
+// Matches a value against a pattern that's empty (matches anything), ends in "*"
+// (matches by prefix), or is otherwise matched exactly.
+func matchPattern(pattern, value string) bool {
+	if pattern == "" {
+		return true
+	} else if prefix, ok := strings.CutSuffix(pattern, "*"); ok {
+		return strings.HasPrefix(value, prefix)
+	}
+	return pattern == value
+}
+
+// Reports whether the content type describes JSON data. A missing content type implies JSON.
+func isJSONContentType(contentType string) bool {
+	if contentType == "" {
+		return true
+	}
+
+	mediaType := strings.ToLower(strings.TrimSpace(strings.Split(contentType, ";")[0]))
+	return mediaType == "application/json" || mediaType == "text/json" || strings.HasSuffix(mediaType, "+json")
+}
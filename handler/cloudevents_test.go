@@ -0,0 +1,178 @@
+package handler
+
+import (
+	"beget/downstream"
+	"beget/util"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/segmentio/kafka-go"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCloudEventsHandler(t *testing.T) {
+	util.InitLogging()
+
+	sink := downstream.NewMemorySink()
+	stubSink := downstream.DefaultSink
+	downstream.DefaultSink = sink
+
+	downstream.KafkaTopics = make(map[string]struct{})
+	downstream.KafkaTopics["orders"] = struct{}{}
+	downstream.KafkaTopics["events"] = struct{}{}
+
+	util.Config.CloudEvents.Mode = util.BinaryEvents
+	util.Config.CloudEvents.Routes = []util.CloudEventRoute{
+		{Type: "com.example.order.*", Topic: "orders"},
+		{Source: "/legacy", Topic: "legacy"},
+		{Source: "/app", Topic: "events"},
+	}
+
+	post := func(contentType string, headers map[string]string, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest(http.MethodPost, "/cloudevents", strings.NewReader(body))
+		req.Header.Set("Content-Type", contentType)
+		for k, v := range headers {
+			req.Header.Set(k, v)
+		}
+		cloudEventsHandler(w, req)
+		return w
+	}
+
+	t.Run("structured", func(t *testing.T) {
+		sink.Reset()
+
+		w := post(cloudEventsContentType, nil, `{"specversion":"1.0","id":"1","source":"/shop","type":"com.example.order.created","partitionkey":"u1","data":{"total":5}}`)
+
+		assert.Equal(t, 200, w.Code)
+		assert.Equal(t, []kafka.Message{{
+			Topic: "orders",
+			Key:   []byte("u1"),
+			Value: []byte(`{"total":5}`),
+			Headers: []kafka.Header{
+				{Key: "ce_id", Value: []byte("1")},
+				{Key: "ce_partitionkey", Value: []byte("u1")},
+				{Key: "ce_source", Value: []byte("/shop")},
+				{Key: "ce_specversion", Value: []byte("1.0")},
+				{Key: "ce_type", Value: []byte("com.example.order.created")},
+			},
+		}}, sink.Messages())
+	})
+
+	t.Run("batch", func(t *testing.T) {
+		sink.Reset()
+
+		w := post(cloudEventsBatchContentType, nil, `[
+			{"specversion":"1.0","id":"1","source":"/app","type":"click","datacontenttype":"text/plain","data":"hello"},
+			{"specversion":"1.0","id":"2","source":"/app","type":"click","data_base64":"aGk="}
+		]`)
+
+		assert.Equal(t, 200, w.Code)
+		assert.Len(t, sink.Messages(), 2)
+		assert.Equal(t, "events", sink.Messages()[0].Topic)
+		assert.Equal(t, []byte("hello"), sink.Messages()[0].Value)
+		assert.Equal(t, kafka.Header{Key: "content-type", Value: []byte("text/plain")}, sink.Messages()[0].Headers[0])
+		assert.Equal(t, []byte("hi"), sink.Messages()[1].Value)
+	})
+
+	t.Run("binary", func(t *testing.T) {
+		sink.Reset()
+
+		w := post("application/json", map[string]string{
+			"ce-specversion": "1.0",
+			"ce-id":          "1",
+			"ce-source":      "/app",
+			"ce-type":        "click",
+		}, `{"x":1}`)
+
+		assert.Equal(t, 200, w.Code)
+		assert.Equal(t, []kafka.Message{{
+			Topic: "events",
+			Value: []byte(`{"x":1}`),
+			Headers: []kafka.Header{
+				{Key: "content-type", Value: []byte("application/json")},
+				{Key: "ce_id", Value: []byte("1")},
+				{Key: "ce_source", Value: []byte("/app")},
+				{Key: "ce_specversion", Value: []byte("1.0")},
+				{Key: "ce_type", Value: []byte("click")},
+			},
+		}}, sink.Messages())
+	})
+
+	t.Run("binary percent-encoded", func(t *testing.T) {
+		sink.Reset()
+
+		w := post("application/json", map[string]string{
+			"ce-specversion": "1.0",
+			"ce-id":          "1",
+			"ce-source":      "/app",
+			"ce-type":        "click",
+			"ce-subject":     "caf%C3%A9%20%2B%20%22bar%22",
+		}, `{"x":1}`)
+
+		assert.Equal(t, 200, w.Code)
+		assert.Contains(t, sink.Messages()[0].Headers, kafka.Header{Key: "ce_subject", Value: []byte(`café + "bar"`)})
+
+		w = post("application/json", map[string]string{
+			"ce-specversion": "1.0",
+			"ce-id":          "%zz",
+			"ce-source":      "/app",
+			"ce-type":        "click",
+		}, `{"x":1}`)
+
+		assert.Equal(t, 400, w.Code)
+		assertProblem(t, w.Header(), w.Body.Bytes(), codeInvalidParameter, "invalid ce-id header")
+	})
+
+	t.Run("structured kafka mode", func(t *testing.T) {
+		sink.Reset()
+		util.Config.CloudEvents.Mode = util.StructuredEvents
+		defer func() { util.Config.CloudEvents.Mode = util.BinaryEvents }()
+
+		w := post("text/plain", map[string]string{
+			"ce-specversion": "1.0",
+			"ce-id":          "1",
+			"ce-source":      "/app",
+			"ce-type":        "click",
+		}, `hello`)
+
+		assert.Equal(t, 200, w.Code)
+		assert.Len(t, sink.Messages(), 1)
+		assert.Equal(t, []kafka.Header{{Key: "content-type", Value: []byte(cloudEventsContentType)}}, sink.Messages()[0].Headers)
+		assert.JSONEq(t, `{"specversion":"1.0","id":"1","source":"/app","type":"click","datacontenttype":"text/plain","data_base64":"aGVsbG8="}`, string(sink.Messages()[0].Value))
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		sink.Reset()
+
+		tests := []struct {
+			contentType string
+			body        string
+			status      int
+			code        string
+			msg         string
+		}{
+			{"application/json", `{}`, 415, codeUnsupportedMediaType, "request is not a CloudEvent"},
+			{cloudEventsContentType, `{"specversion":"0.3","id":"1","source":"/app","type":"click"}`, 400, codeInvalidField, "unsupported specversion"},
+			{cloudEventsContentType, `{"specversion":"1.0","source":"/app","type":"click"}`, 400, codeMissingField, "missing id"},
+			{cloudEventsContentType, `{"specversion":"1.0","id":"1","source":"/other","type":"click"}`, 400, codeNoRoute, "no route for event"},
+			{cloudEventsContentType, `{"specversion":"1.0","id":"1","source":"/legacy","type":"click"}`, 400, codeTopicNotAllowed, "invalid topic"},
+			{cloudEventsBatchContentType, `[{"specversion":"1.0","id":"1","source":"/app","type":"click"},{"specversion":"1.0"}]`, 400, codeMissingField, "event 1: missing id"},
+		}
+
+		for _, test := range tests {
+			w := post(test.contentType, nil, test.body)
+
+			assert.Equal(t, test.status, w.Code)
+			assertProblem(t, w.Header(), w.Body.Bytes(), test.code, test.msg)
+		}
+		assert.Empty(t, sink.Messages())
+	})
+
+	// Restore stubs
+	util.Config.CloudEvents = util.CloudEventsConfig{}
+	downstream.KafkaTopics = make(map[string]struct{})
+	downstream.DefaultSink = stubSink
+}
@@ -0,0 +1,194 @@
+// Handles consuming topics over HTTP.
+//
+// Author: Kirk Morales
+// Copyright 2022. All Rights Reserved.
+
+package handler
+
+import (
+	"beget/downstream"
+	"beget/util"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi"
+	"github.com/segmentio/kafka-go"
+)
+
+const (
+	defaultFetchMax  = 10
+	maxFetchMax      = 1000
+	defaultFetchWait = 5 * time.Second
+)
+
+// A record returned to the client
+type consumeRecord struct {
+	Partition int               `json:"partition"`
+	Offset    int64             `json:"offset"`
+	Key       string            `json:"key,omitempty"`
+	Value     json.RawMessage   `json:"value"`
+	Headers   map[string]string `json:"headers,omitempty"`
+	Timestamp time.Time         `json:"timestamp"`
+}
+
+// Expected request body for committing offsets
+type commitBody struct {
+	Group   string // The consumer group to commit offsets for (required)
+	Offsets []struct {
+		Partition int   // The partition of the record
+		Offset    int64 // The offset of the last record processed in the partition
+	}
+}
+
+// Handles a request to fetch records from a topic for a consumer group. Waits up to
+// `timeout` for a record to arrive, returning an empty list if none do. Records aren't
+// committed until the client commits their offsets.
+func consumeRecordsHandler(w http.ResponseWriter, r *http.Request) {
+	topic, ok := readableTopic(w, r)
+	if !ok {
+		return
+	}
+
+	query := r.URL.Query()
+
+	group := query.Get("group")
+	if group == "" {
+		writeError(w, r, &validationError{http.StatusBadRequest, codeMissingParameter, "missing group", ""})
+		return
+	}
+
+	max := defaultFetchMax
+	if s := query.Get("max"); s != "" {
+		var err error
+		if max, err = strconv.Atoi(s); err != nil || max < 1 || max > maxFetchMax {
+			writeError(w, r, &validationError{http.StatusBadRequest, codeInvalidParameter, "max must be between 1 and 1000", ""})
+			return
+		}
+	}
+
+	wait := defaultFetchWait
+	if s := query.Get("timeout"); s != "" {
+		var err error
+		if wait, err = time.ParseDuration(s); err != nil || wait < 0 {
+			writeError(w, r, &validationError{http.StatusBadRequest, codeInvalidParameter, "invalid timeout", ""})
+			return
+		}
+	}
+
+	// Leave time to respond before the request itself times out. Short timeouts keep
+	// half of their time to respond rather than a second, so the wait stays positive.
+	if timeout := time.Duration(util.Config.Server.Timeout) * time.Second; timeout > 0 {
+		limit := timeout - time.Second
+		if limit < timeout/2 {
+			limit = timeout / 2
+		}
+		if wait > limit {
+			wait = limit
+		}
+	}
+
+	messages, err := downstream.KafkaFetch(r.Context(), topic, group, max, wait)
+	if err != nil {
+		consumeError(w, r, err)
+		return
+	}
+
+	records := make([]consumeRecord, 0, len(messages))
+	for _, m := range messages {
+		records = append(records, newConsumeRecord(m))
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"records": records})
+}
+
+// Handles a request to commit offsets for a consumer group
+func consumeCommitHandler(w http.ResponseWriter, r *http.Request) {
+	topic, ok := readableTopic(w, r)
+	if !ok {
+		return
+	}
+
+	if !checkContentType(w, r, "application/json") {
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, maxBodyBytes())
+	dec := json.NewDecoder(r.Body)
+	dec.DisallowUnknownFields()
+
+	var b commitBody
+	if err := dec.Decode(&b); err != nil {
+		writeError(w, r, decodeError(err))
+		return
+	}
+
+	if b.Group == "" {
+		writeError(w, r, &validationError{http.StatusBadRequest, codeMissingField, "missing group", "/group"})
+		return
+	} else if len(b.Offsets) == 0 {
+		writeError(w, r, &validationError{http.StatusBadRequest, codeMissingField, "missing offsets", "/offsets"})
+		return
+	}
+
+	messages := make([]kafka.Message, 0, len(b.Offsets))
+	for _, o := range b.Offsets {
+		messages = append(messages, kafka.Message{Topic: topic, Partition: o.Partition, Offset: o.Offset})
+	}
+
+	if err := downstream.KafkaCommit(r.Context(), topic, b.Group, messages); err != nil {
+		consumeError(w, r, err)
+		return
+	}
+
+	w.Write([]byte("OK"))
+}
+
+// Returns the topic in the URL if it's readable. If it isn't, an error is written
+// to the `http.ResponseWriter` and false is returned.
+func readableTopic(w http.ResponseWriter, r *http.Request) (string, bool) {
+	topic := chi.URLParam(r, "topic")
+	if _, ok := downstream.KafkaReadableTopics[topic]; !ok {
+		writeError(w, r, &validationError{http.StatusNotFound, codeTopicNotAllowed, "invalid topic", ""})
+		return "", false
+	}
+	return topic, true
+}
+
+// Writes the error from a consume operation to the response
+func consumeError(w http.ResponseWriter, r *http.Request, err error) {
+	if errors.Is(err, downstream.ErrConsumeUnavailable) {
+		writeError(w, r, &validationError{http.StatusServiceUnavailable, codeUnavailable, err.Error(), ""})
+	} else {
+		util.SugarFor(r.Context()).Error("failed to consume kafka messages:", err)
+		writeError(w, r, &validationError{http.StatusInternalServerError, codeInternal, http.StatusText(http.StatusInternalServerError), ""})
+	}
+}
+
+// Converts a Kafka message to the record returned to clients. Values that are
+// valid JSON are returned as-is and anything else is returned as a string.
+func newConsumeRecord(m kafka.Message) consumeRecord {
+	record := consumeRecord{
+		Partition: m.Partition,
+		Offset:    m.Offset,
+		Key:       string(m.Key),
+		Value:     m.Value,
+		Timestamp: m.Time,
+	}
+
+	if !json.Valid(m.Value) {
+		record.Value, _ = json.Marshal(string(m.Value))
+	}
+
+	if len(m.Headers) > 0 {
+		record.Headers = make(map[string]string, len(m.Headers))
+		for _, h := range m.Headers {
+			record.Headers[h.Key] = string(h.Value)
+		}
+	}
+
+	return record
+}
@@ -0,0 +1,138 @@
+package handler
+
+import (
+	"beget/downstream"
+	"beget/util"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConsumeHandlers(t *testing.T) {
+	util.InitLogging()
+
+	type fetchCall struct {
+		topic string
+		group string
+		max   int
+		wait  time.Duration
+	}
+	var fetches []fetchCall
+	stubKafkaFetch := downstream.KafkaFetch
+	downstream.KafkaFetch = func(ctx context.Context, topic, group string, max int, wait time.Duration) ([]kafka.Message, error) {
+		fetches = append(fetches, fetchCall{topic, group, max, wait})
+		return []kafka.Message{
+			{Topic: topic, Partition: 1, Offset: 7, Key: []byte("k"), Value: []byte(`{"foo":1}`), Time: time.Unix(0, 0).UTC()},
+			{Topic: topic, Partition: 1, Offset: 8, Value: []byte("plain"), Headers: []kafka.Header{{Key: "a", Value: []byte("1")}}, Time: time.Unix(0, 0).UTC()},
+		}, nil
+	}
+
+	var commits []kafka.Message
+	stubKafkaCommit := downstream.KafkaCommit
+	downstream.KafkaCommit = func(ctx context.Context, topic, group string, ms []kafka.Message) error {
+		commits = append(commits, ms...)
+		return nil
+	}
+
+	downstream.KafkaReadableTopics = map[string]struct{}{"foo": {}}
+	util.Config.Server.Timeout = 30
+
+	router := InitRouter()
+
+	t.Run("records", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest(http.MethodGet, "/topics/foo/records?group=g1&max=5&timeout=2s", nil)
+
+		router.ServeHTTP(w, req)
+
+		assert.Equal(t, 200, w.Code)
+		assert.Equal(t, []fetchCall{{"foo", "g1", 5, 2 * time.Second}}, fetches)
+		assert.JSONEq(t, `{"records":[
+			{"partition":1,"offset":7,"key":"k","value":{"foo":1},"timestamp":"1970-01-01T00:00:00Z"},
+			{"partition":1,"offset":8,"value":"plain","headers":{"a":"1"},"timestamp":"1970-01-01T00:00:00Z"}
+		]}`, w.Body.String())
+	})
+
+	t.Run("records timeout is capped", func(t *testing.T) {
+		fetches = fetches[:0]
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest(http.MethodGet, "/topics/foo/records?group=g1&timeout=1h", nil)
+
+		router.ServeHTTP(w, req)
+
+		assert.Equal(t, 200, w.Code)
+		assert.Equal(t, []fetchCall{{"foo", "g1", defaultFetchMax, 29 * time.Second}}, fetches)
+
+		// Short timeouts keep half of their time to respond
+		fetches = fetches[:0]
+		util.Config.Server.Timeout = 1
+		w = httptest.NewRecorder()
+
+		InitRouter().ServeHTTP(w, req)
+
+		assert.Equal(t, 200, w.Code)
+		assert.Equal(t, []fetchCall{{"foo", "g1", defaultFetchMax, 500 * time.Millisecond}}, fetches)
+
+		util.Config.Server.Timeout = 30
+	})
+
+	t.Run("invalid records requests", func(t *testing.T) {
+		tests := map[string]struct {
+			status int
+			code   string
+			msg    string
+		}{
+			"/topics/bar/records?group=g1":             {404, codeTopicNotAllowed, "invalid topic"},
+			"/topics/foo/records":                      {400, codeMissingParameter, "missing group"},
+			"/topics/foo/records?group=g1&max=0":       {400, codeInvalidParameter, "max must be between 1 and 1000"},
+			"/topics/foo/records?group=g1&timeout=foo": {400, codeInvalidParameter, "invalid timeout"},
+		}
+
+		for url, expected := range tests {
+			w := httptest.NewRecorder()
+			req, _ := http.NewRequest(http.MethodGet, url, nil)
+
+			router.ServeHTTP(w, req)
+
+			assert.Equal(t, expected.status, w.Code, url)
+			assertProblem(t, w.Header(), w.Body.Bytes(), expected.code, expected.msg)
+		}
+	})
+
+	t.Run("commit", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		body := `{"group":"g1","offsets":[{"partition":1,"offset":8}]}`
+		req, _ := http.NewRequest(http.MethodPost, "/topics/foo/commit", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+
+		router.ServeHTTP(w, req)
+
+		assert.Equal(t, 200, w.Code)
+		assert.Equal(t, []kafka.Message{{Topic: "foo", Partition: 1, Offset: 8}}, commits)
+	})
+
+	t.Run("consuming unavailable", func(t *testing.T) {
+		downstream.KafkaFetch = stubKafkaFetch
+		util.Config.App.Mode = util.DebugMode
+
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest(http.MethodGet, "/topics/foo/records?group=g1", nil)
+
+		router.ServeHTTP(w, req)
+
+		assert.Equal(t, 503, w.Code)
+		assertProblem(t, w.Header(), w.Body.Bytes(), codeUnavailable, "consuming is not available in debug mode")
+	})
+
+	// Restore stubs
+	util.Config.App.Mode = ""
+	downstream.KafkaReadableTopics = make(map[string]struct{})
+	downstream.KafkaFetch = stubKafkaFetch
+	downstream.KafkaCommit = stubKafkaCommit
+}
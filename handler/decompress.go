@@ -0,0 +1,170 @@
+// Handles decompressing request bodies sent with a Content-Encoding.
+//
+// Author: Kirk Morales
+// Copyright 2022. All Rights Reserved.
+
+package handler
+
+import (
+	"beget/util"
+	"compress/gzip"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+)
+
+const (
+	// The most a compressed body may expand by when the ratio isn't configured
+	defaultMaxCompressionRatio = 100
+
+	// Bodies may always decompress to this many bytes, regardless of the ratio, since
+	// small, repetitive JSON documents can compress extremely well
+	minDecompressedBytes = defaultMaxBodyBytes
+
+	// The most memory a zstd decoder may use for its window
+	maxZstdMemory = 64 << 20
+)
+
+// Returned when a body expands by more than the maximum compression ratio
+var errDecompressedTooLarge = errors.New("decompressed request body is too large")
+
+// Returned when a body can't be decompressed using its Content-Encoding
+type decompressError struct {
+	err error
+}
+
+func (e *decompressError) Error() string {
+	return "failed to decompress request body: " + e.err.Error()
+}
+
+func (e *decompressError) Unwrap() error {
+	return e.err
+}
+
+// Returns whether the error came from decompressing a request body
+func isDecompressError(err error) bool {
+	var decompressErr *decompressError
+	return errors.Is(err, errDecompressedTooLarge) || errors.As(err, &decompressErr)
+}
+
+// Middleware that replaces compressed request bodies with their decompressed contents,
+// so handlers (and the limits they enforce) only ever see the decompressed body.
+// Supports gzip, zstd and br. Bodies that expand by more than the configured ratio
+// fail to read, guarding against decompression bombs.
+func decompressBody(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		encoding := strings.ToLower(strings.TrimSpace(r.Header.Get("Content-Encoding")))
+		if encoding == "" || encoding == "identity" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		compressed := &countingReader{r: r.Body}
+
+		var dec io.ReadCloser
+		switch encoding {
+		case "gzip", "x-gzip":
+			gz, err := gzip.NewReader(compressed)
+			if err != nil {
+				writeError(w, r, &validationError{http.StatusBadRequest, codeInvalidEncoding, "Request body is not valid gzip", ""})
+				return
+			}
+			dec = gz
+
+		case "zstd":
+			zr, err := zstd.NewReader(compressed, zstd.WithDecoderConcurrency(1), zstd.WithDecoderMaxMemory(maxZstdMemory))
+			if err != nil {
+				util.Sugar.Error("failed to create zstd decoder:", err)
+				writeError(w, r, &validationError{http.StatusInternalServerError, codeInternal, http.StatusText(http.StatusInternalServerError), ""})
+				return
+			}
+			dec = zr.IOReadCloser()
+
+		case "br":
+			dec = io.NopCloser(brotli.NewReader(compressed))
+
+		default:
+			w.Header().Set("Accept-Encoding", "gzip, zstd, br")
+			writeError(w, r, &validationError{http.StatusUnsupportedMediaType, codeUnsupportedEncoding, "unsupported Content-Encoding", ""})
+			return
+		}
+
+		r.Body = &decompressedBody{
+			dec:        dec,
+			body:       r.Body,
+			compressed: compressed,
+			ratio:      maxCompressionRatio(),
+		}
+		r.Header.Del("Content-Encoding")
+		r.Header.Del("Content-Length")
+		r.ContentLength = -1
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Returns the most a compressed body may expand by
+func maxCompressionRatio() int64 {
+	if util.Config.Server.MaxCompressionRatio > 0 {
+		return int64(util.Config.Server.MaxCompressionRatio)
+	}
+	return defaultMaxCompressionRatio
+}
+
+// Counts the bytes read from a reader and records the last error it returned
+type countingReader struct {
+	r   io.Reader
+	n   int64
+	err error
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	if err != nil {
+		c.err = err
+	}
+	return n, err
+}
+
+// A decompressed request body that fails once it expands by more than `ratio`
+type decompressedBody struct {
+	dec        io.ReadCloser
+	body       io.ReadCloser
+	compressed *countingReader
+	ratio      int64
+	n          int64
+}
+
+func (b *decompressedBody) Read(p []byte) (int, error) {
+	if b.exceeded() {
+		return 0, errDecompressedTooLarge
+	}
+
+	n, err := b.dec.Read(p)
+	b.n += int64(n)
+
+	if b.exceeded() {
+		return n, errDecompressedTooLarge
+	}
+
+	// Errors reading the request itself are passed on as-is
+	if err != nil && err != io.EOF && !errors.Is(err, b.compressed.err) {
+		return n, &decompressError{err}
+	}
+
+	return n, err
+}
+
+// Returns whether the body has expanded by more than the maximum ratio
+func (b *decompressedBody) exceeded() bool {
+	return b.n > minDecompressedBytes && b.n > b.compressed.n*b.ratio
+}
+
+func (b *decompressedBody) Close() error {
+	return errors.Join(b.dec.Close(), b.body.Close())
+}
@@ -0,0 +1,119 @@
+package handler
+
+import (
+	"beget/downstream"
+	"beget/util"
+	"bytes"
+	"compress/gzip"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+	"github.com/segmentio/kafka-go"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDecompressBody(t *testing.T) {
+	util.InitLogging()
+
+	sink := downstream.NewMemorySink()
+	stubSink := downstream.DefaultSink
+	downstream.DefaultSink = sink
+
+	downstream.KafkaTopics = make(map[string]struct{})
+	downstream.KafkaTopics["foo"] = struct{}{}
+
+	body := `{"topic":"foo","value":"bar"}`
+
+	post := func(handler http.HandlerFunc, contentType, encoding string, body []byte) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest(http.MethodPost, "/produce", bytes.NewReader(body))
+		req.Header.Set("Content-Type", contentType)
+		req.Header.Set("Content-Encoding", encoding)
+		decompressBody(handler).ServeHTTP(w, req)
+		return w
+	}
+
+	gzipped := func(s string) []byte {
+		var buf bytes.Buffer
+		gz := gzip.NewWriter(&buf)
+		gz.Write([]byte(s))
+		gz.Close()
+		return buf.Bytes()
+	}
+
+	t.Run("gzip", func(t *testing.T) {
+		sink.Reset()
+
+		w := post(topicProduceHandler, "application/json", "gzip", gzipped(body))
+
+		assert.Equal(t, 200, w.Code)
+		assert.Equal(t, []kafka.Message{{Topic: "foo", Value: []byte("bar")}}, sink.Messages())
+	})
+
+	t.Run("zstd", func(t *testing.T) {
+		sink.Reset()
+
+		enc, _ := zstd.NewWriter(nil)
+		w := post(topicProduceHandler, "application/json", "zstd", enc.EncodeAll([]byte(body), nil))
+
+		assert.Equal(t, 200, w.Code)
+		assert.Equal(t, []kafka.Message{{Topic: "foo", Value: []byte("bar")}}, sink.Messages())
+	})
+
+	t.Run("br", func(t *testing.T) {
+		sink.Reset()
+
+		var buf bytes.Buffer
+		br := brotli.NewWriter(&buf)
+		br.Write([]byte(body))
+		br.Close()
+
+		w := post(topicProduceHandler, "application/json", "br", buf.Bytes())
+
+		assert.Equal(t, 200, w.Code)
+		assert.Equal(t, []kafka.Message{{Topic: "foo", Value: []byte("bar")}}, sink.Messages())
+	})
+
+	t.Run("unsupported encoding", func(t *testing.T) {
+		w := post(topicProduceHandler, "application/json", "compress", []byte(body))
+
+		assert.Equal(t, 415, w.Code)
+		assertProblem(t, w.Header(), w.Body.Bytes(), codeUnsupportedEncoding, "unsupported Content-Encoding")
+		assert.Equal(t, "gzip, zstd, br", w.Header().Get("Accept-Encoding"))
+	})
+
+	t.Run("invalid gzip", func(t *testing.T) {
+		w := post(topicProduceHandler, "application/json", "gzip", []byte(body))
+
+		assert.Equal(t, 400, w.Code)
+		assertProblem(t, w.Header(), w.Body.Bytes(), codeInvalidEncoding, "Request body is not valid gzip")
+	})
+
+	t.Run("truncated gzip", func(t *testing.T) {
+		data := gzipped(body)
+
+		w := post(topicProduceHandler, "application/json", "gzip", data[:len(data)-10])
+
+		assert.Equal(t, 400, w.Code)
+		assertProblem(t, w.Header(), w.Body.Bytes(), codeInvalidEncoding, "Request body could not be decompressed")
+	})
+
+	t.Run("decompressed size is limited", func(t *testing.T) {
+		w := post(topicProduceHandler, "application/json", "gzip", gzipped(`{"topic":"foo","value":"`+strings.Repeat("a", 2*defaultMaxBodyBytes)+`"}`))
+
+		assert.Equal(t, 413, w.Code)
+	})
+
+	t.Run("rejects decompression bombs in streams", func(t *testing.T) {
+		w := post(streamProduceHandler, "application/x-ndjson", "gzip", gzipped(strings.Repeat("\n", 10*defaultMaxBodyBytes)))
+
+		assert.Equal(t, 200, w.Code)
+		assert.Contains(t, w.Body.String(), `"status":413,"error":"Request body expands by too much when decompressed"`)
+	})
+
+	downstream.DefaultSink = stubSink
+}
@@ -0,0 +1,261 @@
+// gRPC service handling
+//
+// Author: Kirk Morales
+// Copyright 2022. All Rights Reserved.
+
+package handler
+
+import (
+	"beget/begetpb"
+	"beget/downstream"
+	"beget/util"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+// The most messages a `ProduceStream` call accepts by default
+const defaultGrpcMaxStreamMessages = 10000
+
+// Implements the `beget.v1.Producer` gRPC service
+type grpcProducer struct {
+	begetpb.UnimplementedProducerServer
+}
+
+// Initializes the gRPC server
+func InitGrpcServer() *grpc.Server {
+	srv := grpc.NewServer(
+		grpc.ChainUnaryInterceptor(grpcUnaryRequestID, grpcUnaryLogger),
+		grpc.ChainStreamInterceptor(grpcStreamRequestID, grpcStreamLogger),
+	)
+
+	begetpb.RegisterProducerServer(srv, &grpcProducer{})
+
+	return srv
+}
+
+// Produces a single message
+func (p *grpcProducer) Produce(ctx context.Context, req *begetpb.ProduceRequest) (*begetpb.ProduceResponse, error) {
+	body, verr := grpcBody(req, grpcMeta(ctx))
+	if verr != nil {
+		return nil, status.Error(grpcCode(verr.status), verr.msg)
+	}
+
+	// As with `/produce`, the request context is intentionally not passed down
+	if err := downstream.Produce(context.Background(), body.message()); err != nil {
+		util.SugarFor(ctx).Error("failed to write kafka messages:", err)
+		return nil, status.Error(codes.Internal, "failed to produce message")
+	}
+
+	return &begetpb.ProduceResponse{}, nil
+}
+
+// Produces a batch of messages
+func (p *grpcProducer) ProduceBatch(ctx context.Context, req *begetpb.ProduceBatchRequest) (*begetpb.ProduceBatchResponse, error) {
+	return &begetpb.ProduceBatchResponse{Results: produceBatch(req.Messages, grpcMeta(ctx))}, nil
+}
+
+// Produces a stream of messages. Messages are written in batches as they arrive
+// so that a long-lived stream isn't buffered in full. Since results are only sent
+// when the stream closes, the stream is closed once it reaches
+// `grpcMaxStreamMessages()` messages; the response then has fewer results than
+// the client sent messages, and the rest should be sent on a new stream.
+func (p *grpcProducer) ProduceStream(stream begetpb.Producer_ProduceStreamServer) error {
+	max := grpcMaxStreamMessages()
+	results := make([]*begetpb.ProduceResult, 0, batchSize())
+	pending := make([]*begetpb.ProduceRequest, 0, batchSize())
+
+	for len(results)+len(pending) < max {
+		req, err := stream.Recv()
+		if errors.Is(err, io.EOF) {
+			break
+		} else if err != nil {
+			return err
+		}
+
+		pending = append(pending, req)
+		if len(pending) == cap(pending) {
+			results = append(results, produceBatch(pending, grpcMeta(stream.Context()))...)
+			pending = pending[:0]
+		}
+	}
+
+	results = append(results, produceBatch(pending, grpcMeta(stream.Context()))...)
+
+	return stream.SendAndClose(&begetpb.ProduceBatchResponse{Results: results})
+}
+
+// Validates and produces the given messages, returning a result for each in the same order
+func produceBatch(reqs []*begetpb.ProduceRequest, meta downstream.RequestMeta) []*begetpb.ProduceResult {
+	results := make([]*begetpb.ProduceResult, len(reqs))
+	messages := make([]kafka.Message, 0, len(reqs))
+	indexes := make([]int, 0, len(reqs))
+
+	for i, req := range reqs {
+		body, verr := grpcBody(req, meta)
+		if verr != nil {
+			results[i] = &begetpb.ProduceResult{Code: uint32(grpcCode(verr.status)), Error: verr.msg}
+			continue
+		}
+
+		messages = append(messages, body.message())
+		indexes = append(indexes, i)
+	}
+
+	if len(messages) == 0 {
+		return results
+	}
+
+	// If only some messages failed, the writer reports an error for each one
+	err := downstream.ProduceBatch(context.Background(), messages)
+	var writeErrors kafka.WriteErrors
+	errors.As(err, &writeErrors)
+
+	for j, i := range indexes {
+		msgErr := err
+		if writeErrors != nil {
+			msgErr = writeErrors[j]
+		}
+
+		results[i] = &begetpb.ProduceResult{}
+		if msgErr != nil {
+			util.SugarForRequest(meta.RequestID).Error("failed to write kafka messages:", msgErr)
+			results[i].Code = uint32(codes.Internal)
+			results[i].Error = "failed to produce message"
+		}
+	}
+
+	return results
+}
+
+// Returns the most messages a `ProduceStream` call accepts
+func grpcMaxStreamMessages() int {
+	if util.Config.Server.GrpcMaxStreamMessages > 0 {
+		return util.Config.Server.GrpcMaxStreamMessages
+	}
+	return defaultGrpcMaxStreamMessages
+}
+
+// Converts a gRPC request to a validated `RequestBody`
+func grpcBody(req *begetpb.ProduceRequest, meta downstream.RequestMeta) (*RequestBody, *validationError) {
+	// Held to the same limits as HTTP bodies, using the encoded message size
+	if verr := checkBodySize(req.Topic, int64(proto.Size(req))); verr != nil {
+		return nil, verr
+	}
+
+	b := RequestBody{
+		Topic: req.Topic,
+		Key:   req.Key,
+	}
+
+	// Protobuf doesn't distinguish between an empty and a missing value
+	if len(req.Value) > 0 {
+		b.Value = string(req.Value)
+	}
+
+	if verr := checkBody(&b, meta); verr != nil {
+		return nil, verr
+	}
+
+	if verr := allowTopic(b.Topic); verr != nil {
+		return nil, verr
+	}
+
+	return &b, nil
+}
+
+// Returns metadata about the call for transforms, as `requestMeta` does for HTTP requests
+func grpcMeta(ctx context.Context) downstream.RequestMeta {
+	meta := downstream.RequestMeta{Received: time.Now()}
+
+	if p, ok := peer.FromContext(ctx); ok && p.Addr != nil {
+		meta.ClientIP = p.Addr.String()
+		if ip, _, err := net.SplitHostPort(meta.ClientIP); err == nil {
+			meta.ClientIP = ip
+		}
+	}
+
+	meta.RequestID = util.RequestIDFrom(ctx)
+
+	return meta
+}
+
+// Maps the HTTP status of a validation error to a gRPC status code
+func grpcCode(httpStatus int) codes.Code {
+	switch httpStatus {
+	case http.StatusBadRequest, http.StatusUnsupportedMediaType:
+		return codes.InvalidArgument
+	case http.StatusRequestEntityTooLarge, http.StatusTooManyRequests:
+		return codes.ResourceExhausted
+	default:
+		return codes.Internal
+	}
+}
+
+// A server stream whose context carries the call's request ID
+type requestIDStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *requestIDStream) Context() context.Context {
+	return s.ctx
+}
+
+// Assigns unary gRPC calls a request ID in the same manner as `util.RequestID`
+func grpcUnaryRequestID(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	id := grpcRequestID(ctx)
+	grpc.SetHeader(ctx, metadata.Pairs("x-request-id", id))
+	return handler(util.WithRequestID(ctx, id), req)
+}
+
+// Assigns streaming gRPC calls a request ID in the same manner as `util.RequestID`
+func grpcStreamRequestID(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	id := grpcRequestID(ss.Context())
+	ss.SetHeader(metadata.Pairs("x-request-id", id))
+	return handler(srv, &requestIDStream{ss, util.WithRequestID(ss.Context(), id)})
+}
+
+// Returns the call's `x-request-id` metadata if it's valid, or a new request ID
+func grpcRequestID(ctx context.Context) string {
+	if ids := metadata.ValueFromIncomingContext(ctx, "x-request-id"); len(ids) > 0 && util.ValidRequestID(ids[0]) {
+		return ids[0]
+	}
+	return util.NewID()
+}
+
+// Logs unary gRPC calls in the same manner as `util.HttpLogger`
+func grpcUnaryLogger(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	start := time.Now()
+	res, err := handler(ctx, req)
+	logGrpc(ctx, info.FullMethod, err, start)
+	return res, err
+}
+
+// Logs streaming gRPC calls in the same manner as `util.HttpLogger`
+func grpcStreamLogger(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	start := time.Now()
+	err := handler(srv, ss)
+	logGrpc(ss.Context(), info.FullMethod, err, start)
+	return err
+}
+
+func logGrpc(ctx context.Context, method string, err error, start time.Time) {
+	util.Sugar.Infow("grpc",
+		"request_id", util.RequestIDFrom(ctx),
+		"method", method,
+		"code", status.Code(err).String(),
+		"duration", time.Since(start),
+	)
+}
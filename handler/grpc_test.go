@@ -0,0 +1,189 @@
+package handler
+
+import (
+	"beget/begetpb"
+	"beget/downstream"
+	"beget/util"
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/segmentio/kafka-go"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+// Starts an in-memory gRPC server and returns a client connected to it
+func newGrpcClient(t *testing.T) begetpb.ProducerClient {
+	lis := bufconn.Listen(1024 * 1024)
+	srv := InitGrpcServer()
+	go srv.Serve(lis)
+
+	conn, err := grpc.NewClient("passthrough:///bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return lis.DialContext(ctx)
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	assert.Nil(t, err)
+
+	t.Cleanup(func() {
+		conn.Close()
+		srv.Stop()
+	})
+
+	return begetpb.NewProducerClient(conn)
+}
+
+func TestGrpcProducer(t *testing.T) {
+	util.InitLogging()
+
+	sink := downstream.NewMemorySink()
+	sink.Fail = func(m kafka.Message) error {
+		if string(m.Value) == "fail" {
+			return errors.New("write failed")
+		}
+		return nil
+	}
+	stubSink := downstream.DefaultSink
+	downstream.DefaultSink = sink
+
+	downstream.KafkaTopics = make(map[string]struct{})
+	downstream.KafkaTopics["foo"] = struct{}{}
+
+	client := newGrpcClient(t)
+
+	t.Run("produce", func(t *testing.T) {
+		sink.Reset()
+
+		var header metadata.MD
+		ctx := metadata.AppendToOutgoingContext(context.Background(), "x-request-id", "req-1")
+		_, err := client.Produce(ctx, &begetpb.ProduceRequest{Topic: "foo", Key: "somekey", Value: []byte("foobar")}, grpc.Header(&header))
+
+		assert.Nil(t, err)
+		assert.Equal(t, []string{"req-1"}, header.Get("x-request-id"))
+		assert.Equal(t, []kafka.Message{{Topic: "foo", Key: []byte("somekey"), Value: []byte("foobar"), Headers: []kafka.Header{{Key: downstream.RequestIDHeader, Value: []byte("req-1")}}}}, sink.Messages())
+	})
+
+	t.Run("produce invalid", func(t *testing.T) {
+		sink.Reset()
+
+		tests := map[string]*begetpb.ProduceRequest{
+			"missing topic":         {Value: []byte("foobar")},
+			"invalid topic":         {Topic: "bar", Value: []byte("foobar")},
+			"missing message value": {Topic: "foo"},
+		}
+
+		for msg, req := range tests {
+			_, err := client.Produce(context.Background(), req)
+
+			assert.Equal(t, codes.InvalidArgument, status.Code(err))
+			assert.Equal(t, msg, status.Convert(err).Message())
+		}
+		assert.Empty(t, sink.Messages())
+	})
+
+	t.Run("produce batch", func(t *testing.T) {
+		sink.Reset()
+
+		var header metadata.MD
+		res, err := client.ProduceBatch(context.Background(), &begetpb.ProduceBatchRequest{
+			Messages: []*begetpb.ProduceRequest{
+				{Topic: "foo", Value: []byte("one")},
+				{Topic: "bar", Value: []byte("two")},
+				{Topic: "foo", Value: []byte("fail")},
+				{Topic: "foo", Value: []byte("three")},
+			},
+		}, grpc.Header(&header))
+
+		assert.Nil(t, err)
+		assert.Len(t, res.Results, 4)
+		assert.Equal(t, uint32(codes.OK), res.Results[0].Code)
+		assert.Equal(t, uint32(codes.InvalidArgument), res.Results[1].Code)
+		assert.Equal(t, "invalid topic", res.Results[1].Error)
+		assert.Equal(t, uint32(codes.Internal), res.Results[2].Code)
+		assert.Equal(t, "failed to produce message", res.Results[2].Error)
+		assert.Equal(t, uint32(codes.OK), res.Results[3].Code)
+
+		// Calls without an ID are given one
+		id := header.Get("x-request-id")
+		if assert.Len(t, id, 1) {
+			assert.Len(t, id[0], 32)
+			assert.Equal(t, []kafka.Message{
+				{Topic: "foo", Value: []byte("one"), Headers: []kafka.Header{{Key: downstream.RequestIDHeader, Value: []byte(id[0])}}},
+				{Topic: "foo", Value: []byte("three"), Headers: []kafka.Header{{Key: downstream.RequestIDHeader, Value: []byte(id[0])}}},
+			}, sink.Messages())
+		}
+	})
+
+	t.Run("produce stream", func(t *testing.T) {
+		sink.Reset()
+
+		stream, err := client.ProduceStream(context.Background())
+		assert.Nil(t, err)
+
+		for _, req := range []*begetpb.ProduceRequest{
+			{Topic: "foo", Value: []byte("one")},
+			{Topic: "foo"},
+			{Topic: "foo", Value: []byte("two")},
+		} {
+			assert.Nil(t, stream.Send(req))
+		}
+
+		res, err := stream.CloseAndRecv()
+
+		assert.Nil(t, err)
+		assert.Len(t, res.Results, 3)
+		assert.Equal(t, uint32(codes.OK), res.Results[0].Code)
+		assert.Equal(t, "missing message value", res.Results[1].Error)
+		assert.Equal(t, uint32(codes.OK), res.Results[2].Code)
+		assert.Len(t, sink.Messages(), 2)
+	})
+
+	t.Run("produce stream limit", func(t *testing.T) {
+		sink.Reset()
+		util.Config.Server.GrpcMaxStreamMessages = 2
+
+		stream, err := client.ProduceStream(context.Background())
+		assert.Nil(t, err)
+
+		// Sends after the server closes the stream fail with io.EOF
+		for _, value := range []string{"one", "two", "three"} {
+			if err := stream.Send(&begetpb.ProduceRequest{Topic: "foo", Value: []byte(value)}); err != nil {
+				break
+			}
+		}
+
+		res, err := stream.CloseAndRecv()
+
+		assert.Nil(t, err)
+		assert.Len(t, res.Results, 2)
+		assert.Len(t, sink.Messages(), 2)
+
+		util.Config.Server.GrpcMaxStreamMessages = 0
+	})
+
+	t.Run("produce too large", func(t *testing.T) {
+		sink.Reset()
+		downstream.KafkaTopicSettings = map[string]*downstream.TopicSettings{"foo": {TopicConfig: util.TopicConfig{MaxBodyBytes: 100}}}
+
+		_, err := client.Produce(context.Background(), &begetpb.ProduceRequest{Topic: "foo", Value: []byte(strings.Repeat("a", 100))})
+
+		assert.Equal(t, codes.ResourceExhausted, status.Code(err))
+		assert.Equal(t, "Request body must not be larger than 100 bytes", status.Convert(err).Message())
+		assert.Empty(t, sink.Messages())
+
+		downstream.KafkaTopicSettings = make(map[string]*downstream.TopicSettings)
+	})
+
+	// Restore stubs
+	downstream.KafkaTopics = make(map[string]struct{})
+	downstream.DefaultSink = stubSink
+}
@@ -0,0 +1,32 @@
+// Handles checking whether the service is ready to accept messages.
+//
+// Author: Kirk Morales
+// Copyright 2022. All Rights Reserved.
+
+package handler
+
+import (
+	"beget/downstream"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// Handles a readiness check. Responds with a 503 listing the sinks that are
+// unhealthy, if any are.
+func readinessHandler(w http.ResponseWriter, r *http.Request) {
+	errs := downstream.Health(r.Context())
+	if len(errs) == 0 {
+		w.Write([]byte("OK"))
+		return
+	}
+
+	lines := make([]string, 0, len(errs))
+	for name, err := range errs {
+		lines = append(lines, fmt.Sprintf("sink %s: %v", name, err))
+	}
+	sort.Strings(lines)
+
+	http.Error(w, strings.Join(lines, "\n"), http.StatusServiceUnavailable)
+}
@@ -0,0 +1,55 @@
+package handler
+
+import (
+	"beget/downstream"
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// A sink that always reports the same health
+type unhealthySink struct {
+	*downstream.MemorySink
+	err error
+}
+
+func (s unhealthySink) Health(ctx context.Context) error {
+	return s.err
+}
+
+func TestReadinessHandler(t *testing.T) {
+	get := func() *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest(http.MethodGet, "/readyz", nil)
+		readinessHandler(w, req)
+		return w
+	}
+
+	t.Run("healthy", func(t *testing.T) {
+		downstream.Sinks = map[string]downstream.Sink{"memory": downstream.NewMemorySink()}
+
+		w := get()
+
+		assert.Equal(t, 200, w.Code)
+		assert.Equal(t, "OK", w.Body.String())
+	})
+
+	t.Run("unhealthy", func(t *testing.T) {
+		downstream.Sinks = map[string]downstream.Sink{
+			"memory": downstream.NewMemorySink(),
+			"kafka":  unhealthySink{downstream.NewMemorySink(), errors.New("no brokers")},
+			"log":    unhealthySink{downstream.NewMemorySink(), errors.New("disk full")},
+		}
+
+		w := get()
+
+		assert.Equal(t, 503, w.Code)
+		assert.Equal(t, "sink kafka: no brokers\nsink log: disk full\n", w.Body.String())
+	})
+
+	downstream.Sinks = nil
+}
@@ -0,0 +1,164 @@
+// Handles deduplication of retried requests using idempotency keys.
+//
+// Author: Kirk Morales
+// Copyright 2022. All Rights Reserved.
+
+package handler
+
+import (
+	"beget/util"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+const (
+	defaultIdempotencyTTL     = 24 * time.Hour
+	defaultIdempotencyMaxKeys = 10000
+)
+
+// The stored outcome of a request made with an idempotency key
+type IdempotentResponse struct {
+	Fingerprint string // Identifies the request the key was first used with
+	Status      int    // The HTTP status code of the response, or 0 while the request is in progress
+	Body        []byte // The body of the response
+}
+
+// Stores the outcome of requests by idempotency key so that retries can be answered
+// without producing again. Entries should expire after a configured TTL. The default
+// is an in-memory LRU, but a shared backend (e.g. Redis) can be used by assigning
+// `Idempotency` before calling `InitRouter`. Implementations must be safe for concurrent use.
+type IdempotencyStore interface {
+	// Claims the key for a new request. If the key was already claimed, the
+	// existing response is returned along with false.
+	Claim(ctx context.Context, key string, res IdempotentResponse) (IdempotentResponse, bool, error)
+
+	// Stores the final response for a claimed key
+	Complete(ctx context.Context, key string, res IdempotentResponse) error
+
+	// Releases a claimed key without storing a response so the request can be retried
+	Release(ctx context.Context, key string) error
+}
+
+// The store used for idempotency keys. If nil, `InitRouter` creates an in-memory store.
+var Idempotency IdempotencyStore
+
+// Initializes the in-memory idempotency store from `Config.Server.Idempotency`
+func initIdempotency() {
+	if Idempotency != nil {
+		return
+	}
+
+	ttl := util.Config.Server.Idempotency.TTL
+	if ttl <= 0 {
+		ttl = defaultIdempotencyTTL
+	}
+
+	maxKeys := util.Config.Server.Idempotency.MaxKeys
+	if maxKeys <= 0 {
+		maxKeys = defaultIdempotencyMaxKeys
+	}
+
+	Idempotency = &memoryIdempotencyStore{cache: util.NewLRUCache[IdempotentResponse](maxKeys, ttl)}
+}
+
+// An `IdempotencyStore` backed by a bounded in-memory LRU
+type memoryIdempotencyStore struct {
+	cache *util.LRUCache[IdempotentResponse]
+}
+
+func (s *memoryIdempotencyStore) Claim(_ context.Context, key string, res IdempotentResponse) (IdempotentResponse, bool, error) {
+	existing, claimed := s.cache.SetIfAbsent(key, res)
+	return existing, claimed, nil
+}
+
+func (s *memoryIdempotencyStore) Complete(_ context.Context, key string, res IdempotentResponse) error {
+	s.cache.Set(key, res)
+	return nil
+}
+
+func (s *memoryIdempotencyStore) Release(_ context.Context, key string) error {
+	s.cache.Remove(key)
+	return nil
+}
+
+// Returns the idempotency key for the request, taken from the `Idempotency-Key`
+// header or, if that's missing, the `id` field of the body.
+func idempotencyKey(r *http.Request, b *RequestBody) string {
+	if key := r.Header.Get("Idempotency-Key"); key != "" {
+		return key
+	}
+	return b.ID
+}
+
+// Returns a fingerprint identifying the message described by the body. The value
+// is taken as sent, since transforms may add fields that differ between retries.
+func (b *RequestBody) fingerprint() string {
+	// Retries are sent in requests of their own, so leave out the request ID
+	c := *b
+	c.requestID = ""
+	m := c.message()
+
+	data, _ := json.Marshal([]interface{}{m.Topic, m.Key, b.Value, m.Headers})
+	sum := sha256.Sum256(data)
+
+	return hex.EncodeToString(sum[:])
+}
+
+// Claims the request's idempotency key. If the key was already used, the original
+// response (or an error) is written to the `http.ResponseWriter` and false is returned.
+// Otherwise the caller must call `completeIdempotent` or `releaseIdempotent` when done.
+func claimIdempotent(w http.ResponseWriter, r *http.Request, key, fingerprint string) bool {
+	existing, claimed, err := Idempotency.Claim(r.Context(), key, IdempotentResponse{Fingerprint: fingerprint})
+	if err != nil {
+		util.SugarFor(r.Context()).Error("failed to claim idempotency key:", err)
+		writeError(w, r, &validationError{http.StatusInternalServerError, codeInternal, http.StatusText(http.StatusInternalServerError), ""})
+		return false
+	} else if claimed {
+		return true
+	}
+
+	switch {
+	case existing.Fingerprint != fingerprint:
+		writeError(w, r, &validationError{http.StatusUnprocessableEntity, codeIdempotencyKeyReused, "Idempotency-Key was already used with a different request", ""})
+	case existing.Status == 0:
+		writeError(w, r, &validationError{http.StatusConflict, codeRequestInProgress, "a request with this Idempotency-Key is in progress", ""})
+	case existing.Status == http.StatusGatewayTimeout:
+		w.Header().Set("Idempotent-Replayed", "true")
+		writeError(w, r, &validationError{http.StatusGatewayTimeout, codeTimeout, "a request with this Idempotency-Key timed out and its message may have been written", ""})
+	default:
+		w.Header().Set("Idempotent-Replayed", "true")
+		w.WriteHeader(existing.Status)
+		w.Write(existing.Body)
+	}
+
+	return false
+}
+
+// Stores the response for a claimed idempotency key. Uses a fresh context since
+// the outcome should be recorded even if the request itself timed out.
+func completeIdempotent(key, fingerprint string, status int, body []byte) {
+	res := IdempotentResponse{Fingerprint: fingerprint, Status: status, Body: body}
+	if err := Idempotency.Complete(context.Background(), key, res); err != nil {
+		util.Sugar.Error("failed to store idempotent response:", err)
+	}
+}
+
+// Releases a claimed idempotency key so the request can be retried
+func releaseIdempotent(key string) {
+	if err := Idempotency.Release(context.Background(), key); err != nil {
+		util.Sugar.Error("failed to release idempotency key:", err)
+	}
+}
+
+// Releases a claimed idempotency key if the caller panics, then panics again. Must
+// be deferred directly so that it can recover.
+func releaseOnPanic(key string) {
+	if p := recover(); p != nil {
+		releaseIdempotent(key)
+		panic(p)
+	}
+}
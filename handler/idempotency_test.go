@@ -0,0 +1,151 @@
+package handler
+
+import (
+	"beget/downstream"
+	"beget/util"
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/segmentio/kafka-go"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/time/rate"
+)
+
+func TestIdempotency(t *testing.T) {
+	util.InitLogging()
+
+	fail := false
+	sink := downstream.NewMemorySink()
+	sink.Fail = func(m kafka.Message) error {
+		if fail {
+			return errors.New("write failed")
+		}
+		return nil
+	}
+	stubSink := downstream.DefaultSink
+	downstream.DefaultSink = sink
+
+	downstream.KafkaTopics = map[string]struct{}{"foo": {}}
+
+	stubIdempotency := Idempotency
+	Idempotency = nil
+	router := InitRouter()
+
+	produce := func(key, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest(http.MethodPost, "/produce", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		if key != "" {
+			req.Header.Set("Idempotency-Key", key)
+		}
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	t.Run("header", func(t *testing.T) {
+		sink.Reset()
+
+		w := produce("k1", `{"topic":"foo","value":"foobar"}`)
+		assert.Equal(t, 200, w.Code)
+		assert.Equal(t, "", w.Header().Get("Idempotent-Replayed"))
+
+		w = produce("k1", `{"topic":"foo","value":"foobar"}`)
+		assert.Equal(t, 200, w.Code)
+		assert.Equal(t, "OK", w.Body.String())
+		assert.Equal(t, "true", w.Header().Get("Idempotent-Replayed"))
+
+		assert.Len(t, sink.Messages(), 1)
+	})
+
+	t.Run("body id", func(t *testing.T) {
+		sink.Reset()
+
+		produce("", `{"id":"k2","topic":"foo","value":"foobar"}`)
+		w := produce("", `{"id":"k2","topic":"foo","value":"foobar"}`)
+
+		assert.Equal(t, "true", w.Header().Get("Idempotent-Replayed"))
+		assert.Len(t, sink.Messages(), 1)
+	})
+
+	t.Run("no key", func(t *testing.T) {
+		sink.Reset()
+
+		produce("", `{"topic":"foo","value":"foobar"}`)
+		produce("", `{"topic":"foo","value":"foobar"}`)
+
+		assert.Len(t, sink.Messages(), 2)
+	})
+
+	t.Run("different request", func(t *testing.T) {
+		sink.Reset()
+
+		produce("k3", `{"topic":"foo","value":"foobar"}`)
+		w := produce("k3", `{"topic":"foo","value":"other"}`)
+
+		assert.Equal(t, 422, w.Code)
+		assertProblem(t, w.Header(), w.Body.Bytes(), codeIdempotencyKeyReused, "Idempotency-Key was already used with a different request")
+		assert.Len(t, sink.Messages(), 1)
+	})
+
+	t.Run("in progress", func(t *testing.T) {
+		Idempotency.Claim(context.Background(), "k4", IdempotentResponse{Fingerprint: (&RequestBody{Topic: "foo", Value: "foobar"}).fingerprint()})
+
+		w := produce("k4", `{"topic":"foo","value":"foobar"}`)
+
+		assert.Equal(t, 409, w.Code)
+		assertProblem(t, w.Header(), w.Body.Bytes(), codeRequestInProgress, "a request with this Idempotency-Key is in progress")
+	})
+
+	t.Run("failed write can be retried", func(t *testing.T) {
+		sink.Reset()
+
+		fail = true
+		produce("k5", `{"topic":"foo","value":"foobar"}`)
+		fail = false
+
+		w := produce("k5", `{"topic":"foo","value":"foobar"}`)
+
+		assert.Equal(t, "", w.Header().Get("Idempotent-Replayed"))
+		assert.Len(t, sink.Messages(), 1)
+	})
+
+	t.Run("panic releases key", func(t *testing.T) {
+		Idempotency.Claim(context.Background(), "k6", IdempotentResponse{Fingerprint: "f"})
+
+		assert.PanicsWithValue(t, "write panicked", func() {
+			defer releaseOnPanic("k6")
+			panic("write panicked")
+		})
+
+		_, claimed, _ := Idempotency.Claim(context.Background(), "k6", IdempotentResponse{Fingerprint: "f"})
+		assert.True(t, claimed)
+	})
+
+	t.Run("replays don't count toward rate limit", func(t *testing.T) {
+		sink.Reset()
+		downstream.KafkaTopicSettings = map[string]*downstream.TopicSettings{"foo": {Limiter: rate.NewLimiter(0, 1)}}
+
+		produce("k7", `{"topic":"foo","value":"foobar"}`)
+		w := produce("k7", `{"topic":"foo","value":"foobar"}`)
+		assert.Equal(t, "true", w.Header().Get("Idempotent-Replayed"))
+
+		w = produce("k8", `{"topic":"foo","value":"foobar"}`)
+		assert.Equal(t, 429, w.Code)
+
+		// A rate limited request may be retried with the same key
+		downstream.KafkaTopicSettings = make(map[string]*downstream.TopicSettings)
+		w = produce("k8", `{"topic":"foo","value":"foobar"}`)
+		assert.Equal(t, 200, w.Code)
+
+		assert.Len(t, sink.Messages(), 2)
+	})
+
+	// Restore stubs
+	Idempotency = stubIdempotency
+	downstream.KafkaTopics = make(map[string]struct{})
+	downstream.DefaultSink = stubSink
+}
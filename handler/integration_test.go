@@ -0,0 +1,344 @@
+package handler
+
+import (
+	"beget/downstream"
+	"beget/downstream/kafkatest"
+	"beget/util"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+	"github.com/stretchr/testify/assert"
+)
+
+// Runs the router and Kafka writer against an in-process broker
+func TestKafkaIntegration(t *testing.T) {
+	util.InitLogging()
+
+	broker, err := kafkatest.NewBroker("events", "orders")
+	assert.Nil(t, err)
+	defer broker.Close()
+
+	stubSink := downstream.DefaultSink
+
+	util.Config.App.Mode = util.ReleaseMode
+	util.Config.Server.Timeout = 1
+	util.Config.Kafka.Brokers = []string{broker.Addr()}
+	util.Config.Kafka.Topics = map[string]util.TopicConfig{"events": {}, "orders": {Compression: "gzip"}}
+	util.Config.Kafka.RequiredAcks = kafka.RequireAll
+
+	// Starts a server whose writer batches messages with the given options
+	serve := func(t *testing.T, batchSize int, batchTimeout time.Duration) *httptest.Server {
+		broker.Reset()
+
+		util.Config.Kafka.BatchSize = batchSize
+		util.Config.Kafka.BatchTimeout = batchTimeout
+		err := downstream.Init()
+		assert.Nil(t, err)
+
+		server := httptest.NewServer(InitRouter())
+		t.Cleanup(func() {
+			server.Close()
+			downstream.Close()
+		})
+		return server
+	}
+
+	t.Run("writes messages", func(t *testing.T) {
+		server := serve(t, 1, time.Second)
+
+		status, body := produceTo(t, server, `{"topic":"events","key":"k","value":{"n":1},"headers":{"a":"1"}}`)
+
+		assert.Equal(t, http.StatusOK, status)
+		assert.Equal(t, "OK", body)
+
+		ms := broker.Messages()
+		if assert.Len(t, ms, 1) {
+			assert.Equal(t, "events", ms[0].Topic)
+			assert.Equal(t, []byte("k"), ms[0].Key)
+			assert.Equal(t, []byte(`{"n":1}`), ms[0].Value)
+
+			// Requests without an ID are given one
+			if assert.Len(t, ms[0].Headers, 2) {
+				assert.Equal(t, kafka.Header{Key: "a", Value: []byte("1")}, ms[0].Headers[0])
+				assert.Equal(t, downstream.RequestIDHeader, ms[0].Headers[1].Key)
+				assert.Len(t, ms[0].Headers[1].Value, 32)
+			}
+		}
+
+		res, err := http.Get(server.URL + "/readyz")
+		assert.Nil(t, err)
+		res.Body.Close()
+		assert.Equal(t, http.StatusOK, res.StatusCode)
+	})
+
+	t.Run("concurrent requests share a batch", func(t *testing.T) {
+		// A full batch is written without waiting for the batch timeout, so no
+		// request times out
+		util.Config.Server.Timeout = 10
+		util.Config.Server.TimeoutPolicy = util.CancelOnTimeout
+		server := serve(t, 3, time.Minute)
+
+		var wg sync.WaitGroup
+		for i := 0; i < 3; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+
+				status, _ := produceTo(t, server, `{"topic":"events","value":"a"}`)
+				assert.Equal(t, http.StatusOK, status)
+			}()
+		}
+		wg.Wait()
+
+		batches := broker.Batches()
+		if assert.Len(t, batches, 1) {
+			assert.Len(t, batches[0], 3)
+		}
+
+		util.Config.Server.Timeout = 1
+		util.Config.Server.TimeoutPolicy = util.DetachOnTimeout
+	})
+
+	t.Run("partial batches wait for the batch timeout", func(t *testing.T) {
+		server := serve(t, 10, 300*time.Millisecond)
+
+		status, _ := produceTo(t, server, `{"topic":"events","value":"a"}`)
+
+		// The batch is never full, so only the timeout writes it
+		assert.Equal(t, http.StatusOK, status)
+		batches := broker.Batches()
+		if assert.Len(t, batches, 1) {
+			assert.Len(t, batches[0], 1)
+		}
+	})
+
+	t.Run("request times out before the batch is full", func(t *testing.T) {
+		server := serve(t, 10, 1500*time.Millisecond)
+		util.Config.Server.TimeoutPolicy = util.AcceptOnTimeout
+
+		res, err := http.Post(server.URL+"/produce", "application/json", strings.NewReader(`{"topic":"events","value":"a"}`))
+		assert.Nil(t, err)
+
+		var accepted produceStatus
+		json.NewDecoder(res.Body).Decode(&accepted)
+		res.Body.Close()
+
+		// Only a request that times out is accepted, and it's answered before the
+		// batch timeout writes the message
+		assert.Equal(t, http.StatusAccepted, res.StatusCode)
+		assert.Equal(t, statusPending, accepted.Status)
+		assert.Empty(t, broker.Messages())
+
+		assert.Eventually(t, func() bool {
+			status, _ := produceStatuses.Get(accepted.ID)
+			return status.Status == statusProduced
+		}, 5*time.Second, 50*time.Millisecond)
+		assert.Len(t, broker.Messages(), 1)
+
+		util.Config.Server.TimeoutPolicy = util.DetachOnTimeout
+	})
+
+	t.Run("request times out before the broker responds", func(t *testing.T) {
+		server := serve(t, 1, time.Second)
+		broker.SetDelay(1500 * time.Millisecond)
+
+		status, body := produceTo(t, server, `{"topic":"events","value":"a"}`)
+
+		assert.Equal(t, http.StatusOK, status)
+		assert.Equal(t, "OK", body)
+		assert.Len(t, broker.Messages(), 1)
+	})
+
+	t.Run("cancelled writes", func(t *testing.T) {
+		server := serve(t, 10, 3*time.Second)
+		util.Config.Server.TimeoutPolicy = util.CancelOnTimeout
+
+		status, _ := produceTo(t, server, `{"topic":"events","value":"a"}`)
+
+		// The batch timeout is well past the request timeout, so the response is
+		// sent before the message is written
+		assert.Equal(t, http.StatusGatewayTimeout, status)
+
+		// The writer only stops waiting, so a message that's already batched is
+		// still written
+		assert.Eventually(t, func() bool {
+			return len(broker.Messages()) == 1
+		}, 10*time.Second, 50*time.Millisecond)
+
+		util.Config.Server.TimeoutPolicy = util.DetachOnTimeout
+	})
+
+	t.Run("receipts", func(t *testing.T) {
+		server := serve(t, 1, time.Second)
+		util.Config.Server.Callbacks = util.CallbackConfig{Secret: "secret", AllowedHosts: []string{"127.0.0.1"}}
+
+		receipts := make(chan produceStatus, 1)
+		callback := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			var receipt produceStatus
+			json.NewDecoder(r.Body).Decode(&receipt)
+			receipts <- receipt
+		}))
+		defer callback.Close()
+
+		// Offset the message so it isn't at the start of the partition
+		produceTo(t, server, `{"topic":"events","value":"a"}`)
+
+		req, _ := http.NewRequest(http.MethodPost, server.URL+"/produce", strings.NewReader(`{"topic":"events","value":"b"}`))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Callback-Url", callback.URL)
+		res, err := http.DefaultClient.Do(req)
+		assert.Nil(t, err)
+		res.Body.Close()
+		assert.Equal(t, http.StatusAccepted, res.StatusCode)
+
+		select {
+		case receipt := <-receipts:
+			assert.Equal(t, statusProduced, receipt.Status)
+			if assert.NotNil(t, receipt.Partition) && assert.NotNil(t, receipt.Offset) {
+				assert.Equal(t, 0, *receipt.Partition)
+				assert.Equal(t, broker.Messages()[1].Offset, *receipt.Offset)
+			}
+		case <-time.After(time.Second):
+			assert.Fail(t, "callback not sent")
+		}
+
+		util.Config.Server.Callbacks = util.CallbackConfig{}
+	})
+
+	t.Run("retries unavailable leaders", func(t *testing.T) {
+		server := serve(t, 1, time.Second)
+		broker.FailProduce("events", kafka.LeaderNotAvailable, kafka.LeaderNotAvailable)
+
+		status, _ := produceTo(t, server, `{"topic":"events","value":"a"}`)
+
+		assert.Equal(t, http.StatusOK, status)
+		assert.Len(t, broker.Messages(), 1)
+	})
+
+	t.Run("failed writes", func(t *testing.T) {
+		server := serve(t, 1, time.Second)
+		broker.FailProduce("events", kafka.TopicAuthorizationFailed)
+
+		status, body := produceTo(t, server, `{"topic":"events","value":"a"}`)
+
+		// Failures are logged rather than returned
+		assert.Equal(t, http.StatusOK, status)
+		assert.Equal(t, "OK", body)
+		assert.Empty(t, broker.Messages())
+	})
+
+	t.Run("failed mirror writes", func(t *testing.T) {
+		mirror, err := kafkatest.NewBroker("events")
+		assert.Nil(t, err)
+		defer mirror.Close()
+
+		util.Config.Kafka.Clusters = map[string]util.ClusterConfig{"global": {Brokers: []string{mirror.Addr()}}}
+		util.Config.Kafka.Topics = map[string]util.TopicConfig{"events": {Mirror: "global"}, "orders": {Compression: "gzip"}}
+		server := serve(t, 1, time.Second)
+		mirror.FailProduce("events", kafka.TopicAuthorizationFailed)
+		failures := downstream.MirrorFailures()
+
+		// The message is written to its own cluster, so the write succeeds and a
+		// retry with the same key doesn't write it again
+		for i := 0; i < 2; i++ {
+			req, _ := http.NewRequest(http.MethodPost, server.URL+"/produce", strings.NewReader(`{"topic":"events","value":"a"}`))
+			req.Header.Set("Content-Type", "application/json")
+			req.Header.Set("Idempotency-Key", "mirrored")
+			res, err := http.DefaultClient.Do(req)
+			assert.Nil(t, err)
+			res.Body.Close()
+			assert.Equal(t, http.StatusOK, res.StatusCode)
+		}
+
+		assert.Len(t, broker.Messages(), 1)
+		assert.Empty(t, mirror.Messages())
+		assert.Equal(t, failures+1, downstream.MirrorFailures())
+
+		util.Config.Kafka.Clusters = nil
+		util.Config.Kafka.Topics = map[string]util.TopicConfig{"events": {}, "orders": {Compression: "gzip"}}
+	})
+
+	t.Run("transactions", func(t *testing.T) {
+		server := serve(t, 1, time.Second)
+		body := `{"messages":[{"topic":"events","value":"a"},{"topic":"orders","key":"o1","value":"b"},{"topic":"events","value":"c"}]}`
+
+		for i := 0; i < 2; i++ {
+			status, res := postTo(t, server, "/produce/transaction", body)
+			assert.Equal(t, http.StatusOK, status)
+			assert.Equal(t, "OK", res)
+		}
+
+		// Each partition's messages are written in a batch, compressed as the topic's
+		// writer would compress them
+		batches := broker.Batches()
+		if assert.Len(t, batches, 4) {
+			assert.Equal(t, []string{"a", "c"}, messageValues(batches[0]))
+			assert.Equal(t, []string{"b"}, messageValues(batches[1]))
+			assert.Equal(t, []byte("o1"), batches[1][0].Key)
+		}
+		assert.Equal(t, []kafka.Compression{0, kafka.Gzip, 0, kafka.Gzip}, broker.Compressions())
+		assert.Zero(t, broker.OpenTransactions())
+	})
+
+	t.Run("aborted transactions", func(t *testing.T) {
+		server := serve(t, 1, time.Second)
+		broker.FailProduce("orders", kafka.TopicAuthorizationFailed)
+		body := `{"messages":[{"topic":"events","value":"a"},{"topic":"orders","value":"b"}]}`
+
+		status, _ := postTo(t, server, "/produce/transaction", body)
+
+		assert.Equal(t, http.StatusInternalServerError, status)
+		assert.Empty(t, broker.Messages())
+		assert.Zero(t, broker.OpenTransactions())
+
+		// The producer is fenced and reinitialized, so the next transaction succeeds
+		status, _ = postTo(t, server, "/produce/transaction", body)
+
+		assert.Equal(t, http.StatusOK, status)
+		assert.Len(t, broker.Messages(), 2)
+	})
+
+	// Reset config
+	util.Config.App.Mode = util.DebugMode
+	util.Config.Kafka.Brokers = []string{}
+	util.Config.Kafka.Topics = nil
+	util.Config.Kafka.RequiredAcks = 0
+	util.Config.Kafka.BatchSize = 0
+	util.Config.Kafka.BatchTimeout = 0
+	downstream.DefaultSink = stubSink
+}
+
+// Produces the body through the server, returning the response
+func produceTo(t *testing.T, server *httptest.Server, body string) (int, string) {
+	return postTo(t, server, "/produce", body)
+}
+
+// Posts the JSON body to the server's path, returning the response
+func postTo(t *testing.T, server *httptest.Server, path, body string) (int, string) {
+	res, err := http.Post(server.URL+path, "application/json", strings.NewReader(body))
+	if !assert.Nil(t, err) {
+		return 0, ""
+	}
+	defer res.Body.Close()
+
+	data, err := ioutil.ReadAll(res.Body)
+	assert.Nil(t, err)
+
+	return res.StatusCode, string(data)
+}
+
+// Returns the values of the messages as strings
+func messageValues(ms []kafka.Message) []string {
+	values := make([]string, len(ms))
+	for i, m := range ms {
+		values[i] = string(m.Value)
+	}
+	return values
+}
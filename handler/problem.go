@@ -0,0 +1,86 @@
+// Functions associated with writing error responses
+//
+// Author: Kirk Morales
+// Copyright 2022. All Rights Reserved.
+
+package handler
+
+import (
+	"beget/util"
+	"encoding/json"
+	"net/http"
+)
+
+// Codes identifying why a request failed. Clients match on these rather than on
+// messages, so they must not change once released.
+const (
+	codeUnsupportedMediaType   = "UNSUPPORTED_MEDIA_TYPE"
+	codeUnsupportedEncoding    = "UNSUPPORTED_ENCODING"
+	codeInvalidEncoding        = "INVALID_ENCODING"
+	codeBodyTooLarge           = "BODY_TOO_LARGE"
+	codeEmptyBody              = "EMPTY_BODY"
+	codeInvalidJSON            = "INVALID_JSON"
+	codeUnknownField           = "UNKNOWN_FIELD"
+	codeInvalidField           = "INVALID_FIELD"
+	codeMissingField           = "MISSING_FIELD"
+	codeTopicNotAllowed        = "TOPIC_NOT_ALLOWED"
+	codeNoRoute                = "NO_ROUTE"
+	codeInvalidValue           = "INVALID_VALUE"
+	codeMessageTooLarge        = "MESSAGE_TOO_LARGE"
+	codeContentTypeNotAllowed  = "CONTENT_TYPE_NOT_ALLOWED"
+	codeSchemaViolation        = "SCHEMA_VIOLATION"
+	codeRuleViolation          = "RULE_VIOLATION"
+	codeRateLimited            = "RATE_LIMITED"
+	codeScriptRejected         = "SCRIPT_REJECTED"
+	codeScriptFailed           = "SCRIPT_FAILED"
+	codeNotTransactional       = "NOT_TRANSACTIONAL"
+	codeSinkMismatch           = "SINK_MISMATCH"
+	codeInvalidParameter       = "INVALID_PARAMETER"
+	codeMissingParameter       = "MISSING_PARAMETER"
+	codeCallbacksDisabled      = "CALLBACKS_DISABLED"
+	codeCallbackHostNotAllowed = "CALLBACK_HOST_NOT_ALLOWED"
+	codeIdempotencyKeyReused   = "IDEMPOTENCY_KEY_REUSED"
+	codeRequestInProgress      = "REQUEST_IN_PROGRESS"
+	codeNotFound               = "NOT_FOUND"
+	codeUnauthorized           = "UNAUTHORIZED"
+	codeTimeout                = "TIMEOUT"
+	codeProduceFailed          = "PRODUCE_FAILED"
+	codeUnavailable            = "UNAVAILABLE"
+	codeInternal               = "INTERNAL_ERROR"
+)
+
+// An error response in the RFC 7807 problem details format
+type problem struct {
+	Type      string `json:"type"`
+	Title     string `json:"title"`
+	Status    int    `json:"status"`
+	Detail    string `json:"detail"`
+	Code      string `json:"code"`                 // Identifies the error for clients
+	Pointer   string `json:"pointer,omitempty"`    // JSON pointer to the field at fault, if any
+	RequestID string `json:"request_id,omitempty"` // The ID of the request, if it has one
+}
+
+// Writes the error to the response according to `Config.Server.ErrorFormat`
+func writeError(w http.ResponseWriter, r *http.Request, verr *validationError) {
+	if util.Config.Server.ErrorFormat == util.TextErrors {
+		http.Error(w, verr.msg, verr.status)
+		return
+	}
+
+	p := problem{
+		Type:      "about:blank",
+		Title:     http.StatusText(verr.status),
+		Status:    verr.status,
+		Detail:    verr.msg,
+		Code:      verr.code,
+		Pointer:   verr.pointer,
+		RequestID: util.RequestIDFrom(r.Context()),
+	}
+
+	// As with `http.Error`, don't keep headers describing a body that isn't sent
+	w.Header().Del("Content-Length")
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(verr.status)
+	json.NewEncoder(w).Encode(p)
+}
@@ -0,0 +1,87 @@
+package handler
+
+import (
+	"beget/util"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Checks that the response is a problem with the code and detail
+func assertProblem(t *testing.T, header http.Header, body []byte, code, detail string) {
+	assert.Equal(t, "application/problem+json", header.Get("Content-Type"))
+
+	var p problem
+	assert.Nil(t, json.Unmarshal(body, &p))
+	assert.Equal(t, code, p.Code)
+	assert.Equal(t, detail, p.Detail)
+}
+
+func TestErrorResponses(t *testing.T) {
+	util.InitLogging()
+
+	produce := func(body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest(http.MethodPost, "/produce", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("X-Request-Id", "req-1")
+
+		util.RequestID(http.HandlerFunc(topicProduceHandler)).ServeHTTP(w, req)
+		return w
+	}
+
+	t.Run("problem details", func(t *testing.T) {
+		w := produce(`{"value":"foo"}`)
+
+		assert.Equal(t, 400, w.Code)
+		assert.Equal(t, "application/problem+json", w.Header().Get("Content-Type"))
+		assert.JSONEq(t, `{
+			"type": "about:blank",
+			"title": "Bad Request",
+			"status": 400,
+			"detail": "missing topic",
+			"code": "MISSING_FIELD",
+			"pointer": "/topic",
+			"request_id": "req-1"
+		}`, w.Body.String())
+	})
+
+	t.Run("field pointers", func(t *testing.T) {
+		tests := []struct {
+			body    string
+			code    string
+			pointer string
+		}{
+			{`{"topic":1}`, codeInvalidField, "/topic"},
+			{`{"headers":"a"}`, codeInvalidField, "/headers"},
+			{`{"a/b":1}`, codeUnknownField, "/a~1b"},
+			{`{"topic":"foo","value":1}`, codeTopicNotAllowed, "/topic"},
+			{`{`, codeInvalidJSON, ""},
+		}
+
+		for _, tt := range tests {
+			w := produce(tt.body)
+
+			var p problem
+			assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &p))
+			assert.Equal(t, tt.code, p.Code, tt.body)
+			assert.Equal(t, tt.pointer, p.Pointer, tt.body)
+		}
+	})
+
+	t.Run("plain text", func(t *testing.T) {
+		util.Config.Server.ErrorFormat = util.TextErrors
+
+		w := produce(`{"value":"foo"}`)
+
+		assert.Equal(t, 400, w.Code)
+		assert.Equal(t, "text/plain; charset=utf-8", w.Header().Get("Content-Type"))
+		assert.Equal(t, "missing topic\n", w.Body.String())
+
+		util.Config.Server.ErrorFormat = ""
+	})
+}
@@ -9,32 +9,55 @@ import (
 	"beget/downstream"
 	"beget/util"
 	"context"
+	"errors"
 	"net/http"
 	"time"
 
 	"github.com/go-chi/chi"
 	"github.com/go-chi/chi/middleware"
-	"github.com/rs/zerolog"
-	"github.com/segmentio/kafka-go"
 )
 
-var httpLogger zerolog.Logger
-
 // Initializes the gin engine
 func InitRouter() http.Handler {
 
+	initIdempotency()
+	initProduceStatuses()
+
 	r := chi.NewRouter()
+	r.Use(util.RequestID)
 	r.Use(util.HttpLogger)
 	r.Use(middleware.Recoverer)
 
 	r.Use(middleware.Heartbeat("/healthz"))
+	r.Use(decompressBody)
+
+	r.Group(func(r chi.Router) {
+		// Set a timeout value on the request context (ctx), that will signal
+		// through ctx.Done() that the request has timed out and further
+		// processing should be stopped.
+		r.Use(middleware.Timeout(time.Duration(util.Config.Server.Timeout) * time.Second))
+
+		r.Post("/produce", topicProduceHandler)
+		r.Post("/produce/transaction", transactionProduceHandler)
+		r.Get("/produce/status/{id}", produceStatusHandler)
+		r.Post("/cloudevents", cloudEventsHandler)
 
-	// Set a timeout value on the request context (ctx), that will signal
-	// through ctx.Done() that the request has timed out and further
-	// processing should be stopped.
-	r.Use(middleware.Timeout(time.Duration(util.Config.Server.Timeout) * time.Second))
+		r.Get("/topics/{topic}/records", consumeRecordsHandler)
+		r.Post("/topics/{topic}/commit", consumeCommitHandler)
 
-	r.Post("/produce", topicProduceHandler)
+		r.Get("/readyz", readinessHandler)
+
+		r.Route("/admin", func(r chi.Router) {
+			r.Use(requireAdmin)
+			r.Get("/loglevel", logLevelHandler)
+			r.Put("/loglevel", setLogLevelHandler)
+		})
+	})
+
+	// Streams and WebSockets may be of arbitrary length, so they aren't subject to the request timeout
+	r.Post("/produce/stream", streamProduceHandler)
+	r.Get("/ws", websocketHandler)
+	r.Get("/topics/{topic}/stream", streamRecordsHandler)
 
 	return r
 }
@@ -51,21 +74,78 @@ func topicProduceHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	message := kafka.Message{
-		Topic: body.Topic,
-		Value: body.valueStr,
+	// Requests with a callback URL are acknowledged right away
+	callback, ok := callbackURL(w, r)
+	if !ok {
+		return
+	}
+
+	// Retries with the same idempotency key get the original response rather than
+	// producing a duplicate message
+	var fingerprint string
+	key := idempotencyKey(r, body)
+	if key != "" {
+		fingerprint = body.fingerprint()
+		if !claimIdempotent(w, r, key, fingerprint) {
+			return
+		}
+
+		// Release the key if producing panics, rather than leaving it in progress
+		defer releaseOnPanic(key)
+	}
+
+	// Replays were answered above, so only new messages count toward the rate limit
+	if verr := allowTopic(body.Topic); verr != nil {
+		if key != "" {
+			releaseIdempotent(key)
+		}
+		writeError(w, r, verr)
+		return
+	}
+
+	if callback != "" {
+		receipt := produceWithReceipt(body.message(), callback, func(err error) {
+			if err != nil {
+				util.SugarFor(r.Context()).Error("failed to write kafka messages:", err)
+			}
+		})
+
+		// Retries get the same receipt, whatever the outcome of the write
+		res := writeAccepted(w, receipt)
+		if key != "" {
+			completeIdempotent(key, fingerprint, http.StatusAccepted, res)
+		}
+		return
 	}
 
-	if body.Key != "" {
-		message.Key = []byte(body.Key)
+	// NOTE: By default, `r.Context()` isn't passed down the chain to the Kafka writer
+	// because we don't believe an HTTP timeout should cause writing to cease immediately.
+	// If you feel differently, set `server.timeout_policy` to "cancel".
+	produce := func(ctx context.Context) error {
+		return downstream.Produce(ctx, body.message())
 	}
 
-	// NOTE: We intentionally do not pass `r.Context()` down the chain to the Kafka
-	// writer because we don't believe an HTTP timeout should cause writing to cease immediately.
-	// If you feel differently, can you change that below.
-	if err := downstream.KafkaProduce(context.Background(), message); err != nil {
-		util.Sugar.Error("failed to write kafka messages:", err)
+	// Idempotency keys are completed even if the write outlives the request
+	done := func(err error) {
+		if err != nil {
+			util.SugarFor(r.Context()).Error("failed to write kafka messages:", err)
+		}
+
+		switch {
+		case key == "":
+		case err == nil:
+			completeIdempotent(key, fingerprint, http.StatusOK, []byte("OK"))
+		case errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded):
+			// A cancelled message may already have been batched and still be written,
+			// so keep the key rather than risk a duplicate
+			completeIdempotent(key, fingerprint, http.StatusGatewayTimeout, nil)
+		default:
+			// Nothing was produced, so let the client retry with the same key
+			releaseIdempotent(key)
+		}
 	}
 
-	w.Write([]byte("OK"))
+	if ok, _ := produceWithPolicy(w, r, produce, done); ok {
+		w.Write([]byte("OK"))
+	}
 }
@@ -3,10 +3,10 @@ package handler
 import (
 	"beget/downstream"
 	"bytes"
-	"context"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
 
 	"github.com/segmentio/kafka-go"
@@ -20,12 +20,9 @@ func TestInitRouter(t *testing.T) {
 
 func TestProduceHandlerFailure(t *testing.T) {
 
-	results := make([]kafka.Message, 0)
-	stubKafkaProduce := downstream.KafkaProduce
-	downstream.KafkaProduce = func(ctx context.Context, m kafka.Message) error {
-		results = append(results, m)
-		return nil
-	}
+	sink := downstream.NewMemorySink()
+	stubSink := downstream.DefaultSink
+	downstream.DefaultSink = sink
 
 	t.Run("failure", func(t *testing.T) {
 
@@ -43,8 +40,8 @@ func TestProduceHandlerFailure(t *testing.T) {
 		}
 
 		assert.Equal(t, 415, res.StatusCode)
-		assert.Equal(t, "missing Content-Type header\n", string(data))
-		assert.Empty(t, results)
+		assertProblem(t, res.Header, data, codeUnsupportedMediaType, "missing Content-Type header")
+		assert.Empty(t, sink.Messages())
 	})
 
 	t.Run("success", func(t *testing.T) {
@@ -56,6 +53,7 @@ func TestProduceHandlerFailure(t *testing.T) {
 			`{"topic":"foo","value":{"foo":1}}`,
 			`{"topic":"bar","value":"foobar"}`,
 			`{"topic":"bar","value":"foobar","key":"somekey"}`,
+			`{"topic":"bar","value":"foobar","headers":{"b":"2","a":"1"}}`,
 		}
 
 		expected := []kafka.Message{
@@ -72,6 +70,14 @@ func TestProduceHandlerFailure(t *testing.T) {
 				Value: []byte("foobar"),
 				Key:   []byte("somekey"),
 			},
+			{
+				Topic: "bar",
+				Value: []byte("foobar"),
+				Headers: []kafka.Header{
+					{Key: "a", Value: []byte("1")},
+					{Key: "b", Value: []byte("2")},
+				},
+			},
 		}
 
 		for _, test := range tests {
@@ -94,8 +100,8 @@ func TestProduceHandlerFailure(t *testing.T) {
 		}
 
 		for i := range tests {
-			if len(results) >= (i + 1) {
-				assert.Equal(t, expected[i], results[i])
+			if len(sink.Messages()) >= (i + 1) {
+				assert.Equal(t, expected[i], sink.Messages()[i])
 			} else {
 				assert.FailNow(t, "invalid result length")
 			}
@@ -105,5 +111,47 @@ func TestProduceHandlerFailure(t *testing.T) {
 	})
 
 	// Restore stubs
-	downstream.KafkaProduce = stubKafkaProduce
+	downstream.DefaultSink = stubSink
+}
+
+func TestRequestIDs(t *testing.T) {
+	sink := downstream.NewMemorySink()
+	stubSink := downstream.DefaultSink
+	downstream.DefaultSink = sink
+
+	downstream.KafkaTopics = make(map[string]struct{})
+	downstream.KafkaTopics["foo"] = struct{}{}
+
+	router := InitRouter()
+
+	produce := func(id string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest(http.MethodPost, "/produce", strings.NewReader(`{"topic":"foo","value":"foobar"}`))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Idempotency-Key", "k1")
+		req.Header.Set("X-Request-Id", id)
+
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	w := produce("req-1")
+
+	assert.Equal(t, 200, w.Code)
+	assert.Equal(t, "req-1", w.Header().Get("X-Request-Id"))
+	assert.Equal(t, []kafka.Message{
+		{Topic: "foo", Value: []byte("foobar"), Headers: []kafka.Header{{Key: downstream.RequestIDHeader, Value: []byte("req-1")}}},
+	}, sink.Messages())
+
+	// Retries have their own request IDs but are still the same request
+	w = produce("req-2")
+
+	assert.Equal(t, 200, w.Code)
+	assert.Equal(t, "req-2", w.Header().Get("X-Request-Id"))
+	assert.Equal(t, "true", w.Header().Get("Idempotent-Replayed"))
+	assert.Len(t, sink.Messages(), 1)
+
+	// Restore stubs
+	downstream.KafkaTopics = make(map[string]struct{})
+	downstream.DefaultSink = stubSink
 }
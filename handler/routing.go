@@ -0,0 +1,85 @@
+// Handles routing messages produced to logical names to topics.
+//
+// Author: Kirk Morales
+// Copyright 2022. All Rights Reserved.
+
+package handler
+
+import (
+	"beget/util"
+	"encoding/json"
+	"net/http"
+	"strings"
+)
+
+// Picks the topic for a message produced to a logical name using the name's rules.
+// Runs once the body has been validated, before the topic's settings are checked.
+func routeMessage(b *RequestBody, route util.RouteConfig) *validationError {
+	// Values decoded from requests are raw JSON, which is only decoded if a rule
+	// needs it
+	value := b.Value
+	if raw, ok := value.(json.RawMessage); ok {
+		value = nil
+		if err := json.Unmarshal(raw, &value); err != nil {
+			return &validationError{http.StatusBadRequest, codeInvalidValue, "invalid message value", "/value"}
+		}
+	}
+
+	for _, rule := range route.Rules {
+		if v, ok := ruleValue(rule, b, value); ok && matchPattern(rule.Match, v) {
+			b.Topic = rule.Topic
+			return nil
+		}
+	}
+
+	if route.Default != "" {
+		b.Topic = route.Default
+		return nil
+	}
+
+	return &validationError{http.StatusBadRequest, codeNoRoute, "no route for message", ""}
+}
+
+// Returns the value of the field, header or key the rule matches on, and whether
+// it's present. `value` is the message's decoded value.
+func ruleValue(rule util.RouteRule, b *RequestBody, value interface{}) (string, bool) {
+	switch {
+	case rule.Field != "":
+		return fieldValue(value, strings.Split(rule.Field, "."))
+
+	case rule.Header != "":
+		for k, v := range b.Headers {
+			if strings.EqualFold(k, rule.Header) {
+				return v, true
+			}
+		}
+		return "", false
+
+	default:
+		return b.Key, b.Key != ""
+	}
+}
+
+// Returns the value at the path within a decoded JSON value. Strings are returned
+// as-is and anything else in its JSON form. Nulls are treated as missing.
+func fieldValue(v interface{}, path []string) (string, bool) {
+	for _, name := range path {
+		obj, ok := v.(map[string]interface{})
+		if !ok {
+			return "", false
+		}
+		if v, ok = obj[name]; !ok {
+			return "", false
+		}
+	}
+
+	switch v := v.(type) {
+	case nil:
+		return "", false
+	case string:
+		return v, true
+	default:
+		data, _ := json.Marshal(v)
+		return string(data), true
+	}
+}
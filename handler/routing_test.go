@@ -0,0 +1,99 @@
+package handler
+
+import (
+	"beget/downstream"
+	"beget/util"
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRouteMessage(t *testing.T) {
+	downstream.KafkaTopics = map[string]struct{}{"events": {}, "events.eu": {}, "events.us": {}, "orders.v2": {}}
+	downstream.KafkaRoutes = map[string]util.RouteConfig{
+		"events": {
+			Name: "events",
+			Rules: []util.RouteRule{
+				{Field: "meta.region", Match: "eu", Topic: "events.eu"},
+				{Header: "x-region", Match: "eu*", Topic: "events.eu"},
+				{Match: "eu-*", Topic: "events.eu"},
+				{Field: "priority", Match: "1", Topic: "events.us"},
+			},
+			Default: "events.us",
+		},
+		"orders": {
+			Name:  "orders",
+			Rules: []util.RouteRule{{Field: "id", Topic: "orders.v2"}},
+		},
+	}
+
+	route := func(b RequestBody) (string, *validationError) {
+		verr := checkBody(&b, downstream.RequestMeta{})
+		return b.Topic, verr
+	}
+
+	t.Run("by field", func(t *testing.T) {
+		topic, verr := route(RequestBody{Topic: "events", Value: map[string]interface{}{"meta": map[string]interface{}{"region": "eu"}}})
+
+		assert.Nil(t, verr)
+		assert.Equal(t, "events.eu", topic)
+	})
+
+	t.Run("by field of a raw value", func(t *testing.T) {
+		topic, verr := route(RequestBody{Topic: "events", Value: json.RawMessage(`{"meta":{"region":"eu"}}`)})
+
+		assert.Nil(t, verr)
+		assert.Equal(t, "events.eu", topic)
+	})
+
+	t.Run("by non-string field", func(t *testing.T) {
+		topic, verr := route(RequestBody{Topic: "events", Value: map[string]interface{}{"priority": float64(1)}})
+
+		assert.Nil(t, verr)
+		assert.Equal(t, "events.us", topic)
+	})
+
+	t.Run("by header", func(t *testing.T) {
+		topic, verr := route(RequestBody{Topic: "events", Value: "a", Headers: map[string]string{"X-Region": "eu-west"}})
+
+		assert.Nil(t, verr)
+		assert.Equal(t, "events.eu", topic)
+	})
+
+	t.Run("by key prefix", func(t *testing.T) {
+		topic, verr := route(RequestBody{Topic: "events", Key: "eu-123", Value: "a"})
+
+		assert.Nil(t, verr)
+		assert.Equal(t, "events.eu", topic)
+	})
+
+	t.Run("default", func(t *testing.T) {
+		topic, verr := route(RequestBody{Topic: "events", Key: "us-123", Value: map[string]interface{}{"meta": nil}})
+
+		assert.Nil(t, verr)
+		assert.Equal(t, "events.us", topic)
+	})
+
+	t.Run("no matching rule", func(t *testing.T) {
+		_, verr := route(RequestBody{Topic: "orders", Value: map[string]interface{}{"id": nil}})
+
+		assert.Equal(t, &validationError{http.StatusBadRequest, codeNoRoute, "no route for message", ""}, verr)
+	})
+
+	t.Run("field presence", func(t *testing.T) {
+		topic, verr := route(RequestBody{Topic: "orders", Value: map[string]interface{}{"id": "o1"}})
+
+		assert.Nil(t, verr)
+		assert.Equal(t, "orders.v2", topic)
+	})
+
+	t.Run("missing value", func(t *testing.T) {
+		_, verr := route(RequestBody{Topic: "events"})
+
+		assert.Equal(t, &validationError{http.StatusBadRequest, codeMissingField, "missing message value", "/value"}, verr)
+	})
+
+	downstream.KafkaRoutes = nil
+}
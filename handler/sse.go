@@ -0,0 +1,183 @@
+// Handles streaming topics to clients as Server-Sent Events.
+//
+// Author: Kirk Morales
+// Copyright 2022. All Rights Reserved.
+
+package handler
+
+import (
+	"beget/downstream"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+)
+
+// How often a comment is sent on an idle stream to keep proxies from closing it
+const sseKeepAlive = 15 * time.Second
+
+// Handles a request to stream records from a topic as Server-Sent Events. Every
+// partition is streamed unless `partition` is given, starting at `offset` (either
+// "earliest", "latest" or, for a single partition, a number). Each event's ID is
+// the position of the stream as comma-separated `partition:offset` pairs, so a
+// reconnecting client resumes where it left off by sending `Last-Event-ID`.
+func streamRecordsHandler(w http.ResponseWriter, r *http.Request) {
+	topic, ok := readableTopic(w, r)
+	if !ok {
+		return
+	}
+
+	pos, verr := streamPosition(r)
+	if verr != nil {
+		writeError(w, r, verr)
+		return
+	}
+
+	messages, starts, err := downstream.KafkaStream(r.Context(), topic, pos)
+	if err != nil {
+		consumeError(w, r, err)
+		return
+	}
+
+	// The cursor tracks the last offset sent for each partition, starting just
+	// before where each partition starts
+	cursor := make(map[int]int64, len(starts))
+	for partition, offset := range starts {
+		cursor[partition] = offset - 1
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	// An ID without data sets the client's Last-Event-ID without dispatching an
+	// event, so a client that reconnects before receiving a record resumes from
+	// where it started rather than from the latest offsets
+	fmt.Fprintf(w, "id: %s\n\n", formatCursor(cursor))
+
+	rc := http.NewResponseController(w)
+	rc.Flush()
+
+	ticker := time.NewTicker(sseKeepAlive)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+
+		case <-ticker.C:
+			fmt.Fprint(w, ": keep-alive\n\n")
+
+		case m, ok := <-messages:
+			if !ok {
+				return
+			}
+
+			cursor[m.Partition] = m.Offset
+
+			data, _ := json.Marshal(newConsumeRecord(m))
+			fmt.Fprintf(w, "id: %s\nevent: record\ndata: %s\n\n", formatCursor(cursor), data)
+		}
+
+		if err := rc.Flush(); err != nil {
+			return
+		}
+	}
+}
+
+// Parses the position to start streaming from using the request's query and `Last-Event-ID`
+func streamPosition(r *http.Request) (downstream.StreamPosition, *validationError) {
+	pos := downstream.StreamPosition{
+		Partition: -1,
+		Offsets:   make(map[int]int64),
+		Start:     kafka.LastOffset,
+	}
+
+	query := r.URL.Query()
+
+	if s := query.Get("partition"); s != "" {
+		partition, err := strconv.Atoi(s)
+		if err != nil || partition < 0 {
+			return pos, &validationError{http.StatusBadRequest, codeInvalidParameter, "invalid partition", ""}
+		}
+		pos.Partition = partition
+	}
+
+	switch s := query.Get("offset"); s {
+	case "", "latest":
+	case "earliest":
+		pos.Start = kafka.FirstOffset
+	default:
+		offset, err := strconv.ParseInt(s, 10, 64)
+		if err != nil || offset < 0 {
+			return pos, &validationError{http.StatusBadRequest, codeInvalidParameter, "invalid offset", ""}
+		} else if pos.Partition < 0 {
+			return pos, &validationError{http.StatusBadRequest, codeInvalidParameter, "a numeric offset requires a partition", ""}
+		}
+		pos.Offsets[pos.Partition] = offset
+	}
+
+	// Resume after the last event the client received
+	if id := r.Header.Get("Last-Event-ID"); id != "" {
+		cursor, ok := parseCursor(id)
+		if !ok {
+			return pos, &validationError{http.StatusBadRequest, codeInvalidParameter, "invalid Last-Event-ID", ""}
+		}
+		for partition, offset := range cursor {
+			if pos.Partition < 0 || pos.Partition == partition {
+				pos.Offsets[partition] = offset + 1
+			}
+		}
+	}
+
+	return pos, nil
+}
+
+// Formats a cursor as comma-separated `partition:offset` pairs, sorted by partition
+func formatCursor(cursor map[int]int64) string {
+	partitions := make([]int, 0, len(cursor))
+	for partition := range cursor {
+		partitions = append(partitions, partition)
+	}
+	sort.Ints(partitions)
+
+	pairs := make([]string, 0, len(partitions))
+	for _, partition := range partitions {
+		pairs = append(pairs, fmt.Sprintf("%d:%d", partition, cursor[partition]))
+	}
+
+	return strings.Join(pairs, ",")
+}
+
+// Parses a cursor formatted by `formatCursor`
+func parseCursor(s string) (map[int]int64, bool) {
+	cursor := make(map[int]int64)
+
+	for _, pair := range strings.Split(s, ",") {
+		p, o, found := strings.Cut(pair, ":")
+		if !found {
+			return nil, false
+		}
+
+		partition, err := strconv.Atoi(p)
+		if err != nil || partition < 0 {
+			return nil, false
+		}
+
+		offset, err := strconv.ParseInt(o, 10, 64)
+		if err != nil || offset < -1 {
+			return nil, false
+		}
+
+		cursor[partition] = offset
+	}
+
+	return cursor, true
+}
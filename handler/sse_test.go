@@ -0,0 +1,121 @@
+package handler
+
+import (
+	"beget/downstream"
+	"beget/util"
+	"bufio"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStreamRecordsHandler(t *testing.T) {
+	util.InitLogging()
+
+	var positions []downstream.StreamPosition
+	stubKafkaStream := downstream.KafkaStream
+	downstream.KafkaStream = func(ctx context.Context, topic string, pos downstream.StreamPosition) (<-chan kafka.Message, map[int]int64, error) {
+		positions = append(positions, pos)
+
+		messages := make(chan kafka.Message, 3)
+		messages <- kafka.Message{Topic: topic, Partition: 0, Offset: 5, Value: []byte(`{"foo":1}`), Time: time.Unix(0, 0).UTC()}
+		messages <- kafka.Message{Topic: topic, Partition: 1, Offset: 9, Value: []byte("bar"), Time: time.Unix(0, 0).UTC()}
+		messages <- kafka.Message{Topic: topic, Partition: 0, Offset: 6, Value: []byte("baz"), Time: time.Unix(0, 0).UTC()}
+		close(messages)
+
+		// Partition 1 starts at the latest offset, as resolved by the broker
+		return messages, map[int]int64{0: pos.Offsets[0], 1: 7, 2: pos.Offsets[2]}, nil
+	}
+
+	downstream.KafkaReadableTopics = map[string]struct{}{"foo": {}}
+
+	router := InitRouter()
+	srv := httptest.NewServer(router)
+	defer srv.Close()
+
+	t.Run("streams records", func(t *testing.T) {
+		positions = positions[:0]
+
+		req, _ := http.NewRequest(http.MethodGet, srv.URL+"/topics/foo/stream", nil)
+		req.Header.Set("Last-Event-ID", "0:4,2:10")
+		res, err := http.DefaultClient.Do(req)
+		assert.Nil(t, err)
+		defer res.Body.Close()
+
+		assert.Equal(t, 200, res.StatusCode)
+		assert.Equal(t, "text/event-stream", res.Header.Get("Content-Type"))
+		assert.Equal(t, []downstream.StreamPosition{{
+			Partition: -1,
+			Offsets:   map[int]int64{0: 5, 2: 11},
+			Start:     kafka.LastOffset,
+		}}, positions)
+
+		ids := make([]string, 0)
+		scanner := bufio.NewScanner(res.Body)
+		for scanner.Scan() {
+			if id, ok := strings.CutPrefix(scanner.Text(), "id: "); ok {
+				ids = append(ids, id)
+			}
+		}
+
+		// The first ID covers every partition, including those that haven't sent a record
+		assert.Equal(t, []string{"0:4,1:6,2:10", "0:5,1:6,2:10", "0:5,1:9,2:10", "0:6,1:9,2:10"}, ids)
+	})
+
+	t.Run("positions", func(t *testing.T) {
+		tests := map[string]downstream.StreamPosition{
+			"":                          {Partition: -1, Offsets: map[int]int64{}, Start: kafka.LastOffset},
+			"?offset=earliest":          {Partition: -1, Offsets: map[int]int64{}, Start: kafka.FirstOffset},
+			"?partition=2&offset=100":   {Partition: 2, Offsets: map[int]int64{2: 100}, Start: kafka.LastOffset},
+			"?partition=2&offset=first": {},
+		}
+
+		for query, expected := range tests {
+			req, _ := http.NewRequest(http.MethodGet, "/topics/foo/stream"+query, nil)
+			pos, verr := streamPosition(req)
+			if expected.Offsets == nil {
+				assert.Equal(t, "invalid offset", verr.msg)
+				continue
+			}
+			assert.Nil(t, verr, query)
+			assert.Equal(t, expected, pos, query)
+		}
+	})
+
+	t.Run("invalid requests", func(t *testing.T) {
+		tests := map[string]struct {
+			lastEventID string
+			status      int
+			code        string
+			msg         string
+		}{
+			"/topics/bar/stream":             {"", 404, codeTopicNotAllowed, "invalid topic"},
+			"/topics/foo/stream?offset=5":    {"", 400, codeInvalidParameter, "a numeric offset requires a partition"},
+			"/topics/foo/stream?partition=x": {"", 400, codeInvalidParameter, "invalid partition"},
+			"/topics/foo/stream":             {"garbage", 400, codeInvalidParameter, "invalid Last-Event-ID"},
+		}
+
+		for url, expected := range tests {
+			w := httptest.NewRecorder()
+			req, _ := http.NewRequest(http.MethodGet, url, nil)
+			if expected.lastEventID != "" {
+				req.Header.Set("Last-Event-ID", expected.lastEventID)
+			}
+
+			router.ServeHTTP(w, req)
+
+			assert.Equal(t, expected.status, w.Code, url)
+			assertProblem(t, w.Header(), w.Body.Bytes(), expected.code, expected.msg)
+		}
+	})
+
+	// Restore stubs
+	downstream.KafkaReadableTopics = make(map[string]struct{})
+	downstream.KafkaStream = stubKafkaStream
+}
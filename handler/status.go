@@ -0,0 +1,135 @@
+// Applies the timeout policy to writes and tracks the outcome of writes that
+// outlive their request.
+//
+// Author: Kirk Morales
+// Copyright 2022. All Rights Reserved.
+
+package handler
+
+import (
+	"beget/util"
+	"context"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/go-chi/chi"
+)
+
+const (
+	defaultStatusTTL        = time.Hour
+	defaultStatusMaxEntries = 10000
+)
+
+// The states of an accepted write
+const (
+	statusPending  = "pending"
+	statusProduced = "produced"
+	statusFailed   = "failed"
+)
+
+// The outcome of an accepted write, as returned by `/produce/status/{id}` and sent
+// to callback URLs. The topic, partition and offset are only known for writes of a
+// single message with a callback URL.
+type produceStatus struct {
+	ID        string `json:"id"`
+	Status    string `json:"status"`
+	Topic     string `json:"topic,omitempty"`
+	Partition *int   `json:"partition,omitempty"`
+	Offset    *int64 `json:"offset,omitempty"`
+	Error     string `json:"error,omitempty"`
+}
+
+// Outcomes of accepted writes by ID
+var produceStatuses *util.LRUCache[produceStatus]
+
+// Initializes the store of accepted writes from `Config.Server.StatusTTL`
+func initProduceStatuses() {
+	ttl := util.Config.Server.StatusTTL
+	if ttl <= 0 {
+		ttl = defaultStatusTTL
+	}
+
+	produceStatuses = util.NewLRUCache[produceStatus](defaultStatusMaxEntries, ttl)
+}
+
+// Writes using `produce` according to `Config.Server.TimeoutPolicy`. `done` is
+// called with the outcome of the write once it finishes, even if that's after
+// the request timed out. Returns true with the outcome if the caller should write
+// the response, or false if a response was already written because the request
+// timed out first.
+func produceWithPolicy(w http.ResponseWriter, r *http.Request, produce func(ctx context.Context) error, done func(err error)) (bool, error) {
+	ctx := r.Context()
+
+	switch util.Config.Server.TimeoutPolicy {
+	case util.CancelOnTimeout:
+		err := produce(ctx)
+		done(err)
+
+		if ctx.Err() != nil {
+			writeError(w, r, &validationError{http.StatusGatewayTimeout, codeTimeout, "request timed out", ""})
+			return false, err
+		}
+		return true, err
+
+	case util.AcceptOnTimeout:
+		result := make(chan error, 1)
+		go func() {
+			err := produce(context.Background())
+			done(err)
+			result <- err
+		}()
+
+		select {
+		case err := <-result:
+			return true, err
+		case <-ctx.Done():
+		}
+
+		status := produceStatus{ID: util.NewID(), Status: statusPending}
+		produceStatuses.Set(status.ID, status)
+
+		// Record the outcome once the write finishes
+		go func() {
+			if err := <-result; err != nil {
+				status.Status, status.Error = statusFailed, err.Error()
+			} else {
+				status.Status = statusProduced
+			}
+			produceStatuses.Set(status.ID, status)
+		}()
+
+		writeAccepted(w, status)
+		return false, nil
+
+	default:
+		// An HTTP timeout shouldn't stop the message from being written, so the
+		// response is sent once the write finishes
+		err := produce(context.Background())
+		done(err)
+		return true, err
+	}
+}
+
+// Responds with a 202 and the status of the accepted write, returning the body
+func writeAccepted(w http.ResponseWriter, status produceStatus) []byte {
+	body, _ := json.Marshal(status)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Location", "/produce/status/"+status.ID)
+	w.WriteHeader(http.StatusAccepted)
+	w.Write(body)
+	return body
+}
+
+// Handles a request for the outcome of an accepted write
+func produceStatusHandler(w http.ResponseWriter, r *http.Request) {
+	status, ok := produceStatuses.Get(chi.URLParam(r, "id"))
+	if !ok {
+		writeError(w, r, &validationError{http.StatusNotFound, codeNotFound, "unknown request", ""})
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(status)
+}
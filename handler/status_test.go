@@ -0,0 +1,158 @@
+package handler
+
+import (
+	"beget/downstream"
+	"beget/util"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+	"github.com/stretchr/testify/assert"
+)
+
+// A sink that takes `delay` to write, unless its context is done first
+type slowSink struct {
+	*downstream.MemorySink
+	delay time.Duration
+}
+
+func (s slowSink) Produce(ctx context.Context, m kafka.Message) error {
+	return s.ProduceBatch(ctx, []kafka.Message{m})
+}
+
+func (s slowSink) ProduceBatch(ctx context.Context, ms []kafka.Message) error {
+	select {
+	case <-time.After(s.delay):
+		return s.MemorySink.ProduceBatch(ctx, ms)
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func TestTimeoutPolicy(t *testing.T) {
+	util.InitLogging()
+	router := InitRouter()
+
+	sink := slowSink{downstream.NewMemorySink(), 100 * time.Millisecond}
+	stubSink := downstream.DefaultSink
+	downstream.DefaultSink = sink
+	downstream.KafkaTopics = map[string]struct{}{"foo": {}}
+
+	// Produces with a request that times out before the write finishes
+	produce := func(key string) *httptest.ResponseRecorder {
+		ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+		defer cancel()
+
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequestWithContext(ctx, http.MethodPost, "/produce", strings.NewReader(`{"topic":"foo","value":"a"}`))
+		req.Header.Add("Content-Type", "application/json")
+		if key != "" {
+			req.Header.Set("Idempotency-Key", key)
+		}
+		topicProduceHandler(w, req)
+		return w
+	}
+
+	status := func(id string) (int, produceStatus) {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest(http.MethodGet, "/produce/status/"+id, nil)
+		router.ServeHTTP(w, req)
+
+		var s produceStatus
+		json.Unmarshal(w.Body.Bytes(), &s)
+		return w.Code, s
+	}
+
+	t.Run("detach", func(t *testing.T) {
+		sink.Reset()
+		util.Config.Server.TimeoutPolicy = util.DetachOnTimeout
+
+		w := produce("")
+
+		assert.Equal(t, 200, w.Code)
+		assert.Equal(t, "OK", w.Body.String())
+		assert.Len(t, sink.Messages(), 1)
+	})
+
+	t.Run("cancel", func(t *testing.T) {
+		sink.Reset()
+		util.Config.Server.TimeoutPolicy = util.CancelOnTimeout
+
+		w := produce("")
+
+		assert.Equal(t, 504, w.Code)
+		assertProblem(t, w.Header(), w.Body.Bytes(), codeTimeout, "request timed out")
+		assert.Empty(t, sink.Messages())
+	})
+
+	t.Run("cancel keeps idempotency key", func(t *testing.T) {
+		sink.Reset()
+		util.Config.Server.TimeoutPolicy = util.CancelOnTimeout
+
+		produce("cancelled")
+		w := produce("cancelled")
+
+		// The first message may have been written, so the retry isn't produced
+		assert.Equal(t, 504, w.Code)
+		assert.Equal(t, "true", w.Header().Get("Idempotent-Replayed"))
+		assertProblem(t, w.Header(), w.Body.Bytes(), codeTimeout, "a request with this Idempotency-Key timed out and its message may have been written")
+	})
+
+	t.Run("accept", func(t *testing.T) {
+		sink.Reset()
+		util.Config.Server.TimeoutPolicy = util.AcceptOnTimeout
+
+		w := produce("")
+
+		var accepted produceStatus
+		assert.Equal(t, 202, w.Code)
+		assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &accepted))
+		assert.Equal(t, statusPending, accepted.Status)
+		assert.Equal(t, "/produce/status/"+accepted.ID, w.Header().Get("Location"))
+
+		code, s := status(accepted.ID)
+		assert.Equal(t, 200, code)
+		assert.Equal(t, accepted, s)
+
+		assert.Eventually(t, func() bool {
+			_, s := status(accepted.ID)
+			return s.Status == statusProduced
+		}, time.Second, 10*time.Millisecond)
+		assert.Len(t, sink.Messages(), 1)
+	})
+
+	t.Run("accept failure", func(t *testing.T) {
+		sink.Reset()
+		sink.Fail = func(m kafka.Message) error { return errors.New("write failed") }
+		util.Config.Server.TimeoutPolicy = util.AcceptOnTimeout
+
+		w := produce("")
+		assert.Equal(t, 202, w.Code)
+
+		var accepted produceStatus
+		json.Unmarshal(w.Body.Bytes(), &accepted)
+
+		assert.Eventually(t, func() bool {
+			_, s := status(accepted.ID)
+			return s.Status == statusFailed && s.Error == "write failed"
+		}, time.Second, 10*time.Millisecond)
+
+		sink.Fail = nil
+	})
+
+	t.Run("unknown status", func(t *testing.T) {
+		code, _ := status("missing")
+		assert.Equal(t, 404, code)
+	})
+
+	// Restore stubs
+	util.Config.Server.TimeoutPolicy = util.DetachOnTimeout
+	downstream.KafkaTopics = make(map[string]struct{})
+	downstream.DefaultSink = stubSink
+}
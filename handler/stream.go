@@ -0,0 +1,137 @@
+// Handles streaming production of newline-delimited JSON messages.
+//
+// Author: Kirk Morales
+// Copyright 2022. All Rights Reserved.
+
+package handler
+
+import (
+	"beget/downstream"
+	"beget/util"
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sync"
+)
+
+// Number of messages handled together for a single stream when the writer's
+// batch size isn't configured. This matches the kafka-go default.
+const defaultBatchSize = 100
+
+// Acknowledgement written back to the client for each line of a stream
+type streamAck struct {
+	Line   int    `json:"line"`            // The 1-based line number in the request body
+	Status int    `json:"status"`          // HTTP status code describing the outcome
+	Error  string `json:"error,omitempty"` // The error message, if production failed
+	Code   string `json:"code,omitempty"`  // The error code, if production failed
+}
+
+// Handles a request to produce an `application/x-ndjson` stream of messages. Each
+// line is a JSON object in the same format accepted by `/produce`. Lines are decoded
+// and produced as they're read, so the body is never buffered in full, and an
+// acknowledgement is streamed back for every line as soon as its write completes.
+// Acknowledgements may therefore arrive out of order and should be matched by line.
+func streamProduceHandler(w http.ResponseWriter, r *http.Request) {
+	if !checkContentType(w, r, "application/x-ndjson") {
+		return
+	}
+
+	// HTTP/1.x servers don't allow reading the request body after the response
+	// has started unless full duplex is enabled. HTTP/2 doesn't need this.
+	rc := http.NewResponseController(w)
+	if err := rc.EnableFullDuplex(); err != nil && !errors.Is(err, http.ErrNotSupported) {
+		util.SugarFor(r.Context()).Error("failed to enable full duplex:", err)
+	}
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(http.StatusOK)
+
+	acks := make(chan streamAck)
+
+	go readStream(r, acks)
+
+	enc := json.NewEncoder(w)
+	for ack := range acks {
+		// Keep draining acks even if the client went away so producers aren't blocked
+		if err := enc.Encode(ack); err == nil {
+			rc.Flush()
+		}
+	}
+}
+
+// Reads lines from the request body, producing each one and sending its
+// acknowledgement to `acks`. The channel is closed once every line is acknowledged.
+func readStream(r *http.Request, acks chan<- streamAck) {
+	var wg sync.WaitGroup
+
+	defer func() {
+		wg.Wait()
+		close(acks)
+	}()
+
+	sem := make(chan struct{}, batchSize())
+
+	maxLineBytes := maxBodyBytes()
+	scanner := bufio.NewScanner(r.Body)
+	scanner.Buffer(make([]byte, 0, 64*1024), int(maxLineBytes))
+
+	line := 0
+	for scanner.Scan() {
+		line++
+
+		raw := bytes.TrimSpace(scanner.Bytes())
+		if len(raw) == 0 {
+			continue
+		}
+
+		body, verr := decodeBody(bytes.NewReader(raw), requestMeta(r))
+		if verr == nil {
+			verr = allowTopic(body.Topic)
+		}
+		if verr != nil {
+			acks <- streamAck{Line: line, Status: verr.status, Error: verr.msg, Code: verr.code}
+			continue
+		}
+
+		sem <- struct{}{}
+		wg.Add(1)
+		go func(line int, body *RequestBody) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			ack := streamAck{Line: line, Status: http.StatusOK}
+
+			// As with `/produce`, the request context is intentionally not passed down
+			if err := downstream.Produce(context.Background(), body.message()); err != nil {
+				util.SugarFor(r.Context()).Error("failed to write kafka messages:", err)
+				ack.Status = http.StatusInternalServerError
+				ack.Error, ack.Code = "failed to produce message", codeProduceFailed
+			}
+
+			acks <- ack
+		}(line, body)
+	}
+
+	if err := scanner.Err(); err != nil {
+		switch {
+		case errors.Is(err, bufio.ErrTooLong):
+			acks <- streamAck{Line: line + 1, Status: http.StatusRequestEntityTooLarge, Error: "Line must not be larger than " + formatBytes(maxLineBytes), Code: codeBodyTooLarge}
+		case isDecompressError(err):
+			verr := decodeError(err)
+			acks <- streamAck{Line: line + 1, Status: verr.status, Error: verr.msg, Code: verr.code}
+		default:
+			util.SugarFor(r.Context()).Error("failed to read stream:", err)
+		}
+	}
+}
+
+// Returns the number of messages to handle together when producing a stream
+func batchSize() int {
+	if util.Config.Kafka.BatchSize > 0 {
+		return util.Config.Kafka.BatchSize
+	}
+	return defaultBatchSize
+}
@@ -0,0 +1,107 @@
+package handler
+
+import (
+	"beget/downstream"
+	"beget/util"
+	"bufio"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/segmentio/kafka-go"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStreamProduceHandler(t *testing.T) {
+	util.InitLogging()
+
+	sink := downstream.NewMemorySink()
+	sink.Fail = func(m kafka.Message) error {
+		if string(m.Value) == "fail" {
+			return errors.New("write failed")
+		}
+		return nil
+	}
+	stubSink := downstream.DefaultSink
+	downstream.DefaultSink = sink
+
+	downstream.KafkaTopics = make(map[string]struct{})
+	downstream.KafkaTopics["foo"] = struct{}{}
+
+	t.Run("invalid content-type header", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest(http.MethodPost, "/produce/stream", strings.NewReader(""))
+		req.Header.Add("Content-Type", "application/json")
+
+		streamProduceHandler(w, req)
+
+		assert.Equal(t, 415, w.Code)
+		assertProblem(t, w.Header(), w.Body.Bytes(), codeUnsupportedMediaType, "Content-Type header is not application/x-ndjson")
+	})
+
+	t.Run("acknowledges each line", func(t *testing.T) {
+		srv := httptest.NewServer(InitRouter())
+		defer srv.Close()
+
+		body := strings.Join([]string{
+			`{"topic":"foo","value":{"foo":1}}`,
+			``,
+			`{"topic":"bar","value":"foobar"}`,
+			`{"topic":"foo","value":"foobar","key":"somekey"}`,
+			`<>`,
+			`{"topic":"foo","value":"fail"}`,
+		}, "\n")
+
+		req, _ := http.NewRequest(http.MethodPost, srv.URL+"/produce/stream", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/x-ndjson")
+		req.Header.Set("X-Request-Id", "req-1")
+
+		res, err := http.DefaultClient.Do(req)
+		assert.Nil(t, err)
+		defer res.Body.Close()
+
+		assert.Equal(t, 200, res.StatusCode)
+		assert.Equal(t, "application/x-ndjson", res.Header.Get("Content-Type"))
+
+		acks := make(map[int]streamAck)
+		scanner := bufio.NewScanner(res.Body)
+		for scanner.Scan() {
+			var ack streamAck
+			assert.Nil(t, json.Unmarshal(scanner.Bytes(), &ack))
+			acks[ack.Line] = ack
+		}
+
+		assert.Equal(t, map[int]streamAck{
+			1: {Line: 1, Status: 200},
+			3: {Line: 3, Status: 400, Error: "invalid topic", Code: codeTopicNotAllowed},
+			4: {Line: 4, Status: 200},
+			5: {Line: 5, Status: 400, Error: "Request body contains badly-formed JSON (at position 1)", Code: codeInvalidJSON},
+			6: {Line: 6, Status: 500, Error: "failed to produce message", Code: codeProduceFailed},
+		}, acks)
+
+		assert.ElementsMatch(t, []kafka.Message{
+			{Topic: "foo", Value: []byte(`{"foo":1}`), Headers: []kafka.Header{{Key: downstream.RequestIDHeader, Value: []byte("req-1")}}},
+			{Topic: "foo", Value: []byte("foobar"), Key: []byte("somekey"), Headers: []kafka.Header{{Key: downstream.RequestIDHeader, Value: []byte("req-1")}}},
+		}, sink.Messages())
+	})
+
+	t.Run("line too large", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		line := `{"topic":"foo","value":"` + strings.Repeat(" ", defaultMaxBodyBytes) + `"}`
+		req, _ := http.NewRequest(http.MethodPost, "/produce/stream", strings.NewReader(line))
+		req.Header.Add("Content-Type", "application/x-ndjson")
+
+		streamProduceHandler(w, req)
+
+		var ack streamAck
+		assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &ack))
+		assert.Equal(t, streamAck{Line: 1, Status: 413, Error: "Line must not be larger than 1MB", Code: codeBodyTooLarge}, ack)
+	})
+
+	// Restore stubs
+	downstream.KafkaTopics = make(map[string]struct{})
+	downstream.DefaultSink = stubSink
+}
@@ -0,0 +1,182 @@
+// Handles checking messages against the settings of their topic.
+//
+// Author: Kirk Morales
+// Copyright 2022. All Rights Reserved.
+
+package handler
+
+import (
+	"beget/downstream"
+	"beget/util"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/santhosh-tekuri/jsonschema/v5"
+	"github.com/segmentio/kafka-go"
+)
+
+// Checks the message against the settings of its topic. Its size is checked
+// separately by `checkMessageSize` once it's redacted, and the topic's rate limit
+// by `allowTopic` once the message is about to be produced.
+func checkTopicSettings(m kafka.Message) *validationError {
+	settings := downstream.SettingsFor(m.Topic)
+
+	if settings.RequireKey && len(m.Key) == 0 {
+		return &validationError{http.StatusBadRequest, codeMissingField, "missing key", "/key"}
+	}
+
+	if len(settings.ContentTypes) > 0 {
+		contentType := messageContentType(m)
+		if !slices.Contains(settings.ContentTypes, contentType) {
+			msg := fmt.Sprintf("content type %s is not allowed for topic", contentType)
+			return &validationError{http.StatusUnsupportedMediaType, codeContentTypeNotAllowed, msg, ""}
+		}
+	}
+
+	if settings.Schema != nil {
+		if verr := checkSchema(settings.Schema, m.Value); verr != nil {
+			return verr
+		}
+	}
+
+	if len(settings.Rules) > 0 {
+		if verr := checkRules(settings.Rules, m); verr != nil {
+			return verr
+		}
+	}
+
+	return nil
+}
+
+// Checks the size of the message as it will be written, so should be called once
+// it's redacted and has all of its headers
+func checkMessageSize(m kafka.Message) *validationError {
+	settings := downstream.SettingsFor(m.Topic)
+
+	if settings.MaxMessageBytes > 0 && len(m.Value) > settings.MaxMessageBytes {
+		msg := fmt.Sprintf("message value must not be larger than %d bytes", settings.MaxMessageBytes)
+		return &validationError{http.StatusRequestEntityTooLarge, codeMessageTooLarge, msg, "/value"}
+	}
+
+	// The writer fails messages larger than its `batch_bytes`, so reject them up front
+	if max := downstream.MaxMessageBytes(m.Topic); max > 0 && messageSize(m) > max {
+		msg := fmt.Sprintf("message must not be larger than %d bytes", max)
+		return &validationError{http.StatusRequestEntityTooLarge, codeMessageTooLarge, msg, ""}
+	}
+
+	return nil
+}
+
+// Counts a message toward the topic's rate limit, returning an error if the limit
+// was exceeded. Called just before producing so that rejected requests and
+// idempotent replays aren't counted.
+func allowTopic(topic string) *validationError {
+	if limiter := downstream.SettingsFor(topic).Limiter; limiter != nil && !limiter.Allow() {
+		return &validationError{http.StatusTooManyRequests, codeRateLimited, "rate limit exceeded for topic", ""}
+	}
+	return nil
+}
+
+// Redacts the fields of the message's topic, recording the ID of the key any fields
+// were encrypted with in a header
+func redactMessage(m *kafka.Message) *validationError {
+	value, keyID, err := downstream.SettingsFor(m.Topic).Redact(m.Value)
+	if err != nil {
+		return &validationError{http.StatusBadRequest, codeInvalidValue, err.Error(), "/value"}
+	}
+	m.Value = value
+
+	if keyID != "" {
+		m.Headers = append(m.Headers, kafka.Header{Key: downstream.KeyIDHeader, Value: []byte(keyID)})
+	}
+	return nil
+}
+
+// Returns the size of the message's key, value and headers
+func messageSize(m kafka.Message) int64 {
+	n := len(m.Key) + len(m.Value)
+	for _, h := range m.Headers {
+		n += len(h.Key) + len(h.Value)
+	}
+	return int64(n)
+}
+
+// Returns the content type of the message's value, taken from its `content-type`
+// header or, if that's missing, detected from the value
+func messageContentType(m kafka.Message) string {
+	for _, h := range m.Headers {
+		if strings.EqualFold(h.Key, "content-type") {
+			if mediaType, _, err := mime.ParseMediaType(string(h.Value)); err == nil {
+				return mediaType
+			}
+			return string(h.Value)
+		}
+	}
+
+	if json.Valid(m.Value) {
+		return "application/json"
+	}
+	return "text/plain"
+}
+
+// Validates the value against the schema
+func checkSchema(schema *jsonschema.Schema, value []byte) *validationError {
+	var v interface{}
+	if err := json.Unmarshal(value, &v); err != nil {
+		return &validationError{http.StatusBadRequest, codeSchemaViolation, "message value must be JSON", "/value"}
+	}
+
+	err := schema.Validate(v)
+	if err == nil {
+		return nil
+	}
+
+	var ve *jsonschema.ValidationError
+	if !errors.As(err, &ve) {
+		return &validationError{http.StatusBadRequest, codeSchemaViolation, "message value does not match schema", "/value"}
+	}
+
+	// Report the most specific cause
+	for len(ve.Causes) > 0 {
+		ve = ve.Causes[0]
+	}
+
+	location := ve.InstanceLocation
+	if location == "" {
+		location = "/"
+	}
+
+	msg := fmt.Sprintf("message value does not match schema at %s: %s", location, ve.Message)
+	return &validationError{http.StatusBadRequest, codeSchemaViolation, msg, "/value" + ve.InstanceLocation}
+}
+
+// Checks the message against the rules, rejecting it with the message of the first
+// rule it breaks
+func checkRules(rules []*downstream.Rule, m kafka.Message) *validationError {
+	var value interface{}
+	if err := json.Unmarshal(m.Value, &value); err != nil {
+		value = string(m.Value)
+	}
+
+	headers := make(map[string]string, len(m.Headers))
+	for _, h := range m.Headers {
+		headers[h.Key] = string(h.Value)
+	}
+
+	for _, rule := range rules {
+		ok, err := rule.Check(value, string(m.Key), headers)
+		if err != nil {
+			util.Sugar.Debugf("rule %q couldn't be evaluated: %v", rule.Expr, err)
+		}
+		if !ok {
+			return &validationError{http.StatusBadRequest, codeRuleViolation, rule.Message, ""}
+		}
+	}
+
+	return nil
+}
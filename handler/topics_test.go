@@ -0,0 +1,284 @@
+package handler
+
+import (
+	"beget/downstream"
+	"beget/util"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/santhosh-tekuri/jsonschema/v5"
+	"github.com/segmentio/kafka-go"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/time/rate"
+)
+
+func TestCheckTopicSettings(t *testing.T) {
+	util.InitLogging()
+
+	schema := jsonschema.MustCompileString("order.json", `{"type":"object","required":["id"],"properties":{"total":{"type":"number"}}}`)
+
+	script, _ := downstream.NewScript("test.star", `
+def process(msg):
+    kind = msg["value"]["type"]
+    if kind == "bad":
+        reject(422, "bad message")
+    elif kind == "broken":
+        msg["key"] = 1
+    msg["topic"] = "missing" if kind == "lost" else "events"
+    msg["headers"]["scripted"] = "true"
+`)
+
+	downstream.KafkaTopics = map[string]struct{}{"orders.v1": {}, "logs": {}, "events": {}, "scripted": {}}
+	downstream.KafkaTopicAliases = map[string]string{"orders": "orders.v1"}
+	downstream.KafkaTopicSettings = map[string]*downstream.TopicSettings{
+		"orders.v1": {
+			TopicConfig: util.TopicConfig{Alias: "orders", RequireKey: true},
+			Schema:      schema,
+		},
+		"logs": {
+			TopicConfig: util.TopicConfig{MaxMessageBytes: 5, ContentTypes: []string{"text/plain"}},
+			Limiter:     rate.NewLimiter(0, 2),
+		},
+		"scripted": {Script: script},
+	}
+
+	check := func(b RequestBody) *validationError {
+		return checkBody(&b, downstream.RequestMeta{})
+	}
+
+	t.Run("resolves aliases", func(t *testing.T) {
+		b := RequestBody{Topic: "orders", Key: "o1", Value: map[string]interface{}{"id": "o1"}}
+
+		assert.Nil(t, checkBody(&b, downstream.RequestMeta{}))
+		assert.Equal(t, "orders.v1", b.Topic)
+
+		verr := check(RequestBody{Topic: "orders.v1", Key: "o1", Value: map[string]interface{}{"id": "o1"}})
+		assert.Equal(t, &validationError{http.StatusBadRequest, codeTopicNotAllowed, "invalid topic", "/topic"}, verr)
+	})
+
+	t.Run("required key", func(t *testing.T) {
+		verr := check(RequestBody{Topic: "orders", Value: map[string]interface{}{"id": "o1"}})
+
+		assert.Equal(t, &validationError{http.StatusBadRequest, codeMissingField, "missing key", "/key"}, verr)
+	})
+
+	t.Run("schema", func(t *testing.T) {
+		verr := check(RequestBody{Topic: "orders", Key: "o1", Value: map[string]interface{}{"id": "o1", "total": "5"}})
+		assert.Equal(t, &validationError{http.StatusBadRequest, codeSchemaViolation, "message value does not match schema at /total: expected number, but got string", "/value/total"}, verr)
+
+		verr = check(RequestBody{Topic: "orders", Key: "o1", Value: "not json"})
+		assert.Equal(t, &validationError{http.StatusBadRequest, codeSchemaViolation, "message value must be JSON", "/value"}, verr)
+	})
+
+	t.Run("max message size", func(t *testing.T) {
+		verr := check(RequestBody{Topic: "logs", Value: "too long"})
+
+		assert.Equal(t, &validationError{http.StatusRequestEntityTooLarge, codeMessageTooLarge, "message value must not be larger than 5 bytes", "/value"}, verr)
+	})
+
+	t.Run("content types", func(t *testing.T) {
+		verr := check(RequestBody{Topic: "logs", Value: map[string]interface{}{}})
+		assert.Equal(t, &validationError{http.StatusUnsupportedMediaType, codeContentTypeNotAllowed, "content type application/json is not allowed for topic", ""}, verr)
+
+		verr = check(RequestBody{Topic: "logs", Value: "{}", Headers: map[string]string{"content-type": "text/plain; charset=utf-8"}})
+		assert.Nil(t, verr)
+	})
+
+	t.Run("rate limit", func(t *testing.T) {
+		// Checking a message doesn't count toward the limit
+		assert.Nil(t, check(RequestBody{Topic: "logs", Value: "a"}))
+
+		assert.Nil(t, allowTopic("logs"))
+		assert.Nil(t, allowTopic("logs"))
+		assert.Equal(t, &validationError{http.StatusTooManyRequests, codeRateLimited, "rate limit exceeded for topic", ""}, allowTopic("logs"))
+		assert.Nil(t, allowTopic("events"))
+	})
+
+	t.Run("topics without settings", func(t *testing.T) {
+		assert.Nil(t, check(RequestBody{Topic: "events", Value: "a"}))
+	})
+
+	t.Run("scripts", func(t *testing.T) {
+		b := RequestBody{Topic: "scripted", Value: map[string]interface{}{"type": "ok"}}
+		assert.Nil(t, checkBody(&b, downstream.RequestMeta{}))
+		assert.Equal(t, "events", b.Topic)
+		assert.Equal(t, map[string]string{"scripted": "true"}, b.Headers)
+
+		verr := check(RequestBody{Topic: "scripted", Value: map[string]interface{}{"type": "bad"}})
+		assert.Equal(t, &validationError{422, codeScriptRejected, "bad message", ""}, verr)
+
+		verr = check(RequestBody{Topic: "scripted", Value: map[string]interface{}{"type": "broken"}})
+		assert.Equal(t, &validationError{http.StatusInternalServerError, codeScriptFailed, "failed to process message", ""}, verr)
+
+		verr = check(RequestBody{Topic: "scripted", Value: map[string]interface{}{"type": "lost"}})
+		assert.Equal(t, &validationError{http.StatusBadRequest, codeTopicNotAllowed, "invalid topic", ""}, verr)
+
+		util.Config.Scripts.MaxBytes = 16
+		verr = check(RequestBody{Topic: "scripted", Value: map[string]interface{}{"type": "too large"}})
+		assert.Equal(t, &validationError{http.StatusRequestEntityTooLarge, codeMessageTooLarge, "message is too large for the topic's script", ""}, verr)
+		util.Config.Scripts.MaxBytes = 0
+	})
+
+	t.Run("message content type", func(t *testing.T) {
+		assert.Equal(t, "application/json", messageContentType(kafka.Message{Value: []byte(`{"a":1}`)}))
+		assert.Equal(t, "text/plain", messageContentType(kafka.Message{Value: []byte("a")}))
+		assert.Equal(t, "application/avro", messageContentType(kafka.Message{Headers: []kafka.Header{{Key: "Content-Type", Value: []byte("application/avro")}}}))
+	})
+
+	downstream.KafkaTopicAliases = nil
+	downstream.KafkaTopicSettings = nil
+}
+
+func TestTransformBody(t *testing.T) {
+	util.InitLogging()
+	stubSink := downstream.DefaultSink
+
+	util.Config.Kafka.Topics = map[string]util.TopicConfig{
+		"orders": {
+			RequireKey: true,
+			Transforms: []util.TransformConfig{
+				{Op: "key", Field: "order.id"},
+				{Op: "rename", Field: "order.total", To: "total"},
+				{Op: "cast", Field: "total", Type: "number"},
+				{Op: "metadata", Field: "client_ip", Source: "client_ip"},
+			},
+		},
+	}
+	assert.Nil(t, downstream.Init())
+
+	meta := requestMeta(httptest.NewRequest(http.MethodPost, "/produce", nil))
+
+	t.Run("transforms values", func(t *testing.T) {
+		b := RequestBody{Topic: "orders", Value: map[string]interface{}{"order": map[string]interface{}{"id": "o1", "total": "4.50"}}}
+
+		// The key is derived before it's required
+		assert.Nil(t, checkBody(&b, meta))
+		assert.Equal(t, "o1", b.Key)
+		assert.JSONEq(t, `{"order":{"id":"o1"},"total":4.5,"client_ip":"192.0.2.1"}`, string(b.valueStr))
+	})
+
+	t.Run("transform errors", func(t *testing.T) {
+		b := RequestBody{Topic: "orders", Key: "o1", Value: map[string]interface{}{"order": map[string]interface{}{"total": "free"}}}
+
+		verr := checkBody(&b, meta)
+		assert.Equal(t, &validationError{http.StatusBadRequest, codeInvalidValue, `field total: can't cast "free" to number`, "/value"}, verr)
+
+		b = RequestBody{Topic: "orders", Key: "o1", Value: "not json"}
+		verr = checkBody(&b, meta)
+		assert.Equal(t, &validationError{http.StatusBadRequest, codeInvalidValue, "message value must be a JSON object", "/value"}, verr)
+	})
+
+	// Reset config
+	util.Config.Kafka.Topics = nil
+	downstream.KafkaTopics = make(map[string]struct{})
+	downstream.KafkaTopicSettings = nil
+	downstream.DefaultSink = stubSink
+}
+
+func TestCheckRules(t *testing.T) {
+	util.InitLogging()
+	stubSink := downstream.DefaultSink
+
+	util.Config.Kafka.Topics = map[string]util.TopicConfig{
+		"payments": {
+			Rules: []util.RuleConfig{
+				{Expr: "has(value.user_id)", Message: "missing user_id"},
+				{Expr: "value.amount > 0", Message: "amount must be positive"},
+				{Expr: "!('test' in headers) || key != ''"},
+			},
+		},
+	}
+	assert.Nil(t, downstream.Init())
+
+	check := func(b RequestBody) *validationError {
+		return checkBody(&b, downstream.RequestMeta{})
+	}
+
+	tests := []struct {
+		name string
+		body RequestBody
+		err  string
+	}{
+		{"passes", RequestBody{Topic: "payments", Value: map[string]interface{}{"user_id": "u1", "amount": 5}}, ""},
+		{"first broken rule", RequestBody{Topic: "payments", Value: map[string]interface{}{"amount": -1}}, "missing user_id"},
+		{"broken rule", RequestBody{Topic: "payments", Value: map[string]interface{}{"user_id": "u1", "amount": 0}}, "amount must be positive"},
+		{"missing field", RequestBody{Topic: "payments", Value: map[string]interface{}{"user_id": "u1"}}, "amount must be positive"},
+		{"default message", RequestBody{Topic: "payments", Value: map[string]interface{}{"user_id": "u1", "amount": 1}, Headers: map[string]string{"test": "1"}}, "message breaks rule: !('test' in headers) || key != ''"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			verr := check(tt.body)
+
+			if tt.err == "" {
+				assert.Nil(t, verr)
+			} else {
+				assert.Equal(t, &validationError{http.StatusBadRequest, codeRuleViolation, tt.err, ""}, verr)
+			}
+		})
+	}
+
+	// Reset config
+	util.Config.Kafka.Topics = nil
+	downstream.KafkaTopics = make(map[string]struct{})
+	downstream.KafkaTopicSettings = nil
+	downstream.DefaultSink = stubSink
+}
+
+func TestRedactBody(t *testing.T) {
+	util.InitLogging()
+	stubSink := downstream.DefaultSink
+
+	util.Config.Redaction = util.RedactionConfig{
+		Keyring:       "../downstream/testdata/keyring.json",
+		EncryptionKey: "2022-05",
+	}
+	util.Config.Kafka.Topics = map[string]util.TopicConfig{
+		"users": {
+			Rules:  []util.RuleConfig{{Expr: "value.email.endsWith('.com')"}},
+			Redact: []util.RedactFieldConfig{{Field: "email", Action: "encrypt"}, {Field: "phone", Action: "drop"}},
+		},
+		"profiles": {
+			MaxMessageBytes: 40,
+			Redact:          []util.RedactFieldConfig{{Field: "email", Action: "encrypt"}},
+		},
+	}
+	assert.Nil(t, downstream.Init())
+
+	t.Run("redacts values", func(t *testing.T) {
+		b := RequestBody{Topic: "users", Value: map[string]interface{}{"email": "jane@example.com", "phone": "555"}}
+
+		// Rules see the value as it was sent
+		assert.Nil(t, checkBody(&b, downstream.RequestMeta{}))
+		assert.NotContains(t, string(b.valueStr), "jane@example.com")
+		assert.NotContains(t, string(b.valueStr), "phone")
+		assert.Equal(t, map[string]string{"beget-key-id": "2022-05"}, b.Headers)
+	})
+
+	t.Run("checks the size of redacted values", func(t *testing.T) {
+		b := RequestBody{Topic: "profiles", Value: map[string]interface{}{"email": "jane@example.com"}}
+
+		// Encrypting the email grows the value past the limit it was sent under
+		verr := checkBody(&b, downstream.RequestMeta{})
+		assert.Equal(t, &validationError{http.StatusRequestEntityTooLarge, codeMessageTooLarge, "message value must not be larger than 40 bytes", "/value"}, verr)
+	})
+
+	t.Run("redacts messages", func(t *testing.T) {
+		m := kafka.Message{Topic: "users", Value: []byte(`{"phone":"555"}`)}
+
+		assert.Nil(t, redactMessage(&m))
+		assert.Equal(t, "{}", string(m.Value))
+		assert.Empty(t, m.Headers)
+
+		m = kafka.Message{Topic: "users", Value: []byte("555")}
+		assert.Equal(t, &validationError{http.StatusBadRequest, codeInvalidValue, "message value must be a JSON object", "/value"}, redactMessage(&m))
+	})
+
+	// Reset config
+	util.Config.Redaction = util.RedactionConfig{}
+	util.Config.Kafka.Topics = nil
+	downstream.KafkaTopics = make(map[string]struct{})
+	downstream.KafkaTopicSettings = nil
+	downstream.DefaultSink = stubSink
+}
@@ -0,0 +1,105 @@
+// Handles producing several messages atomically in a Kafka transaction.
+//
+// Author: Kirk Morales
+// Copyright 2022. All Rights Reserved.
+
+package handler
+
+import (
+	"beget/downstream"
+	"beget/util"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/segmentio/kafka-go"
+)
+
+// Expected request body for a transaction
+type transactionBody struct {
+	Messages []json.RawMessage // The messages to write, each in the same form as a `/produce` body
+}
+
+// Handles a request to write messages, possibly to several topics, in a single
+// transaction. Either every message is committed or, if an error is returned,
+// none of them are.
+func transactionProduceHandler(w http.ResponseWriter, r *http.Request) {
+	if !checkContentType(w, r, "application/json") {
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, maxBodyBytes())
+
+	messages, verr := decodeTransaction(r.Body, requestMeta(r))
+	if verr != nil {
+		writeError(w, r, verr)
+		return
+	}
+
+	produce := func(ctx context.Context) error {
+		return downstream.ProduceTransaction(ctx, messages)
+	}
+	done := func(err error) {
+		if err != nil {
+			util.SugarFor(r.Context()).Error("failed to write kafka transaction:", err)
+		}
+	}
+
+	// As with `/produce`, an HTTP timeout only aborts a transaction that's underway
+	// under the "cancel" timeout policy
+	if ok, err := produceWithPolicy(w, r, produce, done); !ok {
+		return
+	} else if err != nil {
+		writeError(w, r, &validationError{http.StatusInternalServerError, codeProduceFailed, "transaction aborted", ""})
+		return
+	}
+
+	w.Write([]byte("OK"))
+}
+
+// Decodes and validates the messages of a transaction. The transaction is rejected
+// if any of its messages is invalid.
+func decodeTransaction(body io.Reader, meta downstream.RequestMeta) ([]kafka.Message, *validationError) {
+	dec := json.NewDecoder(body)
+	dec.DisallowUnknownFields()
+
+	var b transactionBody
+	if err := dec.Decode(&b); err != nil {
+		return nil, decodeError(err)
+	}
+
+	if len(b.Messages) == 0 {
+		return nil, &validationError{http.StatusBadRequest, codeMissingField, "missing messages", "/messages"}
+	}
+
+	messages := make([]kafka.Message, 0, len(b.Messages))
+	for i, raw := range b.Messages {
+		m, verr := decodeBody(bytes.NewReader(raw), meta)
+		if verr != nil {
+			verr.msg = fmt.Sprintf("message %d: %s", i, verr.msg)
+			if verr.pointer != "" {
+				verr.pointer = fmt.Sprintf("/messages/%d%s", i, verr.pointer)
+			}
+			return nil, verr
+		} else if !downstream.Transactional(m.Topic) {
+			msg := fmt.Sprintf("message %d: topic %s can't be written in a transaction", i, m.Topic)
+			return nil, &validationError{http.StatusBadRequest, codeNotTransactional, msg, fmt.Sprintf("/messages/%d/topic", i)}
+		} else if i > 0 && downstream.SinkFor(m.Topic) != downstream.SinkFor(messages[0].Topic) {
+			msg := fmt.Sprintf("message %d: topic %s is written to a different sink than message 0", i, m.Topic)
+			return nil, &validationError{http.StatusBadRequest, codeSinkMismatch, msg, fmt.Sprintf("/messages/%d/topic", i)}
+		}
+		messages = append(messages, m.message())
+	}
+
+	for i, m := range messages {
+		if verr := allowTopic(m.Topic); verr != nil {
+			verr.msg = fmt.Sprintf("message %d: %s", i, verr.msg)
+			return nil, verr
+		}
+	}
+
+	return messages, nil
+}
@@ -0,0 +1,124 @@
+package handler
+
+import (
+	"beget/downstream"
+	"beget/util"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/segmentio/kafka-go"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTransactionProduceHandler(t *testing.T) {
+	util.InitLogging()
+
+	sink := downstream.NewMemorySink()
+	sink.Fail = func(m kafka.Message) error {
+		if string(m.Value) == "fail" {
+			return errors.New("write failed")
+		}
+		return nil
+	}
+	stubSink := downstream.DefaultSink
+	downstream.DefaultSink = sink
+
+	downstream.KafkaTopics = make(map[string]struct{})
+	downstream.KafkaTopics["orders"] = struct{}{}
+	downstream.KafkaTopics["inventory"] = struct{}{}
+
+	post := func(body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest(http.MethodPost, "/produce/transaction", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		transactionProduceHandler(w, req)
+		return w
+	}
+
+	t.Run("writes every message in one transaction", func(t *testing.T) {
+		sink.Reset()
+
+		w := post(`{"messages":[
+			{"topic":"orders","key":"o1","value":{"status":"created"}},
+			{"topic":"inventory","key":"sku1","value":"reserved","headers":{"order":"o1"}}
+		]}`)
+
+		assert.Equal(t, 200, w.Code)
+		assert.Equal(t, "OK", w.Body.String())
+		assert.Equal(t, []kafka.Message{
+			{Topic: "orders", Key: []byte("o1"), Value: []byte(`{"status":"created"}`)},
+			{Topic: "inventory", Key: []byte("sku1"), Value: []byte("reserved"), Headers: []kafka.Header{{Key: "order", Value: []byte("o1")}}},
+		}, sink.Messages())
+	})
+
+	t.Run("rejects the transaction if a message is invalid", func(t *testing.T) {
+		sink.Reset()
+
+		w := post(`{"messages":[{"topic":"orders","value":"a"},{"topic":"bar","value":"b"}]}`)
+
+		assert.Equal(t, 400, w.Code)
+		assertProblem(t, w.Header(), w.Body.Bytes(), codeTopicNotAllowed, "message 1: invalid topic")
+
+		var p problem
+		json.Unmarshal(w.Body.Bytes(), &p)
+		assert.Equal(t, "/messages/1/topic", p.Pointer)
+		assert.Empty(t, sink.Messages())
+	})
+
+	t.Run("rejects topics written to other sinks", func(t *testing.T) {
+		sink.Reset()
+		downstream.KafkaTopics["audit"] = struct{}{}
+		downstream.KafkaTopicSettings = map[string]*downstream.TopicSettings{"audit": {TopicConfig: util.TopicConfig{Sink: "audit"}}}
+		downstream.Sinks = map[string]downstream.Sink{"audit": downstream.NewMemorySink()}
+		defer func() {
+			downstream.KafkaTopicSettings = nil
+			downstream.Sinks = nil
+		}()
+
+		w := post(`{"messages":[{"topic":"orders","value":"a"},{"topic":"audit","value":"b"}]}`)
+
+		assert.Equal(t, 400, w.Code)
+		assertProblem(t, w.Header(), w.Body.Bytes(), codeSinkMismatch, "message 1: topic audit is written to a different sink than message 0")
+		assert.Empty(t, sink.Messages())
+	})
+
+	t.Run("missing messages", func(t *testing.T) {
+		w := post(`{"messages":[]}`)
+
+		assert.Equal(t, 400, w.Code)
+		assertProblem(t, w.Header(), w.Body.Bytes(), codeMissingField, "missing messages")
+	})
+
+	t.Run("unknown field", func(t *testing.T) {
+		w := post(`{"message":[]}`)
+
+		assert.Equal(t, 400, w.Code)
+		assertProblem(t, w.Header(), w.Body.Bytes(), codeUnknownField, "Request body contains unknown field \"message\"")
+	})
+
+	t.Run("reports an aborted transaction", func(t *testing.T) {
+		sink.Reset()
+
+		w := post(`{"messages":[{"topic":"orders","value":"a"},{"topic":"inventory","value":"fail"}]}`)
+
+		assert.Equal(t, 500, w.Code)
+		assertProblem(t, w.Header(), w.Body.Bytes(), codeProduceFailed, "transaction aborted")
+		assert.Empty(t, sink.Messages())
+	})
+
+	t.Run("invalid content-type header", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest(http.MethodPost, "/produce/transaction", strings.NewReader(""))
+		req.Header.Set("Content-Type", "text/plain")
+
+		transactionProduceHandler(w, req)
+
+		assert.Equal(t, 415, w.Code)
+	})
+
+	downstream.DefaultSink = stubSink
+}
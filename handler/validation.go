@@ -8,23 +8,104 @@ package handler
 import (
 	"beget/downstream"
 	"beget/util"
+	"bytes"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
 	"reflect"
+	"sort"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/golang/gddo/httputil/header"
+	"github.com/segmentio/kafka-go"
 )
 
 // Expected request body
 type RequestBody struct {
-	Topic    string      // The topic to write the message to (required)
-	Key      string      // The key of the message (optional)
-	Value    interface{} // The message value as JSON (required)
-	valueStr []byte      // Message value as a string (this is computed by `validate`)
+	ID        string            // Idempotency key used to deduplicate retries (optional)
+	Topic     string            // The topic to write the message to (required)
+	Key       string            // The key of the message (optional)
+	Value     interface{}       // The message value as JSON (required)
+	Headers   map[string]string // Headers to add to the message (optional)
+	valueStr  []byte            // Message value as a string (this is computed by `validate`)
+	requestID string            // The ID of the request the message was sent in, if known
+}
+
+// A request body as it's decoded. The value is kept as raw JSON so that it's copied
+// rather than decoded into maps and re-encoded.
+type rawRequestBody struct {
+	ID      string
+	Topic   string
+	Key     string
+	Value   json.RawMessage
+	Headers map[string]string
+}
+
+// Returns the request body, with a string value unquoted and any other value as
+// `json.RawMessage`
+func (raw *rawRequestBody) body() RequestBody {
+	b := RequestBody{ID: raw.ID, Topic: raw.Topic, Key: raw.Key, Headers: raw.Headers}
+
+	switch {
+	case len(raw.Value) == 0 || string(raw.Value) == "null":
+	case raw.Value[0] == '"':
+		var s string
+		json.Unmarshal(raw.Value, &s)
+		b.Value = s
+	default:
+		b.Value = raw.Value
+	}
+
+	return b
+}
+
+// The request body limit when neither `server.max_body_bytes` nor `kafka.batch_bytes` is set
+const defaultMaxBodyBytes = 1048576
+
+// Describes a validation failure and the HTTP status code it should be reported with
+type validationError struct {
+	status  int
+	code    string // Identifies the failure for clients; see problem.go
+	msg     string
+	pointer string // JSON pointer to the field at fault in the request body, if any
+}
+
+func (e *validationError) Error() string {
+	return e.msg
+}
+
+// Returns the Kafka message described by the request body
+func (b *RequestBody) message() kafka.Message {
+	message := kafka.Message{
+		Topic: b.Topic,
+		Value: b.valueStr,
+	}
+
+	if b.Key != "" {
+		message.Key = []byte(b.Key)
+	}
+
+	// Sort header keys so messages are built deterministically
+	keys := make([]string, 0, len(b.Headers))
+	for k := range b.Headers {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		message.Headers = append(message.Headers, kafka.Header{Key: k, Value: []byte(b.Headers[k])})
+	}
+
+	if b.requestID != "" {
+		message.Headers = append(message.Headers, kafka.Header{Key: downstream.RequestIDHeader, Value: []byte(b.requestID)})
+	}
+
+	return message
 }
 
 // Validates the given request context. Returns the `ProduceContext` and whether or not the
@@ -32,121 +113,359 @@ type RequestBody struct {
 // to the `http.ResponseWriter` provided.
 func validate(w http.ResponseWriter, r *http.Request) (*RequestBody, bool) {
 
+	if !checkContentType(w, r, "application/json") {
+		return nil, false
+	}
+
+	// Use http.MaxBytesReader to enforce a maximum read from the request body.
+	// A request body larger than that will now result in Decode() returning an
+	// *http.MaxBytesError.
+	r.Body = http.MaxBytesReader(w, r.Body, maxBodyBytes())
+
+	b, verr := decodeBody(r.Body, requestMeta(r))
+	if verr != nil {
+		writeError(w, r, verr)
+		return nil, false
+	}
+
+	return b, true
+}
+
+// Checks that the Content-Type header is present and has the value `want`. If it
+// doesn't, an error is written to the `http.ResponseWriter` and false is returned.
+func checkContentType(w http.ResponseWriter, r *http.Request, want string) bool {
+
 	// If the Content-Type header is present, check that it has the value
-	// application/json. Note that we are using the gddo/httputil/header
+	// we want. Note that we are using the gddo/httputil/header
 	// package to parse and extract the value here, so the check works
 	// even if the client includes additional charset or boundary
 	// information in the header.
 	if r.Header.Get("Content-Type") == "" {
 		msg := "missing Content-Type header"
-		http.Error(w, msg, http.StatusUnsupportedMediaType)
-		return nil, false
-	} else {
-		value, _ := header.ParseValueAndParams(r.Header, "Content-Type")
-		if value != "application/json" {
-			msg := "Content-Type header is not application/json"
-			http.Error(w, msg, http.StatusUnsupportedMediaType)
-			return nil, false
-		}
+		writeError(w, r, &validationError{http.StatusUnsupportedMediaType, codeUnsupportedMediaType, msg, ""})
+		return false
 	}
 
-	// Use http.MaxBytesReader to enforce a maximum read of 1MB from the
-	// response body. A request body larger than that will now result in
-	// Decode() returning a "http: request body too large" error.
-	r.Body = http.MaxBytesReader(w, r.Body, 1048576)
+	value, _ := header.ParseValueAndParams(r.Header, "Content-Type")
+	if value != want {
+		msg := fmt.Sprintf("Content-Type header is not %s", want)
+		writeError(w, r, &validationError{http.StatusUnsupportedMediaType, codeUnsupportedMediaType, msg, ""})
+		return false
+	}
+
+	return true
+}
+
+// Decodes and validates a single JSON request body read from `body`.
+func decodeBody(body io.Reader, meta downstream.RequestMeta) (*RequestBody, *validationError) {
 
 	// Setup the decoder and call the DisallowUnknownFields() method on it.
 	// This will cause Decode() to return a "json: unknown field ..." error
 	// if it encounters any extra unexpected fields in the JSON. Strictly
 	// speaking, it returns an error for "keys which do not match any
 	// non-ignored, exported fields in the destination".
-	dec := json.NewDecoder(r.Body)
+	prefix := &prefixBuffer{buf: make([]byte, 0, bodyPrefixBytes)}
+	counter := &countingReader{r: io.TeeReader(body, prefix)}
+	dec := json.NewDecoder(counter)
 	dec.DisallowUnknownFields()
 
-	var b RequestBody
-	err := dec.Decode(&b)
-	if err != nil {
-		var syntaxError *json.SyntaxError
-		var unmarshalTypeError *json.UnmarshalTypeError
-
-		switch {
-		// Catch any syntax errors in the JSON and send an error message
-		// which interpolates the location of the problem to make it
-		// easier for the client to fix.
-		case errors.As(err, &syntaxError):
-			msg := fmt.Sprintf("Request body contains badly-formed JSON (at position %d)", syntaxError.Offset)
-			http.Error(w, msg, http.StatusBadRequest)
-
-		// In some circumstances Decode() may also return an
-		// io.ErrUnexpectedEOF error for syntax errors in the JSON. There
-		// is an open issue regarding this at
-		// https://github.com/golang/go/issues/25956.
-		case errors.Is(err, io.ErrUnexpectedEOF):
-			msg := "Request body contains badly-formed JSON"
-			http.Error(w, msg, http.StatusBadRequest)
-
-		// Catch any type errors, like trying to assign a string in the
-		// JSON request body to a int field in our Person struct. We can
-		// interpolate the relevant field name and position into the error
-		// message to make it easier for the client to fix.
-		case errors.As(err, &unmarshalTypeError):
-			msg := fmt.Sprintf("Request body contains an invalid value for the %q field (at position %d)", unmarshalTypeError.Field, unmarshalTypeError.Offset)
-			http.Error(w, msg, http.StatusBadRequest)
-
-		// Catch the error caused by extra unexpected fields in the request
-		// body. We extract the field name from the error message and
-		// interpolate it in our custom error message. There is an open
-		// issue at https://github.com/golang/go/issues/29035 regarding
-		// turning this into a sentinel error.
-		case strings.HasPrefix(err.Error(), "json: unknown field "):
-			fieldName := strings.TrimPrefix(err.Error(), "json: unknown field ")
-			msg := fmt.Sprintf("Request body contains unknown field %s", fieldName)
-			http.Error(w, msg, http.StatusBadRequest)
-
-		// An io.EOF error is returned by Decode() if the request body is empty.
-		case errors.Is(err, io.EOF):
-			msg := "Request body must not be empty"
-			http.Error(w, msg, http.StatusBadRequest)
-
-		// Catch the error caused by the request body being too large. Again
-		// there is an open issue regarding turning this into a sentinel
-		// error at https://github.com/golang/go/issues/30715.
-		case err.Error() == "http: request body too large":
-			msg := "Request body must not be larger than 1MB"
-			http.Error(w, msg, http.StatusRequestEntityTooLarge)
-
-		// Otherwise default to logging the error and sending a 500 Internal Server Error response.
-		default:
-			util.Sugar.Error(err.Error())
-			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+	var raw rawRequestBody
+	if err := dec.Decode(&raw); err != nil {
+		// A body cut off at the largest limit is held to its topic's limit, if the
+		// topic came before the cut
+		var maxBytesError *http.MaxBytesError
+		if errors.As(err, &maxBytesError) {
+			if topic, ok := prefixTopic(prefix.buf); ok {
+				if verr := checkBodySize(topic, maxBytesError.Limit+1); verr != nil {
+					return nil, verr
+				}
+			}
 		}
-		return nil, false
+		return nil, decodeError(err)
 	}
 
 	// Call decode again, using a pointer to an empty anonymous struct as
 	// the destination. If the request body only contained a single JSON
 	// object this will return an io.EOF error. So if we get anything else,
 	// we know that there is additional data in the request body.
-	err = dec.Decode(&struct{}{})
-	if err != io.EOF {
-		msg := "Request body must only contain a single JSON object"
-		http.Error(w, msg, http.StatusBadRequest)
-		return nil, false
+	// A compressed body is only known to be intact once it's been read to the end.
+	if err := dec.Decode(&struct{}{}); err != io.EOF {
+		if isDecompressError(err) {
+			return nil, decodeError(err)
+		}
+		return nil, &validationError{http.StatusBadRequest, codeInvalidJSON, "Request body must only contain a single JSON object", ""}
+	}
+
+	if verr := checkBodySize(raw.Topic, counter.n); verr != nil {
+		return nil, verr
+	}
+
+	b := raw.body()
+	if verr := checkBody(&b, meta); verr != nil {
+		return nil, verr
 	}
 
-	// Look for required "topic" value and make sure it's allowed
+	return &b, nil
+}
+
+// How much of a request body is kept to find its topic if it's too large to decode
+const bodyPrefixBytes = 4096
+
+// Keeps the first bytes written to it, up to the capacity of `buf`
+type prefixBuffer struct {
+	buf []byte
+}
+
+func (p *prefixBuffer) Write(data []byte) (int, error) {
+	if n := cap(p.buf) - len(p.buf); n > 0 {
+		if len(data) < n {
+			n = len(data)
+		}
+		p.buf = append(p.buf, data[:n]...)
+	}
+	return len(data), nil
+}
+
+// Returns the "topic" of a JSON object that may be cut off, and whether it was
+// found before the cut
+func prefixTopic(prefix []byte) (string, bool) {
+	dec := json.NewDecoder(bytes.NewReader(prefix))
+	if t, err := dec.Token(); err != nil || t != json.Delim('{') {
+		return "", false
+	}
+
+	for dec.More() {
+		key, err := dec.Token()
+		if err != nil {
+			return "", false
+		} else if key == "topic" {
+			t, err := dec.Token()
+			topic, ok := t.(string)
+			return topic, err == nil && ok
+		}
+
+		// Skip the field's value, which may be an object or array
+		depth := 0
+		for {
+			t, err := dec.Token()
+			if err != nil {
+				return "", false
+			}
+			switch t {
+			case json.Delim('{'), json.Delim('['):
+				depth++
+			case json.Delim('}'), json.Delim(']'):
+				depth--
+			}
+			if depth == 0 {
+				break
+			}
+		}
+	}
+	return "", false
+}
+
+// Returns the request body limit from `Config.Server.MaxBodyBytes`
+func globalMaxBodyBytes() int64 {
+	if n := util.Config.Server.MaxBodyBytes; n > 0 {
+		return n
+	} else if n := util.Config.Kafka.BatchBytes; n > 0 {
+		return n
+	}
+	return defaultMaxBodyBytes
+}
+
+// Returns the most bytes read from a request body before its topic is known: the
+// largest of the global limit and the topics' `max_body_bytes`
+func maxBodyBytes() int64 {
+	max := globalMaxBodyBytes()
+	for _, settings := range downstream.KafkaTopicSettings {
+		if settings.MaxBodyBytes > max {
+			max = settings.MaxBodyBytes
+		}
+	}
+	return max
+}
+
+// Checks the size of a request body against the limit for the topic it's produced to
+func checkBodySize(topic string, n int64) *validationError {
+	limit := globalMaxBodyBytes()
+	if topic, ok := downstream.ResolveTopic(topic); ok && downstream.SettingsFor(topic).MaxBodyBytes > 0 {
+		limit = downstream.SettingsFor(topic).MaxBodyBytes
+	}
+
+	if n > limit {
+		return &validationError{http.StatusRequestEntityTooLarge, codeBodyTooLarge, "Request body must not be larger than " + formatBytes(limit), ""}
+	}
+	return nil
+}
+
+// Formats a size in bytes as it's written in error messages, e.g. "1MB"
+func formatBytes(n int64) string {
+	switch {
+	case n >= 1<<20 && n%(1<<20) == 0:
+		return fmt.Sprintf("%dMB", n>>20)
+	case n >= 1<<10 && n%(1<<10) == 0:
+		return fmt.Sprintf("%dKB", n>>10)
+	default:
+		return fmt.Sprintf("%d bytes", n)
+	}
+}
+
+// Runs the topic's script on the message, applying its changes to the body. A
+// message the script sends to another topic isn't transformed or scripted again.
+func runScript(b *RequestBody, script *downstream.Script) *validationError {
+	m, err := script.Run(downstream.ScriptMessage{Topic: b.Topic, Key: b.Key, Value: b.valueStr, Headers: b.Headers})
+
+	var rejection *downstream.ScriptRejection
+	if errors.As(err, &rejection) {
+		return &validationError{rejection.Status, codeScriptRejected, rejection.Message, ""}
+	} else if errors.Is(err, downstream.ErrScriptInputTooLarge) {
+		return &validationError{http.StatusRequestEntityTooLarge, codeMessageTooLarge, downstream.ErrScriptInputTooLarge.Error(), ""}
+	} else if err != nil {
+		util.SugarForRequest(b.requestID).Errorf("script for topic %s failed: %v", b.Topic, err)
+		return &validationError{http.StatusInternalServerError, codeScriptFailed, "failed to process message", ""}
+	}
+
+	// Scripts refer to topics by their real names
+	if m.Topic != b.Topic && !downstream.Producible(m.Topic) {
+		return &validationError{http.StatusBadRequest, codeTopicNotAllowed, "invalid topic", ""}
+	}
+
+	b.Topic, b.Key, b.valueStr, b.Headers = m.Topic, m.Key, m.Value, m.Headers
+	return nil
+}
+
+// Returns metadata about the request for transforms and the request ID header
+func requestMeta(r *http.Request) downstream.RequestMeta {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		ip = r.RemoteAddr
+	}
+
+	return downstream.RequestMeta{
+		ClientIP:  ip,
+		RequestID: util.RequestIDFrom(r.Context()),
+		Received:  time.Now(),
+	}
+}
+
+// Maps an error returned by the JSON decoder to a client-facing validation error.
+func decodeError(err error) *validationError {
+	var syntaxError *json.SyntaxError
+	var unmarshalTypeError *json.UnmarshalTypeError
+	var decompressErr *decompressError
+	var maxBytesError *http.MaxBytesError
+
+	switch {
+	// Catch compressed bodies that are corrupt or expand by too much. These are checked
+	// first since decompression errors may wrap errors like io.ErrUnexpectedEOF.
+	case errors.Is(err, errDecompressedTooLarge):
+		return &validationError{http.StatusRequestEntityTooLarge, codeBodyTooLarge, "Request body expands by too much when decompressed", ""}
+	case errors.As(err, &decompressErr):
+		return &validationError{http.StatusBadRequest, codeInvalidEncoding, "Request body could not be decompressed", ""}
+
+	// Catch any syntax errors in the JSON and send an error message
+	// which interpolates the location of the problem to make it
+	// easier for the client to fix.
+	case errors.As(err, &syntaxError):
+		msg := fmt.Sprintf("Request body contains badly-formed JSON (at position %d)", syntaxError.Offset)
+		return &validationError{http.StatusBadRequest, codeInvalidJSON, msg, ""}
+
+	// In some circumstances Decode() may also return an
+	// io.ErrUnexpectedEOF error for syntax errors in the JSON. There
+	// is an open issue regarding this at
+	// https://github.com/golang/go/issues/25956.
+	case errors.Is(err, io.ErrUnexpectedEOF):
+		return &validationError{http.StatusBadRequest, codeInvalidJSON, "Request body contains badly-formed JSON", ""}
+
+	// Catch any type errors, like trying to assign a string in the
+	// JSON request body to a int field in our Person struct. We can
+	// interpolate the relevant field name and position into the error
+	// message to make it easier for the client to fix.
+	case errors.As(err, &unmarshalTypeError):
+		field := typeErrorField(unmarshalTypeError)
+		msg := fmt.Sprintf("Request body contains an invalid value for the %q field (at position %d)", field, unmarshalTypeError.Offset)
+		return &validationError{http.StatusBadRequest, codeInvalidField, msg, fieldPointer(field)}
+
+	// Catch the error caused by extra unexpected fields in the request
+	// body. We extract the field name from the error message and
+	// interpolate it in our custom error message. There is an open
+	// issue at https://github.com/golang/go/issues/29035 regarding
+	// turning this into a sentinel error.
+	case strings.HasPrefix(err.Error(), "json: unknown field "):
+		fieldName := strings.TrimPrefix(err.Error(), "json: unknown field ")
+		msg := fmt.Sprintf("Request body contains unknown field %s", fieldName)
+
+		fieldName, _ = strconv.Unquote(fieldName)
+		return &validationError{http.StatusBadRequest, codeUnknownField, msg, fieldPointer(fieldName)}
+
+	// An io.EOF error is returned by Decode() if the request body is empty.
+	case errors.Is(err, io.EOF):
+		return &validationError{http.StatusBadRequest, codeEmptyBody, "Request body must not be empty", ""}
+
+	// Catch the error caused by the request body being larger than the limit
+	// set with http.MaxBytesReader.
+	case errors.As(err, &maxBytesError):
+		return &validationError{http.StatusRequestEntityTooLarge, codeBodyTooLarge, "Request body must not be larger than " + formatBytes(maxBytesError.Limit), ""}
+
+	// Otherwise default to logging the error and sending a 500 Internal Server Error response.
+	default:
+		util.Sugar.Error(err.Error())
+		return &validationError{http.StatusInternalServerError, codeInternal, http.StatusText(http.StatusInternalServerError), ""}
+	}
+}
+
+// Returns the dot-separated path of the field a type error occurred in. Older Go
+// releases name the struct field rather than the key in the body, so the top-level
+// name is lowercased to match the field names clients send.
+func typeErrorField(err *json.UnmarshalTypeError) string {
+	top, rest, found := strings.Cut(err.Field, ".")
+	if !found {
+		return strings.ToLower(top)
+	}
+	return strings.ToLower(top) + "." + rest
+}
+
+// Returns the JSON pointer to a field given by its dot-separated path, as the
+// decoder reports it
+func fieldPointer(field string) string {
+	if field == "" {
+		return ""
+	}
+
+	escaper := strings.NewReplacer("~", "~0", "/", "~1")
+
+	var sb strings.Builder
+	for _, name := range strings.Split(field, ".") {
+		sb.WriteString("/" + escaper.Replace(name))
+	}
+	return sb.String()
+}
+
+// Validates the fields of a decoded request body, computes its `valueStr` and
+// applies the topic's transforms, script and redactions.
+func checkBody(b *RequestBody, meta downstream.RequestMeta) *validationError {
+	b.requestID = meta.RequestID
+
+	// Look for required "topic" value and make sure it's allowed, resolving aliases.
+	// Logical names are routed to a topic once the rest of the body is validated.
 	if b.Topic == "" {
-		http.Error(w, "missing topic", http.StatusBadRequest)
-		return nil, false
-	} else if _, ok := downstream.KafkaTopics[b.Topic]; !ok {
-		http.Error(w, "invalid topic", http.StatusBadRequest)
-		return nil, false
+		return &validationError{http.StatusBadRequest, codeMissingField, "missing topic", "/topic"}
+	}
+
+	route, routed := downstream.KafkaRoutes[b.Topic]
+	if !routed {
+		topic, ok := downstream.ResolveTopic(b.Topic)
+		if !ok {
+			return &validationError{http.StatusBadRequest, codeTopicNotAllowed, "invalid topic", "/topic"}
+		}
+		b.Topic = topic
 	}
 
 	// Look for value
 	if b.Value == nil {
-		http.Error(w, "missing message value", http.StatusBadRequest)
-		return nil, false
+		return &validationError{http.StatusBadRequest, codeMissingField, "missing message value", "/value"}
 	}
 
 	// Test if string
@@ -159,5 +478,46 @@ func validate(w http.ResponseWriter, r *http.Request) (*RequestBody, bool) {
 		b.valueStr = str
 	}
 
-	return &b, true
+	if routed {
+		if verr := routeMessage(b, route); verr != nil {
+			return verr
+		} else if !downstream.Producible(b.Topic) {
+			// Routed to a topic allowed by a pattern that doesn't exist
+			return &validationError{http.StatusBadRequest, codeTopicNotAllowed, "invalid topic", "/topic"}
+		}
+	}
+
+	// Transform before checking settings so they apply to what's written
+	value, key, err := downstream.SettingsFor(b.Topic).Transform(b.valueStr, b.Key, meta)
+	if err != nil {
+		return &validationError{http.StatusBadRequest, codeInvalidValue, err.Error(), "/value"}
+	}
+	b.valueStr, b.Key = value, key
+
+	if script := downstream.SettingsFor(b.Topic).Script; script != nil {
+		if verr := runScript(b, script); verr != nil {
+			return verr
+		}
+	}
+
+	if verr := checkTopicSettings(b.message()); verr != nil {
+		return verr
+	}
+
+	// Redact last so that the topic's other settings apply to the message as sent
+	value, keyID, err := downstream.SettingsFor(b.Topic).Redact(b.valueStr)
+	if err != nil {
+		return &validationError{http.StatusBadRequest, codeInvalidValue, err.Error(), "/value"}
+	}
+	b.valueStr = value
+
+	if keyID != "" {
+		if b.Headers == nil {
+			b.Headers = make(map[string]string)
+		}
+		b.Headers[downstream.KeyIDHeader] = keyID
+	}
+
+	// Redaction may grow the value and add a header, so check the final size
+	return checkMessageSize(b.message())
 }
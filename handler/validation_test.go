@@ -2,10 +2,13 @@ package handler
 
 import (
 	"beget/downstream"
+	"beget/util"
 	"bytes"
+	"encoding/json"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -31,7 +34,7 @@ func TestInvalidBody(t *testing.T) {
 		assert.False(t, ok)
 		assert.Nil(t, body)
 		assert.Equal(t, 415, res.StatusCode)
-		assert.Equal(t, "missing Content-Type header\n", string(data))
+		assertProblem(t, res.Header, data, codeUnsupportedMediaType, "missing Content-Type header")
 	})
 
 	t.Run("invalid content-type header", func(t *testing.T) {
@@ -54,7 +57,7 @@ func TestInvalidBody(t *testing.T) {
 		assert.False(t, ok)
 		assert.Nil(t, body)
 		assert.Equal(t, 415, res.StatusCode)
-		assert.Equal(t, "Content-Type header is not application/json\n", string(data))
+		assertProblem(t, res.Header, data, codeUnsupportedMediaType, "Content-Type header is not application/json")
 	})
 
 	t.Run("empty body", func(t *testing.T) {
@@ -77,7 +80,7 @@ func TestInvalidBody(t *testing.T) {
 		assert.False(t, ok)
 		assert.Nil(t, body)
 		assert.Equal(t, 400, res.StatusCode)
-		assert.Equal(t, "Request body must not be empty\n", string(data))
+		assertProblem(t, res.Header, data, codeEmptyBody, "Request body must not be empty")
 	})
 
 	t.Run("invalid JSON body", func(t *testing.T) {
@@ -100,7 +103,7 @@ func TestInvalidBody(t *testing.T) {
 		assert.False(t, ok)
 		assert.Nil(t, body)
 		assert.Equal(t, 400, res.StatusCode)
-		assert.Equal(t, "Request body contains badly-formed JSON (at position 1)\n", string(data))
+		assertProblem(t, res.Header, data, codeInvalidJSON, "Request body contains badly-formed JSON (at position 1)")
 	})
 
 	t.Run("empty JSON body (missing `topic`)", func(t *testing.T) {
@@ -124,7 +127,7 @@ func TestInvalidBody(t *testing.T) {
 		assert.False(t, ok)
 		assert.Nil(t, body)
 		assert.Equal(t, 400, res.StatusCode)
-		assert.Equal(t, "missing topic\n", string(data))
+		assertProblem(t, res.Header, data, codeMissingField, "missing topic")
 	})
 
 	t.Run("invalid JSON value", func(t *testing.T) {
@@ -148,7 +151,7 @@ func TestInvalidBody(t *testing.T) {
 		assert.False(t, ok)
 		assert.Nil(t, body)
 		assert.Equal(t, 400, res.StatusCode)
-		assert.Equal(t, "Request body contains badly-formed JSON\n", string(data))
+		assertProblem(t, res.Header, data, codeInvalidJSON, "Request body contains badly-formed JSON")
 	})
 
 	t.Run("invalid topic", func(t *testing.T) {
@@ -172,7 +175,7 @@ func TestInvalidBody(t *testing.T) {
 		assert.False(t, ok)
 		assert.Nil(t, body)
 		assert.Equal(t, 400, res.StatusCode)
-		assert.Equal(t, "invalid topic\n", string(data))
+		assertProblem(t, res.Header, data, codeTopicNotAllowed, "invalid topic")
 	})
 
 	t.Run("invalid data type", func(t *testing.T) {
@@ -196,7 +199,7 @@ func TestInvalidBody(t *testing.T) {
 		assert.False(t, ok)
 		assert.Nil(t, body)
 		assert.Equal(t, 400, res.StatusCode)
-		assert.Equal(t, "Request body contains an invalid value for the \"Topic\" field (at position 14)\n", string(data))
+		assertProblem(t, res.Header, data, codeInvalidField, "Request body contains an invalid value for the \"topic\" field (at position 14)")
 	})
 
 	t.Run("invalid field", func(t *testing.T) {
@@ -220,7 +223,7 @@ func TestInvalidBody(t *testing.T) {
 		assert.False(t, ok)
 		assert.Nil(t, body)
 		assert.Equal(t, 400, res.StatusCode)
-		assert.Equal(t, "Request body contains unknown field \"foobar\"\n", string(data))
+		assertProblem(t, res.Header, data, codeUnknownField, "Request body contains unknown field \"foobar\"")
 	})
 
 	t.Run("more than just the json", func(t *testing.T) {
@@ -244,7 +247,7 @@ func TestInvalidBody(t *testing.T) {
 		assert.False(t, ok)
 		assert.Nil(t, body)
 		assert.Equal(t, 400, res.StatusCode)
-		assert.Equal(t, "Request body must only contain a single JSON object\n", string(data))
+		assertProblem(t, res.Header, data, codeInvalidJSON, "Request body must only contain a single JSON object")
 	})
 
 	t.Run("more than just the json", func(t *testing.T) {
@@ -275,7 +278,7 @@ func TestInvalidBody(t *testing.T) {
 		assert.False(t, ok)
 		assert.Nil(t, body)
 		assert.Equal(t, 413, res.StatusCode)
-		assert.Equal(t, "Request body must not be larger than 1MB\n", string(data))
+		assertProblem(t, res.Header, data, codeBodyTooLarge, "Request body must not be larger than 1MB")
 	})
 
 	t.Run("missing message value", func(t *testing.T) {
@@ -300,7 +303,7 @@ func TestInvalidBody(t *testing.T) {
 		assert.False(t, ok)
 		assert.Nil(t, body)
 		assert.Equal(t, 400, res.StatusCode)
-		assert.Equal(t, "missing message value\n", string(data))
+		assertProblem(t, res.Header, data, codeMissingField, "missing message value")
 
 		downstream.KafkaTopics = make(map[string]struct{})
 	})
@@ -321,11 +324,10 @@ func TestValidRequest(t *testing.T) {
 
 		assert.True(t, ok)
 
+		// Values are kept as raw JSON rather than decoded
 		expected := &RequestBody{
-			Topic: "foo",
-			Value: map[string]interface{}{
-				"foo": float64(1),
-			},
+			Topic:    "foo",
+			Value:    json.RawMessage(`{"foo":1}`),
 			valueStr: []byte(`{"foo":1}`),
 		}
 
@@ -359,3 +361,83 @@ func TestValidRequest(t *testing.T) {
 		downstream.KafkaTopics = make(map[string]struct{})
 	})
 }
+
+func TestBodyLimits(t *testing.T) {
+	util.InitLogging()
+	stubSink := downstream.DefaultSink
+
+	util.Config.Kafka.Topics = map[string]util.TopicConfig{"foo": {}, "big": {MaxBodyBytes: 4096}}
+	assert.Nil(t, downstream.Init())
+
+	produce := func(topic string, size int) (int, problem) {
+		body := `{"topic":"` + topic + `","value":"`
+		body += strings.Repeat("a", size-len(body)-2) + `"}`
+
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest(http.MethodPost, "/produce", strings.NewReader(body))
+		req.Header.Add("Content-Type", "application/json")
+		validate(w, req)
+
+		var p problem
+		json.Unmarshal(w.Body.Bytes(), &p)
+		return w.Code, p
+	}
+
+	t.Run("global limit", func(t *testing.T) {
+		util.Config.Server.MaxBodyBytes = 100
+
+		code, _ := produce("foo", 100)
+		assert.Equal(t, 200, code)
+
+		code, p := produce("foo", 101)
+		assert.Equal(t, 413, code)
+		assert.Equal(t, problem{"about:blank", "Request Entity Too Large", 413, "Request body must not be larger than 100 bytes", codeBodyTooLarge, "", ""}, p)
+
+		// Bodies larger than any limit aren't read in full, but are still held to
+		// their topic's limit
+		code, p = produce("foo", 5000)
+		assert.Equal(t, 413, code)
+		assert.Equal(t, problem{"about:blank", "Request Entity Too Large", 413, "Request body must not be larger than 100 bytes", codeBodyTooLarge, "", ""}, p)
+
+		// Unless the topic comes after the cut
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest(http.MethodPost, "/produce", strings.NewReader(`{"value":"`+strings.Repeat("a", 5000)+`","topic":"foo"}`))
+		req.Header.Add("Content-Type", "application/json")
+		validate(w, req)
+		assert.Equal(t, 413, w.Code)
+		assert.Contains(t, w.Body.String(), "Request body must not be larger than 4KB")
+	})
+
+	t.Run("topic limit", func(t *testing.T) {
+		util.Config.Server.MaxBodyBytes = 100
+
+		code, _ := produce("big", 4096)
+		assert.Equal(t, 200, code)
+
+		code, p := produce("big", 4097)
+		assert.Equal(t, 413, code)
+		assert.Equal(t, problem{"about:blank", "Request Entity Too Large", 413, "Request body must not be larger than 4KB", codeBodyTooLarge, "", ""}, p)
+	})
+
+	t.Run("batch bytes", func(t *testing.T) {
+		util.Config.Server.MaxBodyBytes = 0
+		util.Config.Kafka.BatchBytes = 2048
+
+		code, p := produce("foo", 2049)
+		assert.Equal(t, 413, code)
+		assert.Equal(t, problem{"about:blank", "Request Entity Too Large", 413, "Request body must not be larger than 2KB", codeBodyTooLarge, "", ""}, p)
+
+		// Messages the writer would fail are rejected up front
+		code, p = produce("big", 3000)
+		assert.Equal(t, 413, code)
+		assert.Equal(t, problem{"about:blank", "Request Entity Too Large", 413, "message must not be larger than 2048 bytes", codeMessageTooLarge, "", ""}, p)
+	})
+
+	// Reset config
+	util.Config.Server.MaxBodyBytes = 0
+	util.Config.Kafka.BatchBytes = 0
+	util.Config.Kafka.Topics = nil
+	downstream.KafkaTopics = make(map[string]struct{})
+	downstream.KafkaTopicSettings = nil
+	downstream.DefaultSink = stubSink
+}
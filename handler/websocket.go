@@ -0,0 +1,164 @@
+// Handles production over long-lived WebSocket connections.
+//
+// Author: Kirk Morales
+// Copyright 2022. All Rights Reserved.
+
+package handler
+
+import (
+	"beget/downstream"
+	"beget/util"
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/gorilla/websocket"
+)
+
+var upgrader = websocket.Upgrader{
+	CheckOrigin: checkOrigin,
+}
+
+// A produce frame sent by the client. The message fields are the same as the
+// `/produce` request body, plus an optional ID used to correlate acknowledgements.
+type wsFrame struct {
+	ID string
+	RequestBody
+}
+
+// Acknowledgement sent back to the client for each frame
+type wsAck struct {
+	ID     string `json:"id,omitempty"`    // The correlation ID of the frame, if provided
+	Status int    `json:"status"`          // HTTP status code describing the outcome
+	Error  string `json:"error,omitempty"` // The error message, if production failed
+	Code   string `json:"code,omitempty"`  // The error code, if production failed
+}
+
+// Handles a WebSocket connection on which the client sends produce frames. Each
+// frame is validated like a `/produce` request and answered with an ack or error
+// frame once its write completes. Frames are produced concurrently, so acks may
+// arrive out of order and should be matched using the frame's ID.
+func websocketHandler(w http.ResponseWriter, r *http.Request) {
+
+	// If the upgrade fails, an error response has already been written
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	conn.SetReadLimit(maxBodyBytes())
+
+	// Connections support only one concurrent writer
+	var mu sync.Mutex
+	send := func(ack wsAck) {
+		mu.Lock()
+		defer mu.Unlock()
+		if err := conn.WriteJSON(ack); err != nil {
+			util.SugarFor(r.Context()).Debug("failed to write websocket ack:", err)
+		}
+	}
+
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
+	sem := make(chan struct{}, batchSize())
+
+	for {
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			if !websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+				util.SugarFor(r.Context()).Debug("websocket closed:", err)
+			}
+			return
+		}
+
+		frame, verr := decodeFrame(data, requestMeta(r))
+		if verr != nil {
+			send(wsAck{ID: frame.ID, Status: verr.status, Error: verr.msg, Code: verr.code})
+			continue
+		}
+
+		sem <- struct{}{}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			ack := wsAck{ID: frame.ID, Status: http.StatusOK}
+
+			// As with `/produce`, the connection's context is intentionally not passed down
+			if err := downstream.Produce(context.Background(), frame.message()); err != nil {
+				util.SugarFor(r.Context()).Error("failed to write kafka messages:", err)
+				ack.Status = http.StatusInternalServerError
+				ack.Error, ack.Code = "failed to produce message", codeProduceFailed
+			}
+
+			send(ack)
+		}()
+	}
+}
+
+// Decodes and validates a single produce frame. The returned frame is never nil
+// so that its ID, if it could be decoded, can be included in an error ack.
+func decodeFrame(data []byte, meta downstream.RequestMeta) (*wsFrame, *validationError) {
+	var raw struct {
+		ID string
+		rawRequestBody
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+
+	err := dec.Decode(&raw)
+	frame := &wsFrame{ID: raw.ID}
+	if err != nil {
+		return frame, decodeError(err)
+	}
+
+	if err := dec.Decode(&struct{}{}); err != io.EOF {
+		return frame, &validationError{http.StatusBadRequest, codeInvalidJSON, "Request body must only contain a single JSON object", ""}
+	}
+
+	if verr := checkBodySize(raw.Topic, int64(len(data))); verr != nil {
+		return frame, verr
+	}
+
+	frame.RequestBody = raw.body()
+	if verr := checkBody(&frame.RequestBody, meta); verr != nil {
+		return frame, verr
+	}
+
+	if verr := allowTopic(frame.Topic); verr != nil {
+		return frame, verr
+	}
+
+	return frame, nil
+}
+
+// Allows WebSocket connections from the service's own host, from any origin in
+// `Config.Server.Websocket.AllowedOrigins`, and from non-browser clients that
+// don't send an Origin header.
+func checkOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+
+	if u, err := url.Parse(origin); err == nil && strings.EqualFold(u.Host, r.Host) {
+		return true
+	}
+
+	for _, allowed := range util.Config.Server.Websocket.AllowedOrigins {
+		if allowed == "*" || strings.EqualFold(allowed, origin) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,117 @@
+package handler
+
+import (
+	"beget/downstream"
+	"beget/util"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+	"github.com/segmentio/kafka-go"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/time/rate"
+)
+
+func TestWebsocketHandler(t *testing.T) {
+	util.InitLogging()
+
+	sink := downstream.NewMemorySink()
+	sink.Fail = func(m kafka.Message) error {
+		if string(m.Value) == "fail" {
+			return errors.New("write failed")
+		}
+		return nil
+	}
+	stubSink := downstream.DefaultSink
+	downstream.DefaultSink = sink
+
+	downstream.KafkaTopics = make(map[string]struct{})
+	downstream.KafkaTopics["foo"] = struct{}{}
+
+	srv := httptest.NewServer(InitRouter())
+	defer srv.Close()
+
+	wsURL := "ws" + strings.TrimPrefix(srv.URL, "http") + "/ws"
+
+	t.Run("acknowledges each frame", func(t *testing.T) {
+		conn, _, err := websocket.DefaultDialer.Dial(wsURL, http.Header{"X-Request-Id": {"req-1"}})
+		assert.Nil(t, err)
+		defer conn.Close()
+
+		frames := []string{
+			`{"id":"1","topic":"foo","value":{"foo":1},"headers":{"a":"1"}}`,
+			`{"id":"2","topic":"bar","value":"foobar"}`,
+			`{"id":"3","topic":"foo","value":"fail"}`,
+			`<>`,
+			`{"id":"5","topic":"foo","value":"foobar","key":"somekey"}`,
+		}
+		for _, frame := range frames {
+			assert.Nil(t, conn.WriteMessage(websocket.TextMessage, []byte(frame)))
+		}
+
+		acks := make(map[string]wsAck)
+		for range frames {
+			var ack wsAck
+			assert.Nil(t, conn.ReadJSON(&ack))
+			acks[ack.ID] = ack
+		}
+
+		assert.Equal(t, map[string]wsAck{
+			"1": {ID: "1", Status: 200},
+			"2": {ID: "2", Status: 400, Error: "invalid topic", Code: codeTopicNotAllowed},
+			"3": {ID: "3", Status: 500, Error: "failed to produce message", Code: codeProduceFailed},
+			"":  {Status: 400, Error: "Request body contains badly-formed JSON (at position 1)", Code: codeInvalidJSON},
+			"5": {ID: "5", Status: 200},
+		}, acks)
+
+		assert.ElementsMatch(t, []kafka.Message{
+			{Topic: "foo", Value: []byte(`{"foo":1}`), Headers: []kafka.Header{{Key: "a", Value: []byte("1")}, {Key: downstream.RequestIDHeader, Value: []byte("req-1")}}},
+			{Topic: "foo", Value: []byte("foobar"), Key: []byte("somekey"), Headers: []kafka.Header{{Key: downstream.RequestIDHeader, Value: []byte("req-1")}}},
+		}, sink.Messages())
+	})
+
+	t.Run("rate limits each frame", func(t *testing.T) {
+		sink.Reset()
+		downstream.KafkaTopicSettings = map[string]*downstream.TopicSettings{"foo": {Limiter: rate.NewLimiter(0, 2)}}
+		defer func() { downstream.KafkaTopicSettings = nil }()
+
+		conn, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
+		assert.Nil(t, err)
+		defer conn.Close()
+
+		statuses := make(map[int]int)
+		for i := 0; i < 3; i++ {
+			assert.Nil(t, conn.WriteMessage(websocket.TextMessage, []byte(`{"topic":"foo","value":"foobar"}`)))
+
+			var ack wsAck
+			assert.Nil(t, conn.ReadJSON(&ack))
+			statuses[ack.Status]++
+		}
+
+		assert.Equal(t, map[int]int{200: 2, 429: 1}, statuses)
+		assert.Len(t, sink.Messages(), 2)
+	})
+
+	t.Run("origin", func(t *testing.T) {
+		header := http.Header{}
+		header.Set("Origin", "https://dashboard.example.com")
+
+		_, res, err := websocket.DefaultDialer.Dial(wsURL, header)
+		assert.NotNil(t, err)
+		assert.Equal(t, 403, res.StatusCode)
+
+		util.Config.Server.Websocket.AllowedOrigins = []string{"https://dashboard.example.com"}
+		defer func() { util.Config.Server.Websocket.AllowedOrigins = nil }()
+
+		conn, _, err := websocket.DefaultDialer.Dial(wsURL, header)
+		assert.Nil(t, err)
+		conn.Close()
+	})
+
+	// Restore stubs
+	downstream.KafkaTopics = make(map[string]struct{})
+	downstream.DefaultSink = stubSink
+}
@@ -12,11 +12,14 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
 	"syscall"
 	"time"
+
+	"google.golang.org/grpc"
 )
 
 func main() {
@@ -29,6 +32,11 @@ func main() {
 		util.Sugar.Panic(err)
 	}
 
+	// Reinitialize the logger with its configuration
+	if err := util.InitLogging(); err != nil {
+		util.Sugar.Panic(err)
+	}
+
 	// Get web server port
 	port := util.Config.Server.Port
 	if port <= 0 {
@@ -57,9 +65,27 @@ func main() {
 		}
 	}()
 
+	// Start the gRPC server alongside the webserver if a port is configured
+	var grpcSrv *grpc.Server
+	if grpcPort := util.Config.Server.GrpcPort; grpcPort > 0 {
+		lis, err := net.Listen("tcp", fmt.Sprintf(":%d", grpcPort))
+		if err != nil {
+			util.Sugar.Panic(err)
+		}
+
+		grpcSrv = handler.InitGrpcServer()
+
+		go func() {
+			util.Sugar.Infof("Listening for gRPC on port %d", grpcPort)
+			if err := grpcSrv.Serve(lis); err != nil {
+				util.Sugar.Info(err.Error())
+			}
+		}()
+	}
+
 	// Wait for interrupt signal to gracefully shutdown the server with
 	// a timeout of 5 seconds.
-	quit := make(chan os.Signal)
+	quit := make(chan os.Signal, 1)
 	// kill (no param) default send syscall.SIGTERM
 	// kill -2 is syscall.SIGINT
 	// kill -9 is syscall.SIGKILL but can't be caught, so don't need to add it
@@ -76,6 +102,26 @@ func main() {
 		util.Sugar.Fatalf("server forced to shutdown: %s", err.Error())
 	}
 
+	// Give in-flight gRPC calls the same deadline before stopping them forcefully
+	if grpcSrv != nil {
+		stopped := make(chan struct{})
+		go func() {
+			grpcSrv.GracefulStop()
+			close(stopped)
+		}()
+
+		select {
+		case <-stopped:
+		case <-ctx.Done():
+			grpcSrv.Stop()
+		}
+	}
+
+	// Let writes acknowledged with a receipt finish and send their callbacks
+	if err := handler.WaitForReceipts(ctx); err != nil {
+		util.Sugar.Warn("gave up waiting for receipts: ", err.Error())
+	}
+
 	// Close Kafka writer
 	if err := downstream.Close(); err != nil {
 		util.Sugar.Fatalf("failed to close writer: %s", err.Error())
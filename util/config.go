@@ -8,8 +8,11 @@ package util
 import (
 	"bytes"
 	"fmt"
+	"reflect"
+	"strings"
 	"time"
 
+	"github.com/mitchellh/mapstructure"
 	"github.com/segmentio/kafka-go"
 	"github.com/spf13/viper"
 )
@@ -22,21 +25,153 @@ const (
 	DebugMode   ServiceMode = "debug"
 )
 
+// What happens to a write that outlives its request's timeout
+type TimeoutPolicy string
+
+const (
+	DetachOnTimeout TimeoutPolicy = "detach"
+	CancelOnTimeout TimeoutPolicy = "cancel"
+	AcceptOnTimeout TimeoutPolicy = "accept"
+)
+
+// The Kafka protocol binding mode CloudEvents are written with
+type CloudEventsMode string
+
+const (
+	BinaryEvents     CloudEventsMode = "binary"
+	StructuredEvents CloudEventsMode = "structured"
+)
+
+// How error responses are written
+type ErrorFormat string
+
+const (
+	ProblemErrors ErrorFormat = "problem"
+	TextErrors    ErrorFormat = "text"
+)
+
 type Configuration struct {
 	App struct {
 		Mode ServiceMode
 	}
 	Server struct {
 		Port        int
+		GrpcPort    int `mapstructure:"grpc_port"`
 		Timeout     int
 		HttpLogging HttpLoggingConfig `mapstructure:"http_logging"`
+		Websocket   WebsocketConfig
+		Idempotency IdempotencyConfig
+
+		// The most a compressed request body may expand by when decompressed. Default: 100
+		MaxCompressionRatio int `mapstructure:"max_compression_ratio"`
+
+		// What happens to a write that's still in progress when the request times out:
+		// "detach" keeps writing and responds once done, "cancel" stops the write and
+		// responds with a 504, and "accept" keeps writing but responds with a 202 and a
+		// URL to poll for the outcome. Default: detach
+		TimeoutPolicy TimeoutPolicy `mapstructure:"timeout_policy"`
+
+		// How long the outcome of an accepted write can be polled for. Default: 1h
+		StatusTTL time.Duration `mapstructure:"status_ttl"`
+
+		// Delivery receipts sent to a request's `Callback-Url`
+		Callbacks CallbackConfig
+
+		// The largest request body accepted, in bytes, once decompressed. Also limits
+		// each line of a stream and each WebSocket frame.
+		//
+		// Default: `kafka.batch_bytes` if set, otherwise 1MB
+		MaxBodyBytes int64 `mapstructure:"max_body_bytes"`
+
+		// How error responses are written: "problem" writes RFC 7807 problem details
+		// with a stable `code` as `application/problem+json`, and "text" writes just the
+		// message as plain text. Default: problem
+		ErrorFormat ErrorFormat `mapstructure:"error_format"`
+
+		// The bearer token required by `/admin` endpoints, which are disabled unless
+		// it's set
+		AdminToken string `mapstructure:"admin_token"`
+
+		// The most messages a gRPC `ProduceStream` call accepts before it's closed.
+		// Default: 10000
+		GrpcMaxStreamMessages int `mapstructure:"grpc_max_stream_messages"`
 	}
-	Kafka KafkaWriterConfig
+	Kafka       KafkaWriterConfig
+	CloudEvents CloudEventsConfig `mapstructure:"cloudevents"`
+
+	// Logical names clients may produce to, routed to topics by rules
+	Routes []RouteConfig
+
+	// Destinations other than Kafka that topics may be written to, by name
+	Sinks map[string]SinkConfig
+
+	// Limits on topic scripts
+	Scripts ScriptConfig
+
+	// Keys used to redact fields
+	Redaction RedactionConfig
+
+	// How and where logs are written
+	Log LogConfig
 }
 
 type KafkaWriterConfig struct {
 	Brokers []string
-	Topics  []string
+
+	// Topics that may be produced to. May be given as a list of names or as a map
+	// of names to settings. Names may be glob patterns, or regular expressions
+	// wrapped in slashes, to allow any existing topic that matches.
+	Topics map[string]TopicConfig
+
+	// How often to fetch the list of existing topics from the brokers, so topics
+	// matching a pattern become producible. Required for patterns unless topics are
+	// created automatically.
+	DiscoveryInterval time.Duration `mapstructure:"discovery_interval"`
+
+	// Topics that may be consumed over HTTP
+	ReadableTopics []string `mapstructure:"readable_topics"`
+
+	// How long a consumer group's reader may go unused before it's closed and leaves
+	// the group.
+	//
+	// Default: 5m
+	ReaderIdleTimeout time.Duration `mapstructure:"reader_idle_timeout"`
+
+	// The transactional ID used for transactional produce requests. Each instance must
+	// use its own ID, since beginning a transaction fences off any other producer using it.
+	//
+	// Default: "beget-" followed by the hostname
+	TransactionalID string `mapstructure:"transactional_id"`
+
+	// How long a transaction may stay open before the broker aborts it
+	//
+	// Default: 1m
+	TransactionTimeout time.Duration `mapstructure:"transaction_timeout"`
+
+	// Options for connecting to and writing to the brokers above. Clusters use
+	// these too, unless they override them.
+	ClusterOptions `mapstructure:",squash"`
+
+	// Additional clusters that topics may be written to, by name
+	Clusters map[string]ClusterConfig
+}
+
+// A named Kafka cluster
+type ClusterConfig struct {
+	Brokers []string
+
+	// Overrides of the options of the top-level `kafka` configuration. Options
+	// that aren't set are taken from there.
+	ClusterOptions `mapstructure:",squash"`
+}
+
+// Options for connecting to and writing to a cluster
+type ClusterOptions struct {
+	// Connect to the brokers using TLS
+	TLS *TLSConfig
+
+	// Authenticate with the brokers using SASL
+	SASL *SASLConfig
 
 	//
 	// Below is a subset of initiation options:
@@ -108,6 +243,239 @@ type KafkaWriterConfig struct {
 
 	// AllowAutoTopicCreation notifies writer to create topic if missing.
 	AllowAutoTopicCreation bool `mapstructure:"allow_auto_topic_creation"`
+
+	// The codec used to compress message batches, one of "none", "gzip", "snappy",
+	// "lz4" or "zstd".
+	//
+	// Defaults to none.
+	Compression string
+
+	// The options set in the config, by field name, so that options set to their
+	// zero value (e.g. `async: false`) aren't taken from the defaults
+	set map[string]bool
+}
+
+// Returns the options, with any that aren't set taken from `defaults`
+func (o ClusterOptions) WithDefaults(defaults ClusterOptions) ClusterOptions {
+	v := reflect.ValueOf(&o).Elem()
+	d := reflect.ValueOf(defaults)
+	for i := 0; i < v.NumField(); i++ {
+		field := v.Type().Field(i)
+		if field.IsExported() && v.Field(i).IsZero() && !o.set[field.Name] {
+			v.Field(i).Set(d.Field(i))
+		}
+	}
+	return o
+}
+
+// Records which of the cluster options under the config key were set
+func (o *ClusterOptions) recordSet(key string) {
+	o.set = make(map[string]bool)
+
+	t := reflect.TypeOf(*o)
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		name, _, _ := strings.Cut(field.Tag.Get("mapstructure"), ",")
+		if name == "" {
+			name = strings.ToLower(field.Name)
+		}
+		if field.IsExported() && viper.IsSet(key+"."+name) {
+			o.set[field.Name] = true
+		}
+	}
+}
+
+type TLSConfig struct {
+	// Whether to connect using TLS. Defaults to true when the `tls` section is given,
+	// so it's only needed to turn TLS off (e.g. for a cluster when the top-level
+	// brokers use it) or to use TLS with the default settings.
+	Enabled *bool
+
+	// Path to the PEM-encoded CA certificates used to verify the brokers.
+	//
+	// Default: the system's CA certificates
+	CAFile string `mapstructure:"ca_file"`
+
+	// Paths to the PEM-encoded client certificate and key, if the brokers require one
+	CertFile string `mapstructure:"cert_file"`
+	KeyFile  string `mapstructure:"key_file"`
+
+	// Skip verifying the brokers' certificates. Only use this for testing.
+	InsecureSkipVerify bool `mapstructure:"insecure_skip_verify"`
+}
+
+// Returns whether TLS is enabled by the config, which may be nil
+func (c *TLSConfig) IsEnabled() bool {
+	return c != nil && (c.Enabled == nil || *c.Enabled)
+}
+
+type SASLConfig struct {
+	// One of "plain", "scram-sha-256" or "scram-sha-512"
+	Mechanism string
+
+	Username string
+	Password string
+}
+
+// Settings for a single topic. Every setting is optional.
+type TopicConfig struct {
+	// The topic's name, if it differs from its key. Configuration keys are
+	// case-insensitive and can't contain dots, so this is needed for topics that do.
+	Name string
+
+	// The name clients use to refer to the topic. If set, the topic can only be
+	// referred to by its alias.
+	Alias string
+
+	// The largest message value accepted, in bytes, once it's redacted
+	MaxMessageBytes int `mapstructure:"max_message_bytes"`
+
+	// Overrides `server.max_body_bytes` for requests to the topic. It may be larger.
+	MaxBodyBytes int64 `mapstructure:"max_body_bytes"`
+
+	// Whether messages must have a key
+	RequireKey bool `mapstructure:"require_key"`
+
+	// The content types message values may have. A value's content type is taken from
+	// its `content-type` header or, if that's missing, is "application/json" for valid
+	// JSON and "text/plain" for anything else.
+	ContentTypes []string `mapstructure:"content_types"`
+
+	// Path to a JSON Schema file that message values must match
+	Schema string
+
+	// The maximum number of messages per second accepted for the topic, and how many
+	// may be accepted in a burst above that rate.
+	//
+	// Default burst: the rate, rounded up
+	RateLimit float64 `mapstructure:"rate_limit"`
+	RateBurst int     `mapstructure:"rate_burst"`
+
+	// Overrides of the writer options of the same name
+	RequiredAcks *kafka.RequiredAcks `mapstructure:"required_acks"`
+	Compression  string
+
+	// How messages are assigned to partitions, one of "least_bytes", "round_robin",
+	// "hash", "crc32" or "murmur2". The hashing balancers use the message key.
+	//
+	// Default: least_bytes
+	Balancer string
+
+	// The name of the cluster in `kafka.clusters` the topic is written to.
+	//
+	// Default: the top-level `kafka` brokers
+	Cluster string
+
+	// The name of a second cluster every message is also written to. Use "default"
+	// for the top-level `kafka` brokers when `cluster` is set.
+	Mirror string
+
+	// The name of the sink the topic is written to: one of `sinks`, or "kafka",
+	// "stdout" or "memory".
+	//
+	// Default: "kafka" in release mode and "stdout" in debug mode
+	Sink string
+
+	// Operations applied in order to message values, which must then be JSON objects.
+	// Other settings are checked against the transformed message.
+	Transforms []TransformConfig
+
+	// Path to a Starlark script defining a `process(msg)` function that's called
+	// with each message once it's transformed. The script may modify the message,
+	// send it to another topic or reject it.
+	Script string
+
+	// CEL expressions messages must satisfy, checked after the schema
+	Rules []RuleConfig
+
+	// Fields of JSON object values that are dropped, hashed, masked or encrypted
+	// before messages are written. Other settings are checked against the message
+	// before it's redacted.
+	Redact []RedactFieldConfig
+}
+
+// A field redacted before messages are written
+type RedactFieldConfig struct {
+	// The field's path, as with transforms
+	Field string
+
+	// One of "drop", "hash" (salted SHA-256), "mask" or "encrypt" (AES-GCM)
+	Action string
+
+	// For "mask", how many characters at the end of the value are left unmasked.
+	// Values no longer than this are masked in full.
+	//
+	// Default: 4
+	Keep *int
+}
+
+// A CEL expression messages must satisfy
+type RuleConfig struct {
+	// An expression returning a bool, with the variables `value` (the decoded JSON
+	// value, or a string), `key` and `headers`. E.g. "value.amount > 0".
+	Expr string
+
+	// The error messages that break the rule are rejected with.
+	//
+	// Default: "message breaks rule: <expr>"
+	Message string
+}
+
+// An operation applied to a message before it's written
+type TransformConfig struct {
+	// One of "rename", "drop", "add", "default", "cast", "timestamp", "metadata" or "key"
+	Op string
+
+	// The path of the field the operation applies to, e.g. "$.user.id" or "items[0].sku"
+	Field string
+
+	// For "rename", the field's new path
+	To string
+
+	// For "add", the value the field is set to, and for "default", the value it's
+	// set to if it's missing or null
+	Value interface{}
+
+	// For "cast", the type the field is converted to: one of "string", "number",
+	// "integer" or "boolean"
+	Type string
+
+	// For "timestamp", how the time the message was received is written: one of
+	// "rfc3339", "unix" or "unix_ms".
+	//
+	// Default: rfc3339
+	Format string
+
+	// For "metadata", the request metadata the field is set to: one of "client_ip"
+	// or "request_id"
+	Source string
+}
+
+type SinkConfig struct {
+	// One of "kafka", "file", "stdout" or "memory"
+	Type string
+
+	// The file messages are appended to, one JSON object per line. File sinks only.
+	Path string
+
+	// The size in bytes a file may reach before it's rotated. File sinks only.
+	//
+	// Default: 100MB
+	MaxBytes int64 `mapstructure:"max_bytes"`
+
+	// How many rotated files to keep. The most recent is named with a ".1" suffix.
+	// File sinks only.
+	//
+	// Default: 5
+	MaxFiles int `mapstructure:"max_files"`
+}
+
+// Returns the name of the topic configured under the given key
+func (c TopicConfig) TopicName(key string) string {
+	if c.Name != "" {
+		return c.Name
+	}
+	return key
 }
 
 type HttpLoggingConfig struct {
@@ -118,6 +486,176 @@ type HttpLoggingConfig struct {
 	SkipUserAgent bool `mapstructure:"skip_user_agent"`
 }
 
+type WebsocketConfig struct {
+	// Origins allowed to open a WebSocket in addition to the service's own host.
+	// Use "*" to allow any origin.
+	AllowedOrigins []string `mapstructure:"allowed_origins"`
+}
+
+type CloudEventsConfig struct {
+	// The Kafka protocol binding mode events are written with, either "binary"
+	// (attributes as `ce_` headers) or "structured" (the whole event as the value).
+	//
+	// Default: binary
+	Mode CloudEventsMode
+
+	// Rules mapping events to topics. The first rule matching the event wins.
+	Routes []CloudEventRoute
+}
+
+type CloudEventRoute struct {
+	// Patterns matched against the event's `type` and `source` attributes. A
+	// pattern ending in "*" matches by prefix and an empty pattern matches anything.
+	Type   string
+	Source string
+
+	// The topic matching events are written to
+	Topic string
+}
+
+type RouteConfig struct {
+	// The logical name clients produce to. Takes precedence over a topic of the same name.
+	Name string
+
+	// Rules picking the topic for a message. The first rule matching the message wins.
+	Rules []RouteRule
+
+	// The topic for messages that don't match any rule. If empty, they're rejected.
+	Default string
+}
+
+type RouteRule struct {
+	// What the rule matches: a dot-separated path to a field of the message value,
+	// a header or, if neither is given, the message key
+	Field  string
+	Header string
+
+	// Pattern matched against the field, header or key. A pattern ending in "*"
+	// matches by prefix and an empty pattern matches anything that's present.
+	Match string
+
+	// The topic matching messages are written to
+	Topic string
+}
+
+type IdempotencyConfig struct {
+	// How long the response to a request with an idempotency key is remembered.
+	//
+	// Default: 24h
+	TTL time.Duration
+
+	// The maximum number of idempotency keys remembered. Once reached, the least
+	// recently used keys are forgotten first.
+	//
+	// Default: 10000
+	MaxKeys int `mapstructure:"max_keys"`
+}
+
+type CallbackConfig struct {
+	// Key callbacks are signed with using HMAC-SHA256. Requests with a callback URL
+	// are rejected unless it's set.
+	Secret string
+
+	// Hosts callback URLs may point to. Listed hosts may resolve to private
+	// addresses. If empty, any host with a public address is allowed.
+	AllowedHosts []string `mapstructure:"allowed_hosts"`
+
+	// How many times a callback is attempted before giving up.
+	//
+	// Default: 5
+	MaxAttempts int `mapstructure:"max_attempts"`
+
+	// How long to wait before the first retry, doubling after each attempt.
+	//
+	// Default: 1s
+	Backoff time.Duration
+
+	// Timeout for each attempt.
+	//
+	// Default: 10s
+	Timeout time.Duration
+}
+
+type LogConfig struct {
+	// The lowest level logged: debug, info, warn or error. It can be changed while
+	// running with `PUT /admin/loglevel`.
+	//
+	// Default: debug in debug mode, otherwise info
+	Level string
+
+	// How lines are encoded: json or console. Default: json
+	Format string
+
+	// Where logs are written: stdout, stderr or file. Default: stderr
+	Output string
+
+	// The file logs are written to when `output` is "file"
+	File string
+
+	// Rotation of the log file
+	Rotation LogRotationConfig
+
+	// Limits on repeated lines
+	Sampling LogSamplingConfig
+}
+
+type LogRotationConfig struct {
+	// The size in megabytes a log file may reach before it's rotated. Default: 100
+	MaxSize int `mapstructure:"max_size"`
+
+	// How many days rotated files are kept. Rotated files are kept forever if 0.
+	MaxAge int `mapstructure:"max_age"`
+
+	// How many rotated files are kept. All are kept if 0.
+	MaxBackups int `mapstructure:"max_backups"`
+
+	// Whether rotated files are gzipped
+	Compress bool
+}
+
+type LogSamplingConfig struct {
+	// Each second, the first `initial` lines with the same level and message are
+	// logged, then every `thereafter`th. Lines aren't sampled if `initial` is 0.
+	//
+	// Default: 100
+	Initial int
+
+	// Default: 100
+	Thereafter int
+}
+
+type RedactionConfig struct {
+	// The salt hashed fields are prefixed with. Required to hash fields.
+	HashSalt string `mapstructure:"hash_salt"`
+
+	// Path to a JSON file mapping key IDs to base64-encoded AES keys of 16, 24 or 32
+	// bytes. Required to encrypt fields.
+	Keyring string
+
+	// The ID of the key in the keyring that fields are encrypted with. It's recorded
+	// in the `beget-key-id` header of messages with encrypted fields.
+	EncryptionKey string `mapstructure:"encryption_key"`
+}
+
+type ScriptConfig struct {
+	// The most Starlark execution steps a script may take per message.
+	//
+	// Default: 100000
+	MaxSteps uint64 `mapstructure:"max_steps"`
+
+	// The largest message, counting its topic, key, value and headers, a script
+	// may be given or return. Starlark can't limit what a script allocates while
+	// it runs, so this doesn't bound its memory use.
+	//
+	// Default: 1048576
+	MaxBytes int `mapstructure:"max_bytes"`
+
+	// How long a script may run per message.
+	//
+	// Default: 100ms
+	Timeout time.Duration
+}
+
 var Config Configuration
 
 // InitConfig load configuration from a `config.yaml` in the same directory
@@ -164,12 +702,75 @@ func finalizeConfig() error {
 	viper.SetDefault("app.mode", "debug")
 	viper.SetDefault("server.port", 8080)
 	viper.SetDefault("server.timeout", 30)
+	viper.SetDefault("server.timeout_policy", "detach")
+	viper.SetDefault("server.error_format", "problem")
+	viper.SetDefault("log.sampling.initial", 100)
+	viper.SetDefault("log.sampling.thereafter", 100)
+	viper.SetDefault("cloudevents.mode", "binary")
 
 	// Get configuration into our `Config` variable
-	err := viper.Unmarshal(&Config)
+	err := viper.Unmarshal(&Config, viper.DecodeHook(mapstructure.ComposeDecodeHookFunc(
+		topicListHook,
+		mapstructure.StringToTimeDurationHookFunc(),
+		mapstructure.StringToSliceHookFunc(","),
+	)))
 	if err != nil {
 		return fmt.Errorf("unable to decode into struct, %v", err)
 	}
 
+	for name, cluster := range Config.Kafka.Clusters {
+		cluster.ClusterOptions.recordSet("kafka.clusters." + name)
+		Config.Kafka.Clusters[name] = cluster
+	}
+
+	switch Config.Server.TimeoutPolicy {
+	case DetachOnTimeout, CancelOnTimeout, AcceptOnTimeout:
+	default:
+		return fmt.Errorf("invalid timeout policy %q", Config.Server.TimeoutPolicy)
+	}
+
+	switch Config.Server.ErrorFormat {
+	case ProblemErrors, TextErrors:
+	default:
+		return fmt.Errorf("invalid error format %q", Config.Server.ErrorFormat)
+	}
+
+	switch Config.CloudEvents.Mode {
+	case BinaryEvents, StructuredEvents:
+	default:
+		return fmt.Errorf("invalid cloudevents mode %q", Config.CloudEvents.Mode)
+	}
+
 	return nil
 }
+
+// Decodes `kafka.topics` given as a list of names (or a comma-separated string, as
+// with ENV variables) into a map of topics without settings
+func topicListHook(from reflect.Type, to reflect.Type, data interface{}) (interface{}, error) {
+	if to != reflect.TypeOf(map[string]TopicConfig{}) {
+		return data, nil
+	}
+
+	var names []string
+	switch from.Kind() {
+	case reflect.String:
+		names = strings.Split(data.(string), ",")
+	case reflect.Slice:
+		v := reflect.ValueOf(data)
+		for i := 0; i < v.Len(); i++ {
+			names = append(names, fmt.Sprint(v.Index(i).Interface()))
+		}
+	default:
+		return data, nil
+	}
+
+	topics := make(map[string]interface{}, len(names))
+	for _, name := range names {
+		if name = strings.TrimSpace(name); name != "" {
+			// Keep the original name, since keys may be lowercased
+			topics[name] = map[string]interface{}{"name": name}
+		}
+	}
+
+	return topics, nil
+}
@@ -3,6 +3,9 @@ package util_test
 import (
 	"beget/util"
 	"testing"
+	"time"
+
+	"github.com/segmentio/kafka-go"
 
 	"github.com/spf13/viper"
 	"github.com/stretchr/testify/assert"
@@ -23,4 +26,192 @@ func TestInitConfigDefaults(t *testing.T) {
 
 	assert.Equal(t, util.DebugMode, util.Config.App.Mode)
 	assert.Equal(t, 8080, util.Config.Server.Port)
+	assert.Equal(t, util.DetachOnTimeout, util.Config.Server.TimeoutPolicy)
+	assert.Equal(t, util.ProblemErrors, util.Config.Server.ErrorFormat)
+}
+
+func TestTimeoutPolicy(t *testing.T) {
+	err := util.InitConfigFromYaml("server:\n  timeout_policy: accept\n  status_ttl: 10m")
+	assert.Nil(t, err)
+	assert.Equal(t, util.AcceptOnTimeout, util.Config.Server.TimeoutPolicy)
+	assert.Equal(t, 10*time.Minute, util.Config.Server.StatusTTL)
+
+	err = util.InitConfigFromYaml("server:\n  timeout_policy: retry")
+	assert.EqualError(t, err, `invalid timeout policy "retry"`)
+
+	// Reset config
+	util.Config.Server.TimeoutPolicy = util.DetachOnTimeout
+	util.Config.Server.StatusTTL = 0
+}
+
+func TestErrorFormat(t *testing.T) {
+	err := util.InitConfigFromYaml("server:\n  error_format: text")
+	assert.Nil(t, err)
+	assert.Equal(t, util.TextErrors, util.Config.Server.ErrorFormat)
+
+	err = util.InitConfigFromYaml("server:\n  error_format: xml")
+	assert.EqualError(t, err, `invalid error format "xml"`)
+
+	// Reset config
+	util.Config.Server.ErrorFormat = util.ProblemErrors
+}
+
+func TestCloudEventsMode(t *testing.T) {
+	err := util.InitConfigFromYaml("cloudevents:\n  mode: structured")
+	assert.Nil(t, err)
+	assert.Equal(t, util.StructuredEvents, util.Config.CloudEvents.Mode)
+
+	err = util.InitConfigFromYaml("cloudevents:\n  mode: structure")
+	assert.EqualError(t, err, `invalid cloudevents mode "structure"`)
+
+	// Reset config
+	util.Config.CloudEvents.Mode = util.BinaryEvents
+}
+
+func TestTopicsConfig(t *testing.T) {
+	t.Run("list of names", func(t *testing.T) {
+		util.Config.Kafka.Topics = nil
+
+		err := util.InitConfigFromYaml(`
+kafka:
+  topics:
+    - foo
+    - Bar.v1
+`)
+
+		assert.Nil(t, err)
+		assert.Equal(t, map[string]util.TopicConfig{
+			"foo":    {Name: "foo"},
+			"Bar.v1": {Name: "Bar.v1"},
+		}, util.Config.Kafka.Topics)
+	})
+
+	t.Run("patterns", func(t *testing.T) {
+		util.Config.Kafka.Topics = nil
+
+		err := util.InitConfigFromYaml(`
+kafka:
+  topics:
+    - team-x.*
+    - /events\.v2\.(eu|us)/
+  discovery_interval: 1m
+`)
+
+		assert.Nil(t, err)
+		assert.Equal(t, map[string]util.TopicConfig{
+			"team-x.*":              {Name: "team-x.*"},
+			`/events\.v2\.(eu|us)/`: {Name: `/events\.v2\.(eu|us)/`},
+		}, util.Config.Kafka.Topics)
+		assert.Equal(t, time.Minute, util.Config.Kafka.DiscoveryInterval)
+
+		util.Config.Kafka.DiscoveryInterval = 0
+	})
+
+	t.Run("comma-separated names", func(t *testing.T) {
+		util.Config.Kafka.Topics = nil
+		viper.Set("kafka.topics", "foo, bar")
+		defer viper.Set("kafka.topics", nil)
+
+		err := util.InitConfigFromYaml("")
+
+		assert.Nil(t, err)
+		assert.Equal(t, map[string]util.TopicConfig{
+			"foo": {Name: "foo"},
+			"bar": {Name: "bar"},
+		}, util.Config.Kafka.Topics)
+	})
+
+	t.Run("map of settings", func(t *testing.T) {
+		util.Config.Kafka.Topics = nil
+
+		err := util.InitConfigFromYaml(`
+kafka:
+  topics:
+    foo: {}
+    orders_v1:
+      name: Orders.v1
+      alias: orders
+      require_key: true
+      max_message_bytes: 1024
+      content_types:
+        - application/json
+      rate_limit: 2.5
+      required_acks: -1
+      balancer: hash
+`)
+
+		acks := kafka.RequireAll
+
+		assert.Nil(t, err)
+		assert.Equal(t, map[string]util.TopicConfig{
+			"foo": {},
+			"orders_v1": {
+				Name:            "Orders.v1",
+				Alias:           "orders",
+				RequireKey:      true,
+				MaxMessageBytes: 1024,
+				ContentTypes:    []string{"application/json"},
+				RateLimit:       2.5,
+				RequiredAcks:    &acks,
+				Balancer:        "hash",
+			},
+		}, util.Config.Kafka.Topics)
+		assert.Equal(t, "foo", util.Config.Kafka.Topics["foo"].TopicName("foo"))
+		assert.Equal(t, "Orders.v1", util.Config.Kafka.Topics["orders_v1"].TopicName("orders_v1"))
+	})
+
+}
+
+func TestClusterOptions(t *testing.T) {
+	util.Config.Kafka.Clusters = nil
+
+	err := util.InitConfigFromYaml(`
+kafka:
+  max_attempts: 3
+  batch_size: 10
+  async: true
+  required_acks: -1
+  tls:
+    enabled: true
+  clusters:
+    global:
+      brokers:
+        - global.foo.com
+      batch_size: 100
+      sasl:
+        mechanism: plain
+        username: beget
+        password: secret
+    local:
+      brokers:
+        - local.foo.com
+      async: false
+      required_acks: 0
+      tls:
+        enabled: false
+`)
+	assert.Nil(t, err)
+
+	global := util.Config.Kafka.Clusters["global"]
+	assert.Equal(t, []string{"global.foo.com"}, global.Brokers)
+	assert.Equal(t, &util.SASLConfig{Mechanism: "plain", Username: "beget", Password: "secret"}, global.SASL)
+
+	options := global.WithDefaults(util.Config.Kafka.ClusterOptions)
+	assert.Equal(t, 100, options.BatchSize)
+	assert.Equal(t, 3, options.MaxAttempts)
+	assert.True(t, options.TLS.IsEnabled())
+	assert.True(t, options.Async)
+	assert.Equal(t, kafka.RequireAll, options.RequiredAcks)
+	assert.Equal(t, global.SASL, options.SASL)
+
+	// Options set to their zero value override the defaults
+	options = util.Config.Kafka.Clusters["local"].WithDefaults(util.Config.Kafka.ClusterOptions)
+	assert.False(t, options.TLS.IsEnabled())
+	assert.False(t, options.Async)
+	assert.Equal(t, kafka.RequireNone, options.RequiredAcks)
+	assert.Equal(t, 3, options.MaxAttempts)
+
+	// Reset config
+	util.Config.Kafka.ClusterOptions = util.ClusterOptions{}
+	util.Config.Kafka.Clusters = nil
 }
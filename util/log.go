@@ -6,32 +6,111 @@
 package util
 
 import (
+	"fmt"
 	"net/http"
+	"os"
+	"strings"
 	"time"
 
 	"github.com/go-chi/chi/middleware"
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
+	"gopkg.in/natefinch/lumberjack.v2"
 )
 
+const defaultLogMaxSize = 100
+
 var Logger *zap.Logger
 var Sugar *zap.SugaredLogger
 
-func InitLogging() {
+// The level of `Logger`, which may be changed while running
+var LogLevel = zap.NewAtomicLevel()
+
+// The rotated file logs are written to, if they're written to a file
+var logFile *lumberjack.Logger
+
+// InitLogging initializes `Logger` and `Sugar` using `Config.Log`. It may be called
+// again once the configuration is loaded.
+func InitLogging() error {
+	config := Config.Log
+
+	level := zapcore.InfoLevel
+	if config.Level != "" {
+		if err := level.UnmarshalText([]byte(config.Level)); err != nil {
+			return fmt.Errorf("invalid log level %q", config.Level)
+		}
+	} else if Config.App.Mode == DebugMode {
+		level = zapcore.DebugLevel
+	}
 
-	config := zap.NewProductionConfig()
+	encoderConfig := zap.NewProductionEncoderConfig()
 
 	// Default timestamp is epoch. Use ISO8601 instead
-	config.EncoderConfig.EncodeTime = zapcore.ISO8601TimeEncoder
+	encoderConfig.EncodeTime = zapcore.ISO8601TimeEncoder
 
 	// Shorten message key to save bytes
-	config.EncoderConfig.MessageKey = "m"
+	encoderConfig.MessageKey = "m"
+
+	var encoder zapcore.Encoder
+	switch strings.ToLower(config.Format) {
+	case "", "json":
+		encoder = zapcore.NewJSONEncoder(encoderConfig)
+	case "console":
+		encoder = zapcore.NewConsoleEncoder(encoderConfig)
+	default:
+		return fmt.Errorf("invalid log format %q", config.Format)
+	}
+
+	var file *lumberjack.Logger
+	var out zapcore.WriteSyncer
+	switch strings.ToLower(config.Output) {
+	case "", "stderr":
+		out = zapcore.Lock(os.Stderr)
+	case "stdout":
+		out = zapcore.Lock(os.Stdout)
+	case "file":
+		if config.File == "" {
+			return fmt.Errorf("logging to a file requires log.file")
+		}
+
+		file = &lumberjack.Logger{
+			Filename:   config.File,
+			MaxSize:    config.Rotation.MaxSize,
+			MaxAge:     config.Rotation.MaxAge,
+			MaxBackups: config.Rotation.MaxBackups,
+			Compress:   config.Rotation.Compress,
+		}
+		if file.MaxSize <= 0 {
+			file.MaxSize = defaultLogMaxSize
+		}
+
+		// lumberjack.Logger is safe for concurrent use
+		out = zapcore.AddSync(file)
+	default:
+		return fmt.Errorf("invalid log output %q", config.Output)
+	}
+
+	LogLevel.SetLevel(level)
+	core := zapcore.NewCore(encoder, out, LogLevel)
 
-	Logger, _ = config.Build()
+	if config.Sampling.Initial > 0 {
+		core = zapcore.NewSamplerWithOptions(core, time.Second, config.Sampling.Initial, config.Sampling.Thereafter)
+	}
 
-	defer Logger.Sync() // flushes buffer, if any
+	if Logger != nil {
+		Logger.Sync() // flushes buffer, if any
+	}
 
+	Logger = zap.New(core, zap.AddCaller(), zap.AddStacktrace(zapcore.ErrorLevel), zap.ErrorOutput(zapcore.Lock(os.Stderr)))
 	Sugar = Logger.Sugar()
+
+	// Close the previous file once nothing writes to it
+	if logFile != nil {
+		logFile.Close()
+	}
+	logFile = file
+
+	return nil
 }
 
 // HttpLogger returns a new go-chi logging middleware configured
@@ -52,6 +131,7 @@ func HttpLogger(next http.Handler) http.Handler {
 				}
 
 				Sugar.Infow("http",
+					"request_id", RequestIDFrom(r.Context()),
 					"path", r.URL.Path,
 					"status", ww.Status(),
 					"method", r.Method,
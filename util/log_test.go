@@ -2,10 +2,13 @@ package util_test
 
 import (
 	"beget/util"
+	"os"
+	"path/filepath"
 	"reflect"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap/zapcore"
 )
 
 func TestInitLogging(t *testing.T) {
@@ -13,4 +16,56 @@ func TestInitLogging(t *testing.T) {
 
 	assert.Equal(t, "*zap.Logger", reflect.TypeOf(util.Logger).String())
 	assert.Equal(t, "*zap.SugaredLogger", reflect.TypeOf(util.Sugar).String())
+
+	t.Run("levels", func(t *testing.T) {
+		util.Config.App.Mode = util.ReleaseMode
+		assert.Nil(t, util.InitLogging())
+		assert.Equal(t, zapcore.InfoLevel, util.LogLevel.Level())
+
+		util.Config.App.Mode = util.DebugMode
+		assert.Nil(t, util.InitLogging())
+		assert.Equal(t, zapcore.DebugLevel, util.LogLevel.Level())
+
+		util.Config.Log.Level = "warn"
+		assert.Nil(t, util.InitLogging())
+		assert.Equal(t, zapcore.WarnLevel, util.LogLevel.Level())
+
+		util.Config.App.Mode = ""
+		util.Config.Log.Level = ""
+	})
+
+	t.Run("file output", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "beget.log")
+		util.Config.Log = util.LogConfig{Format: "console", Output: "file", File: path}
+
+		assert.Nil(t, util.InitLogging())
+		util.Sugar.Info("hello")
+		util.Logger.Sync()
+
+		b, err := os.ReadFile(path)
+		assert.Nil(t, err)
+		assert.Contains(t, string(b), "\tinfo\t")
+		assert.Contains(t, string(b), "hello")
+
+		// Close the file before the directory is removed
+		util.Config.Log = util.LogConfig{}
+		assert.Nil(t, util.InitLogging())
+	})
+
+	t.Run("invalid config", func(t *testing.T) {
+		tests := map[string]util.LogConfig{
+			`invalid log level "loud"`:            {Level: "loud"},
+			`invalid log format "xml"`:            {Format: "xml"},
+			`invalid log output "syslog"`:         {Output: "syslog"},
+			"logging to a file requires log.file": {Output: "file"},
+		}
+
+		for msg, config := range tests {
+			util.Config.Log = config
+			assert.EqualError(t, util.InitLogging(), msg)
+		}
+
+		util.Config.Log = util.LogConfig{}
+		util.InitLogging()
+	})
 }
@@ -0,0 +1,133 @@
+// Bounded in-memory cache
+//
+// Author: Kirk Morales
+// Copyright 2022. All Rights Reserved.
+
+package util
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// A bounded in-memory cache whose entries expire after a TTL. Once full, the least
+// recently used entry is evicted to make room. Safe for concurrent use.
+type LRUCache[V any] struct {
+	mu       sync.Mutex
+	capacity int
+	ttl      time.Duration
+	ll       *list.List
+	items    map[string]*list.Element
+}
+
+type lruEntry[V any] struct {
+	key     string
+	value   V
+	expires time.Time
+}
+
+// Creates a cache holding at most `capacity` entries, each expiring after `ttl`
+func NewLRUCache[V any](capacity int, ttl time.Duration) *LRUCache[V] {
+	return &LRUCache[V]{
+		capacity: capacity,
+		ttl:      ttl,
+		ll:       list.New(),
+		items:    make(map[string]*list.Element),
+	}
+}
+
+// Returns the value for the key and whether it was found
+func (c *LRUCache[V]) Get(key string) (V, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if el := c.lookup(key); el != nil {
+		c.ll.MoveToFront(el)
+		return el.Value.(*lruEntry[V]).value, true
+	}
+
+	var zero V
+	return zero, false
+}
+
+// Sets the value for the key, resetting its TTL
+func (c *LRUCache[V]) Set(key string, value V) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.set(key, value)
+}
+
+// Sets the value for the key only if it isn't already present. Returns the existing
+// value and false if it was present, or the new value and true if it was added.
+func (c *LRUCache[V]) SetIfAbsent(key string, value V) (V, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if el := c.lookup(key); el != nil {
+		c.ll.MoveToFront(el)
+		return el.Value.(*lruEntry[V]).value, false
+	}
+
+	c.set(key, value)
+	return value, true
+}
+
+// Removes the key
+func (c *LRUCache[V]) Remove(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if el, ok := c.items[key]; ok {
+		c.remove(el)
+	}
+}
+
+// Returns the number of entries, including any that have expired but not yet been evicted
+func (c *LRUCache[V]) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.ll.Len()
+}
+
+// Returns the element for the key, removing it if it has expired. Must hold `mu`.
+func (c *LRUCache[V]) lookup(key string) *list.Element {
+	el, ok := c.items[key]
+	if !ok {
+		return nil
+	}
+
+	if time.Now().After(el.Value.(*lruEntry[V]).expires) {
+		c.remove(el)
+		return nil
+	}
+
+	return el
+}
+
+// Must hold `mu`
+func (c *LRUCache[V]) set(key string, value V) {
+	expires := time.Now().Add(c.ttl)
+
+	if el, ok := c.items[key]; ok {
+		entry := el.Value.(*lruEntry[V])
+		entry.value = value
+		entry.expires = expires
+		c.ll.MoveToFront(el)
+		return
+	}
+
+	c.items[key] = c.ll.PushFront(&lruEntry[V]{key, value, expires})
+
+	for c.capacity > 0 && c.ll.Len() > c.capacity {
+		c.remove(c.ll.Back())
+	}
+}
+
+// Must hold `mu`
+func (c *LRUCache[V]) remove(el *list.Element) {
+	c.ll.Remove(el)
+	delete(c.items, el.Value.(*lruEntry[V]).key)
+}
@@ -0,0 +1,73 @@
+package util_test
+
+import (
+	"beget/util"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLRUCache(t *testing.T) {
+	t.Run("get and set", func(t *testing.T) {
+		c := util.NewLRUCache[int](10, time.Minute)
+
+		_, ok := c.Get("a")
+		assert.False(t, ok)
+
+		c.Set("a", 1)
+		v, ok := c.Get("a")
+		assert.True(t, ok)
+		assert.Equal(t, 1, v)
+
+		c.Set("a", 2)
+		v, _ = c.Get("a")
+		assert.Equal(t, 2, v)
+
+		c.Remove("a")
+		_, ok = c.Get("a")
+		assert.False(t, ok)
+	})
+
+	t.Run("set if absent", func(t *testing.T) {
+		c := util.NewLRUCache[int](10, time.Minute)
+
+		v, added := c.SetIfAbsent("a", 1)
+		assert.True(t, added)
+		assert.Equal(t, 1, v)
+
+		v, added = c.SetIfAbsent("a", 2)
+		assert.False(t, added)
+		assert.Equal(t, 1, v)
+	})
+
+	t.Run("evicts least recently used", func(t *testing.T) {
+		c := util.NewLRUCache[int](2, time.Minute)
+
+		c.Set("a", 1)
+		c.Set("b", 2)
+		c.Get("a")
+		c.Set("c", 3)
+
+		assert.Equal(t, 2, c.Len())
+		_, ok := c.Get("b")
+		assert.False(t, ok)
+		_, ok = c.Get("a")
+		assert.True(t, ok)
+		_, ok = c.Get("c")
+		assert.True(t, ok)
+	})
+
+	t.Run("expires", func(t *testing.T) {
+		c := util.NewLRUCache[int](10, time.Millisecond)
+
+		c.Set("a", 1)
+		time.Sleep(5 * time.Millisecond)
+
+		_, ok := c.Get("a")
+		assert.False(t, ok)
+
+		_, added := c.SetIfAbsent("a", 2)
+		assert.True(t, added)
+	})
+}
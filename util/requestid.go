@@ -0,0 +1,88 @@
+// Functions related to request IDs
+//
+// Author: Kirk Morales
+// Copyright 2022. All Rights Reserved.
+
+package util
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+
+	"go.uber.org/zap"
+)
+
+// The header request IDs are read from and returned in
+const RequestIDHeader = "X-Request-Id"
+
+// The longest request ID accepted from a client
+const maxRequestIDLength = 128
+
+type requestIDKey struct{}
+
+// RequestID is middleware that assigns each request an ID: the request's
+// `X-Request-Id` if it has a valid one, or a new random ID. The ID is returned in
+// the response's `X-Request-Id` header and stored in the request's context.
+func RequestID(next http.Handler) http.Handler {
+
+	fn := func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(RequestIDHeader)
+		if !ValidRequestID(id) {
+			id = NewID()
+		}
+
+		w.Header().Set(RequestIDHeader, id)
+		next.ServeHTTP(w, r.WithContext(WithRequestID(r.Context(), id)))
+	}
+	return http.HandlerFunc(fn)
+}
+
+// Returns a new random ID, as used for requests and accepted writes
+func NewID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// Returns whether a request ID sent by a client may be used. IDs are limited to
+// printable ASCII without spaces so they can't break up log lines or headers.
+func ValidRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+
+	for i := 0; i < len(id); i++ {
+		if id[i] <= ' ' || id[i] > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+// Returns a copy of the context carrying the request ID
+func WithRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, id)
+}
+
+// Returns the request ID stored in the context, or "" if there isn't one
+func RequestIDFrom(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// Returns `Sugar` with the context's request ID, if it has one, added to each line
+func SugarFor(ctx context.Context) *zap.SugaredLogger {
+	return SugarForRequest(RequestIDFrom(ctx))
+}
+
+// Returns `Sugar` with the request ID, unless it's "", added to each line
+func SugarForRequest(id string) *zap.SugaredLogger {
+	if id == "" {
+		return Sugar
+	}
+	return Sugar.With("request_id", id)
+}
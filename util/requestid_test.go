@@ -0,0 +1,65 @@
+package util_test
+
+import (
+	"beget/util"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRequestID(t *testing.T) {
+	var seen string
+	handler := util.RequestID(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen = util.RequestIDFrom(r.Context())
+	}))
+
+	serve := func(id string) string {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest(http.MethodGet, "/", nil)
+		if id != "" {
+			req.Header.Set("X-Request-Id", id)
+		}
+
+		handler.ServeHTTP(w, req)
+
+		assert.Equal(t, seen, w.Header().Get("X-Request-Id"))
+		return seen
+	}
+
+	t.Run("accepts valid IDs", func(t *testing.T) {
+		assert.Equal(t, "abc-123", serve("abc-123"))
+	})
+
+	t.Run("generates IDs", func(t *testing.T) {
+		tests := map[string]string{
+			"missing":  "",
+			"spaces":   "abc 123",
+			"unicode":  "abcé",
+			"too long": strings.Repeat("a", 129),
+		}
+
+		for name, id := range tests {
+			got := serve(id)
+
+			assert.Len(t, got, 32, name)
+			assert.NotEqual(t, id, got, name)
+		}
+
+		assert.NotEqual(t, serve(""), serve(""))
+	})
+
+	t.Run("without an ID", func(t *testing.T) {
+		assert.Equal(t, "", util.RequestIDFrom(context.Background()))
+	})
+}
+
+func TestSugarFor(t *testing.T) {
+	util.InitLogging()
+
+	assert.Same(t, util.Sugar, util.SugarFor(context.Background()))
+	assert.NotSame(t, util.Sugar, util.SugarFor(util.WithRequestID(context.Background(), "abc")))
+}